@@ -12,15 +12,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	_ "github.com/ZorinIvanA/tgbot-electro-tools/docs"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/api"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/bot"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/metrics"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
 	"github.com/joho/godotenv"
@@ -40,6 +45,10 @@ func main() {
 		log.Fatalf("Configuration error: %v", err)
 	}
 
+	// SIGINT and SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize database
 	log.Println("Connecting to database...")
 	db, err := storage.NewPostgresStorage(
@@ -53,22 +62,47 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
+	// Deferred calls run last, so the database closes after the bot and the HTTP server
 	defer db.Close()
 	log.Println("Database connected successfully")
 
+	// Keep scenarios in memory; database triggers report edits made elsewhere
+	cachedDB := storage.NewCachedStorage(db)
+	scenarioListener, err := db.ListenScenarioChanges(cachedDB.Invalidate)
+	if err != nil {
+		log.Fatalf("Failed to listen for scenario changes: %v", err)
+	}
+	defer scenarioListener.Close()
+
 	// Initialize metrics collector
 	metricsCollector := metrics.NewCollector(db)
 
 	// Initialize bot
 	log.Println("Initializing Telegram bot...")
-	telegramBot, err := bot.NewBot(config.TelegramBotToken, db, config.RateLimitPerMinute, config.OpenAIEnabled, config.OpenAIAPIURL, config.OpenAIAPIKey, config.OpenAIModel)
+	telegramBot, err := bot.NewBot(config.TelegramBotToken, config.TelegramAPIURL, cachedDB, config.RateLimitPerMinute, config.OpenAIEnabled, config.OpenAIAPIURL, config.OpenAIAPIKey, config.OpenAIModel, config.UpdateWorkers, config.UpdateQueueSize)
 	if err != nil {
 		log.Fatalf("Failed to create bot: %v", err)
 	}
+	telegramBot.SetEditInPlace(config.EditMessagesInPlace)
+	telegramBot.SetCallbackTTL(config.CallbackTokenTTL)
+	telegramBot.SetSiteOfferScenario(config.SiteOfferScenario)
+	telegramBot.SetMenuPageSize(config.MenuPageSize)
 	log.Printf("Bot initialized: @%s", telegramBot.GetUsername())
 
+	metricsCollector.SetQueueStats(telegramBot.QueueStats)
+
 	// Initialize HTTP API server
-	apiServer := api.NewServer(db, metricsCollector, config.AdminAPIToken, config.HTTPPort, config.DebugMode)
+	apiServer := api.NewServer(cachedDB, metricsCollector, config.AdminAPIToken, config.HTTPPort, config.DebugMode)
+	apiServer.SetBotUsername(telegramBot.GetUsername())
+	apiServer.SetSiteOfferScenario(config.SiteOfferScenario)
+
+	if config.TelegramMode == telegramModeWebhook {
+		// Updates arrive on the API server port
+		apiServer.Handle(config.WebhookPath, telegramBot.WebhookHandler(config.WebhookSecret))
+	}
+
+	// Buttons older than CALLBACK_TOKEN_TTL_HOURS stop working; drop their tokens
+	go purgeExpiredCallbackTokens(ctx, db, time.Hour)
 
 	// Start HTTP API server in a separate goroutine
 	go func() {
@@ -78,41 +112,96 @@ func main() {
 		}
 	}()
 
-	// Start bot in a separate goroutine
-	go func() {
+	if config.TelegramMode == telegramModeWebhook {
+		log.Println("Registering Telegram webhook...")
+		if err := telegramBot.SetWebhook(strings.TrimSuffix(config.WebhookURL, "/")+config.WebhookPath, config.WebhookSecret); err != nil {
+			log.Fatalf("Failed to register webhook: %v", err)
+		}
+	} else {
+		// Polls in the background; Shutdown waits for it
 		log.Println("Starting Telegram bot...")
-		if err := telegramBot.Start(); err != nil {
+		if err := telegramBot.Start(ctx); err != nil {
 			log.Fatalf("Bot error: %v", err)
 		}
-	}()
+	}
 
 	// Wait for interrupt signal to gracefully shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	<-ctx.Done()
+	stop()
 
 	log.Println("Shutting down gracefully...")
-	telegramBot.Stop()
-	log.Println("Bot stopped")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Stop taking updates and let running handlers finish their writes and sends
+	if err := telegramBot.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Bot shutdown incomplete: %v", err)
+	} else {
+		log.Println("Bot stopped")
+	}
+
+	if err := apiServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP API server shutdown incomplete: %v", err)
+	} else {
+		log.Println("HTTP API server stopped")
+	}
+}
+
+// purgeExpiredCallbackTokens deletes expired callback tokens every interval until ctx is done
+func purgeExpiredCallbackTokens(ctx context.Context, db storage.Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := db.DeleteExpiredCallbackTokens()
+			if err != nil {
+				log.Printf("Error deleting expired callback tokens: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d expired callback tokens", deleted)
+			}
+		}
+	}
 }
 
+// Telegram update delivery modes selected by TELEGRAM_MODE
+const (
+	telegramModePolling = "polling"
+	telegramModeWebhook = "webhook"
+)
+
 // Config holds application configuration
 type Config struct {
-	TelegramBotToken   string
-	DBHost             string
-	DBPort             string
-	DBUser             string
-	DBPassword         string
-	DBName             string
-	DBSSLMode          string
-	HTTPPort           string
-	AdminAPIToken      string
-	RateLimitPerMinute int
-	OpenAIEnabled      bool
-	OpenAIAPIURL       string
-	OpenAIAPIKey       string
-	OpenAIModel        string
-	DebugMode          bool
+	TelegramBotToken    string
+	TelegramAPIURL      string
+	TelegramMode        string
+	WebhookURL          string
+	WebhookPath         string
+	WebhookSecret       string
+	DBHost              string
+	DBPort              string
+	DBUser              string
+	DBPassword          string
+	DBName              string
+	DBSSLMode           string
+	HTTPPort            string
+	AdminAPIToken       string
+	RateLimitPerMinute  int
+	UpdateWorkers       int
+	UpdateQueueSize     int
+	EditMessagesInPlace bool
+	CallbackTokenTTL    time.Duration
+	SiteOfferScenario   string
+	MenuPageSize        int
+	ShutdownTimeout     time.Duration
+	OpenAIEnabled       bool
+	OpenAIAPIURL        string
+	OpenAIAPIKey        string
+	OpenAIModel         string
+	DebugMode           bool
 }
 
 // loadConfig loads configuration from environment variables
@@ -124,6 +213,9 @@ func loadConfig() *Config {
 		rateLimit = 10
 	}
 
+	updateWorkers := getEnvInt("UPDATE_WORKERS", 8)
+	updateQueueSize := getEnvInt("UPDATE_QUEUE_SIZE", 100)
+
 	openAIEnabledStr := getEnv("OPENAI_API_ENABLED", "false")
 	openAIEnabled := openAIEnabledStr == "true"
 
@@ -131,21 +223,33 @@ func loadConfig() *Config {
 	debugMode := debugModeStr == "true"
 
 	return &Config{
-		TelegramBotToken:   getEnv("TELEGRAM_BOT_TOKEN", ""),
-		DBHost:             getEnv("DB_HOST", "localhost"),
-		DBPort:             getEnv("DB_PORT", "5432"),
-		DBUser:             getEnv("DB_USER", "postgres"),
-		DBPassword:         getEnv("DB_PASSWORD", "postgres"),
-		DBName:             getEnv("DB_NAME", "electro_tools_bot"),
-		DBSSLMode:          getEnv("DB_SSLMODE", "disable"),
-		HTTPPort:           getEnv("HTTP_PORT", "8080"),
-		AdminAPIToken:      getEnv("ADMIN_API_TOKEN", ""),
-		RateLimitPerMinute: rateLimit,
-		OpenAIEnabled:      openAIEnabled,
-		OpenAIAPIURL:       getEnv("OPENAI_API_URL", "https://bothub.ru/v1"),
-		OpenAIAPIKey:       getEnv("OPENAI_API_KEY", ""),
-		OpenAIModel:        getEnv("OPENAI_MODEL", "gpt-3.5-turbo"),
-		DebugMode:          debugMode,
+		TelegramBotToken:    getEnv("TELEGRAM_BOT_TOKEN", ""),
+		TelegramAPIURL:      getEnv("TELEGRAM_API_URL", ""),
+		TelegramMode:        getEnv("TELEGRAM_MODE", telegramModePolling),
+		WebhookURL:          getEnv("TELEGRAM_WEBHOOK_URL", ""),
+		WebhookPath:         getEnv("TELEGRAM_WEBHOOK_PATH", "/telegram/webhook"),
+		WebhookSecret:       getEnv("TELEGRAM_WEBHOOK_SECRET", ""),
+		DBHost:              getEnv("DB_HOST", "localhost"),
+		DBPort:              getEnv("DB_PORT", "5432"),
+		DBUser:              getEnv("DB_USER", "postgres"),
+		DBPassword:          getEnv("DB_PASSWORD", "postgres"),
+		DBName:              getEnv("DB_NAME", "electro_tools_bot"),
+		DBSSLMode:           getEnv("DB_SSLMODE", "disable"),
+		HTTPPort:            getEnv("HTTP_PORT", "8080"),
+		AdminAPIToken:       getEnv("ADMIN_API_TOKEN", ""),
+		RateLimitPerMinute:  rateLimit,
+		UpdateWorkers:       updateWorkers,
+		UpdateQueueSize:     updateQueueSize,
+		EditMessagesInPlace: getEnv("EDIT_MESSAGES_IN_PLACE", "true") == "true",
+		CallbackTokenTTL:    time.Duration(getEnvInt("CALLBACK_TOKEN_TTL_HOURS", 168)) * time.Hour,
+		SiteOfferScenario:   getEnv("SITE_OFFER_SCENARIO", fsm.DefaultSiteOfferScenario),
+		MenuPageSize:        getEnvInt("MENU_PAGE_SIZE", fsm.DefaultMenuPageSize),
+		ShutdownTimeout:     time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second,
+		OpenAIEnabled:       openAIEnabled,
+		OpenAIAPIURL:        getEnv("OPENAI_API_URL", "https://bothub.ru/v1"),
+		OpenAIAPIKey:        getEnv("OPENAI_API_KEY", ""),
+		OpenAIModel:         getEnv("OPENAI_MODEL", "gpt-3.5-turbo"),
+		DebugMode:           debugMode,
 	}
 }
 
@@ -157,9 +261,27 @@ func validateConfig(config *Config) error {
 	if config.AdminAPIToken == "" {
 		return &ConfigError{Field: "ADMIN_API_TOKEN", Message: "is required"}
 	}
+	switch config.TelegramMode {
+	case telegramModePolling:
+	case telegramModeWebhook:
+		if !strings.HasPrefix(config.WebhookURL, "https://") {
+			return &ConfigError{Field: "TELEGRAM_WEBHOOK_URL", Message: "must be an https:// URL in webhook mode"}
+		}
+		if !strings.HasPrefix(config.WebhookPath, "/") {
+			return &ConfigError{Field: "TELEGRAM_WEBHOOK_PATH", Message: "must start with /"}
+		}
+		// Telegram accepts 1-256 characters A-Z, a-z, 0-9, _ and -
+		if !webhookSecretPattern.MatchString(config.WebhookSecret) {
+			return &ConfigError{Field: "TELEGRAM_WEBHOOK_SECRET", Message: "must be 1-256 characters of A-Z, a-z, 0-9, _ or - in webhook mode"}
+		}
+	default:
+		return &ConfigError{Field: "TELEGRAM_MODE", Message: "must be polling or webhook"}
+	}
 	return nil
 }
 
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
 // getEnv gets environment variable with fallback to default value
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -169,6 +291,16 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// getEnvInt gets a positive integer environment variable with fallback to default value
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || value < 1 {
+		log.Printf("Warning: invalid %s value, using default: %d", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
 // ConfigError represents a configuration error
 type ConfigError struct {
 	Field   string
@@ -0,0 +1,135 @@
+// Command migrate applies and rolls back database migrations.
+//
+// Usage:
+//
+//	migrate status
+//	migrate up [-to VERSION]
+//	migrate down [-steps N]
+//
+// Database connection is configured with the same DB_* environment variables as the bot.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/migrate"
+	"github.com/ZorinIvanA/tgbot-electro-tools/migrations"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+)
+
+const usage = `Usage:
+  migrate status               list migrations and whether they are applied
+  migrate up [-to VERSION]     apply pending migrations, all of them or up to VERSION
+  migrate down [-steps N]      roll back the last N applied migrations (default 1)
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Load .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using environment variables")
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	to := 0
+	steps := 1
+	switch command {
+	case "status":
+	case "up":
+		flags.IntVar(&to, "to", 0, "apply migrations up to and including this version")
+	case "down":
+		flags.IntVar(&steps, "steps", 1, "number of migrations to roll back")
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flags.Parse(args)
+
+	all, err := migrate.Load(migrations.FS)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	db, err := connect()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer db.Close()
+
+	migrator := migrate.NewMigrator(db, all)
+	ctx := context.Background()
+
+	switch command {
+	case "status":
+		err = printStatus(ctx, migrator)
+	case "up":
+		err = migrator.Up(ctx, to)
+	case "down":
+		err = migrator.Down(ctx, steps)
+	}
+	if err != nil {
+		db.Close()
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// printStatus prints one line per migration
+func printStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		appliedAt := ""
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%03d  %-8s  %-19s  %s\n", status.Version, status.State, appliedAt, status.Name)
+	}
+	return nil
+}
+
+// connect opens the database configured by DB_* environment variables
+func connect() (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		getEnv("DB_HOST", "localhost"),
+		getEnv("DB_PORT", "5432"),
+		getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", "postgres"),
+		getEnv("DB_NAME", "electro_tools_bot"),
+		getEnv("DB_SSLMODE", "disable"),
+	)
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, nil
+}
+
+// getEnv gets environment variable with fallback to default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
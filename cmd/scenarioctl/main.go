@@ -0,0 +1,377 @@
+// Command scenarioctl imports, exports, diffs and validates FSM scenario files against the database.
+//
+// Usage:
+//
+//	scenarioctl import [-force] FILE...
+//	scenarioctl export [-format yaml|json] [-dir DIR] [NAME...]
+//	scenarioctl diff FILE...
+//	scenarioctl validate FILE...
+//	scenarioctl validate -db [NAME...]
+//
+// Database connection is configured with the same DB_* environment variables as the bot.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/scenario"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/joho/godotenv"
+)
+
+const usage = `Usage:
+  scenarioctl import [-force] FILE...                    validate and save scenario files to the database;
+                                                         -force saves despite blocking issues
+  scenarioctl export [-format yaml|json] [-dir DIR] [NAME...]
+                                                         write scenarios from the database; all when no NAME is given
+  scenarioctl diff FILE...                               show what import would change; exits with 1 on differences
+  scenarioctl validate FILE...                           check scenario step graphs; exits with 1 on blocking issues
+  scenarioctl validate -db [NAME...]                     check scenarios stored in the database
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Load .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using environment variables")
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	var err error
+	switch command {
+	case "import":
+		err = runImport(args)
+	case "export":
+		err = runExport(args)
+	case "diff":
+		var changed bool
+		changed, err = runDiff(args)
+		if err == nil && changed {
+			os.Exit(1)
+		}
+	case "validate":
+		var blocking bool
+		blocking, err = runValidate(args)
+		if err == nil && blocking {
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// runImport validates and saves every given file, printing the changes it applies
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	force := flags.Bool("force", false, "import scenarios even if validation finds blocking issues")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("import: no scenario files given")
+	}
+
+	definitions, err := loadFiles(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	blocking := false
+	for _, def := range definitions {
+		if printIssues(def.Name, fsm.ValidateScenario(def.ToGraph())) {
+			blocking = true
+		}
+	}
+	if blocking && !*force {
+		return fmt.Errorf("import: blocking validation issues found, nothing imported (use -force to import anyway)")
+	}
+
+	db, err := connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, def := range definitions {
+		changes, err := diffWithDatabase(db, def)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			log.Printf("%s: up to date", def.Name)
+			continue
+		}
+
+		graph := def.ToGraph()
+		if err := db.SaveFSMScenarioGraph(graph); err != nil {
+			return fmt.Errorf("failed to import scenario %q: %w", def.Name, err)
+		}
+
+		log.Printf("%s: imported as scenario %d", def.Name, graph.Scenario.ID)
+		printChanges(changes)
+	}
+
+	return nil
+}
+
+// runExport writes scenarios to stdout or to DIR/<name>.<format>
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", string(scenario.FormatYAML), "output format: yaml or json")
+	dir := flags.String("dir", "", "write one file per scenario into this directory instead of stdout")
+	flags.Parse(args)
+
+	outputFormat := scenario.Format(*format)
+	if outputFormat != scenario.FormatYAML && outputFormat != scenario.FormatJSON {
+		return fmt.Errorf("export: unsupported format %q", *format)
+	}
+
+	db, err := connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names := flags.Args()
+	if len(names) == 0 {
+		scenarios, err := db.GetFSMScenarios()
+		if err != nil {
+			return err
+		}
+		for _, s := range scenarios {
+			names = append(names, s.Name)
+		}
+	}
+
+	for i, name := range names {
+		def, err := loadFromDatabase(db, name)
+		if err != nil {
+			return err
+		}
+		if def == nil {
+			return fmt.Errorf("export: scenario %q not found", name)
+		}
+
+		data, err := scenario.Marshal(def, outputFormat)
+		if err != nil {
+			return err
+		}
+
+		if *dir == "" {
+			if i > 0 && outputFormat == scenario.FormatYAML {
+				os.Stdout.WriteString("---\n")
+			}
+			os.Stdout.Write(data)
+			continue
+		}
+
+		path := filepath.Join(*dir, name+"."+string(outputFormat))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		log.Printf("%s: exported to %s", name, path)
+	}
+
+	return nil
+}
+
+// runDiff prints the changes import would make and reports whether there are any
+func runDiff(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, fmt.Errorf("diff: no scenario files given")
+	}
+
+	definitions, err := loadFiles(args)
+	if err != nil {
+		return false, err
+	}
+
+	db, err := connect()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	changed := false
+	for _, def := range definitions {
+		changes, err := diffWithDatabase(db, def)
+		if err != nil {
+			return false, err
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		changed = true
+		fmt.Printf("%s:\n", def.Name)
+		printChanges(changes)
+	}
+
+	return changed, nil
+}
+
+// runValidate checks scenario files, or stored scenarios with -db, and reports whether any issue is blocking
+func runValidate(args []string) (bool, error) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	fromDB := flags.Bool("db", false, "validate scenarios stored in the database; all when no NAME is given")
+	flags.Parse(args)
+
+	var graphs []*storage.FSMScenarioGraph
+	if *fromDB {
+		db, err := connect()
+		if err != nil {
+			return false, err
+		}
+		defer db.Close()
+
+		names := flags.Args()
+		if len(names) == 0 {
+			scenarios, err := db.GetFSMScenarios()
+			if err != nil {
+				return false, err
+			}
+			for _, s := range scenarios {
+				names = append(names, s.Name)
+			}
+		}
+
+		for _, name := range names {
+			stored, err := db.GetFSMScenarioByName(name)
+			if err != nil {
+				return false, err
+			}
+			if stored == nil {
+				return false, fmt.Errorf("validate: scenario %q not found", name)
+			}
+			graph, err := db.GetFSMScenarioGraph(stored.ID)
+			if err != nil {
+				return false, err
+			}
+			graphs = append(graphs, graph)
+		}
+	} else {
+		if flags.NArg() == 0 {
+			return false, fmt.Errorf("validate: no scenario files given")
+		}
+		definitions, err := loadFiles(flags.Args())
+		if err != nil {
+			return false, err
+		}
+		for _, def := range definitions {
+			graphs = append(graphs, def.ToGraph())
+		}
+	}
+
+	blocking := false
+	for _, graph := range graphs {
+		issues := fsm.ValidateScenario(graph)
+		if len(issues) == 0 {
+			log.Printf("%s: ok", graph.Scenario.Name)
+			continue
+		}
+		if printIssues(graph.Scenario.Name, issues) {
+			blocking = true
+		}
+	}
+
+	return blocking, nil
+}
+
+// printIssues prints validation issues of a scenario and reports whether any of them is blocking
+func printIssues(name string, issues []fsm.ScenarioIssue) bool {
+	blocking := false
+	for _, issue := range issues {
+		level := "warning"
+		if issue.Blocking() {
+			level = "error"
+			blocking = true
+		}
+		fmt.Printf("%s: %s: %s\n", name, level, issue)
+	}
+	return blocking
+}
+
+// loadFiles loads all files before touching the database so a broken file aborts the whole run
+func loadFiles(paths []string) ([]*scenario.Definition, error) {
+	definitions := make([]*scenario.Definition, 0, len(paths))
+	for _, path := range paths {
+		def, err := scenario.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, def)
+	}
+	return definitions, nil
+}
+
+// loadFromDatabase returns the stored definition of a scenario, or nil if it does not exist
+func loadFromDatabase(db *storage.PostgresStorage, name string) (*scenario.Definition, error) {
+	stored, err := db.GetFSMScenarioByName(name)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	graph, err := db.GetFSMScenarioGraph(stored.ID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+	return scenario.FromGraph(graph), nil
+}
+
+// diffWithDatabase compares a file definition with the stored one
+func diffWithDatabase(db *storage.PostgresStorage, def *scenario.Definition) ([]string, error) {
+	stored, err := loadFromDatabase(db, def.Name)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return append([]string{"+ scenario " + def.Name}, scenario.Diff(&scenario.Definition{Name: def.Name}, def)...), nil
+	}
+	return scenario.Diff(stored, def), nil
+}
+
+func printChanges(changes []string) {
+	for _, change := range changes {
+		fmt.Println("  " + change)
+	}
+}
+
+// connect opens the database configured by DB_* environment variables
+func connect() (*storage.PostgresStorage, error) {
+	db, err := storage.NewPostgresStorage(
+		getEnv("DB_HOST", "localhost"),
+		getEnv("DB_PORT", "5432"),
+		getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", "postgres"),
+		getEnv("DB_NAME", "electro_tools_bot"),
+		getEnv("DB_SSLMODE", "disable"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, nil
+}
+
+// getEnv gets environment variable with fallback to default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// ActionRequest represents action create/update request
+type ActionRequest struct {
+	StepKey       string `json:"step_key"`
+	ActionStepKey string `json:"action_step_key"`
+	Label         string `json:"label"`
+	SortOrder     int    `json:"sort_order"`
+}
+
+// ActionResponse represents an action of an action group in API responses
+type ActionResponse struct {
+	ID            int    `json:"id"`
+	ScenarioID    int    `json:"scenario_id"`
+	StepKey       string `json:"step_key"`
+	ActionStepKey string `json:"action_step_key"`
+	Label         string `json:"label"`
+	SortOrder     int    `json:"sort_order"`
+}
+
+// ValidateActionRequest validates action create/update request
+func ValidateActionRequest(req *ActionRequest) error {
+	if strings.TrimSpace(req.StepKey) == "" {
+		return fmt.Errorf("step_key is required")
+	}
+	if strings.TrimSpace(req.ActionStepKey) == "" {
+		return fmt.Errorf("action_step_key is required")
+	}
+	if strings.TrimSpace(req.Label) == "" {
+		return fmt.Errorf("label is required")
+	}
+	return nil
+}
+
+// handleScenarioActions handles listing and creating actions of a scenario
+func (s *Server) handleScenarioActions(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListActions(w, scenarioID)
+	case http.MethodPost:
+		s.handleCreateAction(w, r, scenarioID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleScenarioAction handles reading, updating and deleting a single action
+func (s *Server) handleScenarioAction(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+	actionID, err := strconv.Atoi(r.PathValue("action_id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid action id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetAction(w, scenarioID, actionID)
+	case http.MethodPut:
+		s.handleUpdateAction(w, r, scenarioID, actionID)
+	case http.MethodDelete:
+		s.handleDeleteAction(w, scenarioID, actionID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListActions returns all actions of a scenario
+// @Summary List scenario actions
+// @Description List all terminal actions of an FSM scenario grouped by action-selection step
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Security BearerAuth
+// @Success 200 {array} ActionResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/actions [get]
+func (s *Server) handleListActions(w http.ResponseWriter, scenarioID int) {
+	if !s.scenarioExists(w, scenarioID) {
+		return
+	}
+
+	actions, err := s.storage.GetFSMScenarioActions(scenarioID)
+	if err != nil {
+		log.Printf("Error getting actions for scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ActionResponse, 0, len(actions))
+	for _, action := range actions {
+		response = append(response, newActionResponse(action))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateAction adds an action to a scenario
+// @Summary Create scenario action
+// @Description Add a terminal action to the group of an action-selection step
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param action body ActionRequest true "Action to create"
+// @Security BearerAuth
+// @Success 201 {object} ActionResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Step not found"
+// @Failure 409 {string} string "Action already exists"
+// @Router /api/v1/scenarios/{id}/actions [post]
+func (s *Server) handleCreateAction(w http.ResponseWriter, r *http.Request, scenarioID int) {
+	var request ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateActionRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := newActionFromRequest(&request)
+	action.ScenarioID = scenarioID
+	if err := s.storage.CreateFSMStepAction(action); err != nil {
+		writeStorageError(w, "creating action", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newActionResponse(action))
+}
+
+// handleGetAction returns a single action
+// @Summary Get scenario action
+// @Description Get a terminal action of an FSM scenario by ID
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param action_id path int true "Action ID"
+// @Security BearerAuth
+// @Success 200 {object} ActionResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/actions/{action_id} [get]
+func (s *Server) handleGetAction(w http.ResponseWriter, scenarioID, actionID int) {
+	action, err := s.storage.GetFSMStepAction(scenarioID, actionID)
+	if err != nil {
+		log.Printf("Error getting action %d for scenario %d: %v", actionID, scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if action == nil {
+		http.Error(w, "Action not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newActionResponse(action))
+}
+
+// handleUpdateAction updates an action
+// @Summary Update scenario action
+// @Description Update label, order or target step of a terminal action
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param action_id path int true "Action ID"
+// @Param action body ActionRequest true "Action fields"
+// @Security BearerAuth
+// @Success 200 {object} ActionResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/actions/{action_id} [put]
+func (s *Server) handleUpdateAction(w http.ResponseWriter, r *http.Request, scenarioID, actionID int) {
+	var request ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateActionRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := newActionFromRequest(&request)
+	action.ID = actionID
+	action.ScenarioID = scenarioID
+	if err := s.storage.UpdateFSMStepAction(action); err != nil {
+		writeStorageError(w, "updating action", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newActionResponse(action))
+}
+
+// handleDeleteAction deletes an action
+// @Summary Delete scenario action
+// @Description Remove a terminal action from its group
+// @Tags scenarios
+// @Param id path int true "Scenario ID"
+// @Param action_id path int true "Action ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/actions/{action_id} [delete]
+func (s *Server) handleDeleteAction(w http.ResponseWriter, scenarioID, actionID int) {
+	if err := s.storage.DeleteFSMStepAction(scenarioID, actionID); err != nil {
+		writeStorageError(w, "deleting action", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newActionFromRequest(req *ActionRequest) *storage.FSMStepAction {
+	return &storage.FSMStepAction{
+		StepKey:       strings.TrimSpace(req.StepKey),
+		ActionStepKey: strings.TrimSpace(req.ActionStepKey),
+		Label:         strings.TrimSpace(req.Label),
+		SortOrder:     req.SortOrder,
+	}
+}
+
+func newActionResponse(action *storage.FSMStepAction) ActionResponse {
+	return ActionResponse{
+		ID:            action.ID,
+		ScenarioID:    action.ScenarioID,
+		StepKey:       action.StepKey,
+		ActionStepKey: action.ActionStepKey,
+		Label:         action.Label,
+		SortOrder:     action.SortOrder,
+	}
+}
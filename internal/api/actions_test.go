@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/scenarios/1/actions", "/api/v1/scenarios/1/actions/1")
+	scenario := createScenario(t, handler)
+	actions := fmt.Sprintf("/api/v1/scenarios/%d/actions", scenario.ID)
+
+	rec := serve(t, handler, http.MethodPost, actions, map[string]any{
+		"step_key":        "root",
+		"action_step_key": "no_power",
+		"label":           "Проверить кабель",
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[ActionResponse](t, rec)
+	assert.Equal(t, ActionResponse{
+		ID:            created.ID,
+		ScenarioID:    scenario.ID,
+		StepKey:       "root",
+		ActionStepKey: "no_power",
+		Label:         "Проверить кабель",
+	}, created)
+
+	rec = serve(t, handler, http.MethodGet, actions, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []ActionResponse{created}, decode[[]ActionResponse](t, rec))
+
+	path := fmt.Sprintf("%s/%d", actions, created.ID)
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"step_key":        "root",
+		"action_step_key": "no_power",
+		"label":           "Кабель",
+		"sort_order":      2,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "Кабель", decode[ActionResponse](t, rec).Label)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing action step", http.MethodPost, actions, map[string]any{"step_key": "root", "label": "?"}, http.StatusBadRequest},
+		{"unknown scenario", http.MethodGet, "/api/v1/scenarios/999/actions", nil, http.StatusNotFound},
+		{"unknown action", http.MethodGet, actions + "/999", nil, http.StatusNotFound},
+		{"invalid action id", http.MethodGet, actions + "/abc", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, path, nil).Code)
+}
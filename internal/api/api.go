@@ -1,12 +1,15 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/metrics"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
 	httpSwagger "github.com/swaggo/http-swagger"
@@ -19,6 +22,16 @@ type Server struct {
 	adminToken       string
 	port             string
 	debugMode        bool
+	botUsername      string
+	siteOffer        string
+	routes           []route
+	httpServer       *http.Server
+}
+
+// route is a handler registered from outside the package
+type route struct {
+	pattern string
+	handler http.Handler
 }
 
 // NewServer creates a new HTTP API server
@@ -29,26 +42,79 @@ func NewServer(storage storage.Storage, metricsCollector *metrics.Collector, adm
 		adminToken:       adminToken,
 		port:             port,
 		debugMode:        debugMode,
+		siteOffer:        fsm.DefaultSiteOfferScenario,
+		httpServer:       &http.Server{Addr: ":" + port},
 	}
 }
 
-// Start starts the HTTP server
+// Handle registers an additional handler, such as the Telegram webhook, on the
+// server mux. It must be called before Start.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.routes = append(s.routes, route{pattern: pattern, handler: handler})
+}
+
+// SetBotUsername sets the bot username used in t.me links. Call it before Start.
+func (s *Server) SetBotUsername(username string) {
+	s.botUsername = username
+}
+
+// SetSiteOfferScenario sets the name of the site offer scenario, which is left
+// out of the QR code export. Call it before Start.
+func (s *Server) SetSiteOfferScenario(name string) {
+	s.siteOffer = name
+}
+
+// Start serves HTTP requests until Shutdown is called
 func (s *Server) Start() error {
+	log.Printf("Starting HTTP API server on %s", s.httpServer.Addr)
+
+	s.httpServer.Handler = s.newMux()
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// newMux registers the API routes and the handlers added with Handle
+func (s *Server) newMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	// Register routes
 	mux.HandleFunc("/api/v1/metrics", s.handleMetrics)
 	mux.HandleFunc("/api/v1/settings", s.handleSettings)
+	mux.HandleFunc("/api/v1/scenarios", s.handleScenarios)
+	mux.HandleFunc("/api/v1/scenarios/{id}", s.handleScenario)
+	mux.HandleFunc("/api/v1/scenarios/{id}/steps", s.handleScenarioSteps)
+	mux.HandleFunc("/api/v1/scenarios/{id}/steps/{step_key}", s.handleScenarioStep)
+	mux.HandleFunc("/api/v1/scenarios/{id}/transitions", s.handleScenarioTransitions)
+	mux.HandleFunc("/api/v1/scenarios/{id}/transitions/{transition_id}", s.handleScenarioTransition)
+	mux.HandleFunc("/api/v1/scenarios/{id}/actions", s.handleScenarioActions)
+	mux.HandleFunc("/api/v1/scenarios/{id}/actions/{action_id}", s.handleScenarioAction)
+	mux.HandleFunc("/api/v1/users/{telegram_id}/session", s.handleUserSession)
+	mux.HandleFunc("/api/v1/deep-links", s.handleDeepLinks)
+	mux.HandleFunc("/api/v1/deep-links/{payload}", s.handleDeepLink)
+	mux.HandleFunc("/api/v1/categories", s.handleCategories)
+	mux.HandleFunc("/api/v1/categories/{id}", s.handleCategory)
+	mux.HandleFunc("/api/v1/products", s.handleProducts)
+	mux.HandleFunc("/api/v1/products/{id}", s.handleProduct)
+	mux.HandleFunc("/api/v1/qr", s.handleQRCode)
+	mux.HandleFunc("/api/v1/qr/export", s.handleQRCodeExport)
 	mux.HandleFunc("/health", s.handleHealth)
 
+	for _, route := range s.routes {
+		mux.Handle(route.pattern, route.handler)
+	}
+
 	if s.debugMode {
 		mux.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 	}
+	return mux
+}
 
-	addr := ":" + s.port
-	log.Printf("Starting HTTP API server on %s", addr)
-
-	return http.ListenAndServe(addr, mux)
+// Shutdown stops accepting connections and waits for running requests to
+// finish, or until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
 // handleMetrics returns Prometheus-format metrics
@@ -77,23 +143,6 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleSettings handles GET and PUT requests for settings
-// @Summary Get settings
-// @Description Get current bot settings
-// @Tags settings
-// @Produce json
-// @Security BearerAuth
-// @Success 200 {object} GetSettingsResponse
-// @Router /api/v1/settings [get]
-// @Summary Update settings
-// @Description Update bot settings
-// @Tags settings
-// @Accept json
-// @Produce json
-// @Param settings body UpdateSettingsRequest true "Settings to update"
-// @Security BearerAuth
-// @Success 200 {object} GetSettingsResponse
-// @Failure 400 {string} string "Bad request"
-// @Router /api/v1/settings [put]
 func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 	// Check authentication
 	if !s.authenticate(r) {
@@ -112,6 +161,13 @@ func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleGetSettings returns current settings
+// @Summary Get settings
+// @Description Get current bot settings
+// @Tags settings
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} GetSettingsResponse
+// @Router /api/v1/settings [get]
 func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request) {
 	settings, err := s.storage.GetSettings()
 	if err != nil {
@@ -120,44 +176,54 @@ func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]interface{}{
-		"trigger_message_count": settings.TriggerMessageCount,
-		"site_url":              settings.SiteURL,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, newSettingsResponse(settings))
 }
 
 // handleUpdateSettings updates settings
+// @Summary Update settings
+// @Description Update bot settings
+// @Tags settings
+// @Accept json
+// @Produce json
+// @Param settings body UpdateSettingsRequest true "Settings to update"
+// @Security BearerAuth
+// @Success 200 {object} GetSettingsResponse
+// @Failure 400 {string} string "Bad request"
+// @Router /api/v1/settings [put]
 func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
-	var request struct {
-		TriggerMessageCount int    `json:"trigger_message_count"`
-		SiteURL             string `json:"site_url"`
-	}
-
+	var request UpdateSettingsRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	// Validate input
-	if request.TriggerMessageCount < 1 {
-		http.Error(w, "Bad request: trigger_message_count must be at least 1", http.StatusBadRequest)
+	if err := ValidateUpdateSettingsRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if request.SiteURL == "" {
-		http.Error(w, "Bad request: site_url is required", http.StatusBadRequest)
+	// Update the fields that were sent
+	settings, err := s.storage.GetSettings()
+	if err != nil {
+		log.Printf("Error getting settings: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	// Update settings
-	settings := &storage.Settings{
-		ID:                  1, // Always ID 1 (single row)
-		TriggerMessageCount: request.TriggerMessageCount,
-		SiteURL:             request.SiteURL,
+	settings.ID = 1 // Always ID 1 (single row)
+	settings.TriggerMessageCount = request.TriggerMessageCount
+	settings.SiteURL = request.SiteURL
+	if request.OfferCooldownHours != nil {
+		settings.OfferCooldownHours = *request.OfferCooldownHours
+	}
+	if request.MaxOffersPerUser != nil {
+		settings.MaxOffersPerUser = *request.MaxOffersPerUser
+	}
+	if request.InterruptScenarios != nil {
+		settings.InterruptScenarios = *request.InterruptScenarios
+	}
+	if request.ScenarioTriggerCounts != nil {
+		settings.ScenarioTriggerCounts = request.ScenarioTriggerCounts
 	}
 
 	if err := s.storage.UpdateSettings(settings); err != nil {
@@ -166,14 +232,7 @@ func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]interface{}{
-		"trigger_message_count": settings.TriggerMessageCount,
-		"site_url":              settings.SiteURL,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, newSettingsResponse(settings))
 }
 
 // handleHealth returns health status
@@ -213,16 +272,35 @@ func (s *Server) authenticate(r *http.Request) bool {
 	return parts[1] == s.adminToken
 }
 
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
 // GetSettingsResponse represents settings response
 type GetSettingsResponse struct {
-	TriggerMessageCount int    `json:"trigger_message_count"`
-	SiteURL             string `json:"site_url"`
+	TriggerMessageCount   int            `json:"trigger_message_count"`
+	SiteURL               string         `json:"site_url"`
+	OfferCooldownHours    int            `json:"offer_cooldown_hours"`
+	MaxOffersPerUser      int            `json:"max_offers_per_user"`
+	InterruptScenarios    bool           `json:"interrupt_scenarios"`
+	ScenarioTriggerCounts map[string]int `json:"scenario_trigger_counts"`
 }
 
 // UpdateSettingsRequest represents settings update request
 type UpdateSettingsRequest struct {
 	TriggerMessageCount int    `json:"trigger_message_count"`
 	SiteURL             string `json:"site_url"`
+	// The offer policy fields keep their stored values when omitted, so
+	// clients that only send the fields above do not reset them
+	OfferCooldownHours    *int           `json:"offer_cooldown_hours"`
+	MaxOffersPerUser      *int           `json:"max_offers_per_user"`
+	InterruptScenarios    *bool          `json:"interrupt_scenarios"`
+	ScenarioTriggerCounts map[string]int `json:"scenario_trigger_counts"`
 }
 
 // ValidateUpdateSettingsRequest validates settings update request
@@ -233,5 +311,35 @@ func ValidateUpdateSettingsRequest(req *UpdateSettingsRequest) error {
 	if req.SiteURL == "" {
 		return fmt.Errorf("site_url is required")
 	}
+	if req.OfferCooldownHours != nil && *req.OfferCooldownHours < 0 {
+		return fmt.Errorf("offer_cooldown_hours must not be negative")
+	}
+	if req.MaxOffersPerUser != nil && *req.MaxOffersPerUser < 0 {
+		return fmt.Errorf("max_offers_per_user must not be negative")
+	}
+	for name, count := range req.ScenarioTriggerCounts {
+		if name == "" {
+			return fmt.Errorf("scenario_trigger_counts must not have an empty scenario name")
+		}
+		if count < 1 {
+			return fmt.Errorf("scenario_trigger_counts[%s] must be at least 1", name)
+		}
+	}
 	return nil
 }
+
+// newSettingsResponse converts settings to their API representation
+func newSettingsResponse(settings *storage.Settings) GetSettingsResponse {
+	triggerCounts := settings.ScenarioTriggerCounts
+	if triggerCounts == nil {
+		triggerCounts = map[string]int{}
+	}
+	return GetSettingsResponse{
+		TriggerMessageCount:   settings.TriggerMessageCount,
+		SiteURL:               settings.SiteURL,
+		OfferCooldownHours:    settings.OfferCooldownHours,
+		MaxOffersPerUser:      settings.MaxOffersPerUser,
+		InterruptScenarios:    settings.InterruptScenarios,
+		ScenarioTriggerCounts: triggerCounts,
+	}
+}
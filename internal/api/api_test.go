@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "secret"
+
+// newTestServer returns the API routes over an in-memory storage
+func newTestServer(t *testing.T) (http.Handler, *storage.MemoryStorage) {
+	t.Helper()
+
+	s := storage.NewMemoryStorage()
+	server := NewServer(s, nil, testToken, "0", false)
+	server.SetBotUsername("electro_tools_bot")
+	return server.newMux(), s
+}
+
+// serve sends an authenticated request; body is encoded as JSON unless it is nil
+func serve(t *testing.T, handler http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&reader).Encode(body))
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode unmarshals a JSON response body
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var value T
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &value), rec.Body.String())
+	return value
+}
+
+func TestUpdateSettingsKeepsOmittedFields(t *testing.T) {
+	handler, s := newTestServer(t)
+
+	rec := serve(t, handler, http.MethodPut, "/api/v1/settings", map[string]any{
+		"trigger_message_count":   5,
+		"site_url":                "https://example.com",
+		"offer_cooldown_hours":    12,
+		"max_offers_per_user":     2,
+		"interrupt_scenarios":     true,
+		"scenario_trigger_counts": map[string]int{"diagnose_jigsaw": 8},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// An older client only sends the first two fields
+	rec = serve(t, handler, http.MethodPut, "/api/v1/settings", map[string]any{
+		"trigger_message_count": 7,
+		"site_url":              "https://new.example.com",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, GetSettingsResponse{
+		TriggerMessageCount:   7,
+		SiteURL:               "https://new.example.com",
+		OfferCooldownHours:    12,
+		MaxOffersPerUser:      2,
+		InterruptScenarios:    true,
+		ScenarioTriggerCounts: map[string]int{"diagnose_jigsaw": 8},
+	}, decode[GetSettingsResponse](t, rec))
+
+	settings, err := s.GetSettings()
+	require.NoError(t, err)
+	assert.Equal(t, 12, settings.OfferCooldownHours)
+	assert.Equal(t, 2, settings.MaxOffersPerUser)
+	assert.Equal(t, map[string]int{"diagnose_jigsaw": 8}, settings.ScenarioTriggerCounts)
+
+	// Zero values that are sent are written
+	rec = serve(t, handler, http.MethodPut, "/api/v1/settings", map[string]any{
+		"trigger_message_count":   7,
+		"site_url":                "https://new.example.com",
+		"offer_cooldown_hours":    0,
+		"interrupt_scenarios":     false,
+		"scenario_trigger_counts": map[string]int{},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	settings, err = s.GetSettings()
+	require.NoError(t, err)
+	assert.Zero(t, settings.OfferCooldownHours)
+	assert.Equal(t, 2, settings.MaxOffersPerUser)
+	assert.False(t, settings.InterruptScenarios)
+	assert.Empty(t, settings.ScenarioTriggerCounts)
+
+	rec = serve(t, handler, http.MethodPut, "/api/v1/settings", map[string]any{
+		"trigger_message_count": 7,
+		"site_url":              "https://new.example.com",
+		"max_offers_per_user":   -1,
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestUpdateScenarioKeepsOmittedToolKeywords(t *testing.T) {
+	handler, _ := newTestServer(t)
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/scenarios", map[string]any{
+		"name":          "diagnose_jigsaw",
+		"display_name":  "Лобзик",
+		"tool_keywords": []string{" лобзик ", "электролобзик"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[ScenarioResponse](t, rec)
+	assert.Equal(t, []string{"лобзик", "электролобзик"}, created.ToolKeywords)
+	assert.Equal(t, []string{}, created.TriggerKeywords)
+
+	path := "/api/v1/scenarios/" + strconv.Itoa(created.ID)
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":         "diagnose_jigsaw",
+		"display_name": "Электролобзик",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, []string{"лобзик", "электролобзик"}, decode[ScenarioResponse](t, rec).ToolKeywords)
+
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":          "diagnose_jigsaw",
+		"display_name":  "Электролобзик",
+		"tool_keywords": []string{},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, []string{}, decode[ScenarioResponse](t, rec).ToolKeywords)
+
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":          "diagnose_jigsaw",
+		"display_name":  "Электролобзик",
+		"tool_keywords": []string{" "},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// assertRequireToken checks that the paths reject requests without the admin token
+func assertRequireToken(t *testing.T, handler http.Handler, paths ...string) {
+	t.Helper()
+
+	for _, path := range paths {
+		for _, header := range []string{"", "Bearer wrong", testToken} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, "%s with %q", path, header)
+		}
+	}
+}
+
+func TestRoutesRequireToken(t *testing.T) {
+	handler, _ := newTestServer(t)
+
+	assertRequireToken(t, handler, "/api/v1/settings")
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
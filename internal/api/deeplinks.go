@@ -0,0 +1,270 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// payloadPattern is what Telegram accepts as a /start payload
+var payloadPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// DeepLinkRequest represents deep link create/update request
+type DeepLinkRequest struct {
+	Payload    string  `json:"payload"`
+	ProductSKU string  `json:"product_sku"`
+	ScenarioID *int    `json:"scenario_id"`
+	StepKey    *string `json:"step_key"`
+}
+
+// DeepLinkResponse represents a deep link in API responses
+type DeepLinkResponse struct {
+	Payload    string  `json:"payload"`
+	ProductSKU string  `json:"product_sku"`
+	ScenarioID *int    `json:"scenario_id"`
+	StepKey    *string `json:"step_key"`
+}
+
+// ValidateDeepLinkRequest validates deep link create/update request
+func ValidateDeepLinkRequest(req *DeepLinkRequest) error {
+	if !payloadPattern.MatchString(req.Payload) {
+		return fmt.Errorf("payload must be 1-64 characters A-Z, a-z, 0-9, _ and -")
+	}
+	if strings.TrimSpace(req.ProductSKU) == "" {
+		return fmt.Errorf("product_sku is required")
+	}
+	if req.StepKey != nil && strings.TrimSpace(*req.StepKey) == "" {
+		return fmt.Errorf("step_key must not be empty")
+	}
+	if req.StepKey != nil && req.ScenarioID == nil {
+		return fmt.Errorf("step_key requires scenario_id")
+	}
+	return nil
+}
+
+// handleDeepLinks handles listing and creating deep links
+func (s *Server) handleDeepLinks(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListDeepLinks(w)
+	case http.MethodPost:
+		s.handleCreateDeepLink(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeepLink handles reading, updating and deleting a single deep link
+func (s *Server) handleDeepLink(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payload := r.PathValue("payload")
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetDeepLink(w, payload)
+	case http.MethodPut:
+		s.handleUpdateDeepLink(w, r, payload)
+	case http.MethodDelete:
+		s.handleDeleteDeepLink(w, payload)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListDeepLinks returns all deep links
+// @Summary List deep links
+// @Description List /start payloads with the products and scenarios they open
+// @Tags deep-links
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} DeepLinkResponse
+// @Router /api/v1/deep-links [get]
+func (s *Server) handleListDeepLinks(w http.ResponseWriter) {
+	links, err := s.storage.GetDeepLinks()
+	if err != nil {
+		log.Printf("Error getting deep links: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]DeepLinkResponse, 0, len(links))
+	for _, link := range links {
+		response = append(response, newDeepLinkResponse(link))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateDeepLink creates a deep link
+// @Summary Create deep link
+// @Description Map a /start payload to a product and, optionally, a scenario step
+// @Tags deep-links
+// @Accept json
+// @Produce json
+// @Param link body DeepLinkRequest true "Deep link to create"
+// @Security BearerAuth
+// @Success 201 {object} DeepLinkResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Scenario or step not found"
+// @Failure 409 {string} string "Deep link already exists"
+// @Router /api/v1/deep-links [post]
+func (s *Server) handleCreateDeepLink(w http.ResponseWriter, r *http.Request) {
+	var request DeepLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateDeepLinkRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	link := newDeepLinkFromRequest(&request)
+	if !s.deepLinkStepExists(w, link) {
+		return
+	}
+	if err := s.storage.CreateDeepLink(link); err != nil {
+		writeStorageError(w, "creating deep link", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newDeepLinkResponse(link))
+}
+
+// handleGetDeepLink returns a single deep link
+// @Summary Get deep link
+// @Description Get a deep link by its payload
+// @Tags deep-links
+// @Produce json
+// @Param payload path string true "Start payload"
+// @Security BearerAuth
+// @Success 200 {object} DeepLinkResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/deep-links/{payload} [get]
+func (s *Server) handleGetDeepLink(w http.ResponseWriter, payload string) {
+	link, err := s.storage.GetDeepLink(payload)
+	if err != nil {
+		log.Printf("Error getting deep link %s: %v", payload, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if link == nil {
+		http.Error(w, "Deep link not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newDeepLinkResponse(link))
+}
+
+// handleUpdateDeepLink updates a deep link; the payload in the path wins over the body
+// @Summary Update deep link
+// @Description Change the product, scenario or step of a deep link
+// @Tags deep-links
+// @Accept json
+// @Produce json
+// @Param payload path string true "Start payload"
+// @Param link body DeepLinkRequest true "Deep link fields"
+// @Security BearerAuth
+// @Success 200 {object} DeepLinkResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/deep-links/{payload} [put]
+func (s *Server) handleUpdateDeepLink(w http.ResponseWriter, r *http.Request, payload string) {
+	var request DeepLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	request.Payload = payload
+	if err := ValidateDeepLinkRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	link := newDeepLinkFromRequest(&request)
+	if !s.deepLinkStepExists(w, link) {
+		return
+	}
+	if err := s.storage.UpdateDeepLink(link); err != nil {
+		writeStorageError(w, "updating deep link", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newDeepLinkResponse(link))
+}
+
+// handleDeleteDeepLink deletes a deep link
+// @Summary Delete deep link
+// @Description Remove a deep link; its payload then only opens what it names itself
+// @Tags deep-links
+// @Param payload path string true "Start payload"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/deep-links/{payload} [delete]
+func (s *Server) handleDeleteDeepLink(w http.ResponseWriter, payload string) {
+	if err := s.storage.DeleteDeepLink(payload); err != nil {
+		writeStorageError(w, "deleting deep link", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deepLinkStepExists checks that the step a deep link names exists and writes
+// a 404 if it does not. The scenario is checked by the storage.
+func (s *Server) deepLinkStepExists(w http.ResponseWriter, link *storage.DeepLink) bool {
+	if link.StepKey == nil {
+		return true
+	}
+
+	step, err := s.storage.GetFSMScenarioStep(*link.ScenarioID, *link.StepKey)
+	if err != nil {
+		log.Printf("Error getting step %s of scenario %d: %v", *link.StepKey, *link.ScenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if step == nil {
+		http.Error(w, "Step not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func newDeepLinkFromRequest(req *DeepLinkRequest) *storage.DeepLink {
+	link := &storage.DeepLink{
+		Payload:    req.Payload,
+		ProductSKU: strings.TrimSpace(req.ProductSKU),
+		ScenarioID: req.ScenarioID,
+	}
+	if req.StepKey != nil {
+		stepKey := strings.TrimSpace(*req.StepKey)
+		link.StepKey = &stepKey
+	}
+	return link
+}
+
+func newDeepLinkResponse(link *storage.DeepLink) DeepLinkResponse {
+	return DeepLinkResponse{
+		Payload:    link.Payload,
+		ProductSKU: link.ProductSKU,
+		ScenarioID: link.ScenarioID,
+		StepKey:    link.StepKey,
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeepLinkCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/deep-links", "/api/v1/deep-links/promo")
+	scenario := createScenario(t, handler)
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/deep-links", map[string]any{
+		"payload":     "promo",
+		"product_sku": "JS-650",
+		"scenario_id": scenario.ID,
+		"step_key":    "no_power",
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[DeepLinkResponse](t, rec)
+	stepKey := "no_power"
+	assert.Equal(t, DeepLinkResponse{Payload: "promo", ProductSKU: "JS-650", ScenarioID: &scenario.ID, StepKey: &stepKey}, created)
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/deep-links", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []DeepLinkResponse{created}, decode[[]DeepLinkResponse](t, rec))
+
+	rec = serve(t, handler, http.MethodPut, "/api/v1/deep-links/promo", map[string]any{
+		"payload":     "promo",
+		"product_sku": "JS-700",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, DeepLinkResponse{Payload: "promo", ProductSKU: "JS-700"}, decode[DeepLinkResponse](t, rec))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"invalid payload", http.MethodPost, "/api/v1/deep-links", map[string]any{"payload": "no spaces", "product_sku": "JS-650"}, http.StatusBadRequest},
+		{"missing sku", http.MethodPost, "/api/v1/deep-links", map[string]any{"payload": "other"}, http.StatusBadRequest},
+		{"step without scenario", http.MethodPost, "/api/v1/deep-links", map[string]any{"payload": "other", "product_sku": "JS-650", "step_key": "root"}, http.StatusBadRequest},
+		{"unknown step", http.MethodPost, "/api/v1/deep-links", map[string]any{"payload": "other", "product_sku": "JS-650", "scenario_id": scenario.ID, "step_key": "missing"}, http.StatusNotFound},
+		{"duplicate payload", http.MethodPost, "/api/v1/deep-links", map[string]any{"payload": "promo", "product_sku": "JS-650"}, http.StatusConflict},
+		{"unknown link", http.MethodGet, "/api/v1/deep-links/missing", nil, http.StatusNotFound},
+		{"update unknown link", http.MethodPut, "/api/v1/deep-links/missing", map[string]any{"payload": "missing", "product_sku": "JS-650"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, "/api/v1/deep-links/promo", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, "/api/v1/deep-links/promo", nil).Code)
+}
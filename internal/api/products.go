@@ -0,0 +1,499 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// CategoryRequest represents category create/update request
+type CategoryRequest struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	SortOrder   int    `json:"sort_order"`
+}
+
+// CategoryResponse represents a category in API responses
+type CategoryResponse struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	SortOrder   int    `json:"sort_order"`
+}
+
+// ProductRequest represents product create/update request
+type ProductRequest struct {
+	SKU         string            `json:"sku"`
+	Model       string            `json:"model"`
+	CategoryID  *int              `json:"category_id"`
+	Specs       map[string]string `json:"specs"`
+	ManualURL   string            `json:"manual_url"`
+	ScenarioIDs []int             `json:"scenario_ids"`
+}
+
+// ProductResponse represents a product in API responses
+type ProductResponse struct {
+	ID          int               `json:"id"`
+	SKU         string            `json:"sku"`
+	Model       string            `json:"model"`
+	CategoryID  *int              `json:"category_id"`
+	Specs       map[string]string `json:"specs"`
+	ManualURL   string            `json:"manual_url"`
+	ScenarioIDs []int             `json:"scenario_ids"`
+}
+
+// ValidateCategoryRequest validates category create/update request
+func ValidateCategoryRequest(req *CategoryRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+// ValidateProductRequest validates product create/update request
+func ValidateProductRequest(req *ProductRequest) error {
+	if strings.TrimSpace(req.SKU) == "" {
+		return fmt.Errorf("sku is required")
+	}
+	if strings.TrimSpace(req.Model) == "" {
+		return fmt.Errorf("model is required")
+	}
+	for name := range req.Specs {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("spec names must not be empty")
+		}
+	}
+	if req.ManualURL != "" {
+		u, err := url.Parse(req.ManualURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("manual_url must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// handleCategories handles listing and creating categories
+func (s *Server) handleCategories(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListCategories(w)
+	case http.MethodPost:
+		s.handleCreateCategory(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCategory handles reading, updating and deleting a single category
+func (s *Server) handleCategory(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	categoryID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid category id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetCategory(w, categoryID)
+	case http.MethodPut:
+		s.handleUpdateCategory(w, r, categoryID)
+	case http.MethodDelete:
+		s.handleDeleteCategory(w, categoryID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListCategories returns all categories
+// @Summary List categories
+// @Description List the categories of products and of the scenario menu, in menu order
+// @Tags products
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} CategoryResponse
+// @Router /api/v1/categories [get]
+func (s *Server) handleListCategories(w http.ResponseWriter) {
+	categories, err := s.storage.GetCategories()
+	if err != nil {
+		log.Printf("Error getting categories: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]CategoryResponse, 0, len(categories))
+	for _, category := range categories {
+		response = append(response, newCategoryResponse(category))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateCategory creates a category
+// @Summary Create category
+// @Description Create a product category
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param category body CategoryRequest true "Category to create"
+// @Security BearerAuth
+// @Success 201 {object} CategoryResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 409 {string} string "Category already exists"
+// @Router /api/v1/categories [post]
+func (s *Server) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
+	var request CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateCategoryRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	category := newCategoryFromRequest(&request)
+	if err := s.storage.CreateCategory(category); err != nil {
+		writeStorageError(w, "creating category", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newCategoryResponse(category))
+}
+
+// handleGetCategory returns a single category
+// @Summary Get category
+// @Description Get a category by ID
+// @Tags products
+// @Produce json
+// @Param id path int true "Category ID"
+// @Security BearerAuth
+// @Success 200 {object} CategoryResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/categories/{id} [get]
+func (s *Server) handleGetCategory(w http.ResponseWriter, categoryID int) {
+	category, err := s.storage.GetCategory(categoryID)
+	if err != nil {
+		log.Printf("Error getting category %d: %v", categoryID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if category == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newCategoryResponse(category))
+}
+
+// handleUpdateCategory updates a category
+// @Summary Update category
+// @Description Rename or reorder a category
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path int true "Category ID"
+// @Param category body CategoryRequest true "Category fields"
+// @Security BearerAuth
+// @Success 200 {object} CategoryResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Failure 409 {string} string "Category already exists"
+// @Router /api/v1/categories/{id} [put]
+func (s *Server) handleUpdateCategory(w http.ResponseWriter, r *http.Request, categoryID int) {
+	var request CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateCategoryRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	category := newCategoryFromRequest(&request)
+	category.ID = categoryID
+	if err := s.storage.UpdateCategory(category); err != nil {
+		writeStorageError(w, "updating category", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newCategoryResponse(category))
+}
+
+// handleDeleteCategory deletes a category
+// @Summary Delete category
+// @Description Delete a category; its products and scenarios are left without one
+// @Tags products
+// @Param id path int true "Category ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/categories/{id} [delete]
+func (s *Server) handleDeleteCategory(w http.ResponseWriter, categoryID int) {
+	if err := s.storage.DeleteCategory(categoryID); err != nil {
+		writeStorageError(w, "deleting category", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProducts handles listing and creating products
+func (s *Server) handleProducts(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListProducts(w, r)
+	case http.MethodPost:
+		s.handleCreateProduct(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleProduct handles reading, updating and deleting a single product
+func (s *Server) handleProduct(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid product id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetProduct(w, productID)
+	case http.MethodPut:
+		s.handleUpdateProduct(w, r, productID)
+	case http.MethodDelete:
+		s.handleDeleteProduct(w, productID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListProducts returns all products, or the one with the SKU given in the query
+// @Summary List products
+// @Description List catalog products with their specs and linked scenarios
+// @Tags products
+// @Produce json
+// @Param sku query string false "Only the product with this SKU"
+// @Security BearerAuth
+// @Success 200 {array} ProductResponse
+// @Router /api/v1/products [get]
+func (s *Server) handleListProducts(w http.ResponseWriter, r *http.Request) {
+	var products []*storage.Product
+	var err error
+	if sku := r.URL.Query().Get("sku"); sku != "" {
+		var product *storage.Product
+		product, err = s.storage.GetProductBySKU(sku)
+		if product != nil {
+			products = append(products, product)
+		}
+	} else {
+		products, err = s.storage.GetProducts()
+	}
+	if err != nil {
+		log.Printf("Error getting products: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ProductResponse, 0, len(products))
+	for _, product := range products {
+		response = append(response, newProductResponse(product))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateProduct creates a product
+// @Summary Create product
+// @Description Add a product to the catalog and link it to the scenarios that apply to it
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param product body ProductRequest true "Product to create"
+// @Security BearerAuth
+// @Success 201 {object} ProductResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Category or scenario not found"
+// @Failure 409 {string} string "Product already exists"
+// @Router /api/v1/products [post]
+func (s *Server) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
+	var request ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateProductRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	product := newProductFromRequest(&request)
+	if err := s.storage.CreateProduct(product); err != nil {
+		writeStorageError(w, "creating product", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newProductResponse(product))
+}
+
+// handleGetProduct returns a single product
+// @Summary Get product
+// @Description Get a product by ID
+// @Tags products
+// @Produce json
+// @Param id path int true "Product ID"
+// @Security BearerAuth
+// @Success 200 {object} ProductResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/products/{id} [get]
+func (s *Server) handleGetProduct(w http.ResponseWriter, productID int) {
+	product, err := s.storage.GetProduct(productID)
+	if err != nil {
+		log.Printf("Error getting product %d: %v", productID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newProductResponse(product))
+}
+
+// handleUpdateProduct updates a product
+// @Summary Update product
+// @Description Replace the fields and scenario links of a product
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path int true "Product ID"
+// @Param product body ProductRequest true "Product fields"
+// @Security BearerAuth
+// @Success 200 {object} ProductResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Failure 409 {string} string "Product already exists"
+// @Router /api/v1/products/{id} [put]
+func (s *Server) handleUpdateProduct(w http.ResponseWriter, r *http.Request, productID int) {
+	var request ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateProductRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	product := newProductFromRequest(&request)
+	product.ID = productID
+	if err := s.storage.UpdateProduct(product); err != nil {
+		writeStorageError(w, "updating product", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newProductResponse(product))
+}
+
+// handleDeleteProduct deletes a product
+// @Summary Delete product
+// @Description Delete a product with its scenario links
+// @Tags products
+// @Param id path int true "Product ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/products/{id} [delete]
+func (s *Server) handleDeleteProduct(w http.ResponseWriter, productID int) {
+	if err := s.storage.DeleteProduct(productID); err != nil {
+		writeStorageError(w, "deleting product", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newCategoryFromRequest(req *CategoryRequest) *storage.Category {
+	return &storage.Category{
+		Name:        strings.TrimSpace(req.Name),
+		DisplayName: strings.TrimSpace(req.DisplayName),
+		SortOrder:   req.SortOrder,
+	}
+}
+
+func newCategoryResponse(category *storage.Category) CategoryResponse {
+	return CategoryResponse{
+		ID:          category.ID,
+		Name:        category.Name,
+		DisplayName: category.DisplayName,
+		SortOrder:   category.SortOrder,
+	}
+}
+
+func newProductFromRequest(req *ProductRequest) *storage.Product {
+	specs := make(map[string]string, len(req.Specs))
+	for name, value := range req.Specs {
+		specs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return &storage.Product{
+		SKU:         strings.TrimSpace(req.SKU),
+		Model:       strings.TrimSpace(req.Model),
+		CategoryID:  req.CategoryID,
+		Specs:       specs,
+		ManualURL:   req.ManualURL,
+		ScenarioIDs: req.ScenarioIDs,
+	}
+}
+
+func newProductResponse(product *storage.Product) ProductResponse {
+	specs := product.Specs
+	if specs == nil {
+		specs = map[string]string{}
+	}
+	scenarioIDs := product.ScenarioIDs
+	if scenarioIDs == nil {
+		scenarioIDs = []int{}
+	}
+	return ProductResponse{
+		ID:          product.ID,
+		SKU:         product.SKU,
+		Model:       product.Model,
+		CategoryID:  product.CategoryID,
+		Specs:       specs,
+		ManualURL:   product.ManualURL,
+		ScenarioIDs: scenarioIDs,
+	}
+}
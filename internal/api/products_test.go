@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCategoryCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/categories", "/api/v1/categories/1")
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/categories", map[string]any{
+		"name":         " saws ",
+		"display_name": "Пилы",
+		"sort_order":   2,
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[CategoryResponse](t, rec)
+	assert.Equal(t, CategoryResponse{ID: created.ID, Name: "saws", DisplayName: "Пилы", SortOrder: 2}, created)
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/categories", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []CategoryResponse{created}, decode[[]CategoryResponse](t, rec))
+
+	path := fmt.Sprintf("/api/v1/categories/%d", created.ID)
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{"name": "saws", "display_name": "Пилы и лобзики"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "Пилы и лобзики", decode[CategoryResponse](t, rec).DisplayName)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing name", http.MethodPost, "/api/v1/categories", map[string]any{"display_name": "Пилы"}, http.StatusBadRequest},
+		{"duplicate name", http.MethodPost, "/api/v1/categories", map[string]any{"name": "saws"}, http.StatusConflict},
+		{"invalid id", http.MethodGet, "/api/v1/categories/abc", nil, http.StatusBadRequest},
+		{"unknown category", http.MethodGet, "/api/v1/categories/999", nil, http.StatusNotFound},
+		{"update unknown category", http.MethodPut, "/api/v1/categories/999", map[string]any{"name": "mowers"}, http.StatusNotFound},
+		{"method not allowed", http.MethodPatch, path, nil, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodDelete, path, nil).Code)
+}
+
+func TestProductCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/products", "/api/v1/products/1")
+	scenario := createScenario(t, handler)
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/categories", map[string]any{"name": "saws"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	category := decode[CategoryResponse](t, rec)
+
+	rec = serve(t, handler, http.MethodPost, "/api/v1/products", map[string]any{
+		"sku":          "JS-650",
+		"model":        "Лобзик JS-650",
+		"category_id":  category.ID,
+		"specs":        map[string]string{"Мощность": "650 Вт"},
+		"manual_url":   "https://example.com/js-650.pdf",
+		"scenario_ids": []int{scenario.ID},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[ProductResponse](t, rec)
+	assert.Equal(t, ProductResponse{
+		ID:          created.ID,
+		SKU:         "JS-650",
+		Model:       "Лобзик JS-650",
+		CategoryID:  &category.ID,
+		Specs:       map[string]string{"Мощность": "650 Вт"},
+		ManualURL:   "https://example.com/js-650.pdf",
+		ScenarioIDs: []int{scenario.ID},
+	}, created)
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/products?sku=JS-650", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []ProductResponse{created}, decode[[]ProductResponse](t, rec))
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/products?sku=missing", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, decode[[]ProductResponse](t, rec))
+
+	path := fmt.Sprintf("/api/v1/products/%d", created.ID)
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{"sku": "JS-650", "model": "Лобзик JS-650M"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "Лобзик JS-650M", decode[ProductResponse](t, rec).Model)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing sku", http.MethodPost, "/api/v1/products", map[string]any{"model": "Лобзик"}, http.StatusBadRequest},
+		{"missing model", http.MethodPost, "/api/v1/products", map[string]any{"sku": "JS-700"}, http.StatusBadRequest},
+		{"empty spec name", http.MethodPost, "/api/v1/products", map[string]any{"sku": "JS-700", "model": "Лобзик", "specs": map[string]string{" ": "?"}}, http.StatusBadRequest},
+		{"manual not a URL", http.MethodPost, "/api/v1/products", map[string]any{"sku": "JS-700", "model": "Лобзик", "manual_url": "ftp://example.com"}, http.StatusBadRequest},
+		{"duplicate sku", http.MethodPost, "/api/v1/products", map[string]any{"sku": "JS-650", "model": "Лобзик"}, http.StatusConflict},
+		{"invalid id", http.MethodGet, "/api/v1/products/abc", nil, http.StatusBadRequest},
+		{"unknown product", http.MethodGet, "/api/v1/products/999", nil, http.StatusNotFound},
+		{"update unknown product", http.MethodPut, "/api/v1/products/999", map[string]any{"sku": "JS-700", "model": "Лобзик"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, path, nil).Code)
+}
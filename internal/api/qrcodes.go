@@ -0,0 +1,405 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/skip2/go-qrcode"
+)
+
+// QR code limits and defaults
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// qrLevels maps the level query parameter to error correction levels
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// StartLinkResponse represents a deep link to the bot
+type StartLinkResponse struct {
+	Payload string `json:"payload"`
+	URL     string `json:"url"`
+}
+
+// qrOptions are the rendering options of a QR code request
+type qrOptions struct {
+	format string
+	size   int
+	level  qrcode.RecoveryLevel
+}
+
+// startLink returns the t.me link that opens the bot with payload
+func (s *Server) startLink(payload string) string {
+	return "https://t.me/" + s.botUsername + "?start=" + url.QueryEscape(payload)
+}
+
+// handleQRCode renders the deep link of a payload as a QR code
+// @Summary Deep link QR code
+// @Description Render https://t.me/<bot>?start=<payload> as a QR code. The payload is given as is, or built from sku, scenario_id and step_key as sku__scenario__step.
+// @Tags deep-links
+// @Produce png
+// @Produce image/svg+xml
+// @Produce json
+// @Param payload query string false "Start payload"
+// @Param sku query string false "Product SKU"
+// @Param scenario_id query int false "Scenario ID"
+// @Param step_key query string false "Step key, requires scenario_id"
+// @Param format query string false "png (default), svg or link"
+// @Param size query int false "Image size in pixels, 64-2048, default 256"
+// @Param level query string false "Error correction level: L, M (default), Q or H"
+// @Security BearerAuth
+// @Success 200 {object} StartLinkResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Scenario or step not found"
+// @Router /api/v1/qr [get]
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.botUsername == "" {
+		http.Error(w, "Bot username is not known yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	options, err := parseQROptions(query, "png", "svg", "link")
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payload, ok := s.qrPayload(w, query)
+	if !ok {
+		return
+	}
+
+	link := s.startLink(payload)
+	if options.format == "link" {
+		writeJSON(w, http.StatusOK, StartLinkResponse{Payload: payload, URL: link})
+		return
+	}
+
+	image, contentType, err := renderQR(link, options)
+	if err != nil {
+		log.Printf("Error rendering QR code for payload %s: %v", payload, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", payload+"."+options.format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(image)
+}
+
+// handleQRCodeExport returns a ZIP with a QR code for every deep link and every menu scenario
+// @Summary Export deep link QR codes
+// @Description ZIP archive with a QR code for every saved deep link (deep-links/<payload>) and every scenario shown in the menu (scenarios/<name>, payload sku__name), and links.csv listing file, payload and URL. Hidden scenarios and the site offer are left out.
+// @Tags deep-links
+// @Produce application/zip
+// @Param sku query string false "Product SKU for scenario links"
+// @Param format query string false "png (default) or svg"
+// @Param size query int false "Image size in pixels, 64-2048, default 256"
+// @Param level query string false "Error correction level: L, M (default), Q or H"
+// @Security BearerAuth
+// @Success 200 {file} file "ZIP archive"
+// @Failure 400 {string} string "Bad request"
+// @Router /api/v1/qr/export [get]
+func (s *Server) handleQRCodeExport(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.botUsername == "" {
+		http.Error(w, "Bot username is not known yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	options, err := parseQROptions(query, "png", "svg")
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sku := strings.TrimSpace(query.Get("sku"))
+
+	type entry struct{ name, payload string }
+	var entries []entry
+
+	links, err := s.storage.GetDeepLinks()
+	if err != nil {
+		log.Printf("Error getting deep links: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, link := range links {
+		entries = append(entries, entry{name: "deep-links/" + link.Payload, payload: link.Payload})
+	}
+
+	scenarios, err := s.storage.GetFSMScenarios()
+	if err != nil {
+		log.Printf("Error getting scenarios: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, scenario := range scenarios {
+		// Users never reach these from the menu, so they get no printed codes
+		if scenario.HiddenFromMenu || scenario.Name == s.siteOffer {
+			continue
+		}
+		payload := fsm.StartPayload{ProductSKU: sku, Scenario: scenario.Name}.String()
+		if !payloadPattern.MatchString(payload) {
+			log.Printf("Skipping scenario %s in QR export: payload %q is not a valid start payload", scenario.Name, payload)
+			continue
+		}
+		entries = append(entries, entry{name: "scenarios/" + scenario.Name, payload: payload})
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	manifest := [][]string{{"file", "payload", "url"}}
+	for _, e := range entries {
+		link := s.startLink(e.payload)
+		image, _, err := renderQR(link, options)
+		if err != nil {
+			log.Printf("Error rendering QR code for payload %s: %v", e.payload, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		name := e.name + "." + options.format
+		if err := writeZipFile(zw, name, image); err != nil {
+			log.Printf("Error writing QR export: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		manifest = append(manifest, []string{name, e.payload, link})
+	}
+
+	var csvData bytes.Buffer
+	cw := csv.NewWriter(&csvData)
+	cw.WriteAll(manifest)
+	if err := writeZipFile(zw, "links.csv", csvData.Bytes()); err != nil {
+		log.Printf("Error writing QR export: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error writing QR export: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="qr-codes.zip"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive.Bytes())
+}
+
+// qrPayload returns the payload a QR code request asks for, writing an error response if it is invalid.
+// A payload that names a scenario must be one fsm.PayloadCanOpen allows.
+func (s *Server) qrPayload(w http.ResponseWriter, query url.Values) (string, bool) {
+	var scenario *storage.FSMScenario
+	payload := strings.TrimSpace(query.Get("payload"))
+	parts := fsm.ParseStartPayload(payload)
+	if payload != "" {
+		if parts.Scenario != "" {
+			var err error
+			scenario, err = s.scenarioByName(parts.Scenario)
+			if err != nil {
+				log.Printf("Error getting scenario %s: %v", parts.Scenario, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return "", false
+			}
+		}
+	} else {
+		parts = fsm.StartPayload{
+			ProductSKU: strings.TrimSpace(query.Get("sku")),
+			StepKey:    strings.TrimSpace(query.Get("step_key")),
+		}
+
+		if value := query.Get("scenario_id"); value != "" {
+			scenarioID, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "Bad request: invalid scenario_id", http.StatusBadRequest)
+				return "", false
+			}
+			scenario, err = s.storage.GetFSMScenario(scenarioID)
+			if err != nil {
+				log.Printf("Error getting scenario %d: %v", scenarioID, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return "", false
+			}
+			if scenario == nil {
+				http.Error(w, "Scenario not found", http.StatusNotFound)
+				return "", false
+			}
+			parts.Scenario = scenario.Name
+		}
+
+		if parts.StepKey != "" && parts.Scenario == "" {
+			http.Error(w, "Bad request: step_key requires scenario_id", http.StatusBadRequest)
+			return "", false
+		}
+		if parts.ProductSKU == "" && parts.Scenario == "" {
+			http.Error(w, "Bad request: payload, sku or scenario_id is required", http.StatusBadRequest)
+			return "", false
+		}
+		payload = parts.String()
+	}
+
+	if !payloadPattern.MatchString(payload) {
+		http.Error(w, "Bad request: payload must be 1-64 characters A-Z, a-z, 0-9, _ and -", http.StatusBadRequest)
+		return "", false
+	}
+	if scenario != nil && !s.payloadCanOpen(w, scenario, parts.StepKey) {
+		return "", false
+	}
+	return payload, true
+}
+
+// payloadCanOpen writes an error response and returns false if a start link
+// may not open the scenario or its step
+func (s *Server) payloadCanOpen(w http.ResponseWriter, scenario *storage.FSMScenario, stepKey string) bool {
+	var step *storage.FSMScenarioStep
+	if stepKey != "" {
+		var err error
+		step, err = s.storage.GetFSMScenarioStep(scenario.ID, stepKey)
+		if err != nil {
+			log.Printf("Error getting step %s of scenario %d: %v", stepKey, scenario.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return false
+		}
+		if step == nil {
+			http.Error(w, "Step not found", http.StatusNotFound)
+			return false
+		}
+	}
+
+	if !fsm.PayloadCanOpen(scenario, step, s.siteOffer) {
+		http.Error(w, "Bad request: links cannot open the site offer, hidden scenarios or steps with effects", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// scenarioByName returns the scenario with a name, or nil if there is none
+func (s *Server) scenarioByName(name string) (*storage.FSMScenario, error) {
+	scenarios, err := s.storage.GetFSMScenarios()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenarios: %w", err)
+	}
+	for _, scenario := range scenarios {
+		if scenario.Name == name {
+			return scenario, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseQROptions reads format, size and level from the query; the first format is the default
+func parseQROptions(query url.Values, formats ...string) (qrOptions, error) {
+	options := qrOptions{format: formats[0], size: defaultQRSize, level: qrcode.Medium}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		known := false
+		for _, f := range formats {
+			known = known || f == format
+		}
+		if !known {
+			return options, fmt.Errorf("format must be one of %s", strings.Join(formats, ", "))
+		}
+		options.format = format
+	}
+
+	if value := query.Get("size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return options, fmt.Errorf("size must be between %d and %d", minQRSize, maxQRSize)
+		}
+		options.size = size
+	}
+
+	if value := query.Get("level"); value != "" {
+		level, ok := qrLevels[strings.ToUpper(value)]
+		if !ok {
+			return options, fmt.Errorf("level must be L, M, Q or H")
+		}
+		options.level = level
+	}
+
+	return options, nil
+}
+
+// renderQR renders content as a QR code image and returns it with its content type
+func renderQR(content string, options qrOptions) ([]byte, string, error) {
+	code, err := qrcode.New(content, options.level)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode QR code: %w", err)
+	}
+
+	if options.format == "svg" {
+		return qrSVG(code.Bitmap(), options.size), "image/svg+xml", nil
+	}
+
+	image, err := code.PNG(options.size)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render QR code: %w", err)
+	}
+	return image, "image/png", nil
+}
+
+// qrSVG draws a QR code bitmap, quiet zone included, as an SVG of size x size pixels
+func qrSVG(bitmap [][]bool, size int) []byte {
+	modules := len(bitmap)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// writeZipFile adds a file to a ZIP archive
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQROptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    qrOptions
+		wantErr bool
+	}{
+		{"defaults", "", qrOptions{format: "png", size: defaultQRSize, level: qrcode.Medium}, false},
+		{"all set", "format=SVG&size=512&level=q", qrOptions{format: "svg", size: 512, level: qrcode.High}, false},
+		{"link", "format=link", qrOptions{format: "link", size: defaultQRSize, level: qrcode.Medium}, false},
+		{"unknown format", "format=gif", qrOptions{}, true},
+		{"size too small", "size=10", qrOptions{}, true},
+		{"size too large", "size=4096", qrOptions{}, true},
+		{"size not a number", "size=big", qrOptions{}, true},
+		{"unknown level", "level=X", qrOptions{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+
+			options, err := parseQROptions(query, "png", "svg", "link")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, options)
+		})
+	}
+}
+
+func TestQRPayload(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	scenario := &storage.FSMScenario{Name: "diagnose_jigsaw", TriggerKeywords: []string{}}
+	require.NoError(t, s.CreateFSMScenario(scenario))
+	require.NoError(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "no_power", Message: "No power", StateType: "intermediate"}))
+	require.NoError(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "consent", Message: "Consent", StateType: "intermediate", Effects: []string{"grant_consent"}}))
+	hidden := &storage.FSMScenario{Name: "replace_brushes", HiddenFromMenu: true, TriggerKeywords: []string{}}
+	require.NoError(t, s.CreateFSMScenario(hidden))
+	siteOffer := &storage.FSMScenario{Name: fsm.DefaultSiteOfferScenario, TriggerKeywords: []string{}}
+	require.NoError(t, s.CreateFSMScenario(siteOffer))
+	server := NewServer(s, nil, testToken, "0", false)
+	scenarioID := strconv.Itoa(scenario.ID)
+
+	tests := []struct {
+		name     string
+		query    string
+		want     string
+		wantCode int
+	}{
+		{"payload as is", "payload=JS-650", "JS-650", http.StatusOK},
+		{"payload wins over parts", "payload=promo&sku=JS-650", "promo", http.StatusOK},
+		{"sku", "sku=JS-650", "JS-650", http.StatusOK},
+		{"sku and scenario", "sku=JS-650&scenario_id=" + scenarioID, "JS-650__diagnose_jigsaw", http.StatusOK},
+		{"scenario and step", "scenario_id=" + scenarioID + "&step_key=no_power", "__diagnose_jigsaw__no_power", http.StatusOK},
+		{"nothing", "", "", http.StatusBadRequest},
+		{"step without scenario", "sku=JS-650&step_key=no_power", "", http.StatusBadRequest},
+		{"invalid scenario id", "scenario_id=abc", "", http.StatusBadRequest},
+		{"unknown scenario", "scenario_id=999", "", http.StatusNotFound},
+		{"invalid payload", "payload=JS 650", "", http.StatusBadRequest},
+		{"unknown step", "scenario_id=" + scenarioID + "&step_key=missing", "", http.StatusNotFound},
+		{"step with effects", "scenario_id=" + scenarioID + "&step_key=consent", "", http.StatusBadRequest},
+		{"hidden scenario", "scenario_id=" + strconv.Itoa(hidden.ID), "", http.StatusBadRequest},
+		{"site offer", "scenario_id=" + strconv.Itoa(siteOffer.ID), "", http.StatusBadRequest},
+		{"payload with step effects", "payload=__diagnose_jigsaw__consent", "", http.StatusBadRequest},
+		{"payload with site offer", "payload=__site_offer", "", http.StatusBadRequest},
+		{"payload with hidden scenario", "payload=__replace_brushes", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			payload, ok := server.qrPayload(rec, query)
+			assert.Equal(t, tt.wantCode == http.StatusOK, ok)
+			assert.Equal(t, tt.want, payload)
+			assert.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	handler, _ := newTestServer(t)
+
+	rec := serve(t, handler, http.MethodGet, "/api/v1/qr?payload=JS-650&format=link", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, StartLinkResponse{
+		Payload: "JS-650",
+		URL:     "https://t.me/electro_tools_bot?start=JS-650",
+	}, decode[StartLinkResponse](t, rec))
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/qr?payload=JS-650", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.True(t, bytes.HasPrefix(rec.Body.Bytes(), []byte("\x89PNG")))
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/qr?payload=JS-650&format=svg", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "image/svg+xml", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "<svg")
+
+	assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodGet, "/api/v1/qr?payload=JS-650&size=1", nil).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(t, handler, http.MethodPost, "/api/v1/qr?payload=JS-650", nil).Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/qr?payload=JS-650", nil)
+	unauthorized := httptest.NewRecorder()
+	handler.ServeHTTP(unauthorized, req)
+	assert.Equal(t, http.StatusUnauthorized, unauthorized.Code)
+}
+
+func TestQRCodeExport(t *testing.T) {
+	handler, s := newTestServer(t)
+
+	require.NoError(t, s.CreateDeepLink(&storage.DeepLink{Payload: "promo", ProductSKU: "JS-650"}))
+	for _, scenario := range []*storage.FSMScenario{
+		{Name: "diagnose_jigsaw"},
+		{Name: "replace_brushes", HiddenFromMenu: true},
+		{Name: fsm.DefaultSiteOfferScenario},
+	} {
+		scenario.TriggerKeywords = []string{}
+		require.NoError(t, s.CreateFSMScenario(scenario))
+	}
+
+	rec := serve(t, handler, http.MethodGet, "/api/v1/qr/export?sku=JS-650&format=svg", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"deep-links/promo.svg", "scenarios/diagnose_jigsaw.svg", "links.csv"}, names)
+
+	manifest, err := archive.Open("links.csv")
+	require.NoError(t, err)
+	defer manifest.Close()
+	rows, err := csv.NewReader(manifest).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"file", "payload", "url"},
+		{"deep-links/promo.svg", "promo", "https://t.me/electro_tools_bot?start=promo"},
+		{"scenarios/diagnose_jigsaw.svg", "JS-650__diagnose_jigsaw", "https://t.me/electro_tools_bot?start=JS-650__diagnose_jigsaw"},
+	}, rows)
+
+	assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodGet, "/api/v1/qr/export?format=link", nil).Code)
+}
@@ -0,0 +1,680 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// Allowed values of fsm_steps.state_type
+const (
+	StateTypeStart        = "start"
+	StateTypeIntermediate = "intermediate"
+	StateTypeFinal        = "final"
+)
+
+// NullableInt is an int field of a request that tells an omitted value from null
+type NullableInt struct {
+	// Set is true if the field was present, null included
+	Set   bool
+	Value *int
+}
+
+// UnmarshalJSON records that the field was present
+func (n *NullableInt) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	return json.Unmarshal(data, &n.Value)
+}
+
+// ScenarioRequest represents scenario create/update request. On update the
+// omitted tool_keywords, category_id, visible_in_menu and sort_order keep
+// their stored values.
+type ScenarioRequest struct {
+	Name            string      `json:"name"`
+	DisplayName     string      `json:"display_name"`
+	TriggerKeywords []string    `json:"trigger_keywords"`
+	ToolKeywords    []string    `json:"tool_keywords"`
+	Description     string      `json:"description"`
+	CategoryID      NullableInt `json:"category_id" swaggertype:"integer"`
+	// VisibleInMenu defaults to true when omitted on create
+	VisibleInMenu *bool `json:"visible_in_menu"`
+	SortOrder     *int  `json:"sort_order"`
+}
+
+// ScenarioResponse represents a scenario in API responses
+type ScenarioResponse struct {
+	ID              int      `json:"id"`
+	Name            string   `json:"name"`
+	DisplayName     string   `json:"display_name"`
+	TriggerKeywords []string `json:"trigger_keywords"`
+	ToolKeywords    []string `json:"tool_keywords"`
+	Description     string   `json:"description"`
+	CategoryID      *int     `json:"category_id"`
+	VisibleInMenu   bool     `json:"visible_in_menu"`
+	SortOrder       int      `json:"sort_order"`
+}
+
+// StepRequest represents step create/update request. On update the omitted
+// input, input_error and effects keep their stored values.
+type StepRequest struct {
+	StepKey     string   `json:"step_key"`
+	Message     string   `json:"message"`
+	IsFinal     bool     `json:"is_final"`
+	NextStepKey *string  `json:"next_step_key"`
+	StateType   string   `json:"state_type"`
+	Input       *string  `json:"input"`
+	InputError  *string  `json:"input_error"`
+	Effects     []string `json:"effects"`
+}
+
+// StepResponse represents a scenario step in API responses
+type StepResponse struct {
+	ID          int      `json:"id"`
+	ScenarioID  int      `json:"scenario_id"`
+	StepKey     string   `json:"step_key"`
+	Message     string   `json:"message"`
+	IsFinal     bool     `json:"is_final"`
+	NextStepKey *string  `json:"next_step_key"`
+	StateType   string   `json:"state_type"`
+	Input       string   `json:"input"`
+	InputError  string   `json:"input_error"`
+	Effects     []string `json:"effects"`
+}
+
+// ValidateScenarioRequest validates scenario create/update request
+func ValidateScenarioRequest(req *ScenarioRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	for _, keyword := range req.TriggerKeywords {
+		if strings.TrimSpace(keyword) == "" {
+			return fmt.Errorf("trigger_keywords must not contain empty values")
+		}
+	}
+	for _, keyword := range req.ToolKeywords {
+		if strings.TrimSpace(keyword) == "" {
+			return fmt.Errorf("tool_keywords must not contain empty values")
+		}
+	}
+	return nil
+}
+
+// ValidateStepRequest validates step create/update request
+func ValidateStepRequest(req *StepRequest) error {
+	if strings.TrimSpace(req.StepKey) == "" {
+		return fmt.Errorf("step_key is required")
+	}
+	if strings.ContainsAny(req.StepKey, " \t\n/") {
+		return fmt.Errorf("step_key must not contain whitespace or '/'")
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		return fmt.Errorf("message is required")
+	}
+	switch req.StateType {
+	case StateTypeStart, StateTypeIntermediate, StateTypeFinal:
+	default:
+		return fmt.Errorf("state_type must be one of: start, intermediate, final")
+	}
+	if req.NextStepKey != nil && strings.TrimSpace(*req.NextStepKey) == "" {
+		return fmt.Errorf("next_step_key must be null or a step key")
+	}
+	if req.InputError != nil && *req.InputError != "" && (req.Input == nil || *req.Input == "") {
+		return fmt.Errorf("input_error requires input")
+	}
+	for _, effect := range req.Effects {
+		if strings.TrimSpace(effect) == "" {
+			return fmt.Errorf("effects must not contain empty values")
+		}
+	}
+	return nil
+}
+
+// handleScenarios handles listing and creating scenarios
+func (s *Server) handleScenarios(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListScenarios(w, r)
+	case http.MethodPost:
+		s.handleCreateScenario(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleScenario handles reading, updating and deleting a single scenario
+func (s *Server) handleScenario(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetScenario(w, scenarioID)
+	case http.MethodPut:
+		s.handleUpdateScenario(w, r, scenarioID)
+	case http.MethodDelete:
+		s.handleDeleteScenario(w, scenarioID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListScenarios returns all scenarios
+// @Summary List scenarios
+// @Description List all FSM scenarios
+// @Tags scenarios
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} ScenarioResponse
+// @Router /api/v1/scenarios [get]
+func (s *Server) handleListScenarios(w http.ResponseWriter, r *http.Request) {
+	scenarios, err := s.storage.GetFSMScenarios()
+	if err != nil {
+		log.Printf("Error getting scenarios: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ScenarioResponse, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		response = append(response, newScenarioResponse(scenario))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateScenario creates a scenario
+// @Summary Create scenario
+// @Description Create a new FSM scenario
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param scenario body ScenarioRequest true "Scenario to create"
+// @Security BearerAuth
+// @Success 201 {object} ScenarioResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 409 {string} string "Scenario already exists"
+// @Router /api/v1/scenarios [post]
+func (s *Server) handleCreateScenario(w http.ResponseWriter, r *http.Request) {
+	var request ScenarioRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateScenarioRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scenario := newScenarioFromRequest(&request)
+	if err := s.storage.CreateFSMScenario(scenario); err != nil {
+		writeStorageError(w, "creating scenario", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newScenarioResponse(scenario))
+}
+
+// handleGetScenario returns a single scenario
+// @Summary Get scenario
+// @Description Get FSM scenario by ID
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Security BearerAuth
+// @Success 200 {object} ScenarioResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id} [get]
+func (s *Server) handleGetScenario(w http.ResponseWriter, scenarioID int) {
+	scenario, err := s.storage.GetFSMScenario(scenarioID)
+	if err != nil {
+		log.Printf("Error getting scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if scenario == nil {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newScenarioResponse(scenario))
+}
+
+// handleUpdateScenario updates a scenario
+// @Summary Update scenario
+// @Description Update FSM scenario metadata and trigger keywords
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param scenario body ScenarioRequest true "Scenario fields"
+// @Security BearerAuth
+// @Success 200 {object} ScenarioResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id} [put]
+func (s *Server) handleUpdateScenario(w http.ResponseWriter, r *http.Request, scenarioID int) {
+	var request ScenarioRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateScenarioRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := s.storage.GetFSMScenario(scenarioID)
+	if err != nil {
+		log.Printf("Error getting scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+
+	scenario := newScenarioFromRequest(&request)
+	scenario.ID = scenarioID
+	// Omitted fields keep their stored values
+	if request.ToolKeywords == nil {
+		scenario.ToolKeywords = existing.ToolKeywords
+	}
+	if !request.CategoryID.Set {
+		scenario.CategoryID = existing.CategoryID
+	}
+	if request.VisibleInMenu == nil {
+		scenario.HiddenFromMenu = existing.HiddenFromMenu
+	}
+	if request.SortOrder == nil {
+		scenario.SortOrder = existing.SortOrder
+	}
+	if err := s.storage.UpdateFSMScenario(scenario); err != nil {
+		writeStorageError(w, "updating scenario", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newScenarioResponse(scenario))
+}
+
+// handleDeleteScenario deletes a scenario
+// @Summary Delete scenario
+// @Description Delete FSM scenario with all its steps
+// @Tags scenarios
+// @Param id path int true "Scenario ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id} [delete]
+func (s *Server) handleDeleteScenario(w http.ResponseWriter, scenarioID int) {
+	if err := s.storage.DeleteFSMScenario(scenarioID); err != nil {
+		writeStorageError(w, "deleting scenario", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleScenarioSteps handles listing and creating steps of a scenario
+func (s *Server) handleScenarioSteps(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListSteps(w, scenarioID)
+	case http.MethodPost:
+		s.handleCreateStep(w, r, scenarioID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleScenarioStep handles reading, updating and deleting a single step
+func (s *Server) handleScenarioStep(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+	stepKey := r.PathValue("step_key")
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetStep(w, scenarioID, stepKey)
+	case http.MethodPut:
+		s.handleUpdateStep(w, r, scenarioID, stepKey)
+	case http.MethodDelete:
+		s.handleDeleteStep(w, scenarioID, stepKey)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListSteps returns all steps of a scenario
+// @Summary List scenario steps
+// @Description List all steps of an FSM scenario
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Security BearerAuth
+// @Success 200 {array} StepResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/steps [get]
+func (s *Server) handleListSteps(w http.ResponseWriter, scenarioID int) {
+	if !s.scenarioExists(w, scenarioID) {
+		return
+	}
+
+	steps, err := s.storage.GetFSMScenarioSteps(scenarioID)
+	if err != nil {
+		log.Printf("Error getting steps for scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]StepResponse, 0, len(steps))
+	for _, step := range steps {
+		response = append(response, newStepResponse(step))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateStep adds a step to a scenario
+// @Summary Create scenario step
+// @Description Add a step to an FSM scenario
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param step body StepRequest true "Step to create"
+// @Security BearerAuth
+// @Success 201 {object} StepResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Failure 409 {string} string "Step already exists"
+// @Router /api/v1/scenarios/{id}/steps [post]
+func (s *Server) handleCreateStep(w http.ResponseWriter, r *http.Request, scenarioID int) {
+	request := StepRequest{StateType: StateTypeIntermediate}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateStepRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	step := newStepFromRequest(&request)
+	step.ScenarioID = scenarioID
+	if err := s.storage.CreateFSMScenarioStep(step); err != nil {
+		writeStorageError(w, "creating step", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newStepResponse(step))
+}
+
+// handleGetStep returns a single step
+// @Summary Get scenario step
+// @Description Get a step of an FSM scenario by its key
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param step_key path string true "Step key"
+// @Security BearerAuth
+// @Success 200 {object} StepResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/steps/{step_key} [get]
+func (s *Server) handleGetStep(w http.ResponseWriter, scenarioID int, stepKey string) {
+	step, err := s.storage.GetFSMScenarioStep(scenarioID, stepKey)
+	if err != nil {
+		log.Printf("Error getting step %s for scenario %d: %v", stepKey, scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if step == nil {
+		http.Error(w, "Step not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newStepResponse(step))
+}
+
+// handleUpdateStep updates a step
+// @Summary Update scenario step
+// @Description Update message, transitions and type of a step. The step key in the body must match the path.
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param step_key path string true "Step key"
+// @Param step body StepRequest true "Step fields"
+// @Security BearerAuth
+// @Success 200 {object} StepResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/steps/{step_key} [put]
+func (s *Server) handleUpdateStep(w http.ResponseWriter, r *http.Request, scenarioID int, stepKey string) {
+	request := StepRequest{StepKey: stepKey, StateType: StateTypeIntermediate}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if request.StepKey != stepKey {
+		http.Error(w, "Bad request: step_key cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := s.storage.GetFSMScenarioStep(scenarioID, stepKey)
+	if err != nil {
+		log.Printf("Error getting step %s of scenario %d: %v", stepKey, scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Step not found", http.StatusNotFound)
+		return
+	}
+
+	// Omitted fields keep their stored values, so editing the text of a step
+	// does not drop its validator or effects
+	if request.Input == nil {
+		request.Input = &existing.Input
+	}
+	if request.InputError == nil {
+		request.InputError = &existing.InputError
+	}
+	if request.Effects == nil {
+		request.Effects = existing.Effects
+	}
+
+	if err := ValidateStepRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	step := newStepFromRequest(&request)
+	step.ScenarioID = scenarioID
+	if err := s.storage.UpdateFSMScenarioStep(step); err != nil {
+		writeStorageError(w, "updating step", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newStepResponse(step))
+}
+
+// handleDeleteStep deletes a step
+// @Summary Delete scenario step
+// @Description Delete a step. Sessions parked on this step are reset.
+// @Tags scenarios
+// @Param id path int true "Scenario ID"
+// @Param step_key path string true "Step key"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/steps/{step_key} [delete]
+func (s *Server) handleDeleteStep(w http.ResponseWriter, scenarioID int, stepKey string) {
+	if err := s.storage.DeleteFSMScenarioStep(scenarioID, stepKey); err != nil {
+		writeStorageError(w, "deleting step", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scenarioExists writes 404 and returns false when the scenario does not exist
+func (s *Server) scenarioExists(w http.ResponseWriter, scenarioID int) bool {
+	scenario, err := s.storage.GetFSMScenario(scenarioID)
+	if err != nil {
+		log.Printf("Error getting scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if scenario == nil {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// writeStorageError maps storage errors to HTTP status codes
+func writeStorageError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrAlreadyExists):
+		http.Error(w, "Conflict: already exists", http.StatusConflict)
+	default:
+		log.Printf("Error %s: %v", action, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func newScenarioFromRequest(req *ScenarioRequest) *storage.FSMScenario {
+	sortOrder := 0
+	if req.SortOrder != nil {
+		sortOrder = *req.SortOrder
+	}
+
+	return &storage.FSMScenario{
+		Name:            strings.TrimSpace(req.Name),
+		DisplayName:     strings.TrimSpace(req.DisplayName),
+		TriggerKeywords: trimKeywords(req.TriggerKeywords),
+		ToolKeywords:    trimKeywords(req.ToolKeywords),
+		Description:     req.Description,
+		CategoryID:      req.CategoryID.Value,
+		HiddenFromMenu:  req.VisibleInMenu != nil && !*req.VisibleInMenu,
+		SortOrder:       sortOrder,
+	}
+}
+
+// trimKeywords trims keywords from a request; omitted keywords stay nil
+func trimKeywords(keywords []string) []string {
+	if keywords == nil {
+		return nil
+	}
+	trimmed := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		trimmed = append(trimmed, strings.TrimSpace(keyword))
+	}
+	return trimmed
+}
+
+func newScenarioResponse(scenario *storage.FSMScenario) ScenarioResponse {
+	keywords := scenario.TriggerKeywords
+	if keywords == nil {
+		keywords = []string{}
+	}
+	toolKeywords := scenario.ToolKeywords
+	if toolKeywords == nil {
+		toolKeywords = []string{}
+	}
+
+	return ScenarioResponse{
+		ID:              scenario.ID,
+		Name:            scenario.Name,
+		DisplayName:     scenario.DisplayName,
+		TriggerKeywords: keywords,
+		ToolKeywords:    toolKeywords,
+		Description:     scenario.Description,
+		CategoryID:      scenario.CategoryID,
+		VisibleInMenu:   !scenario.HiddenFromMenu,
+		SortOrder:       scenario.SortOrder,
+	}
+}
+
+func newStepFromRequest(req *StepRequest) *storage.FSMScenarioStep {
+	step := &storage.FSMScenarioStep{
+		StepKey:     req.StepKey,
+		Message:     req.Message,
+		IsFinal:     req.IsFinal,
+		NextStepKey: req.NextStepKey,
+		StateType:   req.StateType,
+		Effects:     req.Effects,
+	}
+	if req.Input != nil {
+		step.Input = *req.Input
+	}
+	if req.InputError != nil {
+		step.InputError = *req.InputError
+	}
+	return step
+}
+
+func newStepResponse(step *storage.FSMScenarioStep) StepResponse {
+	effects := step.Effects
+	if effects == nil {
+		effects = []string{}
+	}
+
+	return StepResponse{
+		ID:          step.ID,
+		ScenarioID:  step.ScenarioID,
+		StepKey:     step.StepKey,
+		Message:     step.Message,
+		IsFinal:     step.IsFinal,
+		NextStepKey: step.NextStepKey,
+		StateType:   step.StateType,
+		Input:       step.Input,
+		InputError:  step.InputError,
+		Effects:     effects,
+	}
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createScenario creates a scenario with root and no_power steps through the API
+func createScenario(t *testing.T, handler http.Handler) ScenarioResponse {
+	t.Helper()
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/scenarios", map[string]any{
+		"name":             "diagnose_jigsaw",
+		"display_name":     "Лобзик",
+		"trigger_keywords": []string{"пилит криво"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	scenario := decode[ScenarioResponse](t, rec)
+
+	for _, step := range []map[string]any{
+		{"step_key": "root", "message": "Что случилось?", "state_type": "start"},
+		{"step_key": "no_power", "message": "Проверьте кабель", "state_type": "intermediate"},
+	} {
+		rec = serve(t, handler, http.MethodPost, fmt.Sprintf("/api/v1/scenarios/%d/steps", scenario.ID), step)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	return scenario
+}
+
+func TestScenarioCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+
+	created := createScenario(t, handler)
+	assert.Equal(t, ScenarioResponse{
+		ID:              created.ID,
+		Name:            "diagnose_jigsaw",
+		DisplayName:     "Лобзик",
+		TriggerKeywords: []string{"пилит криво"},
+		ToolKeywords:    []string{},
+		VisibleInMenu:   true,
+	}, created)
+
+	path := fmt.Sprintf("/api/v1/scenarios/%d", created.ID)
+	rec := serve(t, handler, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, created, decode[ScenarioResponse](t, rec))
+
+	rec = serve(t, handler, http.MethodGet, "/api/v1/scenarios", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []ScenarioResponse{created}, decode[[]ScenarioResponse](t, rec))
+
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":            "diagnose_jigsaw",
+		"display_name":    "Электролобзик",
+		"visible_in_menu": false,
+		"sort_order":      3,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated := decode[ScenarioResponse](t, rec)
+	assert.Equal(t, "Электролобзик", updated.DisplayName)
+	assert.False(t, updated.VisibleInMenu)
+	assert.Equal(t, 3, updated.SortOrder)
+
+	rec = serve(t, handler, http.MethodDelete, path, nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodDelete, path, nil).Code)
+}
+
+func TestScenarioErrors(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler,
+		"/api/v1/scenarios",
+		"/api/v1/scenarios/1",
+		"/api/v1/scenarios/1/steps",
+		"/api/v1/scenarios/1/steps/root",
+	)
+
+	created := createScenario(t, handler)
+	path := fmt.Sprintf("/api/v1/scenarios/%d", created.ID)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing name", http.MethodPost, "/api/v1/scenarios", map[string]any{"display_name": "Лобзик"}, http.StatusBadRequest},
+		{"empty trigger keyword", http.MethodPost, "/api/v1/scenarios", map[string]any{"name": "drill", "trigger_keywords": []string{""}}, http.StatusBadRequest},
+		{"invalid JSON", http.MethodPost, "/api/v1/scenarios", "not an object", http.StatusBadRequest},
+		{"duplicate name", http.MethodPost, "/api/v1/scenarios", map[string]any{"name": "diagnose_jigsaw"}, http.StatusConflict},
+		{"invalid id", http.MethodGet, "/api/v1/scenarios/abc", nil, http.StatusBadRequest},
+		{"unknown scenario", http.MethodGet, "/api/v1/scenarios/999", nil, http.StatusNotFound},
+		{"update unknown scenario", http.MethodPut, "/api/v1/scenarios/999", map[string]any{"name": "drill"}, http.StatusNotFound},
+		{"update without name", http.MethodPut, path, map[string]any{"display_name": "Лобзик"}, http.StatusBadRequest},
+		{"method not allowed", http.MethodPatch, path, nil, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+func TestStepCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	scenario := createScenario(t, handler)
+	steps := fmt.Sprintf("/api/v1/scenarios/%d/steps", scenario.ID)
+
+	rec := serve(t, handler, http.MethodGet, steps, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var keys []string
+	for _, step := range decode[[]StepResponse](t, rec) {
+		keys = append(keys, step.StepKey)
+	}
+	assert.ElementsMatch(t, []string{"root", "no_power"}, keys)
+
+	rec = serve(t, handler, http.MethodPut, steps+"/no_power", map[string]any{
+		"step_key":   "no_power",
+		"message":    "Кабель цел?",
+		"state_type": "final",
+		"is_final":   true,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "Кабель цел?", decode[StepResponse](t, rec).Message)
+
+	rec = serve(t, handler, http.MethodGet, steps+"/no_power", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	step := decode[StepResponse](t, rec)
+	assert.Equal(t, scenario.ID, step.ScenarioID)
+	assert.True(t, step.IsFinal)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing message", http.MethodPost, steps, map[string]any{"step_key": "sparks", "state_type": "intermediate"}, http.StatusBadRequest},
+		{"unknown state type", http.MethodPost, steps, map[string]any{"step_key": "sparks", "message": "Искрит", "state_type": "middle"}, http.StatusBadRequest},
+		{"key with a slash", http.MethodPost, steps, map[string]any{"step_key": "a/b", "message": "Искрит", "state_type": "intermediate"}, http.StatusBadRequest},
+		{"input error without input", http.MethodPost, steps, map[string]any{"step_key": "sparks", "message": "Искрит", "state_type": "intermediate", "input_error": "?"}, http.StatusBadRequest},
+		{"duplicate key", http.MethodPost, steps, map[string]any{"step_key": "root", "message": "Ещё раз", "state_type": "start"}, http.StatusConflict},
+		{"unknown scenario", http.MethodGet, "/api/v1/scenarios/999/steps", nil, http.StatusNotFound},
+		{"unknown step", http.MethodGet, steps + "/missing", nil, http.StatusNotFound},
+		{"invalid scenario id", http.MethodGet, "/api/v1/scenarios/abc/steps", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, steps+"/no_power", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, steps+"/no_power", nil).Code)
+}
+
+func TestUpdateScenarioKeepsOmittedMenuFields(t *testing.T) {
+	handler, s := newTestServer(t)
+	scenario := createScenario(t, handler)
+	path := fmt.Sprintf("/api/v1/scenarios/%d", scenario.ID)
+
+	rec := serve(t, handler, http.MethodPost, "/api/v1/categories", map[string]any{"name": "saws"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	category := decode[CategoryResponse](t, rec)
+
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":            "diagnose_jigsaw",
+		"category_id":     category.ID,
+		"visible_in_menu": false,
+		"sort_order":      4,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// Fixing a typo leaves the scenario hidden, in its category and in place
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":         "diagnose_jigsaw",
+		"display_name": "Электролобзик",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated := decode[ScenarioResponse](t, rec)
+	assert.Equal(t, "Электролобзик", updated.DisplayName)
+	assert.Equal(t, &category.ID, updated.CategoryID)
+	assert.False(t, updated.VisibleInMenu)
+	assert.Equal(t, 4, updated.SortOrder)
+
+	stored, err := s.GetFSMScenario(scenario.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.HiddenFromMenu)
+	assert.Equal(t, &category.ID, stored.CategoryID)
+	assert.Equal(t, 4, stored.SortOrder)
+
+	// Sent values are written, null moves the scenario to the top level
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"name":            "diagnose_jigsaw",
+		"category_id":     nil,
+		"visible_in_menu": true,
+		"sort_order":      0,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated = decode[ScenarioResponse](t, rec)
+	assert.Nil(t, updated.CategoryID)
+	assert.True(t, updated.VisibleInMenu)
+	assert.Zero(t, updated.SortOrder)
+}
+
+func TestUpdateStepKeepsOmittedFields(t *testing.T) {
+	handler, _ := newTestServer(t)
+	scenario := createScenario(t, handler)
+	steps := fmt.Sprintf("/api/v1/scenarios/%d/steps", scenario.ID)
+
+	rec := serve(t, handler, http.MethodPost, steps, map[string]any{
+		"step_key":    "ask_email",
+		"message":     "Введите email",
+		"state_type":  "intermediate",
+		"input":       "email",
+		"input_error": "Это не email",
+		"effects":     []string{"save_email"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	// Editing the text keeps the validator and the effects
+	rec = serve(t, handler, http.MethodPut, steps+"/ask_email", map[string]any{
+		"step_key":   "ask_email",
+		"message":    "Введите ваш email",
+		"state_type": "intermediate",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	step := decode[StepResponse](t, rec)
+	assert.Equal(t, "Введите ваш email", step.Message)
+	assert.Equal(t, "email", step.Input)
+	assert.Equal(t, "Это не email", step.InputError)
+	assert.Equal(t, []string{"save_email"}, step.Effects)
+
+	rec = serve(t, handler, http.MethodGet, steps+"/ask_email", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, step, decode[StepResponse](t, rec))
+
+	// Clearing the validator leaves its error message without an input
+	rec = serve(t, handler, http.MethodPut, steps+"/ask_email", map[string]any{
+		"step_key":   "ask_email",
+		"message":    "Введите ваш email",
+		"state_type": "intermediate",
+		"input":      "",
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Sent empty values are written
+	rec = serve(t, handler, http.MethodPut, steps+"/ask_email", map[string]any{
+		"step_key":    "ask_email",
+		"message":     "Введите ваш email",
+		"state_type":  "intermediate",
+		"input":       "",
+		"input_error": "",
+		"effects":     []string{},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	step = decode[StepResponse](t, rec)
+	assert.Empty(t, step.Input)
+	assert.Empty(t, step.InputError)
+	assert.Empty(t, step.Effects)
+
+	rec = serve(t, handler, http.MethodPut, steps+"/missing", map[string]any{
+		"step_key":   "missing",
+		"message":    "?",
+		"state_type": "intermediate",
+	})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SessionStepResponse represents a visited step in a session history
+type SessionStepResponse struct {
+	ScenarioID int    `json:"scenario_id"`
+	StepKey    string `json:"step_key"`
+}
+
+// SessionResponse represents a user's conversation state with the path that led to the current step
+type SessionResponse struct {
+	TelegramID     int64                 `json:"telegram_id"`
+	State          string                `json:"state"`
+	ScenarioID     *int                  `json:"scenario_id"`
+	CurrentStepKey *string               `json:"current_step_key"`
+	History        []SessionStepResponse `json:"history"`
+	UpdatedAt      time.Time             `json:"updated_at"`
+}
+
+// handleUserSession returns a user's current conversation state
+// @Summary Get user session
+// @Description Get the conversation state and the current FSM step of a user and the steps visited before it, oldest first
+// @Tags sessions
+// @Produce json
+// @Param telegram_id path int true "Telegram user ID"
+// @Security BearerAuth
+// @Success 200 {object} SessionResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/users/{telegram_id}/session [get]
+func (s *Server) handleUserSession(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	telegramID, err := strconv.ParseInt(r.PathValue("telegram_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid telegram ID", http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.storage.GetUserSession(telegramID)
+	if err != nil {
+		log.Printf("Error getting session for user %d: %v", telegramID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	response := SessionResponse{
+		TelegramID:     session.UserID,
+		State:          session.State,
+		ScenarioID:     session.ScenarioID,
+		CurrentStepKey: session.CurrentStepKey,
+		History:        make([]SessionStepResponse, 0, len(session.History)),
+		UpdatedAt:      session.UpdatedAt,
+	}
+	for _, step := range session.History {
+		response.History = append(response.History, SessionStepResponse{ScenarioID: step.ScenarioID, StepKey: step.StepKey})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSession(t *testing.T) {
+	handler, s := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/users/1/session")
+	scenario := createScenario(t, handler)
+
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, "/api/v1/users/42/session", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodGet, "/api/v1/users/abc/session", nil).Code)
+
+	_, err := s.GetOrCreateUser(42)
+	require.NoError(t, err)
+	storagetest.EnterStep(t, s, 42, scenario.ID, "root")
+	storagetest.EnterStep(t, s, 42, scenario.ID, "no_power")
+	noPower := "no_power"
+
+	rec := serve(t, handler, http.MethodGet, "/api/v1/users/42/session", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	session := decode[SessionResponse](t, rec)
+	assert.Equal(t, int64(42), session.TelegramID)
+	assert.Equal(t, &scenario.ID, session.ScenarioID)
+	assert.Equal(t, &noPower, session.CurrentStepKey)
+	assert.Equal(t, []SessionStepResponse{{ScenarioID: scenario.ID, StepKey: "root"}}, session.History)
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// TransitionRequest represents transition create/update request
+type TransitionRequest struct {
+	FromStepKey string  `json:"from_step_key"`
+	ToStepKey   string  `json:"to_step_key"`
+	ButtonLabel string  `json:"button_label"`
+	SortOrder   int     `json:"sort_order"`
+	Condition   *string `json:"condition"`
+}
+
+// TransitionResponse represents a transition in API responses
+type TransitionResponse struct {
+	ID          int     `json:"id"`
+	ScenarioID  int     `json:"scenario_id"`
+	FromStepKey string  `json:"from_step_key"`
+	ToStepKey   string  `json:"to_step_key"`
+	ButtonLabel string  `json:"button_label"`
+	SortOrder   int     `json:"sort_order"`
+	Condition   *string `json:"condition"`
+}
+
+// ValidateTransitionRequest validates transition create/update request
+func ValidateTransitionRequest(req *TransitionRequest) error {
+	if strings.TrimSpace(req.FromStepKey) == "" {
+		return fmt.Errorf("from_step_key is required")
+	}
+	if strings.TrimSpace(req.ToStepKey) == "" {
+		return fmt.Errorf("to_step_key is required")
+	}
+	if strings.TrimSpace(req.ButtonLabel) == "" {
+		return fmt.Errorf("button_label is required")
+	}
+	if req.Condition != nil && strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(*req.Condition), "!")) == "" {
+		return fmt.Errorf("condition must be null or a condition name")
+	}
+	return nil
+}
+
+// handleScenarioTransitions handles listing and creating transitions of a scenario
+func (s *Server) handleScenarioTransitions(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListTransitions(w, scenarioID)
+	case http.MethodPost:
+		s.handleCreateTransition(w, r, scenarioID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleScenarioTransition handles reading, updating and deleting a single transition
+func (s *Server) handleScenarioTransition(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scenarioID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid scenario id", http.StatusBadRequest)
+		return
+	}
+	transitionID, err := strconv.Atoi(r.PathValue("transition_id"))
+	if err != nil {
+		http.Error(w, "Bad request: invalid transition id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetTransition(w, scenarioID, transitionID)
+	case http.MethodPut:
+		s.handleUpdateTransition(w, r, scenarioID, transitionID)
+	case http.MethodDelete:
+		s.handleDeleteTransition(w, scenarioID, transitionID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListTransitions returns all transitions of a scenario
+// @Summary List scenario transitions
+// @Description List all transitions (buttons between steps) of an FSM scenario
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Security BearerAuth
+// @Success 200 {array} TransitionResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/transitions [get]
+func (s *Server) handleListTransitions(w http.ResponseWriter, scenarioID int) {
+	if !s.scenarioExists(w, scenarioID) {
+		return
+	}
+
+	transitions, err := s.storage.GetFSMScenarioTransitions(scenarioID)
+	if err != nil {
+		log.Printf("Error getting transitions for scenario %d: %v", scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]TransitionResponse, 0, len(transitions))
+	for _, transition := range transitions {
+		response = append(response, newTransitionResponse(transition))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleCreateTransition adds a transition to a scenario
+// @Summary Create scenario transition
+// @Description Add a button leading from one step to another
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param transition body TransitionRequest true "Transition to create"
+// @Security BearerAuth
+// @Success 201 {object} TransitionResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Step not found"
+// @Failure 409 {string} string "Transition already exists"
+// @Router /api/v1/scenarios/{id}/transitions [post]
+func (s *Server) handleCreateTransition(w http.ResponseWriter, r *http.Request, scenarioID int) {
+	var request TransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateTransitionRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transition := newTransitionFromRequest(&request)
+	transition.ScenarioID = scenarioID
+	if err := s.storage.CreateFSMTransition(transition); err != nil {
+		writeStorageError(w, "creating transition", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newTransitionResponse(transition))
+}
+
+// handleGetTransition returns a single transition
+// @Summary Get scenario transition
+// @Description Get a transition of an FSM scenario by ID
+// @Tags scenarios
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param transition_id path int true "Transition ID"
+// @Security BearerAuth
+// @Success 200 {object} TransitionResponse
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/transitions/{transition_id} [get]
+func (s *Server) handleGetTransition(w http.ResponseWriter, scenarioID, transitionID int) {
+	transition, err := s.storage.GetFSMTransition(scenarioID, transitionID)
+	if err != nil {
+		log.Printf("Error getting transition %d for scenario %d: %v", transitionID, scenarioID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if transition == nil {
+		http.Error(w, "Transition not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTransitionResponse(transition))
+}
+
+// handleUpdateTransition updates a transition
+// @Summary Update scenario transition
+// @Description Update label, target, order or condition of a transition
+// @Tags scenarios
+// @Accept json
+// @Produce json
+// @Param id path int true "Scenario ID"
+// @Param transition_id path int true "Transition ID"
+// @Param transition body TransitionRequest true "Transition fields"
+// @Security BearerAuth
+// @Success 200 {object} TransitionResponse
+// @Failure 400 {string} string "Bad request"
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/transitions/{transition_id} [put]
+func (s *Server) handleUpdateTransition(w http.ResponseWriter, r *http.Request, scenarioID, transitionID int) {
+	var request TransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateTransitionRequest(&request); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transition := newTransitionFromRequest(&request)
+	transition.ID = transitionID
+	transition.ScenarioID = scenarioID
+	if err := s.storage.UpdateFSMTransition(transition); err != nil {
+		writeStorageError(w, "updating transition", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTransitionResponse(transition))
+}
+
+// handleDeleteTransition deletes a transition
+// @Summary Delete scenario transition
+// @Description Delete a transition
+// @Tags scenarios
+// @Param id path int true "Scenario ID"
+// @Param transition_id path int true "Transition ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 404 {string} string "Not found"
+// @Router /api/v1/scenarios/{id}/transitions/{transition_id} [delete]
+func (s *Server) handleDeleteTransition(w http.ResponseWriter, scenarioID, transitionID int) {
+	if err := s.storage.DeleteFSMTransition(scenarioID, transitionID); err != nil {
+		writeStorageError(w, "deleting transition", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newTransitionFromRequest(req *TransitionRequest) *storage.FSMTransition {
+	var condition *string
+	if req.Condition != nil {
+		trimmed := strings.TrimSpace(*req.Condition)
+		condition = &trimmed
+	}
+
+	return &storage.FSMTransition{
+		FromStepKey: strings.TrimSpace(req.FromStepKey),
+		ToStepKey:   strings.TrimSpace(req.ToStepKey),
+		ButtonLabel: strings.TrimSpace(req.ButtonLabel),
+		SortOrder:   req.SortOrder,
+		Condition:   condition,
+	}
+}
+
+func newTransitionResponse(transition *storage.FSMTransition) TransitionResponse {
+	return TransitionResponse{
+		ID:          transition.ID,
+		ScenarioID:  transition.ScenarioID,
+		FromStepKey: transition.FromStepKey,
+		ToStepKey:   transition.ToStepKey,
+		ButtonLabel: transition.ButtonLabel,
+		SortOrder:   transition.SortOrder,
+		Condition:   transition.Condition,
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransitionCRUD(t *testing.T) {
+	handler, _ := newTestServer(t)
+	assertRequireToken(t, handler, "/api/v1/scenarios/1/transitions", "/api/v1/scenarios/1/transitions/1")
+	scenario := createScenario(t, handler)
+	transitions := fmt.Sprintf("/api/v1/scenarios/%d/transitions", scenario.ID)
+
+	rec := serve(t, handler, http.MethodPost, transitions, map[string]any{
+		"from_step_key": "root",
+		"to_step_key":   "no_power",
+		"button_label":  "Не включается",
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	created := decode[TransitionResponse](t, rec)
+	assert.Equal(t, TransitionResponse{
+		ID:          created.ID,
+		ScenarioID:  scenario.ID,
+		FromStepKey: "root",
+		ToStepKey:   "no_power",
+		ButtonLabel: "Не включается",
+	}, created)
+
+	rec = serve(t, handler, http.MethodGet, transitions, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []TransitionResponse{created}, decode[[]TransitionResponse](t, rec))
+
+	path := fmt.Sprintf("%s/%d", transitions, created.ID)
+	rec = serve(t, handler, http.MethodPut, path, map[string]any{
+		"from_step_key": "root",
+		"to_step_key":   "no_power",
+		"button_label":  "Нет питания",
+		"condition":     "!has_email",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated := decode[TransitionResponse](t, rec)
+	assert.Equal(t, "Нет питания", updated.ButtonLabel)
+	require.NotNil(t, updated.Condition)
+	assert.Equal(t, "!has_email", *updated.Condition)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"missing label", http.MethodPost, transitions, map[string]any{"from_step_key": "root", "to_step_key": "no_power"}, http.StatusBadRequest},
+		{"empty condition", http.MethodPost, transitions, map[string]any{"from_step_key": "root", "to_step_key": "no_power", "button_label": "?", "condition": "!"}, http.StatusBadRequest},
+		{"unknown scenario", http.MethodGet, "/api/v1/scenarios/999/transitions", nil, http.StatusNotFound},
+		{"unknown transition", http.MethodGet, transitions + "/999", nil, http.StatusNotFound},
+		{"invalid transition id", http.MethodGet, transitions + "/abc", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(t, handler, http.MethodDelete, path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, path, nil).Code)
+}
@@ -1,12 +1,15 @@
 package bot
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/metrics"
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -16,10 +19,20 @@ type Bot struct {
 	storage         storage.Storage
 	fsm             *fsm.FSM
 	rateLimitPerMin int
+	dispatcher      *Dispatcher
+	polling         sync.WaitGroup
+	editInPlace     bool
 }
 
-func NewBot(token string, storage storage.Storage, rateLimitPerMin int, openAIEnabled bool, openAIURL, openAIKey, openAIModel string) (*Bot, error) {
-	api, err := tgbotapi.NewBotAPI(token)
+// NewBot creates a bot handling updates on workers goroutines, each queueing up to queueSize updates.
+// apiURL is the base URL of the Bot API server; empty means https://api.telegram.org.
+func NewBot(token, apiURL string, storage storage.Storage, rateLimitPerMin int, openAIEnabled bool, openAIURL, openAIKey, openAIModel string, workers, queueSize int) (*Bot, error) {
+	apiEndpoint := tgbotapi.APIEndpoint
+	if apiURL != "" {
+		apiEndpoint = strings.TrimSuffix(apiURL, "/") + "/bot%s/%s"
+	}
+
+	api, err := tgbotapi.NewBotAPIWithAPIEndpoint(token, apiEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create bot API: %w", err)
 	}
@@ -33,24 +46,101 @@ func NewBot(token string, storage storage.Storage, rateLimitPerMin int, openAIEn
 		storage:         storage,
 		fsm:             fsmInstance,
 		rateLimitPerMin: rateLimitPerMin,
+		dispatcher:      NewDispatcher(workers, queueSize),
+		editInPlace:     true,
 	}, nil
 }
 
-func (b *Bot) Start() error {
+// Start begins receiving updates by long polling in the background until ctx
+// is done. Updates already fetched by then are still queued for handling.
+// Polling is registered before Start returns, so a Shutdown that follows it
+// always waits for the poller.
+func (b *Bot) Start(ctx context.Context) error {
+	// getUpdates is refused while a webhook is set, e.g. after switching back from webhook mode
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
 	updates := b.api.GetUpdatesChan(u)
 
-	for update := range updates {
-		if update.Message != nil {
-			go b.handleMessage(update.Message)
-		} else if update.CallbackQuery != nil {
-			go b.handleCallbackQuery(update.CallbackQuery)
+	b.polling.Add(1)
+	go func() {
+		defer b.polling.Done()
+		b.poll(ctx, updates)
+	}()
+	return nil
+}
+
+// poll queues updates until ctx is done, then drains what was already fetched
+func (b *Bot) poll(ctx context.Context, updates tgbotapi.UpdatesChannel) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			b.handleUpdate(update)
+		case <-ctx.Done():
+			b.api.StopReceivingUpdates()
+			for {
+				select {
+				case update, ok := <-updates:
+					if !ok {
+						return
+					}
+					b.handleUpdate(update)
+				default:
+					return
+				}
+			}
 		}
 	}
+}
 
-	return nil
+// Shutdown stops taking new updates and waits until handlers of queued updates
+// finish, or until ctx is done. Polling stops when the context given to Start
+// is done; webhook requests arriving after Shutdown are refused.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	polled := make(chan struct{})
+	go func() {
+		b.polling.Wait()
+		close(polled)
+	}()
+
+	select {
+	case <-polled:
+	case <-ctx.Done():
+		// The poller may be waiting for room in a queue behind a stuck handler
+		b.dispatcher.stop()
+	}
+	return b.dispatcher.Close(ctx)
+}
+
+// handleUpdate queues an update received by polling or webhook on the worker of its user
+// and reports false if the bot is shutting down and the update was dropped
+func (b *Bot) handleUpdate(update tgbotapi.Update) bool {
+	// Handlers work with the sender's user record; channel posts have no sender
+	from := update.SentFrom()
+	if from == nil {
+		return true
+	}
+
+	if update.Message != nil {
+		message := update.Message
+		return b.dispatcher.Dispatch(from.ID, func() { b.handleMessage(message) })
+	} else if update.CallbackQuery != nil {
+		query := update.CallbackQuery
+		return b.dispatcher.Dispatch(from.ID, func() { b.handleCallbackQuery(query) })
+	}
+	return true
+}
+
+// QueueStats returns the state of the update queue
+func (b *Bot) QueueStats() metrics.QueueStats {
+	return b.dispatcher.Stats()
 }
 
 func (b *Bot) handleMessage(message *tgbotapi.Message) {
@@ -74,29 +164,31 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 	}
 
 	if message.IsCommand() && message.Command() == "start" {
-		b.handleStartCommand(message.Chat.ID, user)
+		b.handleStartCommand(message.Chat.ID, user, message.CommandArguments())
 		return
 	}
 
 	b.processMessage(message, user)
 }
 
-func (b *Bot) handleStartCommand(chatID int64, user *storage.User) {
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error resetting FSM state for user %d: %v", user.TelegramID, err)
-	}
-
-	if err := b.storage.DeleteUserSession(user.TelegramID); err != nil {
-		log.Printf("Error clearing user session for user %d: %v", user.TelegramID, err)
+// handleStartCommand starts the conversation over. A deep link payload opens
+// the scenario it points to; without one the scenario list is shown.
+func (b *Bot) handleStartCommand(chatID int64, user *storage.User, payload string) {
+	if err := b.fsm.Reset(user.TelegramID); err != nil {
+		log.Printf("Error resetting conversation for user %d: %v", user.TelegramID, err)
 	}
 
 	if err := b.storage.ResetUserMessageCount(user.TelegramID); err != nil {
 		log.Printf("Error resetting message count for user %d: %v", user.TelegramID, err)
 	}
 
+	if payload != "" && b.startFromPayload(chatID, user, payload) {
+		return
+	}
+
 	msg := tgbotapi.NewMessage(chatID, fsm.GetStartMessage())
 
-	scenariosButtons, err := b.fsm.GetScenariosButtons()
+	scenariosButtons, err := b.fsm.GetScenariosButtons(user.TelegramID)
 	if err != nil {
 		log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
 	} else if len(scenariosButtons) > 0 {
@@ -115,342 +207,114 @@ func (b *Bot) handleStartCommand(chatID int64, user *storage.User) {
 	}
 }
 
-func (b *Bot) offerSiteLink(chatID int64, user *storage.User) {
-	log.Printf("offerSiteLink called for user %d", user.TelegramID)
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateOfferingSiteLink)); err != nil {
-		log.Printf("Error updating FSM state to OfferingSiteLink for user %d: %v", user.TelegramID, err)
-	}
-
-	msg := tgbotapi.NewMessage(chatID, fsm.GetSiteLinkOfferMessage())
-
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Да", "site_link_yes"),
-			tgbotapi.NewInlineKeyboardButtonData("Нет", "site_link_no"),
-		),
-	)
-	msg.ReplyMarkup = keyboard
-
-	sentMsg, err := b.api.Send(msg)
-	if err != nil {
-		log.Printf("Error sending site link offer for user %d: %v", user.TelegramID, err)
-		return
-	}
-
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("offerSiteLink finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
-	allowed, err := b.storage.CheckRateLimit(query.From.ID, b.rateLimitPerMin)
-	if err != nil {
-		log.Printf("Error checking rate limit for user %d: %v", query.From.ID, err)
-		return
-	}
+// startFromPayload opens the scenario step a /start payload points to and
+// reports whether it did
+func (b *Bot) startFromPayload(chatID int64, user *storage.User, payload string) bool {
+	log.Printf("User %d started the bot with payload %q", user.TelegramID, payload)
 
-	if !allowed {
-		log.Printf("Rate limit exceeded for user %d", query.From.ID)
-		return
-	}
-
-	user, err := b.storage.GetUser(query.From.ID)
+	response, buttons, started, err := b.fsm.StartFromPayload(user.TelegramID, payload)
 	if err != nil {
-		log.Printf("Error getting user %d for callback query: %v", query.From.ID, err)
-		return
+		log.Printf("Error starting from payload %q for user %d: %v", payload, user.TelegramID, err)
+		return false
 	}
-
-	if user == nil {
-		log.Printf("User %d not found for callback query", query.From.ID)
-		return
+	if !started {
+		return false
 	}
 
-	b.processCallbackQuery(query, user)
-}
-
-func (b *Bot) handleSiteLinkYes(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleSiteLinkYes called for user %d", user.TelegramID)
-
-	settings, err := b.storage.GetSettings()
-	if err != nil {
-		log.Printf("Error getting settings for user %d: %v", user.TelegramID, err)
-		return
+	msg := tgbotapi.NewMessage(chatID, response)
+	if len(buttons) > 0 {
+		msg.ReplyMarkup = b.createInlineKeyboard(buttons)
 	}
 
-	// Store the current state before redirecting
-	// But we actually don't want to change to AwaitingEmail state here,
-	// we want to show the site and set the site state directly
-
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateOfferingSitePost)); err != nil {
-		log.Printf("Error updating FSM state to OfferingSitePost for user %d: %v", user.TelegramID, err)
-	}
-
-	// Instead of going to email, go directly to show the site URL
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetSiteLinkOfferPost(settings.SiteURL))
-
-	// Add "В начало" button to return to scenario selection
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("В начало", "site_link_back_to_start"),
-		),
-	)
-	msg.ReplyMarkup = keyboard
-
 	sentMsg, err := b.api.Send(msg)
 	if err != nil {
-		log.Printf("Error sending site link for user %d: %v", user.TelegramID, err)
-		return
+		log.Printf("Error sending deep link step for user %d: %v", user.TelegramID, err)
+		return true
 	}
 
 	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
 		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
 	}
-	log.Printf("handleSiteLinkYes finished for user %d", user.TelegramID)
+	return true
 }
 
-func (b *Bot) handleSiteLinkNo(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleSiteLinkNo called for user %d. Current MessageCount: %d", user.TelegramID, user.MessageCount)
-	if err := b.storage.ResetUserMessageCount(user.TelegramID); err != nil {
-		log.Printf("Error resetting user message count for user %d: %v", user.TelegramID, err)
-	} else {
-		log.Printf("Called ResetUserMessageCount for user %d", user.TelegramID)
-	}
-
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-	}
-
-	// Check if user had an active session before the site offer (to include "В начало" button)
-	session, err := b.storage.GetUserSession(user.TelegramID)
-	if err != nil {
-		log.Printf("Error getting user session for user %d: %v", user.TelegramID, err)
-	} else if session != nil && session.ScenarioID != nil && session.CurrentStepKey != nil {
-		// User had a session, so they should be able to return to the beginning
-		// Restore the user's session to continue the scenario they were in
-		// Set the FSM state back to the idle state (which would trigger the normal behavior)
-		if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-			log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-		}
-	}
-
-	// Always show the decline message with "В начало" button
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetSiteLinkDeclinedMessage())
+// SetMenuPageSize sets how many entries a page of the scenario menu lists. Call it before Start.
+func (b *Bot) SetMenuPageSize(size int) {
+	b.fsm.SetMenuPageSize(size)
+}
 
-	// Add "В начало" button to return to scenario selection
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("В начало", "site_link_back_to_start"),
-		),
-	)
-	msg.ReplyMarkup = keyboard
+// SetSiteOfferScenario sets the scenario started to offer the site link. Call it before Start.
+func (b *Bot) SetSiteOfferScenario(name string) {
+	b.fsm.SetSiteOfferScenario(name)
+}
 
-	sentMsg, err := b.api.Send(msg)
+// offerSiteLink sends the site offer after a reply if the offer policy allows it now
+func (b *Bot) offerSiteLink(chatID int64, userID int64) {
+	response, buttons, offered, err := b.fsm.OfferSiteLink(userID)
 	if err != nil {
-		log.Printf("Error sending decline message for user %d: %v", user.TelegramID, err)
+		log.Printf("Error offering site link to user %d: %v", userID, err)
 		return
 	}
-
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("handleSiteLinkNo finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleSiteLinkBackToStart(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleSiteLinkBackToStart called for user %d", user.TelegramID)
-
-	// Reset user's message count
-	if err := b.storage.ResetUserMessageCount(user.TelegramID); err != nil {
-		log.Printf("Error resetting user message count for user %d: %v", user.TelegramID, err)
-	} else {
-		log.Printf("Called ResetUserMessageCount for user %d", user.TelegramID)
-	}
-
-	// Reset user's session to start from the beginning
-	if err := b.storage.DeleteUserSession(user.TelegramID); err != nil {
-		log.Printf("Error clearing session for user %d: %v", user.TelegramID, err)
+	if !offered {
+		return
 	}
 
-	// Reset state to Idle
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-	}
-
-	// Send the initial welcome message with scenario selection buttons
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetStartMessage())
-	scenariosButtons, err := b.fsm.GetScenariosButtons()
-	if err != nil {
-		log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
-	} else if len(scenariosButtons) > 0 {
-		keyboard := b.createInlineKeyboard(scenariosButtons)
-		msg.ReplyMarkup = keyboard
+	msg := tgbotapi.NewMessage(chatID, response)
+	if len(buttons) > 0 {
+		msg.ReplyMarkup = b.createInlineKeyboard(buttons)
 	}
 
 	sentMsg, err := b.api.Send(msg)
 	if err != nil {
-		log.Printf("Error sending start message for user %d: %v", user.TelegramID, err)
+		log.Printf("Error sending site link offer for user %d: %v", userID, err)
 		return
 	}
 
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
+	if err := b.storage.LogMessage(userID, sentMsg.Text, "outgoing"); err != nil {
+		log.Printf("Error logging outgoing message for user %d: %v", userID, err)
 	}
-
-	log.Printf("handleSiteLinkBackToStart finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleSiteLinkYesPost(query *tgbotapi.CallbackQuery, user *storage.User, settings *storage.Settings) {
-	log.Printf("handleSiteLinkYesPost called for user %d. Current MessageCount: %d", user.TelegramID, user.MessageCount)
-	// This function is no longer needed after changes
-	// We're now redirecting directly to the site URL display from handleSiteLinkYes
-	// Keeping it for potential backward compatibility, but it won't be used
-	log.Printf("handleSiteLinkYesPost finished for user %d (no longer used)", user.TelegramID)
 }
 
-func (b *Bot) handleSiteLinkNoPost(query *tgbotapi.CallbackQuery, user *storage.User, settings *storage.Settings) {
-	log.Printf("handleSiteLinkNoPost called for user %d. Current MessageCount: %d", user.TelegramID, user.MessageCount)
-	if err := b.storage.ResetUserMessageCount(user.TelegramID); err != nil {
-		log.Printf("Error resetting user message count for user %d: %v", user.TelegramID, err)
-	} else {
-		log.Printf("Called ResetUserMessageCount for user %d", user.TelegramID)
-	}
-
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-	}
-
-	// Check if user had an active session before the site offer (to include "В начало" button)
-	session, err := b.storage.GetUserSession(user.TelegramID)
-	if err != nil {
-		log.Printf("Error getting user session for user %d: %v", user.TelegramID, err)
-	} else if session != nil && session.ScenarioID != nil && session.CurrentStepKey != nil {
-		// User had a session, so they should be able to return to the beginning
-		msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetSiteLinkDeclinedMessage())
-
-		// Add "В начало" button to return to scenario selection
-		keyboard := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("В начало", "site_link_back_to_start"),
-			),
-		)
-		msg.ReplyMarkup = keyboard
-
-		sentMsg, err := b.api.Send(msg)
-		if err != nil {
-			log.Printf("Error sending site link decline with button for user %d: %v", user.TelegramID, err)
-			return
-		}
+// handleCallbackQuery handles a button press and always answers it, with a toast if there is something to tell
+func (b *Bot) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
+	var toast string
+	defer func() { b.answerCallback(query, toast) }()
 
-		if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-			log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-		}
-		log.Printf("handleSiteLinkNoPost finished for user %d", user.TelegramID)
+	// Buttons of inline-mode messages and of messages too old for Telegram to
+	// attach come without a message, so there is no chat to reply in
+	if query.Message == nil {
+		log.Printf("Callback query from user %d has no message, ignoring", query.From.ID)
 		return
 	}
 
-	// Fallback to standard message without button
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, "Можете продолжать консультацию. Если возникнут другие вопросы по электроинструменту, напишите мне.")
-	sentMsg, err := b.api.Send(msg)
+	allowed, err := b.storage.CheckRateLimit(query.From.ID, b.rateLimitPerMin)
 	if err != nil {
-		log.Printf("Error sending message after site link post decline for user %d: %v", user.TelegramID, err)
+		log.Printf("Error checking rate limit for user %d: %v", query.From.ID, err)
 		return
 	}
 
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("handleSiteLinkNoPost finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleEmailConsentYes(query *tgbotapi.CallbackQuery, user *storage.User, settings *storage.Settings) {
-	log.Printf("handleEmailConsentYes called for user %d", user.TelegramID)
-	if user.Email != "" {
-		if err := b.storage.UpdateUserEmail(user.TelegramID, user.Email, true); err != nil {
-			log.Printf("Error updating user email consent for user %d: %v", user.TelegramID, err)
-		}
-	}
-
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-	}
-
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetEmailSavedMessage(settings.SiteURL))
-	sentMsg, err := b.api.Send(msg)
-	if err != nil {
-		log.Printf("Error sending confirmation for user %d: %v", user.TelegramID, err)
+	if !allowed {
+		log.Printf("Rate limit exceeded for user %d", query.From.ID)
+		toast = fsm.GetRateLimitMessage()
 		return
 	}
 
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("handleEmailConsentYes finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleEmailConsentNo(query *tgbotapi.CallbackQuery, user *storage.User, settings *storage.Settings) {
-	log.Printf("handleEmailConsentNo called for user %d", user.TelegramID)
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateIdle)); err != nil {
-		log.Printf("Error updating FSM state to Idle for user %d: %v", user.TelegramID, err)
-	}
-
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetEmailDeclinedMessage(settings.SiteURL))
-	sentMsg, err := b.api.Send(msg)
+	user, err := b.storage.GetUser(query.From.ID)
 	if err != nil {
-		log.Printf("Error sending decline message for user %d: %v", user.TelegramID, err)
+		log.Printf("Error getting user %d for callback query: %v", query.From.ID, err)
 		return
 	}
 
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("handleEmailConsentNo finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleEmailConfirm(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleEmailConfirm called for user %d with data: %s", query.From.ID, query.Data)
-	email := strings.TrimPrefix(query.Data, "email_confirm_")
-	log.Printf("Parsed email for user %d: %s", user.TelegramID, email)
-
-	if err := b.storage.UpdateUserEmail(user.TelegramID, email, false); err != nil {
-		log.Printf("Error saving email for user %d: %v", user.TelegramID, err)
-	}
-
-	if err := b.storage.UpdateUserFSMState(user.TelegramID, string(fsm.StateAwaitingEmailConsent)); err != nil {
-		log.Printf("Error updating FSM state to AwaitingEmailConsent for user %d: %v", user.TelegramID, err)
-	}
-
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetEmailConsentMessage())
-
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Разрешаю", "email_consent_yes"),
-			tgbotapi.NewInlineKeyboardButtonData("Нет, спасибо", "email_consent_no"),
-		),
-	)
-	msg.ReplyMarkup = keyboard
-
-	sentMsg, err := b.api.Send(msg)
-	if err != nil {
-		log.Printf("Error sending consent request for user %d: %v", user.TelegramID, err)
+	if user == nil {
+		log.Printf("User %d not found for callback query", query.From.ID)
 		return
 	}
 
-	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-	}
-	log.Printf("handleEmailConfirm finished for user %d", user.TelegramID)
+	toast = b.processCallbackQuery(query, user)
 }
 
-func (b *Bot) handleStartScenario(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleStartScenario called for user %d with data: %s", query.From.ID, query.Data)
-	scenarioIDStr := strings.TrimPrefix(query.Data, "start_scenario_")
-	scenarioID, err := strconv.Atoi(scenarioIDStr)
-	if err != nil {
-		log.Printf("Error parsing scenario ID for user %d: %v", query.From.ID, err)
-		return
-	}
-	log.Printf("Parsed scenarioID for user %d: %d", user.TelegramID, scenarioID)
+func (b *Bot) handleStartScenario(query *tgbotapi.CallbackQuery, user *storage.User, scenarioID int) {
+	log.Printf("handleStartScenario called for user %d with scenarioID %d", query.From.ID, scenarioID)
 
 	scenario, err := b.storage.GetFSMScenario(scenarioID)
 	if err != nil {
@@ -469,14 +333,13 @@ func (b *Bot) handleStartScenario(query *tgbotapi.CallbackQuery, user *storage.U
 	}
 	if step != nil {
 		log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, step.StepKey)
-		err = b.storage.UpdateUserSession(user.TelegramID, &scenarioID, &step.StepKey)
+		text, buttons, err := b.fsm.EnterStep(user.TelegramID, step, "")
 		if err != nil {
-			log.Printf("Error updating session for user %d: %v", user.TelegramID, err)
+			log.Printf("Error entering step for user %d: %v", user.TelegramID, err)
 			return
 		}
 
-		buttons := b.fsm.GenerateButtonsForStep(step, scenarioID)
-		msg := tgbotapi.NewMessage(query.Message.Chat.ID, step.Message)
+		msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
 		if len(buttons) > 0 {
 			keyboard := b.createInlineKeyboard(buttons)
 			msg.ReplyMarkup = keyboard
@@ -495,257 +358,121 @@ func (b *Bot) handleStartScenario(query *tgbotapi.CallbackQuery, user *storage.U
 	log.Printf("handleStartScenario finished for user %d", user.TelegramID)
 }
 
-func (b *Bot) handleOption(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleOption called for user %d with data: %s", query.From.ID, query.Data)
-	parts := strings.Split(query.Data, "_")
-	if len(parts) >= 4 {
-		scenarioID, _ := strconv.Atoi(parts[1])
-		stepKey := parts[2]
-		optionNum := parts[3]
-
-		log.Printf("Parsed option for user %d: scenarioID=%d, stepKey=%s, optionNum=%s", user.TelegramID, scenarioID, stepKey, optionNum)
-
-		steps, err := b.storage.GetFSMScenarioSteps(scenarioID)
-		if err != nil {
-			log.Printf("Error getting steps for scenario %d, user %d: %v", scenarioID, user.TelegramID, err)
-			return
-		}
-
-		var nextStep *storage.FSMScenarioStep
-		for _, step := range steps {
-			if step.StepKey == stepKey+"_"+optionNum {
-				nextStep = step
-				break
-			}
-		}
-
-		if nextStep != nil {
-			log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, nextStep.StepKey)
-			err = b.storage.UpdateUserSession(user.TelegramID, &scenarioID, &nextStep.StepKey)
-			if err != nil {
-				log.Printf("Error updating session for user %d: %v", user.TelegramID, err)
-				return
-			}
-
-			buttons := b.fsm.GenerateButtonsForStep(nextStep, scenarioID)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, nextStep.Message)
-			if len(buttons) > 0 {
-				keyboard := b.createInlineKeyboard(buttons)
-				msg.ReplyMarkup = keyboard
-			}
+// handleGoto moves the user to another step of the scenario the pressed button belongs to
+func (b *Bot) handleGoto(query *tgbotapi.CallbackQuery, user *storage.User, scenarioID int, stepKey string) {
+	log.Printf("handleGoto called for user %d: scenarioID=%d, stepKey=%s", query.From.ID, scenarioID, stepKey)
 
-			sentMsg, err := b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending option response for user %d: %v", user.TelegramID, err)
-				return
-			}
-
-			if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-				log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-			}
-		} else {
-			log.Printf("Next step not found for user %d: scenarioID=%d, stepKey=%s_%s", user.TelegramID, scenarioID, stepKey, optionNum)
-		}
-	} else {
-		log.Printf("Invalid option data for user %d: %s", user.TelegramID, query.Data)
+	step, err := b.storage.GetFSMScenarioStep(scenarioID, stepKey)
+	if err != nil {
+		log.Printf("Error getting step %s for scenario %d, user %d: %v", stepKey, scenarioID, user.TelegramID, err)
+		return
+	}
+	if step == nil {
+		log.Printf("Step not found for user %d: scenarioID=%d, stepKey=%s", user.TelegramID, scenarioID, stepKey)
+		return
 	}
-	log.Printf("handleOption finished for user %d", user.TelegramID)
-}
-
-func (b *Bot) handleGoto(query *tgbotapi.CallbackQuery, user *storage.User) {
-	parts := strings.SplitN(query.Data, "_", 3)
-	log.Printf("handleGoto called for user %d with data: %s", query.From.ID, query.Data)
-	if len(parts) >= 3 {
-		scenarioID, _ := strconv.Atoi(parts[1])
-		stepKey := parts[2]
-
-		log.Printf("handleGoto parsed for user %d: scenarioID=%d, stepKey=%s", user.TelegramID, scenarioID, stepKey)
-
-		step, err := b.storage.GetFSMScenarioStep(scenarioID, stepKey)
-		if err != nil {
-			log.Printf("Error getting step %s for scenario %d, user %d: %v", stepKey, scenarioID, user.TelegramID, err)
-			return
-		}
-		if step != nil {
-			log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, step.StepKey)
-			err = b.storage.UpdateUserSession(user.TelegramID, &scenarioID, &step.StepKey)
-			if err != nil {
-				log.Printf("Error updating session for user %d: %v", user.TelegramID, err)
-				return
-			}
 
-			buttons := b.fsm.GenerateButtonsForStep(step, scenarioID)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, step.Message)
-			if len(buttons) > 0 {
-				keyboard := b.createInlineKeyboard(buttons)
-				msg.ReplyMarkup = keyboard
-			}
+	log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, step.StepKey)
+	text, buttons, err := b.fsm.EnterStep(user.TelegramID, step, "")
+	if err != nil {
+		log.Printf("Error entering step for user %d: %v", user.TelegramID, err)
+		return
+	}
 
-			sentMsg, err := b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending goto response for user %d: %v", user.TelegramID, err)
-				return
-			}
+	text, err = b.replyToCallback(query, text, buttons)
+	if err != nil {
+		log.Printf("Error sending goto response for user %d: %v", user.TelegramID, err)
+		return
+	}
 
-			if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-				log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-			}
-		} else {
-			log.Printf("Step not found for user %d: scenarioID=%d, stepKey=%s", user.TelegramID, scenarioID, stepKey)
-		}
-	} else {
-		log.Printf("Invalid goto data for user %d: %s", user.TelegramID, query.Data)
+	if err := b.storage.LogMessage(user.TelegramID, text, "outgoing"); err != nil {
+		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
 	}
 	log.Printf("handleGoto finished for user %d", user.TelegramID)
 }
 
-func ShouldOfferSiteLink(messageCount int, triggerCount int, currentState string) bool {
-	return messageCount == triggerCount && currentState == string(fsm.StateIdle)
-}
-
-func (b *Bot) Stop() {
-	b.api.StopReceivingUpdates()
-}
-
 func (b *Bot) GetUsername() string {
 	return b.api.Self.UserName
 }
 
+// createInlineKeyboard lays buttons out two per row; a button with NewRow starts a row of its own
 func (b *Bot) createInlineKeyboard(buttons []fsm.Button) tgbotapi.InlineKeyboardMarkup {
 	var rows [][]tgbotapi.InlineKeyboardButton
 
-	for i := 0; i < len(buttons); i += 2 {
-		var row []tgbotapi.InlineKeyboardButton
-		row = append(row, tgbotapi.NewInlineKeyboardButtonData(buttons[i].Text, buttons[i].CallbackData))
-		if i+1 < len(buttons) {
-			row = append(row, tgbotapi.NewInlineKeyboardButtonData(buttons[i+1].Text, buttons[i+1].CallbackData))
+	for _, button := range buttons {
+		if len(rows) == 0 || len(rows[len(rows)-1]) == 2 || button.NewRow {
+			rows = append(rows, nil)
 		}
-		rows = append(rows, row)
+		rows[len(rows)-1] = append(rows[len(rows)-1], tgbotapi.NewInlineKeyboardButtonData(button.Text, button.CallbackData))
 	}
 
 	return tgbotapi.NewInlineKeyboardMarkup(rows...)
 }
 
-func (b *Bot) handleAction(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleAction called for user %d with data: %s", query.From.ID, query.Data)
-	parts := strings.Split(query.Data, "_")
-	if len(parts) >= 3 {
-		scenarioID, _ := strconv.Atoi(parts[1])
-		actionKey := parts[2]
-
-		log.Printf("Parsed action for user %d: scenarioID=%d, actionKey=%s", user.TelegramID, scenarioID, actionKey)
+// handleBack returns the user to the step they came from, taken from the
+// session history. Steps removed since the visit are skipped; when the history
+// is empty the session ends and the scenario list is shown.
+func (b *Bot) handleBack(query *tgbotapi.CallbackQuery, user *storage.User) {
+	log.Printf("handleBack called for user %d with data: %s", query.From.ID, query.Data)
 
-		step, err := b.storage.GetFSMScenarioStep(scenarioID, actionKey)
+	var step *storage.FSMScenarioStep
+	for step == nil {
+		session, err := b.storage.PopUserSessionStep(user.TelegramID)
 		if err != nil {
-			log.Printf("Error getting action step %s for scenario %d, user %d: %v", actionKey, scenarioID, user.TelegramID, err)
+			log.Printf("Error popping session step for user %d: %v", user.TelegramID, err)
 			return
 		}
-		if step != nil {
-			log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, step.StepKey)
-			err = b.storage.UpdateUserSession(user.TelegramID, &scenarioID, &step.StepKey)
-			if err != nil {
-				log.Printf("Error updating session for user %d: %v", user.TelegramID, err)
-				return
-			}
-
-			buttons := b.fsm.GenerateButtonsForStep(step, scenarioID)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, step.Message)
-			if len(buttons) > 0 {
-				keyboard := b.createInlineKeyboard(buttons)
-				msg.ReplyMarkup = keyboard
-			}
-
-			sentMsg, err := b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending action response for user %d: %v", user.TelegramID, err)
-				return
-			}
+		if session == nil || session.ScenarioID == nil || session.CurrentStepKey == nil {
+			break
+		}
 
-			if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-				log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-			}
+		step, err = b.storage.GetFSMScenarioStep(*session.ScenarioID, *session.CurrentStepKey)
+		if err != nil {
+			log.Printf("Error getting previous step %s for scenario %d, user %d: %v", *session.CurrentStepKey, *session.ScenarioID, user.TelegramID, err)
+			return
+		}
+		if step == nil {
+			log.Printf("Previous step %s of scenario %d no longer exists, skipping it for user %d", *session.CurrentStepKey, *session.ScenarioID, user.TelegramID)
 		}
 	}
-	log.Printf("handleAction finished for user %d", user.TelegramID)
-}
 
-func (b *Bot) handleBack(query *tgbotapi.CallbackQuery, user *storage.User) {
-	log.Printf("handleBack called for user %d with data: %s", query.From.ID, query.Data)
-	parts := strings.Split(query.Data, "_")
-	if len(parts) >= 3 {
-		scenarioID, _ := strconv.Atoi(parts[1])
-		currentStepKey := parts[2]
-
-		log.Printf("Parsed back for user %d: scenarioID=%d, currentStepKey=%s", user.TelegramID, scenarioID, currentStepKey)
-
-		if currentStepKey == "root" {
-			log.Printf("User %d on root step, clearing session to return to scenario selection", user.TelegramID)
-			if err := b.storage.DeleteUserSession(user.TelegramID); err != nil {
-				log.Printf("Error clearing session for user %d: %v", user.TelegramID, err)
-				return
-			}
-
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, fsm.GetStartMessage())
-			scenariosButtons, err := b.fsm.GetScenariosButtons()
-			if err != nil {
-				log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
-				return
-			}
-			if len(scenariosButtons) > 0 {
-				keyboard := b.createInlineKeyboard(scenariosButtons)
-				msg.ReplyMarkup = keyboard
-			}
-
-			sentMsg, err := b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending scenario selection for user %d: %v", user.TelegramID, err)
-				return
-			}
-
-			if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-				log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-			}
-			log.Printf("handleBack finished for user %d (root case)", user.TelegramID)
+	if step == nil {
+		log.Printf("User %d has no step to go back to, clearing session to return to scenario selection", user.TelegramID)
+		if err := b.fsm.Reset(user.TelegramID); err != nil {
+			log.Printf("Error clearing session for user %d: %v", user.TelegramID, err)
 			return
 		}
 
-		previousStepKey := b.fsm.GetPreviousStepKey(currentStepKey)
-		log.Printf("Previous step key for user %d from %s is %s", user.TelegramID, currentStepKey, previousStepKey)
+		scenariosButtons, err := b.fsm.GetScenariosButtons(user.TelegramID)
+		if err != nil {
+			log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
+			return
+		}
 
-		step, err := b.storage.GetFSMScenarioStep(scenarioID, previousStepKey)
+		text, err := b.replyToCallback(query, fsm.GetStartMessage(), scenariosButtons)
 		if err != nil {
-			log.Printf("Error getting previous step %s for scenario %d, user %d: %v", previousStepKey, scenarioID, user.TelegramID, err)
+			log.Printf("Error sending scenario selection for user %d: %v", user.TelegramID, err)
 			return
 		}
-		if step != nil {
-			log.Printf("Updating session for user %d to scenario %d, step %s", user.TelegramID, scenarioID, step.StepKey)
-			err = b.storage.UpdateUserSession(user.TelegramID, &scenarioID, &step.StepKey)
-			if err != nil {
-				log.Printf("Error updating session for user %d: %v", user.TelegramID, err)
-				return
-			}
 
-			buttons := b.fsm.GenerateButtonsForStep(step, scenarioID)
-			msg := tgbotapi.NewMessage(query.Message.Chat.ID, step.Message)
-			if len(buttons) > 0 {
-				keyboard := b.createInlineKeyboard(buttons)
-				msg.ReplyMarkup = keyboard
-			}
+		if err := b.storage.LogMessage(user.TelegramID, text, "outgoing"); err != nil {
+			log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
+		}
+		log.Printf("handleBack finished for user %d (scenario selection)", user.TelegramID)
+		return
+	}
 
-			sentMsg, err := b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending back navigation response for user %d: %v", user.TelegramID, err)
-				return
-			}
+	log.Printf("User %d went back to scenario %d, step %s", user.TelegramID, step.ScenarioID, step.StepKey)
 
-			if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
-				log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
-			}
-		} else {
-			log.Printf("Previous step not found for user %d: scenarioID=%d, previousStepKey=%s", user.TelegramID, scenarioID, previousStepKey)
-		}
-	} else {
-		log.Printf("Invalid back data for user %d: %s", user.TelegramID, query.Data)
+	buttons := b.fsm.GenerateButtonsForStep(user.TelegramID, step, step.ScenarioID)
+	text, err := b.replyToCallback(query, b.fsm.RenderMessage(user.TelegramID, step.Message), buttons)
+	if err != nil {
+		log.Printf("Error sending back navigation response for user %d: %v", user.TelegramID, err)
+		return
+	}
+
+	if err := b.storage.LogMessage(user.TelegramID, text, "outgoing"); err != nil {
+		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
 	}
 	log.Printf("handleBack finished for user %d", user.TelegramID)
 }
@@ -760,34 +487,10 @@ func (b *Bot) processMessage(message *tgbotapi.Message, user *storage.User) {
 		return
 	}
 
-	updatedUser, err := b.storage.GetUser(message.From.ID)
-	if err != nil {
-		log.Printf("Error reloading user %d: %v", message.From.ID, err)
-		return
-	}
-	if updatedUser == nil {
-		log.Printf("ERROR: Failed to reload user %d, got nil", message.From.ID)
-		return
-	}
-
 	if err := b.storage.LogMessage(message.From.ID, message.Text, "incoming"); err != nil {
 		log.Printf("Error logging incoming message for user %d: %v", message.From.ID, err)
 	}
 
-	settings, err := b.storage.GetSettings()
-	if err != nil {
-		log.Printf("Error getting settings for user %d: %v", message.From.ID, err)
-		return
-	}
-
-	if updatedUser.MessageCount >= settings.TriggerMessageCount {
-		b.offerSiteLink(message.Chat.ID, updatedUser)
-		if err := b.storage.ResetUserMessageCount(message.From.ID); err != nil {
-			log.Printf("Error resetting message count for user %d: %v", message.From.ID, err)
-		}
-		return
-	}
-
 	response, buttons, handled, err := b.fsm.ProcessMessage(message.From.ID, message.Text)
 	if err != nil {
 		log.Printf("Error processing message through FSM for user %d: %v", message.From.ID, err)
@@ -824,68 +527,23 @@ func (b *Bot) processMessage(message *tgbotapi.Message, user *storage.User) {
 			log.Printf("Error logging generic response for user %d: %v", message.From.ID, err)
 		}
 	}
+
+	b.offerSiteLink(message.Chat.ID, message.From.ID)
 }
 
-func (b *Bot) processCallbackQuery(query *tgbotapi.CallbackQuery, user *storage.User) {
+// processCallbackQuery dispatches a button press and returns the toast to answer it with
+func (b *Bot) processCallbackQuery(query *tgbotapi.CallbackQuery, user *storage.User) string {
 	if err := b.storage.UpdateUserMessageCount(query.From.ID); err != nil {
 		log.Printf("Error updating message count for user %d (callback): %v", query.From.ID, err)
-		return
-	}
-
-	updatedUser, err := b.storage.GetUser(query.From.ID)
-	if err != nil {
-		log.Printf("Error reloading user %d (callback): %v", query.From.ID, err)
-		return
-	}
-	if updatedUser == nil {
-		log.Printf("ERROR: Failed to reload user %d, got nil (callback)", query.From.ID)
-		return
+		return ""
 	}
 
-	settings, err := b.storage.GetSettings()
-	if err != nil {
-		log.Printf("Error getting settings for user %d during callback: %v", query.From.ID, err)
-		return
+	if !fsm.IsCallbackToken(query.Data) && !isLegacyCallback(query.Data) {
+		log.Printf("Unknown callback data for user %d: %s", query.From.ID, query.Data)
+		return fsm.GetUnknownButtonMessage()
 	}
 
-	if updatedUser.MessageCount >= settings.TriggerMessageCount {
-		b.offerSiteLink(query.Message.Chat.ID, updatedUser)
-		if err := b.storage.ResetUserMessageCount(query.From.ID); err != nil {
-			log.Printf("Error resetting message count for user %d: %v", query.From.ID, err)
-		}
-		return
-	}
-
-	switch query.Data {
-	case "site_link_yes":
-		b.handleSiteLinkYes(query, user)
-	case "site_link_no":
-		b.handleSiteLinkNo(query, user)
-	case "site_link_back_to_start":
-		b.handleSiteLinkBackToStart(query, user)
-	case "site_link_yes_post":
-		b.handleSiteLinkYesPost(query, user, settings)
-	case "site_link_no_post":
-		b.handleSiteLinkNoPost(query, user, settings)
-	case "email_consent_yes":
-		b.handleEmailConsentYes(query, user, settings)
-	case "email_consent_no":
-		b.handleEmailConsentNo(query, user, settings)
-	default:
-		if strings.HasPrefix(query.Data, "email_confirm_") {
-			b.handleEmailConfirm(query, user)
-		} else if strings.HasPrefix(query.Data, "start_scenario_") {
-			b.handleStartScenario(query, user)
-		} else if strings.HasPrefix(query.Data, "option_") {
-			b.handleOption(query, user)
-		} else if strings.HasPrefix(query.Data, "goto_") {
-			b.handleGoto(query, user)
-		} else if strings.HasPrefix(query.Data, "action_") {
-			b.handleAction(query, user)
-		} else if strings.HasPrefix(query.Data, "back_") {
-			b.handleBack(query, user)
-		} else {
-			log.Printf("Unknown callback data for user %d: %s", query.From.ID, query.Data)
-		}
-	}
+	toast := b.handleCallbackToken(query, user)
+	b.offerSiteLink(query.Message.Chat.ID, query.From.ID)
+	return toast
 }
@@ -0,0 +1,510 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/bot/telegramtest"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/scenario"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUserID = 42
+
+// startTestBot runs a bot against a fake Telegram server over an in-memory
+// storage seeded with two scenarios and the site offer. The site link is offered after
+// triggerMessageCount messages; configure adjusts the bot before it starts.
+func startTestBot(t *testing.T, triggerMessageCount int, configure ...func(b *Bot)) (*telegramtest.Server, *storage.MemoryStorage) {
+	t.Helper()
+
+	srv := telegramtest.NewServer(t)
+	store := storage.NewMemoryStorage()
+	seedScenarios(t, store)
+	require.NoError(t, store.UpdateSettings(&storage.Settings{TriggerMessageCount: triggerMessageCount, SiteURL: "https://tools.example.com"}))
+
+	b, err := NewBot("test-token", srv.URL, store, 1000, false, "", "", "", 2, 10)
+	require.NoError(t, err)
+	for _, fn := range configure {
+		fn(b)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, b.Start(ctx))
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, b.Shutdown(context.Background()))
+	})
+
+	return srv, store
+}
+
+func seedScenarios(t *testing.T, store *storage.MemoryStorage) {
+	t.Helper()
+
+	grinder := &storage.FSMScenario{Name: "grinder", DisplayName: "УШМ", TriggerKeywords: []string{"не включается"}}
+	require.NoError(t, store.CreateFSMScenario(grinder))
+	for _, step := range []*storage.FSMScenarioStep{
+		{StepKey: "root", Message: "Что случилось с УШМ?", StateType: "start"},
+		{StepKey: "no_power", Message: "Проверьте питание", StateType: "intermediate"},
+		{StepKey: "check_cable", Message: "Осмотрите кабель", StateType: "intermediate"},
+		{StepKey: "sparks", Message: "Обратитесь в сервис", IsFinal: true, StateType: "final"},
+	} {
+		step.ScenarioID = grinder.ID
+		require.NoError(t, store.CreateFSMScenarioStep(step))
+	}
+	for _, transition := range []*storage.FSMTransition{
+		{FromStepKey: "root", ToStepKey: "no_power", ButtonLabel: "Не включается", SortOrder: 1},
+		{FromStepKey: "root", ToStepKey: "sparks", ButtonLabel: "Искрит", SortOrder: 2},
+	} {
+		transition.ScenarioID = grinder.ID
+		require.NoError(t, store.CreateFSMTransition(transition))
+	}
+	require.NoError(t, store.CreateFSMStepAction(&storage.FSMStepAction{
+		ScenarioID: grinder.ID, StepKey: "no_power", ActionStepKey: "check_cable", Label: "Проверить кабель",
+	}))
+
+	saw := &storage.FSMScenario{Name: "miter_saw", DisplayName: "Торцовочная пила", TriggerKeywords: []string{"пила"}}
+	require.NoError(t, store.CreateFSMScenario(saw))
+	require.NoError(t, store.CreateFSMScenarioStep(&storage.FSMScenarioStep{
+		ScenarioID: saw.ID, StepKey: "root", Message: "Что случилось с пилой?", StateType: "start",
+	}))
+
+	def, err := scenario.Load("../../scenarios/site_offer.yaml")
+	require.NoError(t, err)
+	graph := def.ToGraph()
+	require.NoError(t, store.CreateFSMScenario(graph.Scenario))
+	for _, step := range graph.Steps {
+		step.ScenarioID = graph.Scenario.ID
+		require.NoError(t, store.CreateFSMScenarioStep(step))
+	}
+	for _, transition := range graph.Transitions {
+		transition.ScenarioID = graph.Scenario.ID
+		require.NoError(t, store.CreateFSMTransition(transition))
+	}
+}
+
+const siteOfferMessage = "Хотите подробнее ознакомиться с инструкциями и рекомендациями по эксплуатации? Перейти на сайт?"
+
+// conversationState returns the conversation state of the test user
+func conversationState(t *testing.T, store storage.Storage) fsm.State {
+	t.Helper()
+
+	state, err := fsm.NewFSM(store, false, "", "", "").GetState(testUserID)
+	require.NoError(t, err)
+	return state
+}
+
+func TestStartShowsScenarioMenu(t *testing.T) {
+	srv, store := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "/start")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, int64(testUserID), reply.ChatID)
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, []string{"УШМ", "Торцовочная пила"}, reply.Buttons())
+
+	assert.Equal(t, fsm.StateIdle, conversationState(t, store))
+}
+
+func TestStartPayloadOpensScenario(t *testing.T) {
+	srv, store := startTestBot(t, 100)
+	grinderID, noPower := 1, "no_power"
+	require.NoError(t, store.CreateDeepLink(&storage.DeepLink{Payload: "GWS-750", ProductSKU: "GWS-750", ScenarioID: &grinderID, StepKey: &noPower}))
+
+	srv.SendText(testUserID, "/start GWS-750")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Проверьте питание", reply.Text)
+	assert.Equal(t, []string{"Проверить кабель", "⬅️ Назад"}, reply.Buttons())
+
+	user, err := store.GetUser(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "GWS-750", user.StartPayload)
+	assert.Equal(t, "GWS-750", user.ProductSKU)
+
+	// A payload that opens nothing still shows the scenario list
+	srv.SendText(testUserID, "/start UNKNOWN-1")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, fsm.StateIdle, conversationState(t, store))
+}
+
+func TestProductLimitsScenarioMenu(t *testing.T) {
+	srv, store := startTestBot(t, 100)
+	require.NoError(t, store.CreateProduct(&storage.Product{SKU: "LS-1800", Model: "LS 1800", ScenarioIDs: []int{2}}))
+
+	srv.SendText(testUserID, "/start LS-1800")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, []string{"Торцовочная пила", fsm.GetAllScenariosButtonText()}, reply.Buttons())
+
+	srv.PressButton(t, testUserID, fsm.GetAllScenariosButtonText())
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, []string{"УШМ", "Торцовочная пила"}, reply.Buttons())
+
+	srv.PressButton(t, testUserID, "УШМ")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, "Что случилось с УШМ?", reply.Text)
+}
+
+func TestCategorizedMenu(t *testing.T) {
+	srv, store := startTestBot(t, 100, func(b *Bot) { b.SetMenuPageSize(1) })
+	grinders := &storage.Category{Name: "grinders", DisplayName: "Шлифмашины"}
+	require.NoError(t, store.CreateCategory(grinders))
+	grinder, err := store.GetFSMScenario(1)
+	require.NoError(t, err)
+	grinder.CategoryID = &grinders.ID
+	require.NoError(t, store.UpdateFSMScenario(grinder))
+
+	srv.SendText(testUserID, "/start")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, []string{"Шлифмашины", fsm.GetNextPageButtonText()}, reply.Buttons())
+	// Page navigation gets a row of its own
+	assert.Len(t, reply.ReplyMarkup.InlineKeyboard, 2)
+
+	srv.PressButton(t, testUserID, fsm.GetNextPageButtonText())
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, []string{"Торцовочная пила", fsm.GetPreviousPageButtonText()}, reply.Buttons())
+
+	srv.PressButton(t, testUserID, fsm.GetPreviousPageButtonText())
+	srv.Next(t, 1)
+	srv.PressButton(t, testUserID, "Шлифмашины")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, []string{"УШМ", fsm.GetCategoriesButtonText()}, reply.Buttons())
+
+	srv.PressButton(t, testUserID, "УШМ")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, "Что случилось с УШМ?", reply.Text)
+}
+
+func TestScenarioNavigation(t *testing.T) {
+	srv, store := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "/start")
+	srv.Next(t, 1)
+
+	srv.PressButton(t, testUserID, "УШМ")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Что случилось с УШМ?", reply.Text)
+	assert.Equal(t, []string{"Не включается", "Искрит", "⬅️ Назад"}, reply.Buttons())
+	scenarioMessageID := reply.ID
+
+	// Navigation inside the scenario edits the same message
+	srv.PressButton(t, testUserID, "Не включается")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, "Проверьте питание", reply.Text)
+	assert.Equal(t, []string{"Проверить кабель", "⬅️ Назад"}, reply.Buttons())
+	assert.Equal(t, scenarioMessageID, reply.ID)
+
+	srv.PressButton(t, testUserID, "Проверить кабель")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, "Осмотрите кабель", reply.Text)
+	assert.Equal(t, scenarioMessageID, reply.ID)
+	assert.Len(t, srv.Requests("editMessageText"), 2)
+
+	session, err := store.GetUserSession(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, "check_cable", *session.CurrentStepKey)
+
+	// Back walks the visited steps in reverse and ends at the scenario menu
+	for _, want := range []string{"Проверьте питание", "Что случилось с УШМ?", fsm.GetStartMessage()} {
+		srv.PressButton(t, testUserID, "⬅️ Назад")
+		reply = srv.Next(t, 1)[0]
+		assert.Equal(t, want, reply.Text)
+		assert.Equal(t, scenarioMessageID, reply.ID)
+	}
+
+	// Every press is acknowledged, without a toast
+	answers := srv.WaitAnswers(t, 6)
+	assert.Len(t, answers, 6)
+	for _, answer := range answers {
+		assert.Empty(t, answer.Text)
+	}
+
+	session, err = store.GetUserSession(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestTriggerMessageStartsScenario(t *testing.T) {
+	srv, _ := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "Болгарка не включается")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Что случилось с УШМ?", reply.Text)
+
+	srv.PressButton(t, testUserID, "Искрит")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, "Обратитесь в сервис", reply.Text)
+	assert.Equal(t, []string{"⬅️ Назад"}, reply.Buttons())
+
+	// A message on a final step repeats it and ends the scenario
+	srv.SendText(testUserID, "спасибо")
+	assert.Equal(t, "Обратитесь в сервис", srv.Next(t, 1)[0].Text)
+
+	srv.SendText(testUserID, "добрый день")
+	assert.Contains(t, srv.Next(t, 1)[0].Text, "Если возникнут проблемы")
+}
+
+func TestSiteLinkAccepted(t *testing.T) {
+	srv, store := startTestBot(t, 3)
+
+	srv.SendText(testUserID, "привет")
+	srv.SendText(testUserID, "как дела")
+	srv.Next(t, 2)
+
+	// The offer follows the reply to the message that reached the trigger count
+	srv.SendText(testUserID, "ещё вопрос")
+	replies := srv.Next(t, 2)
+	assert.Contains(t, replies[0].Text, "Если возникнут проблемы")
+	offer := replies[1]
+	assert.Equal(t, siteOfferMessage, offer.Text)
+	assert.Equal(t, []string{"Да", "Нет", "📧 Получать рекомендации на email"}, offer.Buttons())
+	assert.Equal(t, fsm.StateInScenario, conversationState(t, store))
+
+	// With no scenario to return to, the offer ends with the scenario list
+	srv.PressButton(t, testUserID, "Да")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Отличный выбор! Вот ссылка на полезные материалы: https://tools.example.com", reply.Text)
+	assert.Equal(t, []string{"УШМ", "Торцовочная пила"}, reply.Buttons())
+	assert.Equal(t, fsm.StateIdle, conversationState(t, store))
+}
+
+func TestSiteOfferWaitsForFinalStep(t *testing.T) {
+	srv, store := startTestBot(t, 2)
+	require.NoError(t, store.UpdateSettings(&storage.Settings{TriggerMessageCount: 2, SiteURL: "https://tools.example.com", OfferCooldownHours: 24}))
+
+	srv.SendText(testUserID, "не включается")
+	srv.Next(t, 1)
+
+	// The trigger count is reached in the middle of the scenario: no offer yet
+	srv.PressButton(t, testUserID, "Не включается")
+	assert.Equal(t, "Проверьте питание", srv.Next(t, 1)[0].Text)
+	srv.PressButton(t, testUserID, "⬅️ Назад")
+	assert.Equal(t, "Что случилось с УШМ?", srv.Next(t, 1)[0].Text)
+
+	// The final step is followed by the offer
+	srv.PressButton(t, testUserID, "Искрит")
+	replies := srv.Next(t, 2)
+	assert.Equal(t, "Обратитесь в сервис", replies[0].Text)
+	assert.Equal(t, siteOfferMessage, replies[1].Text)
+
+	// Declining ends the finished scenario and starts the cooldown
+	srv.PressButton(t, testUserID, "Нет")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Хорошо, если что — обращайтесь! Всегда рад помочь.", reply.Text)
+	assert.Equal(t, []string{"УШМ", "Торцовочная пила"}, reply.Buttons())
+	assert.Equal(t, fsm.StateIdle, conversationState(t, store))
+
+	for _, text := range []string{"привет", "как дела", "ещё вопрос"} {
+		srv.SendText(testUserID, text)
+		assert.Contains(t, srv.Next(t, 1)[0].Text, "Если возникнут проблемы")
+	}
+
+	user, err := store.GetUser(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, user.SiteOffersCount)
+	assert.NotNil(t, user.SiteOfferDeclinedAt)
+}
+
+func TestEmailConsentFlow(t *testing.T) {
+	srv, store := startTestBot(t, 1)
+
+	srv.SendText(testUserID, "привет")
+	assert.Equal(t, siteOfferMessage, srv.Next(t, 2)[1].Text)
+	require.NoError(t, store.UpdateSettings(&storage.Settings{TriggerMessageCount: 100, SiteURL: "https://tools.example.com"}))
+
+	srv.PressButton(t, testUserID, "📧 Получать рекомендации на email")
+	srv.Next(t, 1)
+
+	srv.SendText(testUserID, "user at example")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Похоже, в адресе ошибка. Напишите email в формате name@example.com.", reply.Text)
+	assert.Equal(t, []string{"⬅️ Назад"}, reply.Buttons())
+
+	srv.SendText(testUserID, "user@example.com")
+	reply = srv.Next(t, 1)[0]
+	assert.Equal(t, []string{"Разрешаю", "Нет, спасибо", "⬅️ Назад"}, reply.Buttons())
+
+	srv.PressButton(t, testUserID, "Разрешаю")
+	assert.Equal(t, "Спасибо! Информация сохранена.\n\nВот ссылка на полезные материалы: https://tools.example.com", srv.Next(t, 1)[0].Text)
+
+	user, err := store.GetUser(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", user.Email)
+	assert.True(t, user.ConsentGranted)
+	assert.Equal(t, fsm.StateIdle, conversationState(t, store))
+}
+
+func TestCallbackFromUnknownUserIsIgnored(t *testing.T) {
+	srv, _ := startTestBot(t, 100)
+
+	srv.SendCallback(7, "start_scenario_1")
+	srv.SendText(testUserID, "/start")
+
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, int64(testUserID), reply.ChatID)
+	assert.Len(t, srv.Messages(), 1)
+}
+
+func TestCallbackWithoutMessageIsAnswered(t *testing.T) {
+	srv, _ := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "/start")
+	menu := srv.Next(t, 1)[0]
+	data, ok := menu.CallbackData("УШМ")
+	require.True(t, ok)
+
+	id := srv.SendDetachedCallback(testUserID, data)
+	answers := srv.WaitAnswers(t, 1)
+	assert.Equal(t, id, answers[0].CallbackQueryID)
+
+	srv.SendText(testUserID, "/start")
+	srv.Next(t, 1)
+	assert.Len(t, srv.Messages(), 2)
+}
+
+func TestNavigationSendsNewMessagesWhenEditingIsOff(t *testing.T) {
+	srv, _ := startTestBot(t, 100, func(b *Bot) { b.SetEditInPlace(false) })
+
+	srv.SendText(testUserID, "не включается")
+	first := srv.Next(t, 1)[0]
+
+	srv.PressButton(t, testUserID, "Не включается")
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, "Проверьте питание", reply.Text)
+	assert.NotEqual(t, first.ID, reply.ID)
+	assert.Empty(t, srv.Requests("editMessageText"))
+	assert.Len(t, srv.WaitAnswers(t, 1), 1)
+}
+
+func TestUnknownCallbackIsAnsweredWithToast(t *testing.T) {
+	srv, _ := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "/start")
+	srv.Next(t, 1)
+
+	id := srv.SendCallback(testUserID, "no_such_button")
+	answers := srv.WaitAnswers(t, 1)
+	assert.Equal(t, id, answers[0].CallbackQueryID)
+	assert.Equal(t, fsm.GetUnknownButtonMessage(), answers[0].Text)
+}
+
+func TestForgedCallbackShowsCurrentStep(t *testing.T) {
+	srv, store := startTestBot(t, 100)
+
+	srv.SendText(testUserID, "не включается")
+	srv.Next(t, 1)
+	srv.PressButton(t, testUserID, "Не включается")
+	srv.Next(t, 1)
+
+	expiresAt := time.Now().Add(time.Hour)
+	for _, token := range []*storage.CallbackToken{
+		// "sparks" is not reachable from no_power
+		{Token: "t:root-sparks", UserID: testUserID, Kind: fsm.CallbackGoto, ScenarioID: 1, FromStepKey: "root", StepKey: "sparks", ExpiresAt: expiresAt},
+		// Buttons shown to another user do not work for this one
+		{Token: "t:other-user", UserID: 7, Kind: fsm.CallbackGoto, ScenarioID: 1, FromStepKey: "no_power", StepKey: "check_cable", ExpiresAt: expiresAt},
+		{Token: "t:expired", UserID: testUserID, Kind: fsm.CallbackGoto, ScenarioID: 1, FromStepKey: "no_power", StepKey: "check_cable", ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		require.NoError(t, store.SaveCallbackToken(token))
+	}
+
+	forged := []string{"t:root-sparks", "t:other-user", "t:expired", "t:never-issued", "goto_1_sparks"}
+	for _, data := range forged {
+		srv.SendCallback(testUserID, data)
+		reply := srv.Next(t, 1)[0]
+		assert.Equal(t, "Проверьте питание", reply.Text, data)
+		assert.Equal(t, []string{"Проверить кабель", "⬅️ Назад"}, reply.Buttons(), data)
+	}
+
+	answers := srv.WaitAnswers(t, 1+len(forged))
+	for _, answer := range answers[1:] {
+		assert.Equal(t, fsm.GetOutdatedMenuMessage(), answer.Text)
+	}
+
+	session, err := store.GetUserSession(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, 1, *session.ScenarioID)
+	assert.Equal(t, "no_power", *session.CurrentStepKey)
+	assert.Len(t, session.History, 1)
+}
+
+func TestStaleButtonShowsCurrentStep(t *testing.T) {
+	srv, store := startTestBot(t, 100, func(b *Bot) { b.SetEditInPlace(false) })
+
+	srv.SendText(testUserID, "не включается")
+	root := srv.Next(t, 1)[0]
+	srv.PressButton(t, testUserID, "Не включается")
+	srv.Next(t, 1)
+
+	// "Искрит" is still on the first message, left over from the previous step
+	data, ok := root.CallbackData("Искрит")
+	require.True(t, ok)
+	srv.SendCallback(testUserID, data)
+	assert.Equal(t, "Проверьте питание", srv.Next(t, 1)[0].Text)
+	assert.Equal(t, fsm.GetOutdatedMenuMessage(), srv.WaitAnswers(t, 2)[1].Text)
+
+	session, err := store.GetUserSession(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "no_power", *session.CurrentStepKey)
+
+	// Without a session every step button is outdated and the scenario list is shown
+	require.NoError(t, store.DeleteUserSession(testUserID))
+	data, ok = root.CallbackData("Не включается")
+	require.True(t, ok)
+	srv.SendCallback(testUserID, data)
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+	assert.Equal(t, []string{"УШМ", "Торцовочная пила"}, reply.Buttons())
+
+	session, err = store.GetUserSession(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestShutdownDoesNotWaitForStuckPolling(t *testing.T) {
+	b := &Bot{dispatcher: NewDispatcher(1, 1)}
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	b.dispatcher.Dispatch(testUserID, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	require.True(t, b.dispatcher.Dispatch(testUserID, func() {}), "fills the queue")
+
+	// The poller drains a fetched update into the full queue
+	dispatched := make(chan bool, 1)
+	b.polling.Add(1)
+	go func() {
+		defer b.polling.Done()
+		dispatched <- b.handleUpdate(tgbotapi.Update{Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: testUserID},
+			Chat: &tgbotapi.Chat{ID: testUserID},
+			Text: "/start",
+		}})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() { shutdown <- b.Shutdown(ctx) }()
+
+	select {
+	case err := <-shutdown:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown is stuck behind the poller")
+	}
+	assert.False(t, <-dispatched, "the update is dropped")
+}
@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"log"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// legacyCallbackPrefixes mark callback data of buttons sent before buttons were backed by
+// callback tokens, including the buttons of the site offer before it became a scenario
+var legacyCallbackPrefixes = []string{"goto_", "action_", "option_", "back_", "start_scenario_", "email_confirm_", "site_link_", "email_consent_"}
+
+// isLegacyCallback reports whether callback data comes from a button sent before callback tokens
+func isLegacyCallback(data string) bool {
+	for _, prefix := range legacyCallbackPrefixes {
+		if strings.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCallbackToken dispatches a press of a button backed by a callback token
+// and returns the toast to answer it with. Unknown and expired tokens, legacy
+// callback data, tokens issued to another user and step buttons that do not
+// belong to the step the session is on are answered by showing the current step.
+func (b *Bot) handleCallbackToken(query *tgbotapi.CallbackQuery, user *storage.User) string {
+	token, err := b.fsm.ResolveCallback(query.Data)
+	if err != nil {
+		log.Printf("Error resolving callback of user %d: %v", user.TelegramID, err)
+		return ""
+	}
+
+	current, err := b.fsm.CurrentStep(user.TelegramID)
+	if err != nil {
+		log.Printf("Error getting current step of user %d: %v", user.TelegramID, err)
+		return ""
+	}
+
+	if token == nil || token.UserID != user.TelegramID {
+		b.handleOutdatedCallback(query, user, current)
+		return fsm.GetOutdatedMenuMessage()
+	}
+
+	switch token.Kind {
+	case fsm.CallbackStartScenario:
+		b.handleStartScenario(query, user, token.ScenarioID)
+		return ""
+	case fsm.CallbackMenu:
+		b.handleMenuPage(query, user, token.Value)
+		return ""
+	}
+
+	// Step buttons only work while the session is on the step that showed them
+	if current == nil || current.ScenarioID != token.ScenarioID || current.StepKey != token.FromStepKey {
+		b.handleOutdatedCallback(query, user, current)
+		return fsm.GetOutdatedMenuMessage()
+	}
+
+	switch token.Kind {
+	case fsm.CallbackGoto:
+		b.handleGoto(query, user, token.ScenarioID, token.StepKey)
+	case fsm.CallbackBack:
+		b.handleBack(query, user)
+	default:
+		log.Printf("Unknown callback token kind for user %d: %s", user.TelegramID, token.Kind)
+		return fsm.GetUnknownButtonMessage()
+	}
+	return ""
+}
+
+// handleMenuPage replaces the scenario menu with the page a menu button leads to
+func (b *Bot) handleMenuPage(query *tgbotapi.CallbackQuery, user *storage.User, value string) {
+	page, err := fsm.ParseMenuPage(value)
+	if err != nil {
+		log.Printf("Error parsing menu page for user %d: %v", user.TelegramID, err)
+		page = fsm.MenuPage{}
+	}
+
+	buttons, err := b.fsm.MenuButtons(user.TelegramID, page)
+	if err != nil {
+		log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
+		return
+	}
+
+	text, err := b.replyToCallback(query, fsm.GetStartMessage(), buttons)
+	if err != nil {
+		log.Printf("Error sending scenario menu for user %d: %v", user.TelegramID, err)
+		return
+	}
+
+	if err := b.storage.LogMessage(user.TelegramID, text, "outgoing"); err != nil {
+		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
+	}
+}
+
+// handleOutdatedCallback answers a press of an outdated or forged step button by
+// showing the current step, or the scenario list if the user is not in a
+// scenario. The session is left as it is.
+func (b *Bot) handleOutdatedCallback(query *tgbotapi.CallbackQuery, user *storage.User, current *storage.FSMScenarioStep) {
+	log.Printf("Outdated callback from user %d: %s", user.TelegramID, query.Data)
+
+	text := fsm.GetStartMessage()
+	var buttons []fsm.Button
+	var err error
+	if current != nil {
+		text = b.fsm.RenderMessage(user.TelegramID, current.Message)
+		buttons = b.fsm.GenerateButtonsForStep(user.TelegramID, current, current.ScenarioID)
+	} else if buttons, err = b.fsm.GetScenariosButtons(user.TelegramID); err != nil {
+		log.Printf("Error getting scenarios buttons for user %d: %v", user.TelegramID, err)
+	}
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	if len(buttons) > 0 {
+		msg.ReplyMarkup = b.createInlineKeyboard(buttons)
+	}
+
+	sentMsg, err := b.api.Send(msg)
+	if err != nil {
+		log.Printf("Error sending current step for user %d: %v", user.TelegramID, err)
+		return
+	}
+
+	if err := b.storage.LogMessage(user.TelegramID, sentMsg.Text, "outgoing"); err != nil {
+		log.Printf("Error logging outgoing message for user %d: %v", user.TelegramID, err)
+	}
+}
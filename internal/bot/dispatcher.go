@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/metrics"
+)
+
+// Dispatcher runs update handlers on a fixed number of workers. Updates are
+// sharded by user ID, so the updates of one user are handled one at a time in
+// the order they arrived, while different users are served in parallel.
+//
+// Every worker has a bounded queue. Dispatch blocks while the queue of the
+// user's worker is full, which slows down polling or webhook delivery instead
+// of piling up goroutines.
+type Dispatcher struct {
+	mu     sync.RWMutex
+	closed bool
+	// done is closed by stop, first thing in Close, releasing Dispatch calls
+	// waiting for room so Close can take mu
+	done      chan struct{}
+	closeOnce sync.Once
+	queues    []chan func()
+	capacity  int
+	busy      atomic.Int64
+	processed atomic.Uint64
+	wg        sync.WaitGroup
+}
+
+// NewDispatcher starts workers that each buffer up to queueSize updates
+func NewDispatcher(workers, queueSize int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	d := &Dispatcher{
+		done:     make(chan struct{}),
+		queues:   make([]chan func(), workers),
+		capacity: workers * queueSize,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), queueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// Dispatch queues handle on the worker of userID, waiting for room in its
+// queue. It reports false if the dispatcher is closed, before or while
+// waiting, and handle was dropped.
+func (d *Dispatcher) Dispatch(userID int64, handle func()) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+
+	shard := userID % int64(len(d.queues))
+	if shard < 0 {
+		shard = -shard
+	}
+	select {
+	case d.queues[shard] <- handle:
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+// stop makes Dispatch drop updates instead of waiting for room in a queue
+func (d *Dispatcher) stop() {
+	d.closeOnce.Do(func() { close(d.done) })
+}
+
+// Close stops accepting updates and waits until the workers finish everything
+// already queued, or until ctx is done
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.stop()
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		stats := d.Stats()
+		return fmt.Errorf("%d updates queued and %d in progress were not finished: %w", stats.Queued, stats.Busy, ctx.Err())
+	}
+}
+
+// Stats returns the current queue depth and worker load
+func (d *Dispatcher) Stats() metrics.QueueStats {
+	queued := 0
+	for _, queue := range d.queues {
+		queued += len(queue)
+	}
+
+	return metrics.QueueStats{
+		Workers:   len(d.queues),
+		Busy:      int(d.busy.Load()),
+		Queued:    queued,
+		Capacity:  d.capacity,
+		Processed: d.processed.Load(),
+	}
+}
+
+func (d *Dispatcher) work(queue chan func()) {
+	defer d.wg.Done()
+
+	for handle := range queue {
+		d.busy.Add(1)
+		handle()
+		d.busy.Add(-1)
+		d.processed.Add(1)
+	}
+}
@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcherKeepsUserOrder(t *testing.T) {
+	d := NewDispatcher(4, 10)
+
+	var mu sync.Mutex
+	handled := make(map[int64][]int)
+	for i := 0; i < 50; i++ {
+		for userID := int64(1); userID <= 6; userID++ {
+			userID, i := userID, i
+			d.Dispatch(userID, func() {
+				mu.Lock()
+				handled[userID] = append(handled[userID], i)
+				mu.Unlock()
+			})
+		}
+	}
+	require.NoError(t, d.Close(context.Background()))
+
+	for userID := int64(1); userID <= 6; userID++ {
+		assert.Len(t, handled[userID], 50)
+		for i, n := range handled[userID] {
+			assert.Equal(t, i, n, "user %d", userID)
+		}
+	}
+	assert.Equal(t, uint64(300), d.Stats().Processed)
+	assert.False(t, d.Dispatch(1, func() {}))
+}
+
+func TestDispatcherLimitsConcurrency(t *testing.T) {
+	d := NewDispatcher(3, 5)
+
+	var running, peak atomic.Int64
+	release := make(chan struct{})
+	for userID := int64(0); userID < 12; userID++ {
+		d.Dispatch(userID, func() {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			<-release
+			running.Add(-1)
+		})
+	}
+
+	stats := d.Stats()
+	assert.Equal(t, 3, stats.Workers)
+	assert.Equal(t, 15, stats.Capacity)
+	assert.LessOrEqual(t, stats.Busy+stats.Queued, 12)
+
+	close(release)
+	require.NoError(t, d.Close(context.Background()))
+	assert.LessOrEqual(t, peak.Load(), int64(3))
+}
+
+func TestDispatcherCloseTimeout(t *testing.T) {
+	d := NewDispatcher(1, 1)
+
+	release := make(chan struct{})
+	defer close(release)
+	d.Dispatch(1, func() { <-release })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, d.Close(ctx), context.Canceled)
+}
+
+func TestDispatcherCloseReleasesWaitingDispatch(t *testing.T) {
+	d := NewDispatcher(1, 1)
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	d.Dispatch(1, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	require.True(t, d.Dispatch(1, func() {}), "fills the queue")
+
+	dispatched := make(chan bool)
+	go func() { dispatched <- d.Dispatch(1, func() {}) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closed := make(chan error)
+	go func() { closed <- d.Close(ctx) }()
+
+	select {
+	case err := <-closed:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("Close is stuck behind a full queue")
+	}
+	assert.False(t, <-dispatched)
+}
@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SetEditInPlace selects how scenario navigation replies to a button press:
+// by editing the message with the pressed button (the default) or by sending
+// a new message. Call it before Start.
+func (b *Bot) SetEditInPlace(enabled bool) {
+	b.editInPlace = enabled
+}
+
+// SetCallbackTTL sets how long scenario buttons keep working after they are shown
+func (b *Bot) SetCallbackTTL(ttl time.Duration) {
+	b.fsm.SetCallbackTTL(ttl)
+}
+
+// answerCallback acknowledges a button press so Telegram stops showing the
+// loading spinner; a non-empty text is shown to the user as a toast
+func (b *Bot) answerCallback(query *tgbotapi.CallbackQuery, text string) {
+	if _, err := b.api.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		log.Printf("Error answering callback query for user %d: %v", query.From.ID, err)
+	}
+}
+
+// replyToCallback shows text and buttons in reply to a button press, editing
+// the message with the pressed button when editing in place is enabled and
+// falling back to a new message if the edit fails. It returns the shown text.
+func (b *Bot) replyToCallback(query *tgbotapi.CallbackQuery, text string, buttons []fsm.Button) (string, error) {
+	if b.editInPlace && query.Message != nil && query.Message.MessageID != 0 {
+		edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+		if len(buttons) > 0 {
+			keyboard := b.createInlineKeyboard(buttons)
+			edit.ReplyMarkup = &keyboard
+		}
+
+		_, err := b.api.Send(edit)
+		// Pressing the button of the step already shown changes nothing
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			return text, nil
+		}
+		log.Printf("Error editing message %d for user %d, sending a new one: %v", query.Message.MessageID, query.From.ID, err)
+	}
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	if len(buttons) > 0 {
+		msg.ReplyMarkup = b.createInlineKeyboard(buttons)
+	}
+
+	sentMsg, err := b.api.Send(msg)
+	if err != nil {
+		return "", err
+	}
+	return sentMsg.Text, nil
+}
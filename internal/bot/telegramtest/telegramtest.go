@@ -0,0 +1,485 @@
+// Package telegramtest provides a local stand-in for the Telegram Bot API.
+//
+// A Server hands scripted updates to the bot through getUpdates and records
+// what the bot sends back, so conversations can be tested end to end:
+//
+//	srv := telegramtest.NewServer(t)
+//	b, _ := bot.NewBot("token", srv.URL, ...)
+//	srv.SendText(42, "/start")
+//	reply := srv.Next(t, 1)[0]
+package telegramtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// WaitTimeout bounds how long Next waits for the bot to respond
+var WaitTimeout = 5 * time.Second
+
+// maxPollWait bounds how long getUpdates blocks, regardless of the timeout the bot asks for
+const maxPollWait = 200 * time.Millisecond
+
+// Message is a message sent or edited by the bot
+type Message struct {
+	ID          int
+	ChatID      int64
+	Text        string
+	ReplyMarkup *tgbotapi.InlineKeyboardMarkup
+}
+
+// Buttons returns the labels of the inline keyboard, row by row
+func (m Message) Buttons() []string {
+	var labels []string
+	if m.ReplyMarkup != nil {
+		for _, row := range m.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				labels = append(labels, button.Text)
+			}
+		}
+	}
+	return labels
+}
+
+// CallbackData returns the callback data of the button with the given label
+func (m Message) CallbackData(label string) (string, bool) {
+	if m.ReplyMarkup != nil {
+		for _, row := range m.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				if button.Text == label && button.CallbackData != nil {
+					return *button.CallbackData, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// CallbackAnswer is a recorded answerCallbackQuery call
+type CallbackAnswer struct {
+	CallbackQueryID string
+	Text            string
+	ShowAlert       bool
+}
+
+// Request is a recorded Bot API call
+type Request struct {
+	Method string
+	Params map[string]string
+}
+
+// Server is a fake Bot API server. Its URL is passed to bot.NewBot as the API URL.
+type Server struct {
+	URL string
+
+	server  *httptest.Server
+	mu      sync.Mutex
+	changed chan struct{}
+	closed  chan struct{}
+
+	updates       []tgbotapi.Update
+	nextUpdateID  int
+	nextMessageID int
+	nextQueryID   int
+	messages      []Message
+	read          int
+	answers       []CallbackAnswer
+	requests      []Request
+}
+
+// NewServer starts a fake Bot API server that is closed when the test ends
+func NewServer(t *testing.T) *Server {
+	t.Helper()
+
+	s := &Server{
+		changed:      make(chan struct{}),
+		closed:       make(chan struct{}),
+		nextUpdateID: 1,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close stops the server, releasing pending getUpdates calls
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	s.server.Close()
+}
+
+// SendText queues a private text message from userID; text starting with "/" is a command
+func (s *Server) SendText(userID int64, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextMessageID++
+	message := &tgbotapi.Message{
+		MessageID: s.nextMessageID,
+		From:      user(userID),
+		Chat:      chat(userID),
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(text)
+		if i := strings.IndexByte(text, ' '); i >= 0 {
+			length = i
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+
+	s.queue(tgbotapi.Update{Message: message})
+}
+
+// SendCallback queues a callback query from userID with arbitrary data,
+// attached to the last message the bot sent to the user
+func (s *Server) SendCallback(userID int64, data string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message := &tgbotapi.Message{Chat: chat(userID)}
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].ChatID == userID {
+			message = s.apiMessage(s.messages[i])
+			break
+		}
+	}
+	return s.queueCallback(userID, message, data)
+}
+
+// SendDetachedCallback queues a button press without the message it was
+// attached to, as Telegram sends for inline-mode messages, and returns the query ID
+func (s *Server) SendDetachedCallback(userID int64, data string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queueCallback(userID, nil, data)
+}
+
+// PressButton queues a press of the button with the given label on the last
+// message sent to userID that has such a button, and returns the query ID
+func (s *Server) PressButton(t *testing.T, userID int64, label string) string {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].ChatID != userID {
+			continue
+		}
+		if data, ok := s.messages[i].CallbackData(label); ok {
+			return s.queueCallback(userID, s.apiMessage(s.messages[i]), data)
+		}
+	}
+
+	t.Fatalf("no button %q in messages sent to user %d", label, userID)
+	return ""
+}
+
+// Next waits until the bot has sent n messages since the previous call and returns them
+func (s *Server) Next(t *testing.T, n int) []Message {
+	t.Helper()
+
+	if !s.wait(func() bool { return len(s.messages)-s.read >= n }) {
+		s.mu.Lock()
+		got := s.messages[s.read:]
+		s.mu.Unlock()
+		t.Fatalf("timed out waiting for %d messages from the bot, got %d: %+v", n, len(got), got)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := append([]Message(nil), s.messages[s.read:s.read+n]...)
+	s.read += n
+	return messages
+}
+
+// Messages returns all messages sent by the bot
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+// WaitAnswers waits until the bot has answered n callback queries and returns all answers
+func (s *Server) WaitAnswers(t *testing.T, n int) []CallbackAnswer {
+	t.Helper()
+
+	if !s.wait(func() bool { return len(s.answers) >= n }) {
+		t.Fatalf("timed out waiting for %d callback answers", n)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]CallbackAnswer(nil), s.answers...)
+}
+
+// Requests returns recorded calls of method, or all calls if method is empty
+func (s *Server) Requests(method string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []Request
+	for _, request := range s.requests {
+		if method == "" || request.Method == method {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// wait blocks until cond, evaluated under the lock, holds or WaitTimeout passes
+func (s *Server) wait(cond func() bool) bool {
+	deadline := time.After(WaitTimeout)
+	for {
+		s.mu.Lock()
+		ok := cond()
+		changed := s.changed
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// notify wakes up waiters; the caller holds the lock
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// queue adds an update for getUpdates; the caller holds the lock
+func (s *Server) queue(update tgbotapi.Update) {
+	update.UpdateID = s.nextUpdateID
+	s.nextUpdateID++
+	s.updates = append(s.updates, update)
+	s.notify()
+}
+
+// queueCallback adds a callback query update; the caller holds the lock
+func (s *Server) queueCallback(userID int64, message *tgbotapi.Message, data string) string {
+	s.nextQueryID++
+	id := strconv.Itoa(s.nextQueryID)
+	s.queue(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:           id,
+		From:         user(userID),
+		Message:      message,
+		ChatInstance: strconv.FormatInt(userID, 10),
+		Data:         data,
+	}})
+	return id
+}
+
+// apiMessage converts a recorded message back to the form Telegram attaches to callback queries
+func (s *Server) apiMessage(m Message) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID:   m.ID,
+		From:        &tgbotapi.User{ID: botID, IsBot: true, FirstName: "Test", UserName: botUserName},
+		Chat:        chat(m.ChatID),
+		Date:        int(time.Now().Unix()),
+		Text:        m.Text,
+		ReplyMarkup: m.ReplyMarkup,
+	}
+}
+
+const (
+	botID       = 1
+	botUserName = "test_bot"
+)
+
+func user(id int64) *tgbotapi.User {
+	return &tgbotapi.User{ID: id, FirstName: "User" + strconv.FormatInt(id, 10)}
+}
+
+func chat(id int64) *tgbotapi.Chat {
+	return &tgbotapi.Chat{ID: id, Type: "private"}
+}
+
+// handle serves /bot<token>/<method>
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	method := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+	params := make(map[string]string)
+	for key := range r.PostForm {
+		params[key] = r.PostForm.Get(key)
+	}
+
+	s.mu.Lock()
+	if method != "getUpdates" {
+		s.requests = append(s.requests, Request{Method: method, Params: params})
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	switch method {
+	case "getMe":
+		writeResult(w, tgbotapi.User{ID: botID, IsBot: true, FirstName: "Test", UserName: botUserName})
+	case "getUpdates":
+		s.getUpdates(w, r, params)
+	case "sendMessage":
+		s.sendMessage(w, params)
+	case "editMessageText", "editMessageReplyMarkup":
+		s.editMessage(w, method, params)
+	case "answerCallbackQuery":
+		s.mu.Lock()
+		s.answers = append(s.answers, CallbackAnswer{
+			CallbackQueryID: params["callback_query_id"],
+			Text:            params["text"],
+			ShowAlert:       params["show_alert"] == "true",
+		})
+		s.notify()
+		s.mu.Unlock()
+		writeResult(w, true)
+	default:
+		writeResult(w, true)
+	}
+}
+
+// getUpdates returns queued updates from offset on, waiting briefly if there are none
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	offset, _ := strconv.Atoi(params["offset"])
+	deadline := time.After(maxPollWait)
+
+	for {
+		s.mu.Lock()
+		var updates []tgbotapi.Update
+		for _, update := range s.updates {
+			if update.UpdateID >= offset {
+				updates = append(updates, update)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(updates) > 0 {
+			writeResult(w, updates)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeResult(w, []tgbotapi.Update{})
+			return
+		case <-s.closed:
+			writeResult(w, []tgbotapi.Update{})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, params map[string]string) {
+	chatID, err := strconv.ParseInt(params["chat_id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+	markup, err := parseMarkup(params["reply_markup"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: can't parse reply keyboard markup JSON object")
+		return
+	}
+
+	s.mu.Lock()
+	s.nextMessageID++
+	message := Message{ID: s.nextMessageID, ChatID: chatID, Text: params["text"], ReplyMarkup: markup}
+	s.messages = append(s.messages, message)
+	s.notify()
+	s.mu.Unlock()
+
+	writeResult(w, s.apiMessage(message))
+}
+
+// editMessage records an edit as a new message carrying the ID of the edited one
+func (s *Server) editMessage(w http.ResponseWriter, method string, params map[string]string) {
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+	messageID, _ := strconv.Atoi(params["message_id"])
+	markup, err := parseMarkup(params["reply_markup"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: can't parse reply keyboard markup JSON object")
+		return
+	}
+
+	s.mu.Lock()
+	var original *Message
+	for i := range s.messages {
+		if s.messages[i].ID == messageID && s.messages[i].ChatID == chatID {
+			original = &s.messages[i]
+		}
+	}
+	if original == nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+		return
+	}
+
+	edited := Message{ID: messageID, ChatID: chatID, Text: original.Text, ReplyMarkup: markup}
+	if method == "editMessageText" {
+		edited.Text = params["text"]
+	}
+	s.messages = append(s.messages, edited)
+	s.notify()
+	s.mu.Unlock()
+
+	writeResult(w, s.apiMessage(edited))
+}
+
+func parseMarkup(raw string) (*tgbotapi.InlineKeyboardMarkup, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var markup tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(raw), &markup); err != nil {
+		return nil, err
+	}
+	return &markup, nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: raw})
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: false, ErrorCode: code, Description: description})
+}
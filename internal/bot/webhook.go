@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// secretTokenHeader carries the secret_token given to setWebhook in every webhook request
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookAllowedUpdates are the update types the bot handles
+var webhookAllowedUpdates = []string{"message", "callback_query"}
+
+// SetWebhook registers url as the webhook for the bot. Telegram sends
+// secretToken with every update so WebhookHandler can reject forged requests.
+func (b *Bot) SetWebhook(url, secretToken string) error {
+	// WebhookConfig of telegram-bot-api v5.5.1 has no secret_token field
+	params := tgbotapi.Params{
+		"url":          url,
+		"secret_token": secretToken,
+	}
+	if err := params.AddInterface("allowed_updates", webhookAllowedUpdates); err != nil {
+		return fmt.Errorf("failed to encode allowed updates: %w", err)
+	}
+
+	if _, err := b.api.MakeRequest("setWebhook", params); err != nil {
+		return fmt.Errorf("failed to set webhook: %w", err)
+	}
+
+	info, err := b.api.GetWebhookInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get webhook info: %w", err)
+	}
+	if info.LastErrorDate != 0 {
+		log.Printf("Webhook reports last delivery error: %s", info.LastErrorMessage)
+	}
+	log.Printf("Webhook set to %s, %d updates pending", info.URL, info.PendingUpdateCount)
+
+	return nil
+}
+
+// WebhookHandler returns the HTTP handler receiving updates from Telegram.
+// Requests without the matching secret token are rejected.
+func (b *Bot) WebhookHandler(secretToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(secretToken)) != 1 {
+			log.Printf("Rejected webhook request from %s: invalid secret token", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		update, err := b.api.HandleUpdate(r)
+		if err != nil {
+			log.Printf("Error decoding webhook update: %v", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		// Updates are handled asynchronously; Telegram only needs a quick 200.
+		// During shutdown Telegram is asked to deliver the update again later.
+		if !b.handleUpdate(*update) {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
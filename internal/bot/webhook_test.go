@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/bot/telegramtest"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "webhook-secret"
+
+// newWebhookBot returns a bot that is not polling, so updates reach it only through WebhookHandler
+func newWebhookBot(t *testing.T) (*Bot, *telegramtest.Server) {
+	t.Helper()
+
+	srv := telegramtest.NewServer(t)
+	store := storage.NewMemoryStorage()
+	seedScenarios(t, store)
+
+	b, err := NewBot("test-token", srv.URL, store, 1000, false, "", "", "", 2, 10)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, b.Shutdown(context.Background()))
+	})
+	return b, srv
+}
+
+func startUpdate(t *testing.T) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(tgbotapi.Update{
+		UpdateID: 1,
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			From:      &tgbotapi.User{ID: testUserID, FirstName: "Test"},
+			Chat:      &tgbotapi.Chat{ID: testUserID, Type: "private"},
+			Date:      int(time.Now().Unix()),
+			Text:      "/start",
+			Entities:  []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/start")}},
+		},
+	})
+	require.NoError(t, err)
+	return body
+}
+
+func postWebhook(handler http.Handler, secret string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	if secret != "" {
+		req.Header.Set(secretTokenHeader, secret)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWebhookHandlesUpdate(t *testing.T) {
+	b, srv := newWebhookBot(t)
+	handler := b.WebhookHandler(testSecret)
+
+	rec := postWebhook(handler, testSecret, startUpdate(t))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	reply := srv.Next(t, 1)[0]
+	assert.Equal(t, int64(testUserID), reply.ChatID)
+	assert.Equal(t, fsm.GetStartMessage(), reply.Text)
+}
+
+func TestWebhookRejectsInvalidRequests(t *testing.T) {
+	b, srv := newWebhookBot(t)
+	handler := b.WebhookHandler(testSecret)
+
+	tests := []struct {
+		name     string
+		method   string
+		secret   string
+		body     []byte
+		wantCode int
+	}{
+		{"GET", http.MethodGet, testSecret, nil, http.StatusMethodNotAllowed},
+		{"no secret", http.MethodPost, "", startUpdate(t), http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "guess", startUpdate(t), http.StatusUnauthorized},
+		{"secret prefix", http.MethodPost, testSecret[:len(testSecret)-1], startUpdate(t), http.StatusUnauthorized},
+		{"invalid JSON", http.MethodPost, testSecret, []byte("{not json"), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/webhook", bytes.NewReader(tt.body))
+			if tt.secret != "" {
+				req.Header.Set(secretTokenHeader, tt.secret)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+
+	// None of the rejected requests reached the bot
+	assert.Empty(t, srv.Messages())
+}
+
+func TestWebhookAsksForRetryDuringShutdown(t *testing.T) {
+	b, srv := newWebhookBot(t)
+	handler := b.WebhookHandler(testSecret)
+	require.NoError(t, b.Shutdown(context.Background()))
+
+	rec := postWebhook(handler, testSecret, startUpdate(t))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Empty(t, srv.Messages())
+}
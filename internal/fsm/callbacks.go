@@ -0,0 +1,72 @@
+package fsm
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// CallbackTokenPrefix starts the callback data of every button backed by a callback token
+const CallbackTokenPrefix = "t:"
+
+// DefaultCallbackTTL is how long a button keeps working after it was shown
+const DefaultCallbackTTL = 7 * 24 * time.Hour
+
+// Callback token kinds
+const (
+	CallbackGoto          = "goto"
+	CallbackBack          = "back"
+	CallbackStartScenario = "start_scenario"
+	CallbackMenu          = "menu"
+)
+
+// SetCallbackTTL sets how long buttons shown from now on keep working
+func (f *FSM) SetCallbackTTL(ttl time.Duration) {
+	f.callbackTTL = ttl
+}
+
+// IsCallbackToken reports whether callback data is a callback token
+func IsCallbackToken(data string) bool {
+	return strings.HasPrefix(data, CallbackTokenPrefix)
+}
+
+// ResolveCallback returns the action behind a token button, or nil if the token is unknown or expired
+func (f *FSM) ResolveCallback(data string) (*storage.CallbackToken, error) {
+	if !IsCallbackToken(data) {
+		return nil, nil
+	}
+
+	token, err := f.storage.GetCallbackToken(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get callback token: %w", err)
+	}
+	return token, nil
+}
+
+// registerCallback stores the action of a button and returns the token to use as its
+// callback data. Telegram limits callback data to 64 bytes, so keys and values
+// never go into the payload itself.
+func (f *FSM) registerCallback(token *storage.CallbackToken) string {
+	token.Token = newCallbackToken()
+	token.ExpiresAt = time.Now().Add(f.callbackTTL)
+
+	// A button whose token was not saved is answered as outdated when pressed
+	if err := f.storage.SaveCallbackToken(token); err != nil {
+		log.Printf("Error saving callback token for user %d: %v", token.UserID, err)
+	}
+	return token.Token
+}
+
+// newCallbackToken returns a random token of 18 characters
+func newCallbackToken() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate callback token: %v", err))
+	}
+	return CallbackTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,183 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// PayloadSeparator separates the parts of a /start payload
+const PayloadSeparator = "__"
+
+// StartPayload is a /start payload split into its parts
+type StartPayload struct {
+	ProductSKU string
+	Scenario   string
+	StepKey    string
+}
+
+// ParseStartPayload splits a /start payload of the form sku[__scenario[__step]],
+// e.g. "JS-650__diagnose_jigsaw__no_power"
+func ParseStartPayload(payload string) StartPayload {
+	parts := strings.SplitN(strings.TrimSpace(payload), PayloadSeparator, 3)
+	parsed := StartPayload{ProductSKU: parts[0]}
+	if len(parts) > 1 {
+		parsed.Scenario = parts[1]
+	}
+	if len(parts) > 2 {
+		parsed.StepKey = parts[2]
+	}
+	return parsed
+}
+
+// String joins the parts back into a payload, the inverse of ParseStartPayload
+func (p StartPayload) String() string {
+	switch {
+	case p.StepKey != "":
+		return p.ProductSKU + PayloadSeparator + p.Scenario + PayloadSeparator + p.StepKey
+	case p.Scenario != "":
+		return p.ProductSKU + PayloadSeparator + p.Scenario
+	default:
+		return p.ProductSKU
+	}
+}
+
+// StartFromPayload handles /start <payload>: it remembers the payload and its
+// product on the user and opens the step the payload points to. It reports
+// false when the payload points to no scenario or to one it may not open, so
+// the caller shows the scenario list instead.
+func (f *FSM) StartFromPayload(userID int64, payload string) (response string, buttons []Button, started bool, err error) {
+	link, err := f.ResolveStartPayload(payload)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	if err := f.storage.UpdateUserStartPayload(userID, payload, link.ProductSKU); err != nil {
+		return "", nil, false, err
+	}
+
+	if link.ScenarioID == nil {
+		return "", nil, false, nil
+	}
+
+	step, err := f.deepLinkStep(link)
+	if err != nil || step == nil {
+		return "", nil, false, err
+	}
+
+	response, buttons, err = f.EnterStep(userID, step, "")
+	if err != nil {
+		return "", nil, false, err
+	}
+	return response, buttons, true, nil
+}
+
+// PayloadCanOpen reports whether a /start payload may open a scenario and, when
+// step is not nil, that step of it. Anyone can print a start link, so links
+// never open the site offer, hidden scenarios or steps with effects: those
+// would record consent or a declined offer the user never gave.
+func PayloadCanOpen(scenario *storage.FSMScenario, step *storage.FSMScenarioStep, siteOffer string) bool {
+	if scenario.HiddenFromMenu || scenario.Name == siteOffer {
+		return false
+	}
+	return step == nil || len(step.Effects) == 0
+}
+
+// ResolveStartPayload finds what a /start payload opens. A payload saved in
+// the deep links table is used as is. Otherwise it is parsed: the deep link
+// saved for its SKU gives the default scenario and step, and a scenario or step
+// named in the payload overrides them. A scenario PayloadCanOpen refuses is
+// dropped, leaving only the product.
+func (f *FSM) ResolveStartPayload(payload string) (*storage.DeepLink, error) {
+	link, err := f.storage.GetDeepLink(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deep link: %w", err)
+	}
+	if link != nil {
+		return f.openableLink(link)
+	}
+
+	parsed := ParseStartPayload(payload)
+	link = &storage.DeepLink{Payload: payload, ProductSKU: parsed.ProductSKU}
+
+	product, err := f.storage.GetDeepLink(parsed.ProductSKU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deep link: %w", err)
+	}
+	if product != nil {
+		link.ProductSKU = product.ProductSKU
+		link.ScenarioID = product.ScenarioID
+		link.StepKey = product.StepKey
+	}
+
+	if parsed.Scenario != "" {
+		scenario, err := f.scenarioByName(parsed.Scenario)
+		if err != nil {
+			return nil, err
+		}
+		if scenario == nil {
+			log.Printf("Scenario %q of start payload %q not found", parsed.Scenario, payload)
+			return link, nil
+		}
+		link.ScenarioID = &scenario.ID
+		link.StepKey = nil
+	}
+	if parsed.StepKey != "" && link.ScenarioID != nil {
+		link.StepKey = &parsed.StepKey
+	}
+
+	return f.openableLink(link)
+}
+
+// openableLink returns a copy of link without its scenario and step if
+// PayloadCanOpen refuses the scenario
+func (f *FSM) openableLink(link *storage.DeepLink) (*storage.DeepLink, error) {
+	openable := *link
+	if openable.ScenarioID == nil {
+		return &openable, nil
+	}
+
+	scenario, err := f.storage.GetFSMScenario(*openable.ScenarioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenario: %w", err)
+	}
+	if scenario == nil || !PayloadCanOpen(scenario, nil, f.siteOffer) {
+		log.Printf("Start payload %q points to scenario %d, which links cannot open", openable.Payload, *openable.ScenarioID)
+		openable.ScenarioID = nil
+		openable.StepKey = nil
+	}
+	return &openable, nil
+}
+
+// deepLinkStep returns the step a deep link opens: its step if it still
+// exists, otherwise the first step of its scenario. It returns nil for a step
+// with effects, which a link must not run.
+func (f *FSM) deepLinkStep(link *storage.DeepLink) (*storage.FSMScenarioStep, error) {
+	var step *storage.FSMScenarioStep
+	if link.StepKey != nil {
+		var err error
+		step, err = f.storage.GetFSMScenarioStep(*link.ScenarioID, *link.StepKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get step: %w", err)
+		}
+		if step == nil {
+			log.Printf("Step %s of scenario %d for start payload %q not found, opening the first step", *link.StepKey, *link.ScenarioID, link.Payload)
+		}
+	}
+
+	if step == nil {
+		var err error
+		step, err = f.GetFirstStep(*link.ScenarioID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get first step: %w", err)
+		}
+	}
+
+	if step != nil && len(step.Effects) > 0 {
+		log.Printf("Step %s of scenario %d for start payload %q has effects, showing the menu", step.StepKey, step.ScenarioID, link.Payload)
+		return nil, nil
+	}
+	return step, nil
+}
@@ -0,0 +1,94 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// ValidatorFunc checks free text a user sends on a step that expects input
+type ValidatorFunc func(input string) bool
+
+// EffectFunc is a side effect run when a user enters a step. input is the text
+// the user sent to get there, empty when they pressed a button.
+type EffectFunc func(userID int64, input string) error
+
+// RegisterValidator registers a named validator that steps can reference as input
+func (f *FSM) RegisterValidator(name string, fn ValidatorFunc) {
+	f.validators[name] = fn
+}
+
+// RegisterEffect registers a named side effect that steps can reference
+func (f *FSM) RegisterEffect(name string, fn EffectFunc) {
+	f.effects[name] = fn
+}
+
+// validateInput checks input against a named validator. Unknown validators reject any input.
+func (f *FSM) validateInput(name, input string) bool {
+	fn, ok := f.validators[name]
+	if !ok {
+		log.Printf("Unknown input validator %q", name)
+		return false
+	}
+	return fn(input)
+}
+
+// runEffects runs the effects of a step in order. A failing or unknown effect
+// is logged and does not stop the others.
+func (f *FSM) runEffects(userID int64, step *storage.FSMScenarioStep, input string) {
+	for _, name := range step.Effects {
+		fn, ok := f.effects[name]
+		if !ok {
+			log.Printf("Unknown effect %q on step %s of scenario %d", name, step.StepKey, step.ScenarioID)
+			continue
+		}
+		if err := fn(userID, input); err != nil {
+			log.Printf("Error running effect %q on step %s of scenario %d for user %d: %v", name, step.StepKey, step.ScenarioID, userID, err)
+		}
+	}
+}
+
+// resumeScenario returns the user to the step they were on before the current
+// scenario started, taken from the session history, or ends the session if the
+// scenario was not started on top of another one
+func (f *FSM) resumeScenario(userID int64) error {
+	session, err := f.storage.GetUserSession(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user session: %w", err)
+	}
+	if session == nil || session.ScenarioID == nil {
+		return nil
+	}
+
+	scenarioID := *session.ScenarioID
+	for {
+		session, err = f.storage.PopUserSessionStep(userID)
+		if err != nil {
+			return fmt.Errorf("failed to pop session step: %w", err)
+		}
+		if session == nil {
+			return f.Reset(userID)
+		}
+		if session.ScenarioID != nil && *session.ScenarioID != scenarioID {
+			return nil
+		}
+	}
+}
+
+// RenderMessage fills the placeholders of a step message: {site_url} becomes the
+// site link from the settings, the product placeholders come from the user's product
+func (f *FSM) RenderMessage(userID int64, message string) string {
+	message = f.renderProduct(userID, message)
+	if !strings.Contains(message, "{site_url}") {
+		return message
+	}
+
+	settings, err := f.storage.GetSettings()
+	if err != nil || settings == nil {
+		log.Printf("Error getting settings to render message: %v", err)
+		return message
+	}
+	return strings.ReplaceAll(message, "{site_url}", settings.SiteURL)
+}
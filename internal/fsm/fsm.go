@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
 )
@@ -16,20 +18,12 @@ import (
 type Button struct {
 	Text         string
 	CallbackData string
+	// NewRow starts a new keyboard row with this button
+	NewRow bool
 }
 
-// State represents FSM state
-type State string
-
-const (
-	StateIdle                    State = "idle"
-	StateUSHMNotStartingStep1   State = "ushm_not_starting_step1"
-	StateUSHMNotStartingStep2   State = "ushm_not_starting_step2"
-	StateAwaitingEmail          State = "awaiting_email"
-	StateAwaitingEmailConsent    State = "awaiting_email_consent"
-	StateOfferingSiteLink       State = "offering_site_link"
-	StateOfferingSitePost       State = "offering_site_post"
-)
+// ConditionFunc decides whether a transition guarded by a named condition is shown to a user
+type ConditionFunc func(userID int64) (bool, error)
 
 // FSM represents the finite state machine
 type FSM struct {
@@ -38,17 +32,104 @@ type FSM struct {
 	openAIURL     string
 	openAIKey     string
 	openAIModel   string
+	conditions    map[string]ConditionFunc
+	validators    map[string]ValidatorFunc
+	effects       map[string]EffectFunc
+	callbackTTL   time.Duration
+	siteOffer     string
+	offerPolicy   OfferPolicy
+	menuPageSize  int
 }
 
 // NewFSM creates a new FSM instance
 func NewFSM(storage storage.Storage, openAIEnabled bool, openAIURL, openAIKey, openAIModel string) *FSM {
-	return &FSM{
+	f := &FSM{
 		storage:       storage,
 		openAIEnabled: openAIEnabled,
 		openAIURL:     openAIURL,
 		openAIKey:     openAIKey,
 		openAIModel:   openAIModel,
+		conditions:    make(map[string]ConditionFunc),
+		validators:    make(map[string]ValidatorFunc),
+		effects:       make(map[string]EffectFunc),
+		callbackTTL:   DefaultCallbackTTL,
+		siteOffer:     DefaultSiteOfferScenario,
+		offerPolicy:   DefaultOfferPolicy{},
+		menuPageSize:  DefaultMenuPageSize,
+	}
+
+	f.RegisterCondition("has_email", func(userID int64) (bool, error) {
+		user, err := f.storage.GetUser(userID)
+		if err != nil || user == nil {
+			return false, err
+		}
+		return user.Email != "", nil
+	})
+	f.RegisterCondition("consent_granted", func(userID int64) (bool, error) {
+		user, err := f.storage.GetUser(userID)
+		if err != nil || user == nil {
+			return false, err
+		}
+		return user.ConsentGranted, nil
+	})
+
+	f.RegisterValidator("email", IsValidEmail)
+
+	f.RegisterEffect("save_email", func(userID int64, input string) error {
+		if input == "" {
+			return fmt.Errorf("no email to save")
+		}
+		return f.storage.UpdateUserEmail(userID, input, false)
+	})
+	f.RegisterEffect("grant_consent", func(userID int64, input string) error {
+		user, err := f.storage.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		if user == nil || user.Email == "" {
+			return fmt.Errorf("no email to grant consent for")
+		}
+		return f.storage.UpdateUserEmail(userID, user.Email, true)
+	})
+	f.RegisterEffect("decline_site_offer", func(userID int64, input string) error {
+		return f.storage.RecordSiteOfferDeclined(userID)
+	})
+	f.RegisterEffect("resume_scenario", func(userID int64, input string) error {
+		return f.resumeScenario(userID)
+	})
+
+	return f
+}
+
+// RegisterCondition registers a named condition that transitions can reference
+func (f *FSM) RegisterCondition(name string, fn ConditionFunc) {
+	f.conditions[name] = fn
+}
+
+// evaluateCondition evaluates a transition condition such as "has_email" or "!has_email".
+// Unknown conditions and evaluation errors hide the transition.
+func (f *FSM) evaluateCondition(userID int64, condition string) bool {
+	condition = strings.TrimSpace(condition)
+	if condition == "" {
+		return true
 	}
+
+	negate := strings.HasPrefix(condition, "!")
+	name := strings.TrimSpace(strings.TrimPrefix(condition, "!"))
+
+	fn, ok := f.conditions[name]
+	if !ok {
+		log.Printf("Unknown transition condition %q", name)
+		return false
+	}
+
+	result, err := fn(userID)
+	if err != nil {
+		log.Printf("Error evaluating condition %q for user %d: %v", name, userID, err)
+		return false
+	}
+
+	return result != negate
 }
 
 // ProcessMessage processes incoming message and returns response, buttons and whether it was handled
@@ -74,33 +155,39 @@ func (f *FSM) ProcessMessage(userID int64, message string) (response string, but
 					return "", nil, false, fmt.Errorf("failed to get first step: %w", err)
 				}
 				if step != nil {
-					err = f.storage.UpdateUserSession(userID, &scenario.ID, &step.StepKey)
+					response, buttons, err = f.EnterStep(userID, step, "")
 					if err != nil {
-						return "", nil, false, fmt.Errorf("failed to update session: %w", err)
+						return "", nil, false, err
 					}
-					buttons = f.GenerateButtonsForStep(step, scenario.ID)
-					return step.Message, buttons, true, nil
+					return response, buttons, true, nil
 				}
 			}
 		}
 
 		// Fallback to keyword matching
-		scenario, err := f.storage.GetFSMScenarioByTrigger(message)
+		matches, err := f.storage.GetFSMScenariosByTrigger(message)
 		if err != nil {
 			return "", nil, false, fmt.Errorf("failed to check triggers: %w", err)
 		}
-		if scenario != nil {
-			step, err := f.GetFirstStep(scenario.ID)
+		candidates := triggerCandidates(matches)
+		if len(candidates) > 1 {
+			// No clear winner: let the user pick instead of guessing
+			for _, candidate := range candidates {
+				buttons = append(buttons, f.entryButton(userID, scenarioEntry(candidate.Scenario)))
+			}
+			return GetChooseScenarioMessage(), buttons, true, nil
+		}
+		if len(candidates) == 1 {
+			step, err := f.GetFirstStep(candidates[0].Scenario.ID)
 			if err != nil {
 				return "", nil, false, fmt.Errorf("failed to get first step: %w", err)
 			}
 			if step != nil {
-				err = f.storage.UpdateUserSession(userID, &scenario.ID, &step.StepKey)
+				response, buttons, err = f.EnterStep(userID, step, "")
 				if err != nil {
-					return "", nil, false, fmt.Errorf("failed to update session: %w", err)
+					return "", nil, false, err
 				}
-				buttons = f.GenerateButtonsForStep(step, scenario.ID)
-				return step.Message, buttons, true, nil
+				return response, buttons, true, nil
 			}
 		}
 
@@ -115,21 +202,31 @@ func (f *FSM) ProcessMessage(userID int64, message string) (response string, but
 	}
 	if step == nil {
 		// Invalid step, clear session
-		f.storage.DeleteUserSession(userID)
+		f.leaveScenario(userID)
 		return "", nil, false, nil
 	}
 
 	// If this is a final step, clear session and return response
 	if step.IsFinal {
-		f.storage.DeleteUserSession(userID)
-		return step.Message, nil, true, nil
+		f.leaveScenario(userID)
+		return f.RenderMessage(userID, step.Message), nil, true, nil
+	}
+
+	// Steps expecting input stay put until the text passes their validator
+	input := strings.TrimSpace(message)
+	if step.Input != "" && !f.validateInput(step.Input, input) {
+		response = step.InputError
+		if response == "" {
+			response = GetInvalidInputMessage()
+		}
+		return response, f.GenerateButtonsForStep(userID, step, *session.ScenarioID), true, nil
 	}
 
 	// Move to next step
 	if step.NextStepKey == nil {
 		// No next step, clear session
-		f.storage.DeleteUserSession(userID)
-		return step.Message, nil, true, nil
+		f.leaveScenario(userID)
+		return f.RenderMessage(userID, step.Message), nil, true, nil
 	}
 
 	nextStep, err := f.storage.GetFSMScenarioStep(*session.ScenarioID, *step.NextStepKey)
@@ -138,18 +235,54 @@ func (f *FSM) ProcessMessage(userID int64, message string) (response string, but
 	}
 	if nextStep == nil {
 		// Invalid next step, clear session
-		f.storage.DeleteUserSession(userID)
-		return step.Message, nil, true, nil
+		f.leaveScenario(userID)
+		return f.RenderMessage(userID, step.Message), nil, true, nil
 	}
 
-	// Update session with next step
-	err = f.storage.UpdateUserSession(userID, session.ScenarioID, &nextStep.StepKey)
+	response, buttons, err = f.EnterStep(userID, nextStep, input)
 	if err != nil {
-		return "", nil, false, fmt.Errorf("failed to update session: %w", err)
+		return "", nil, false, err
+	}
+	return response, buttons, true, nil
+}
+
+// EnterStep moves the user to a step, runs its effects with the text the user
+// sent to get there and returns the reply. When the effects take the user back
+// to an interrupted scenario, the reply goes on with the step resumed there; when
+// they end the session, it offers the scenario list.
+func (f *FSM) EnterStep(userID int64, step *storage.FSMScenarioStep, input string) (string, []Button, error) {
+	if err := f.moveTo(userID, storage.StepPosition(step.ScenarioID, step.StepKey)); err != nil {
+		return "", nil, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	response := f.RenderMessage(userID, step.Message)
+	if len(step.Effects) == 0 {
+		return response, f.GenerateButtonsForStep(userID, step, step.ScenarioID), nil
+	}
+
+	f.runEffects(userID, step, input)
+
+	current, err := f.CurrentStep(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if current == nil {
+		// The session ended, or was resumed on a step that no longer exists
+		if err := f.Reset(userID); err != nil {
+			return "", nil, err
+		}
+		buttons, err := f.GetScenariosButtons(userID)
+		if err != nil {
+			log.Printf("Error getting scenarios buttons for user %d: %v", userID, err)
+		}
+		return response, buttons, nil
+	}
+	if current.ScenarioID == step.ScenarioID && current.StepKey == step.StepKey {
+		return response, f.GenerateButtonsForStep(userID, step, step.ScenarioID), nil
 	}
 
-	buttons = f.GenerateButtonsForStep(nextStep, *session.ScenarioID)
-	return nextStep.Message, buttons, true, nil
+	response += "\n\n" + f.RenderMessage(userID, current.Message)
+	return response, f.GenerateButtonsForStep(userID, current, current.ScenarioID), nil
 }
 
 // recognizeScenarioWithAI uses OpenAI-compatible API to recognize the scenario
@@ -171,7 +304,11 @@ func (f *FSM) recognizeScenarioWithAI(message string) (*storage.FSMScenario, err
 	// Prepare scenario descriptions for AI
 	var scenarioDescriptions []string
 	for _, scenario := range scenarios {
-		keywords := strings.Join(scenario.TriggerKeywords, ", ")
+		// The site offer is started by the bot, never by what the user writes
+		if scenario.Name == f.siteOffer {
+			continue
+		}
+		keywords := strings.Join(append(append([]string(nil), scenario.ToolKeywords...), scenario.TriggerKeywords...), ", ")
 		scenarioDescriptions = append(scenarioDescriptions, fmt.Sprintf("%s (%s): %s", scenario.Name, keywords, scenario.Description))
 	}
 
@@ -279,218 +416,127 @@ func (f *FSM) GetFirstStep(scenarioID int) (*storage.FSMScenarioStep, error) {
 	return steps[0], nil
 }
 
+// CurrentStep returns the step the user's session is on, or nil if the user is not in a scenario
+func (f *FSM) CurrentStep(userID int64) (*storage.FSMScenarioStep, error) {
+	session, err := f.storage.GetUserSession(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user session: %w", err)
+	}
+	if session == nil || session.ScenarioID == nil || session.CurrentStepKey == nil {
+		return nil, nil
+	}
+
+	step, err := f.storage.GetFSMScenarioStep(*session.ScenarioID, *session.CurrentStepKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current step: %w", err)
+	}
+	return step, nil
+}
+
 // GenerateButtonsForStep generates buttons for a given step
-func (f *FSM) GenerateButtonsForStep(step *storage.FSMScenarioStep, scenarioID int) []Button {
+func (f *FSM) GenerateButtonsForStep(userID int64, step *storage.FSMScenarioStep, scenarioID int) []Button {
 	var buttons []Button
 
 	switch step.StateType {
 	case "start":
-		// Start states: only problem selection buttons, no back button
-		if step.StepKey == "root" {
-			buttons = f.getProblemButtons(scenarioID)
-		} else {
-			// Fallback to parsing buttons from message content
-			buttons = f.parseButtonsFromMessage(step.Message, scenarioID, step.StepKey)
-		}
-	case "intermediate":
-		// Intermediate states: transition buttons + back button
-		diagnosticButtons := f.getDiagnosticButtons(scenarioID, step.StepKey)
-		if len(diagnosticButtons) > 0 {
-			buttons = diagnosticButtons
-		} else {
+		// Start states: only problem selection buttons
+		buttons = f.getTransitionButtons(userID, scenarioID, step.StepKey)
+		if len(buttons) == 0 {
 			// Fallback to parsing buttons from message content
-			buttons = f.parseButtonsFromMessage(step.Message, scenarioID, step.StepKey)
+			buttons = f.parseButtonsFromMessage(userID, step.Message, scenarioID, step.StepKey)
 		}
-		// Add back button (but not on root step)
-		if step.StepKey != "root" {
-			backButton := Button{
-				Text:         "⬅️ Назад",
-				CallbackData: fmt.Sprintf("back_%d_%s", scenarioID, step.StepKey),
-			}
-			buttons = append(buttons, backButton)
+		// Root problem selection leads back to the scenario list
+		if step.StepKey == "root" {
+			buttons = append(buttons, f.backButton(userID, scenarioID, step.StepKey))
 		}
 	case "final":
 		// Final states: only back button
-		backButton := Button{
-			Text:         "⬅️ Назад",
-			CallbackData: fmt.Sprintf("back_%d_%s", scenarioID, step.StepKey),
-		}
-		buttons = []Button{backButton}
+		buttons = []Button{f.backButton(userID, scenarioID, step.StepKey)}
 	default:
-		// Fallback for undefined state types
-		diagnosticButtons := f.getDiagnosticButtons(scenarioID, step.StepKey)
-		if len(diagnosticButtons) > 0 {
-			buttons = diagnosticButtons
-		} else {
-			buttons = f.parseButtonsFromMessage(step.Message, scenarioID, step.StepKey)
+		// Intermediate (and undefined) states: transition and action buttons + back button
+		buttons = f.getTransitionButtons(userID, scenarioID, step.StepKey)
+		buttons = append(buttons, f.getActionButtons(userID, scenarioID, step.StepKey)...)
+		if len(buttons) == 0 {
+			// Fallback to parsing buttons from message content
+			buttons = f.parseButtonsFromMessage(userID, step.Message, scenarioID, step.StepKey)
 		}
-		// Add back button as fallback (but not on root step)
+		// Add back button (but not on root step)
 		if step.StepKey != "root" {
-			backButton := Button{
-				Text:         "⬅️ Назад",
-				CallbackData: fmt.Sprintf("back_%d_%s", scenarioID, step.StepKey),
-			}
-			buttons = append(buttons, backButton)
+			buttons = append(buttons, f.backButton(userID, scenarioID, step.StepKey))
 		}
 	}
 
 	return buttons
 }
 
-// getProblemButtons generates buttons for problem selection on root step
-func (f *FSM) getProblemButtons(scenarioID int) []Button {
-	steps, err := f.storage.GetFSMScenarioSteps(scenarioID)
+// getTransitionButtons generates buttons from the transitions leaving a step
+func (f *FSM) getTransitionButtons(userID int64, scenarioID int, stepKey string) []Button {
+	transitions, err := f.storage.GetFSMTransitions(scenarioID, stepKey)
 	if err != nil {
+		log.Printf("Error getting transitions for scenario %d, step %s: %v", scenarioID, stepKey, err)
 		return nil
 	}
 
 	var buttons []Button
-	// Find all problem steps (steps that start with problem keywords)
-	problemKeywords := []string{"no_power", "stops_during_work", "vibration_noise", "motor_runs_no_blade", "vibration_inaccurate", "blade_no_move", "vibration_drift", "spins_no_torque", "battery_drains", "uneven_vibration"}
-
-	for _, step := range steps {
-		for _, keyword := range problemKeywords {
-			if strings.HasPrefix(step.StepKey, keyword) && step.StepKey == keyword {
-				// Extract problem description from first line
-				firstLine := strings.Split(step.Message, "\n")[0]
-				// Clean up the description
-				problemText := strings.TrimSpace(strings.Split(firstLine, ".")[0])
-				if strings.HasPrefix(problemText, "Устройство") {
-					problemText = strings.TrimPrefix(problemText, "Устройство ")
-				}
-				if strings.HasPrefix(problemText, "Мотор") {
-					problemText = strings.TrimPrefix(problemText, "Мотор ")
-				}
-				if strings.HasPrefix(problemText, "Полотно") {
-					problemText = strings.TrimPrefix(problemText, "Полотно ")
-				}
-				if strings.HasPrefix(problemText, "Вращается") {
-					problemText = "Вращается, но не крутит"
-				}
-				if strings.HasPrefix(problemText, "Аккумулятор") {
-					problemText = "Аккумулятор быстро садится"
-				}
-				if strings.HasPrefix(problemText, "Неровный") {
-					problemText = "Неровный срез или вибрация"
-				}
-
-				buttons = append(buttons, Button{
-					Text:         problemText,
-					CallbackData: fmt.Sprintf("goto_%d_%s", scenarioID, step.StepKey),
-				})
-				break
-			}
+	for _, transition := range transitions {
+		if transition.Condition != nil && !f.evaluateCondition(userID, *transition.Condition) {
+			continue
 		}
-	}
 
-	// Add back button to problem selection
-	backButton := Button{
-		Text:         "⬅️ Назад",
-		CallbackData: fmt.Sprintf("back_%d_root", scenarioID),
+		buttons = append(buttons, f.gotoButton(userID, scenarioID, stepKey, transition.ToStepKey, transition.ButtonLabel))
 	}
-	buttons = append(buttons, backButton)
 
 	return buttons
 }
 
-// getDiagnosticButtons generates Yes/No buttons for diagnostic questions
-func (f *FSM) getDiagnosticButtons(scenarioID int, currentStepKey string) []Button {
-	steps, err := f.storage.GetFSMScenarioSteps(scenarioID)
-	if err != nil {
-		return nil
+// gotoButton returns a button moving the user from one step of a scenario to another
+func (f *FSM) gotoButton(userID int64, scenarioID int, fromStepKey, toStepKey, text string) Button {
+	return Button{
+		Text: text,
+		CallbackData: f.registerCallback(&storage.CallbackToken{
+			UserID:      userID,
+			Kind:        CallbackGoto,
+			ScenarioID:  scenarioID,
+			FromStepKey: fromStepKey,
+			StepKey:     toStepKey,
+		}),
 	}
+}
 
+// backButton returns the back navigation button for a step
+func (f *FSM) backButton(userID int64, scenarioID int, stepKey string) Button {
+	return Button{
+		Text: "⬅️ Назад",
+		CallbackData: f.registerCallback(&storage.CallbackToken{
+			UserID:      userID,
+			Kind:        CallbackBack,
+			ScenarioID:  scenarioID,
+			FromStepKey: stepKey,
+		}),
+	}
+}
+
+// parseButtonsFromMessage parses buttons from message text; option N of step "x" leads to step "x_N"
+func (f *FSM) parseButtonsFromMessage(userID int64, message string, scenarioID int, stepKey string) []Button {
 	var buttons []Button
-	baseKey := currentStepKey + "_"
-
-	// Look for steps that continue from current step
-	for _, step := range steps {
-		if strings.HasPrefix(step.StepKey, baseKey) {
-			// Determine button text based on suffix
-			suffix := strings.TrimPrefix(step.StepKey, baseKey)
-			var buttonText string
-
-			switch suffix {
-			case "lit", "ok", "yes", "reacts", "turns", "disk_turns":
-				buttonText = "Да"
-			case "dark", "no", "not_ok", "no_reaction", "disk_stuck", "immediately", "hot", "not_hot", "strong_vibration", "grinding_noise", "other_noise":
-				buttonText = "Нет"
-			case "power_ok":
-				buttonText = "Да, работает"
-			case "no_power":
-				buttonText = "Нет, не работает"
-			case "locks_ok":
-				buttonText = "Да, в порядке"
-			case "locks_not_ok":
-				buttonText = "Нет, проблемы"
-			case "belt_ok":
-				buttonText = "Да, целый"
-			case "belt_broken":
-				buttonText = "Нет, повреждён"
-			case "disk_ok":
-				buttonText = "Да, в порядке"
-			case "disk_problem":
-				buttonText = "Нет, проблемы"
-			case "blade_ok":
-				buttonText = "Да, правильно"
-			case "blade_not_ok":
-				buttonText = "Нет, проблемы"
-			case "clutch_ok":
-				buttonText = "Нет, муфта не сработала"
-			case "clutch_triggered":
-				buttonText = "Да, муфта сработала"
-			case "old":
-				buttonText = "Да, старый"
-			case "new":
-				buttonText = "Нет, новый"
-			case "clear":
-				buttonText = "Да, чистый"
-			case "blocked":
-				buttonText = "Нет, заблокирован"
-			case "wheels_ok":
-				buttonText = "Да, одинаково"
-			case "wheels_not_level":
-				buttonText = "Нет, разная высота"
-			default:
-				continue
-			}
 
-			buttons = append(buttons, Button{
-				Text:         buttonText,
-				CallbackData: fmt.Sprintf("goto_%d_%s", scenarioID, step.StepKey),
-			})
-		}
+	for _, option := range parseMessageOptions(message) {
+		buttons = append(buttons, f.gotoButton(userID, scenarioID, stepKey, stepKey+"_"+option.number, option.text))
 	}
 
 	return buttons
 }
 
-// GetPreviousStepKey returns the previous step key for navigation
-func (f *FSM) GetPreviousStepKey(currentStepKey string) string {
-	// For final diagnostic steps, go back to the immediate parent diagnostic step
-	// Remove suffixes to find parent steps
-	if strings.Contains(currentStepKey, "_") {
-		parts := strings.Split(currentStepKey, "_")
-		if len(parts) > 1 {
-			// Remove the last suffix to get parent
-			parentKey := strings.Join(parts[:len(parts)-1], "_")
-
-			// If parent exists and is not root, return it
-			if parentKey != "root" && parentKey != "" {
-				return parentKey
-			}
-		}
-	}
-
-	// Default to root for top-level problem steps
-	return "root"
+// messageOption is a numbered option written in a step message
+type messageOption struct {
+	number string
+	text   string
 }
 
-// parseButtonsFromMessage parses buttons from message text
-func (f *FSM) parseButtonsFromMessage(message string, scenarioID int, stepKey string) []Button {
-	var buttons []Button
+// parseMessageOptions finds numbered options like "1. Option", "2. Option" in message text
+func parseMessageOptions(message string) []messageOption {
+	var options []messageOption
 
-	// Look for numbered options like "1. Option", "2. Option"
 	lines := strings.Split(message, "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -498,165 +544,30 @@ func (f *FSM) parseButtonsFromMessage(message string, scenarioID int, stepKey st
 			// Extract option text
 			parts := strings.SplitN(line, ".", 2)
 			if len(parts) == 2 {
-				text := strings.TrimSpace(parts[1])
-				callbackData := fmt.Sprintf("option_%d_%s_%s", scenarioID, stepKey, parts[0])
-				buttons = append(buttons, Button{
-					Text:         text,
-					CallbackData: callbackData,
-				})
+				options = append(options, messageOption{number: parts[0], text: strings.TrimSpace(parts[1])})
 			}
 		}
 	}
 
-	return buttons
+	return options
 }
 
-// getNextStepButtons gets buttons for next possible steps
-func (f *FSM) getNextStepButtons(scenarioID int, currentStepKey string) []Button {
-	steps, err := f.storage.GetFSMScenarioSteps(scenarioID)
+// getActionButtons generates buttons for the action group of an action-selection step
+func (f *FSM) getActionButtons(userID int64, scenarioID int, stepKey string) []Button {
+	actions, err := f.storage.GetFSMStepActions(scenarioID, stepKey)
 	if err != nil {
+		log.Printf("Error getting actions for scenario %d, step %s: %v", scenarioID, stepKey, err)
 		return nil
 	}
 
 	var buttons []Button
-	for _, step := range steps {
-		if step.StepKey != currentStepKey && step.StepKey != "step1" { // Don't include current or first step
-			buttons = append(buttons, Button{
-				Text:         step.Message[:min(50, len(step.Message))], // Truncate long messages
-				CallbackData: fmt.Sprintf("goto_%d_%s", scenarioID, step.StepKey),
-			})
-		}
+	for _, action := range actions {
+		buttons = append(buttons, f.gotoButton(userID, scenarioID, stepKey, action.ActionStepKey, action.Label))
 	}
 
 	return buttons
 }
 
-// generateActionButtons generates buttons for terminal actions based on the action step
-func (f *FSM) generateActionButtons(scenarioID int, stepKey string) []Button {
-	var buttons []Button
-	actionMap := f.getActionMapping(stepKey)
-
-	for _, actionKey := range actionMap {
-		step, err := f.storage.GetFSMScenarioStep(scenarioID, actionKey)
-		if err != nil {
-			continue
-		}
-		if step != nil {
-			// Extract first line as button text
-			firstLine := strings.Split(step.Message, "\n")[0]
-			if strings.HasPrefix(firstLine, "🔋") || strings.HasPrefix(firstLine, "🔘") ||
-			   strings.HasPrefix(firstLine, "🔌") || strings.HasPrefix(firstLine, "🏪") ||
-			   strings.HasPrefix(firstLine, "🔄") || strings.HasPrefix(firstLine, "❄️") ||
-			   strings.HasPrefix(firstLine, "⚙️") || strings.HasPrefix(firstLine, "🖊️") {
-				// Remove emoji and clean up text for button
-				text := strings.TrimSpace(strings.TrimPrefix(firstLine, strings.Split(firstLine, " ")[0]))
-				buttons = append(buttons, Button{
-					Text:         text,
-					CallbackData: fmt.Sprintf("action_%d_%s", scenarioID, actionKey),
-				})
-			}
-		}
-	}
-
-	return buttons
-}
-
-// getActionMapping returns terminal actions for a given action step
-func (f *FSM) getActionMapping(stepKey string) []string {
-	switch stepKey {
-	case "no_power_action":
-		return []string{
-			"charge_or_replace_battery",
-			"replace_trigger_button",
-			"repair_internal_wiring",
-			"refer_to_service_center",
-		}
-	case "stopped_action":
-		return []string{
-			"restart_after_protection_reset",
-			"restart_after_cooling",
-			"repair_mechanical_drive",
-			"replace_carbon_brushes",
-			"refer_to_service_center",
-		}
-	case "no_power_action_miter":
-		return []string{
-			"restore_power",
-			"replace_power_cable",
-			"disable_safety_lock",
-			"repair_mechanical_drive_miter",
-			"replace_belt",
-			"reinstall_blade",
-			"install_new_blade",
-			"refer_to_service_center",
-		}
-	case "motor_no_blade_action":
-		return []string{
-			"repair_mechanical_drive_miter",
-			"replace_belt",
-		}
-	case "vibration_action":
-		return []string{
-			"reinstall_blade",
-			"install_new_blade",
-			"repair_mechanical_drive_miter",
-		}
-	case "no_power_action_jigsaw":
-		return []string{
-			"restore_power",
-			"replace_trigger_button",
-			"repair_internal_wiring",
-		}
-	case "blade_not_moving_action":
-		return []string{
-			"correctly_install_blade",
-			"repair_reciprocating_mechanism",
-		}
-	case "vibration_drift_action":
-		return []string{
-			"install_new_blade",
-			"repair_mechanical_drive",
-			"tighten_housing",
-		}
-	case "no_power_action_drill":
-		return []string{
-			"charge_or_replace_battery",
-			"service_contact_group",
-			"replace_trigger_button",
-		}
-	case "spins_no_torque_action":
-		return []string{
-			"adjust_torque_setting",
-			"repair_gearbox",
-		}
-	case "battery_drains_action":
-		return []string{
-			"replace_battery_cells",
-			"refer_to_service_center",
-		}
-	case "no_power_action_lawnmower":
-		return []string{
-			"restore_power",
-			"replace_power_cable",
-			"restart_after_cooling",
-		}
-	case "motor_no_blade_action_lawnmower":
-		return []string{
-			"clear_working_area",
-			"replace_belt",
-			"repair_mechanical_drive",
-		}
-	case "uneven_cut_action":
-		return []string{
-			"sharpen_or_replace_blade",
-			"correctly_install_blade",
-			"adjust_cutting_height",
-		}
-	default:
-		return []string{}
-	}
-}
-
 // min returns minimum of two ints
 func min(a, b int) int {
 	if a < b {
@@ -718,34 +629,10 @@ func GetUSHMFinalResponse() string {
 		"Чем ещё могу помочь?"
 }
 
-// GetSiteLinkOfferMessage returns the message offering site link
-func GetSiteLinkOfferMessage() string {
-	return "Хотите подробнее ознакомиться с инструкциями и рекомендациями по эксплуатации? Перейти на сайт?"
-}
-
-// GetEmailRequestMessage returns message requesting email
-func GetEmailRequestMessage() string {
-	return "Отлично! Пожалуйста, укажите ваш email адрес для получения полезной информации об эксплуатации электроинструментов."
-}
-
-// GetEmailConsentMessage returns message for email consent
-func GetEmailConsentMessage() string {
-	return "Разрешаете ли вы получать технические рекомендации и инструкции по эксплуатации на этот email? Это не реклама."
-}
-
-// GetEmailSavedMessage returns message after email is saved
-func GetEmailSavedMessage(siteURL string) string {
-	return "Спасибо! Информация сохранена.\n\nВот ссылка на полезные материалы: " + siteURL
-}
-
-// GetEmailDeclinedMessage returns message when user declines email consent
-func GetEmailDeclinedMessage(siteURL string) string {
-	return "Понял, не будем использовать ваш email.\n\nВот ссылка на полезные материалы: " + siteURL
-}
-
-// GetSiteLinkDeclinedMessage returns message when user declines site link
-func GetSiteLinkDeclinedMessage() string {
-	return "Хорошо, если что — обращайтесь! Всегда рад помочь."
+// GetInvalidInputMessage returns the reply to text a step's input validator rejects
+// when the step sets no input error of its own
+func GetInvalidInputMessage() string {
+	return "Не удалось распознать ответ. Проверьте, пожалуйста, и отправьте ещё раз."
 }
 
 // GetRateLimitMessage returns rate limit exceeded message
@@ -753,29 +640,12 @@ func GetRateLimitMessage() string {
 	return "Пожалуйста, подождите немного. Вы отправляете сообщения слишком часто."
 }
 
-// GetSiteLinkOfferPost returns the message with site link and back button
-func GetSiteLinkOfferPost(siteURL string) string {
-	return "Отличный выбор! Вот ссылка на полезные материалы: " + siteURL + "\n\n⬅️ Назад"
+// GetUnknownButtonMessage returns the toast shown for a button the bot does not recognize
+func GetUnknownButtonMessage() string {
+	return "Эта кнопка больше не действует. Отправьте /start, чтобы начать заново."
 }
 
-// GetScenariosButtons returns buttons for all available scenarios
-func (f *FSM) GetScenariosButtons() ([]Button, error) {
-	scenarios, err := f.storage.GetFSMScenarios()
-	if err != nil {
-		return nil, err
-	}
-
-	var buttons []Button
-	for _, scenario := range scenarios {
-		displayName := scenario.Name
-		if scenario.DisplayName != "" {
-			displayName = scenario.DisplayName
-		}
-		buttons = append(buttons, Button{
-			Text:         displayName,
-			CallbackData: fmt.Sprintf("start_scenario_%d", scenario.ID),
-		})
-	}
-
-	return buttons, nil
+// GetOutdatedMenuMessage returns the toast shown for a button that does not belong to the current step
+func GetOutdatedMenuMessage() string {
+	return "Это меню устарело. Показываю текущий шаг."
 }
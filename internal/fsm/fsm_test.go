@@ -1,13 +1,711 @@
 package fsm
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/scenario"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage/storagetest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-// Note: Tests are disabled since FSM now uses database-driven scenarios
-// TODO: Implement proper integration tests with database setup
+// newTestFSM returns an FSM over an in-memory scenario: root offers two
+// problems, "no_power" leads through "check_cable" to the final "service" step
+func newTestFSM(t *testing.T) (*FSM, *storage.MemoryStorage, int) {
+	t.Helper()
+
+	s := storage.NewMemoryStorage()
+	scenario := &storage.FSMScenario{Name: "grinder", DisplayName: "УШМ", TriggerKeywords: []string{"не включается"}}
+	require.NoError(t, s.CreateFSMScenario(scenario))
+
+	service := "service"
+	for _, step := range []*storage.FSMScenarioStep{
+		{StepKey: "root", Message: "Что случилось?", StateType: "start"},
+		{StepKey: "no_power", Message: "Проверьте кабель", StateType: "intermediate"},
+		{StepKey: "check_cable", Message: "Кабель цел?", NextStepKey: &service, StateType: "intermediate"},
+		{StepKey: "sparks", Message: "Искрит двигатель", StateType: "intermediate"},
+		{StepKey: "service", Message: "Обратитесь в сервис", IsFinal: true, StateType: "final"},
+	} {
+		step.ScenarioID = scenario.ID
+		require.NoError(t, s.CreateFSMScenarioStep(step))
+	}
+
+	for _, transition := range []*storage.FSMTransition{
+		{FromStepKey: "root", ToStepKey: "sparks", ButtonLabel: "Искрит", SortOrder: 2},
+		{FromStepKey: "root", ToStepKey: "no_power", ButtonLabel: "Не включается", SortOrder: 1},
+	} {
+		transition.ScenarioID = scenario.ID
+		require.NoError(t, s.CreateFSMTransition(transition))
+	}
+	require.NoError(t, s.CreateFSMStepAction(&storage.FSMStepAction{
+		ScenarioID: scenario.ID, StepKey: "no_power", ActionStepKey: "check_cable", Label: "Проверить кабель",
+	}))
+
+	return NewFSM(s, false, "", "", ""), s, scenario.ID
+}
+
+func TestProcessMessageStartsScenarioByTrigger(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+
+	response, buttons, handled, err := f.ProcessMessage(1, "болгарка не включается")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, "Что случилось?", response)
+	assert.Equal(t, []string{"Не включается", "Искрит", "⬅️ Назад"}, buttonTexts(buttons))
+	assert.Equal(t, []storage.CallbackToken{
+		{UserID: 1, Kind: CallbackGoto, ScenarioID: scenarioID, FromStepKey: "root", StepKey: "no_power"},
+		{UserID: 1, Kind: CallbackGoto, ScenarioID: scenarioID, FromStepKey: "root", StepKey: "sparks"},
+		{UserID: 1, Kind: CallbackBack, ScenarioID: scenarioID, FromStepKey: "root"},
+	}, resolveButtons(t, f, buttons))
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, scenarioID, *session.ScenarioID)
+	assert.Equal(t, "root", *session.CurrentStepKey)
+
+	_, _, handled, err = f.ProcessMessage(2, "добрый день")
+	require.NoError(t, err)
+	assert.False(t, handled)
+}
+
+func TestProcessMessageOffersMatchingScenarios(t *testing.T) {
+	f, s, grinderID := newTestFSM(t)
+	drill := &storage.FSMScenario{Name: "drill", DisplayName: "Шуруповёрт", TriggerKeywords: []string{"шуруповёрт"}}
+	require.NoError(t, s.CreateFSMScenario(drill))
+	require.NoError(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{
+		ScenarioID: drill.ID, StepKey: "root", Message: "Что с шуруповёртом?", StateType: "start",
+	}))
+
+	// Both keywords match and neither scenario names a tool
+	response, buttons, handled, err := f.ProcessMessage(1, "шуруповёрт не включается")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, GetChooseScenarioMessage(), response)
+	assert.Equal(t, []storage.CallbackToken{
+		{UserID: 1, Kind: CallbackStartScenario, ScenarioID: grinderID},
+		{UserID: 1, Kind: CallbackStartScenario, ScenarioID: drill.ID},
+	}, resolveButtons(t, f, buttons))
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	// A tool keyword outranks a longer symptom keyword
+	drill.TriggerKeywords = []string{}
+	drill.ToolKeywords = []string{"шуруповёрт"}
+	require.NoError(t, s.UpdateFSMScenario(drill))
+
+	response, _, handled, err = f.ProcessMessage(1, "шуруповёрт не включается")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, "Что с шуруповёртом?", response)
+}
+
+func TestProcessMessageToolKeywordWins(t *testing.T) {
+	f, s, grinderID := newTestFSM(t)
+
+	// A category says nothing about whether a keyword names a tool
+	grinders := &storage.Category{Name: "grinders"}
+	require.NoError(t, s.CreateCategory(grinders))
+	grinder, err := s.GetFSMScenario(grinderID)
+	require.NoError(t, err)
+	grinder.CategoryID = &grinders.ID
+	require.NoError(t, s.UpdateFSMScenario(grinder))
+
+	def, err := scenario.Load("../../scenarios/diagnose_jigsaw.yaml")
+	require.NoError(t, err)
+	jigsaw := loadGraph(t, s, def.ToGraph())
+
+	response, _, handled, err := f.ProcessMessage(1, "Лобзик не включается")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, def.Steps[0].Message, response)
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, jigsaw.ID, *session.ScenarioID)
+}
+
+func TestProcessMessageFollowsNextStep(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	storagetest.EnterStep(t, s, 1, scenarioID, "check_cable")
+
+	response, buttons, handled, err := f.ProcessMessage(1, "да")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, "Обратитесь в сервис", response)
+	assert.Equal(t, []string{"⬅️ Назад"}, buttonTexts(buttons))
+	assert.Equal(t, []storage.CallbackToken{
+		{UserID: 1, Kind: CallbackBack, ScenarioID: scenarioID, FromStepKey: "service"},
+	}, resolveButtons(t, f, buttons))
+
+	// Any message on a final step ends the scenario
+	response, _, handled, err = f.ProcessMessage(1, "спасибо")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, "Обратитесь в сервис", response)
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+// staleSessions reports every session as it was when the test captured it
+type staleSessions struct {
+	*storage.MemoryStorage
+	session *storage.UserSession
+}
+
+func (s staleSessions) GetUserSession(int64) (*storage.UserSession, error) {
+	return s.session, nil
+}
+
+func TestStateTransitions(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+
+	state, err := f.GetState(1)
+	require.NoError(t, err)
+	assert.Equal(t, StateIdle, state)
+	require.NoError(t, f.Reset(1), "staying idle is allowed")
+
+	// Entering a scenario and moving between its steps are transitions too
+	_, _, handled, err := f.ProcessMessage(1, "не включается")
+	require.NoError(t, err)
+	require.True(t, handled)
+	state, err = f.GetState(1)
+	require.NoError(t, err)
+	assert.Equal(t, StateInScenario, state)
+
+	require.NoError(t, f.Reset(1))
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	// The final step ends the scenario through the same transition
+	storagetest.EnterStep(t, s, 1, scenarioID, "service")
+	_, _, handled, err = f.ProcessMessage(1, "спасибо")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	state, err = f.GetState(1)
+	require.NoError(t, err)
+	assert.Equal(t, StateIdle, state)
+}
+
+func TestStateTransitionsCompareStep(t *testing.T) {
+	_, s, scenarioID := newTestFSM(t)
+	storagetest.EnterStep(t, s, 1, scenarioID, "root")
+	stale, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	storagetest.EnterStep(t, s, 1, scenarioID, "no_power")
+
+	// A move planned from the root step loses to the one that already left it
+	f := NewFSM(staleSessions{MemoryStorage: s, session: stale}, false, "", "", "")
+	step, err := s.GetFSMScenarioStep(scenarioID, "sparks")
+	require.NoError(t, err)
+	_, _, err = f.EnterStep(1, step, "")
+	assert.ErrorIs(t, err, ErrStateChanged)
+	assert.ErrorIs(t, f.Reset(1), ErrStateChanged)
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, storage.StepPosition(scenarioID, "no_power"), session.Position())
+}
+
+func TestStateTransitionsAreKnown(t *testing.T) {
+	for from, targets := range stateTransitions {
+		for _, to := range targets {
+			_, known := stateTransitions[to]
+			assert.True(t, known, "%s → %s leads to an unknown state", from, to)
+		}
+	}
+	assert.False(t, CanTransition(StateIdle, StateIdle), "idle has nothing to leave")
+	assert.False(t, CanTransition("offering_site_link", StateIdle), "legacy states are gone")
+}
+
+func TestGenerateButtonsForStepWithActions(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	step, err := s.GetFSMScenarioStep(scenarioID, "no_power")
+	require.NoError(t, err)
+
+	buttons := f.GenerateButtonsForStep(1, step, scenarioID)
+	assert.Equal(t, []string{"Проверить кабель", "⬅️ Назад"}, buttonTexts(buttons))
+	assert.Equal(t, []storage.CallbackToken{
+		{UserID: 1, Kind: CallbackGoto, ScenarioID: scenarioID, FromStepKey: "no_power", StepKey: "check_cable"},
+		{UserID: 1, Kind: CallbackBack, ScenarioID: scenarioID, FromStepKey: "no_power"},
+	}, resolveButtons(t, f, buttons))
+}
+
+func TestSiteOfferScenario(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	def, err := scenario.Load("../../scenarios/site_offer.yaml")
+	require.NoError(t, err)
+	offerID := loadGraph(t, s, def.ToGraph()).ID
+	require.NoError(t, s.UpdateSettings(&storage.Settings{TriggerMessageCount: 1, SiteURL: "https://tools.example.com", InterruptScenarios: true}))
+	_, err = s.GetOrCreateUser(1)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateUserMessageCount(1))
+
+	scenarios, err := f.GetScenariosButtons(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"УШМ"}, buttonTexts(scenarios), "the site offer is not in the scenario list")
+
+	// With InterruptScenarios the offer interrupts the scenario the user is in
+	storagetest.EnterStep(t, s, 1, scenarioID, "no_power")
+	response, buttons, offered, err := f.OfferSiteLink(1)
+	require.NoError(t, err)
+	require.True(t, offered)
+	assert.Equal(t, def.Steps[0].Message, response)
+	assert.Equal(t, []string{"Да", "Нет", "📧 Получать рекомендации на email"}, buttonTexts(buttons))
+
+	require.NoError(t, s.UpdateUserMessageCount(1))
+	_, _, offered, err = f.OfferSiteLink(1)
+	require.NoError(t, err)
+	assert.False(t, offered, "the offer is not repeated while it is shown")
+
+	askEmail, err := s.GetFSMScenarioStep(offerID, "ask_email")
+	require.NoError(t, err)
+	_, _, err = f.EnterStep(1, askEmail, "")
+	require.NoError(t, err)
+
+	// Text that is not an email keeps the user on the step
+	response, buttons, handled, err := f.ProcessMessage(1, "не скажу")
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, askEmail.InputError, response)
+	assert.Equal(t, []string{"⬅️ Назад"}, buttonTexts(buttons))
+	step, err := f.CurrentStep(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_email", step.StepKey)
+
+	response, buttons, _, err = f.ProcessMessage(1, " user@example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Разрешаю", "Нет, спасибо", "⬅️ Назад"}, buttonTexts(buttons))
+	user, err := s.GetUser(1)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", user.Email)
+	assert.False(t, user.ConsentGranted)
+
+	// Granting consent ends the offer and resumes the interrupted scenario
+	saved, err := s.GetFSMScenarioStep(offerID, "email_saved")
+	require.NoError(t, err)
+	response, buttons, err = f.EnterStep(1, saved, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Спасибо! Информация сохранена.\n\nВот ссылка на полезные материалы: https://tools.example.com\n\nПроверьте кабель", response)
+	assert.Equal(t, []string{"Проверить кабель", "⬅️ Назад"}, buttonTexts(buttons))
+	user, err = s.GetUser(1)
+	require.NoError(t, err)
+	assert.True(t, user.ConsentGranted)
+	step, err = f.CurrentStep(1)
+	require.NoError(t, err)
+	assert.Equal(t, scenarioID, step.ScenarioID)
+	assert.Equal(t, "no_power", step.StepKey)
+
+	// Without a scenario to return to the offer ends with the scenario list
+	require.NoError(t, f.Reset(1))
+	require.NoError(t, s.UpdateUserMessageCount(1))
+	_, buttons, offered, err = f.OfferSiteLink(1)
+	require.NoError(t, err)
+	require.True(t, offered)
+	assert.Equal(t, []string{"Да", "Нет"}, buttonTexts(buttons), "users who gave consent are not asked again")
+	declined, err := s.GetFSMScenarioStep(offerID, "declined")
+	require.NoError(t, err)
+	response, buttons, err = f.EnterStep(1, declined, "")
+	require.NoError(t, err)
+	assert.Equal(t, declined.Message, response)
+	assert.Equal(t, []string{"УШМ"}, buttonTexts(buttons))
+	state, err := f.GetState(1)
+	require.NoError(t, err)
+	assert.Equal(t, StateIdle, state)
+	user, err = s.GetUser(1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, user.SiteOffersCount)
+	assert.NotNil(t, user.SiteOfferDeclinedAt)
+}
+
+func TestDefaultOfferPolicy(t *testing.T) {
+	now := time.Now()
+	declined := now.Add(-2 * time.Hour)
+	final := &storage.FSMScenarioStep{StepKey: "service", IsFinal: true, StateType: "final"}
+	middle := &storage.FSMScenarioStep{StepKey: "no_power", StateType: "intermediate"}
+	grinder := &storage.FSMScenario{Name: "grinder"}
+
+	tests := []struct {
+		name     string
+		user     storage.User
+		settings storage.Settings
+		scenario *storage.FSMScenario
+		step     *storage.FSMScenarioStep
+		want     bool
+	}{
+		{"idle user below trigger", storage.User{MessageCount: 2}, storage.Settings{TriggerMessageCount: 3}, nil, nil, false},
+		{"idle user at trigger", storage.User{MessageCount: 3}, storage.Settings{TriggerMessageCount: 3}, nil, nil, true},
+		{"middle of scenario", storage.User{MessageCount: 3}, storage.Settings{TriggerMessageCount: 3}, grinder, middle, false},
+		{"middle of scenario with interrupts", storage.User{MessageCount: 3}, storage.Settings{TriggerMessageCount: 3, InterruptScenarios: true}, grinder, middle, true},
+		{"final step", storage.User{MessageCount: 3}, storage.Settings{TriggerMessageCount: 3}, grinder, final, true},
+		{"scenario trigger count", storage.User{MessageCount: 3}, storage.Settings{TriggerMessageCount: 3, ScenarioTriggerCounts: map[string]int{"grinder": 5}}, grinder, final, false},
+		{"other scenario trigger count", storage.User{MessageCount: 1}, storage.Settings{TriggerMessageCount: 3, ScenarioTriggerCounts: map[string]int{"grinder": 1}}, nil, nil, false},
+		{"cooldown", storage.User{MessageCount: 3, SiteOfferDeclinedAt: &declined}, storage.Settings{TriggerMessageCount: 3, OfferCooldownHours: 24}, nil, nil, false},
+		{"cooldown over", storage.User{MessageCount: 3, SiteOfferDeclinedAt: &declined}, storage.Settings{TriggerMessageCount: 3, OfferCooldownHours: 1}, nil, nil, true},
+		{"offer cap", storage.User{MessageCount: 3, SiteOffersCount: 2}, storage.Settings{TriggerMessageCount: 3, MaxOffersPerUser: 2}, nil, nil, false},
+		{"no offer cap", storage.User{MessageCount: 3, SiteOffersCount: 10}, storage.Settings{TriggerMessageCount: 3}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DefaultOfferPolicy{}.ShouldOffer(OfferContext{
+				User: &tt.user, Settings: &tt.settings, Scenario: tt.scenario, Step: tt.step, Now: now,
+			})
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestOfferPolicyIsPluggable(t *testing.T) {
+	f, s, _ := newTestFSM(t)
+	def, err := scenario.Load("../../scenarios/site_offer.yaml")
+	require.NoError(t, err)
+	loadGraph(t, s, def.ToGraph())
+	_, err = s.GetOrCreateUser(1)
+	require.NoError(t, err)
+
+	var seen OfferContext
+	f.SetOfferPolicy(OfferPolicyFunc(func(c OfferContext) bool {
+		seen = c
+		return false
+	}))
+	_, _, offered, err := f.OfferSiteLink(1)
+	require.NoError(t, err)
+	assert.False(t, offered)
+	require.NotNil(t, seen.User)
+	assert.Equal(t, int64(1), seen.User.TelegramID)
+	assert.Nil(t, seen.Step)
+
+	f.SetOfferPolicy(OfferPolicyFunc(func(c OfferContext) bool { return true }))
+	_, _, offered, err = f.OfferSiteLink(1)
+	require.NoError(t, err)
+	assert.True(t, offered)
+}
+
+func TestParseStartPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    StartPayload
+	}{
+		{"JS-650", StartPayload{ProductSKU: "JS-650"}},
+		{"JS-650__grinder", StartPayload{ProductSKU: "JS-650", Scenario: "grinder"}},
+		{"JS_650__grinder__no_power", StartPayload{ProductSKU: "JS_650", Scenario: "grinder", StepKey: "no_power"}},
+		{"JS-650____no_power", StartPayload{ProductSKU: "JS-650", StepKey: "no_power"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseStartPayload(tt.payload))
+			assert.Equal(t, tt.payload, tt.want.String())
+		})
+	}
+}
+
+func TestStartFromPayload(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	_, err := s.GetOrCreateUser(1)
+	require.NoError(t, err)
+	sparks := "sparks"
+	require.NoError(t, s.CreateDeepLink(&storage.DeepLink{Payload: "qr1", ProductSKU: "GWS-750", ScenarioID: &scenarioID, StepKey: &sparks}))
+	require.NoError(t, s.CreateDeepLink(&storage.DeepLink{Payload: "GWS-900", ProductSKU: "GWS-900", ScenarioID: &scenarioID}))
+
+	tests := []struct {
+		name    string
+		payload string
+		sku     string
+		want    string // message of the opened step, empty if none
+	}{
+		{"saved payload", "qr1", "GWS-750", "Искрит двигатель"},
+		{"product default", "GWS-900", "GWS-900", "Что случилось?"},
+		{"step overrides product default", "GWS-900__grinder__no_power", "GWS-900", "Проверьте кабель"},
+		{"scenario in payload", "OTHER__grinder", "OTHER", "Что случилось?"},
+		{"missing step falls back to first", "OTHER__grinder__gone", "OTHER", "Что случилось?"},
+		{"unknown scenario", "OTHER__lawnmower", "OTHER", ""},
+		{"product only", "OTHER", "OTHER", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, f.Reset(1))
+
+			response, _, started, err := f.StartFromPayload(1, tt.payload)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want != "", started)
+			assert.Equal(t, tt.want, response)
+
+			user, err := s.GetUser(1)
+			require.NoError(t, err)
+			assert.Equal(t, tt.payload, user.StartPayload)
+			assert.Equal(t, tt.sku, user.ProductSKU)
+		})
+	}
+}
+
+func TestStartPayloadRunsNoEffects(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	def, err := scenario.Load("../../scenarios/site_offer.yaml")
+	require.NoError(t, err)
+	offerID := loadGraph(t, s, def.ToGraph()).ID
+	require.NoError(t, s.CreateFSMScenario(&storage.FSMScenario{Name: "replace_brushes", TriggerKeywords: []string{}, HiddenFromMenu: true}))
+	require.NoError(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenarioID, StepKey: "consent", Message: "Согласие записано", StateType: "final", IsFinal: true, Effects: []string{"grant_consent"}}))
+	emailSaved := "email_saved"
+	require.NoError(t, s.CreateDeepLink(&storage.DeepLink{Payload: "consent", ProductSKU: "GWS-750", ScenarioID: &offerID, StepKey: &emailSaved}))
+	_, err = s.GetOrCreateUser(1)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateUserEmail(1, "user@example.com", false))
+
+	for _, payload := range []string{
+		"x__site_offer__email_saved",
+		"x__site_offer__declined",
+		"x__site_offer",
+		"x__replace_brushes",
+		"x__grinder__consent",
+		"consent",
+	} {
+		t.Run(payload, func(t *testing.T) {
+			response, buttons, started, err := f.StartFromPayload(1, payload)
+			require.NoError(t, err)
+			assert.False(t, started)
+			assert.Empty(t, response)
+			assert.Empty(t, buttons)
+
+			user, err := s.GetUser(1)
+			require.NoError(t, err)
+			assert.False(t, user.ConsentGranted, "a link must not grant consent")
+			assert.Nil(t, user.SiteOfferDeclinedAt, "a link must not decline the offer")
+			state, err := f.GetState(1)
+			require.NoError(t, err)
+			assert.Equal(t, StateIdle, state)
+		})
+	}
+}
+
+func TestRenderProductPlaceholders(t *testing.T) {
+	f, s, _ := newTestFSM(t)
+	require.NoError(t, s.CreateProduct(&storage.Product{
+		SKU:       "GWS-750",
+		Model:     "GWS 750",
+		Specs:     map[string]string{"brushes": "6x10 мм"},
+		ManualURL: "https://example.com/gws-750.pdf",
+	}))
+	_, err := s.GetOrCreateUser(1)
+	require.NoError(t, err)
+	_, err = s.GetOrCreateUser(2)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateUserStartPayload(1, "GWS-750", "GWS-750"))
+
+	message := "Замените щётки.\nДля вашей модели {product_model} подходят щётки {spec:brushes}.\nМощность: {spec:power}\nИнструкция: {product_manual}"
+
+	assert.Equal(t, "Замените щётки.\nДля вашей модели GWS 750 подходят щётки 6x10 мм.\nИнструкция: https://example.com/gws-750.pdf",
+		f.RenderMessage(1, message))
+	assert.Equal(t, "Замените щётки.", f.RenderMessage(2, message))
+}
+
+func TestScenariosButtonsForProduct(t *testing.T) {
+	f, s, scenarioID := newTestFSM(t)
+	require.NoError(t, s.CreateFSMScenario(&storage.FSMScenario{Name: "saw", DisplayName: "Пила", TriggerKeywords: []string{}}))
+	require.NoError(t, s.CreateProduct(&storage.Product{SKU: "GWS-750", Model: "GWS 750", ScenarioIDs: []int{scenarioID}}))
+	require.NoError(t, s.CreateProduct(&storage.Product{SKU: "NEW-1", Model: "New"}))
+	for _, id := range []int64{1, 2, 3} {
+		_, err := s.GetOrCreateUser(id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.UpdateUserStartPayload(1, "GWS-750", "GWS-750"))
+	require.NoError(t, s.UpdateUserStartPayload(2, "NEW-1", "NEW-1"))
+
+	labels := func(buttons []Button) []string {
+		var texts []string
+		for _, button := range buttons {
+			texts = append(texts, button.Text)
+		}
+		return texts
+	}
+
+	buttons, err := f.GetScenariosButtons(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"УШМ", GetAllScenariosButtonText()}, labels(buttons))
+	token, err := f.ResolveCallback(buttons[1].CallbackData)
+	require.NoError(t, err)
+	assert.Equal(t, CallbackMenu, token.Kind)
+	assert.Equal(t, MenuPage{All: true}.String(), token.Value)
+
+	buttons, err = f.MenuButtons(1, MenuPage{All: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"УШМ", "Пила"}, labels(buttons))
+
+	// A product without linked scenarios does not limit the list
+	for _, userID := range []int64{2, 3} {
+		buttons, err = f.GetScenariosButtons(userID)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"УШМ", "Пила"}, labels(buttons))
+	}
+}
+
+func TestParseMenuPage(t *testing.T) {
+	for _, page := range []MenuPage{{}, {CategoryID: 3, Page: 2}, {Page: 1, All: true}} {
+		parsed, err := ParseMenuPage(page.String())
+		require.NoError(t, err)
+		assert.Equal(t, page, parsed)
+	}
+
+	for _, value := range []string{"", "1", "a:0", "1:-1", "1:0:some", "1:0:all:x"} {
+		_, err := ParseMenuPage(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestMenuButtons(t *testing.T) {
+	f, s, grinderID := newTestFSM(t)
+	f.SetMenuPageSize(2)
+	_, err := s.GetOrCreateUser(1)
+	require.NoError(t, err)
+
+	saws := &storage.Category{Name: "saws", DisplayName: "Пилы", SortOrder: 2}
+	require.NoError(t, s.CreateCategory(saws))
+	grinders := &storage.Category{Name: "grinders", SortOrder: 1}
+	require.NoError(t, s.CreateCategory(grinders))
+	require.NoError(t, s.CreateCategory(&storage.Category{Name: "empty"}))
+
+	grinder, err := s.GetFSMScenario(grinderID)
+	require.NoError(t, err)
+	grinder.CategoryID = &grinders.ID
+	require.NoError(t, s.UpdateFSMScenario(grinder))
+	for _, scenario := range []*storage.FSMScenario{
+		{Name: "jigsaw", DisplayName: "Лобзик", CategoryID: &saws.ID, SortOrder: 3},
+		{Name: "circular_saw", DisplayName: "Дисковая пила", CategoryID: &saws.ID, SortOrder: 2},
+		{Name: "miter_saw", DisplayName: "Торцовочная пила", CategoryID: &saws.ID, SortOrder: 1},
+		{Name: "replace_brushes", DisplayName: "Замена щёток", HiddenFromMenu: true},
+		{Name: "service", DisplayName: "Сервис"},
+		{Name: DefaultSiteOfferScenario},
+	} {
+		scenario.TriggerKeywords = []string{}
+		require.NoError(t, s.CreateFSMScenario(scenario))
+	}
+
+	tests := []struct {
+		name string
+		page MenuPage
+		want []string
+	}{
+		{"top level", MenuPage{}, []string{"grinders", "Пилы", GetNextPageButtonText()}},
+		{"top level last page", MenuPage{Page: 1}, []string{"Сервис", GetPreviousPageButtonText()}},
+		{"category", MenuPage{CategoryID: saws.ID}, []string{"Торцовочная пила", "Дисковая пила", GetNextPageButtonText(), GetCategoriesButtonText()}},
+		{"page past the end", MenuPage{CategoryID: saws.ID, Page: 5}, []string{"Лобзик", GetPreviousPageButtonText(), GetCategoriesButtonText()}},
+		{"empty category", MenuPage{CategoryID: saws.ID + 100}, []string{GetCategoriesButtonText()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buttons, err := f.MenuButtons(1, tt.page)
+			require.NoError(t, err)
+
+			var labels []string
+			for _, button := range buttons {
+				labels = append(labels, button.Text)
+			}
+			assert.Equal(t, tt.want, labels)
+		})
+	}
+
+	// Navigation starts a row of its own and leads to the neighbouring page
+	buttons, err := f.MenuButtons(1, MenuPage{CategoryID: saws.ID})
+	require.NoError(t, err)
+	assert.False(t, buttons[1].NewRow)
+	assert.True(t, buttons[2].NewRow)
+	assert.True(t, buttons[3].NewRow)
+	token, err := f.ResolveCallback(buttons[2].CallbackData)
+	require.NoError(t, err)
+	assert.Equal(t, CallbackMenu, token.Kind)
+	assert.Equal(t, MenuPage{CategoryID: saws.ID, Page: 1}.String(), token.Value)
+}
+
+// countingStorage counts the callback tokens stored
+type countingStorage struct {
+	storage.Storage
+	saved int
+}
+
+func (s *countingStorage) SaveCallbackToken(token *storage.CallbackToken) error {
+	s.saved++
+	return s.Storage.SaveCallbackToken(token)
+}
+
+func TestMenuButtonsStoreVisibleTokensOnly(t *testing.T) {
+	s := &countingStorage{Storage: storage.NewMemoryStorage()}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, s.CreateFSMScenario(&storage.FSMScenario{
+			Name:            fmt.Sprintf("scenario_%d", i),
+			TriggerKeywords: []string{},
+		}))
+	}
+	f := NewFSM(s, false, "", "", "")
+	f.SetMenuPageSize(3)
+
+	buttons, err := f.MenuButtons(1, MenuPage{Page: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"scenario_6", "scenario_7", "scenario_8", GetPreviousPageButtonText(), GetNextPageButtonText()}, buttonTexts(buttons))
+	assert.Equal(t, len(buttons), s.saved)
+}
+
+func TestCallbackTokens(t *testing.T) {
+	f, _, scenarioID := newTestFSM(t)
+
+	scenarios, err := f.GetScenariosButtons(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"УШМ"}, buttonTexts(scenarios))
+	assert.Equal(t, []storage.CallbackToken{
+		{UserID: 1, Kind: CallbackStartScenario, ScenarioID: scenarioID},
+	}, resolveButtons(t, f, scenarios))
+
+	token, err := f.ResolveCallback("goto_1_no_power")
+	require.NoError(t, err)
+	assert.Nil(t, token, "legacy callback data is not a token")
+
+	f.SetCallbackTTL(-time.Minute)
+	expired, err := f.GetScenariosButtons(1)
+	require.NoError(t, err)
+	token, err = f.ResolveCallback(expired[0].CallbackData)
+	require.NoError(t, err)
+	assert.Nil(t, token)
+}
+
+func buttonTexts(buttons []Button) []string {
+	var texts []string
+	for _, button := range buttons {
+		texts = append(texts, button.Text)
+	}
+	return texts
+}
+
+// resolveButtons returns the actions behind token buttons without their random tokens and expiry
+func resolveButtons(t *testing.T, f *FSM, buttons []Button) []storage.CallbackToken {
+	t.Helper()
+
+	var tokens []storage.CallbackToken
+	for _, button := range buttons {
+		assert.LessOrEqual(t, len(button.CallbackData), 64, "Telegram limits callback data to 64 bytes")
+
+		token, err := f.ResolveCallback(button.CallbackData)
+		require.NoError(t, err)
+		require.NotNil(t, token, "button %q", button.Text)
+		assert.Equal(t, button.CallbackData, token.Token)
+		assert.True(t, token.ExpiresAt.After(time.Now()))
+
+		token.Token = ""
+		token.ExpiresAt = time.Time{}
+		tokens = append(tokens, *token)
+	}
+	return tokens
+}
 
 func TestIsValidEmail(t *testing.T) {
 	tests := []struct {
@@ -62,11 +760,8 @@ func TestGetMessages(t *testing.T) {
 	assert.NotEmpty(t, GetUSHMStep1Response())
 	assert.NotEmpty(t, GetUSHMStep2Response())
 	assert.NotEmpty(t, GetUSHMFinalResponse())
-	assert.NotEmpty(t, GetSiteLinkOfferMessage())
-	assert.NotEmpty(t, GetEmailRequestMessage())
-	assert.NotEmpty(t, GetEmailConsentMessage())
-	assert.NotEmpty(t, GetEmailSavedMessage("https://example.com"))
-	assert.NotEmpty(t, GetEmailDeclinedMessage("https://example.com"))
-	assert.NotEmpty(t, GetSiteLinkDeclinedMessage())
+	assert.NotEmpty(t, GetInvalidInputMessage())
 	assert.NotEmpty(t, GetRateLimitMessage())
+	assert.NotEmpty(t, GetUnknownButtonMessage())
+	assert.NotEmpty(t, GetOutdatedMenuMessage())
 }
@@ -0,0 +1,259 @@
+package fsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// DefaultMenuPageSize is how many scenarios or categories a page of the menu lists
+const DefaultMenuPageSize = 8
+
+// MenuPage identifies a page of the scenario menu
+type MenuPage struct {
+	// CategoryID is the category whose scenarios are listed, 0 for the top level
+	CategoryID int
+	// Page counts from 0
+	Page int
+	// All lists every scenario even when the user's product limits the menu
+	All bool
+}
+
+// String encodes the page as the value of a menu button token
+func (p MenuPage) String() string {
+	value := fmt.Sprintf("%d:%d", p.CategoryID, p.Page)
+	if p.All {
+		value += ":all"
+	}
+	return value
+}
+
+// ParseMenuPage decodes a page encoded with MenuPage.String
+func ParseMenuPage(value string) (MenuPage, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 || len(parts) == 3 && parts[2] != "all" {
+		return MenuPage{}, fmt.Errorf("invalid menu page %q", value)
+	}
+
+	categoryID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return MenuPage{}, fmt.Errorf("invalid menu page category %q: %w", parts[0], err)
+	}
+	page, err := strconv.Atoi(parts[1])
+	if err != nil || page < 0 {
+		return MenuPage{}, fmt.Errorf("invalid menu page number %q", parts[1])
+	}
+	return MenuPage{CategoryID: categoryID, Page: page, All: len(parts) == 3}, nil
+}
+
+// menuEntry is an entry of the scenario menu: a scenario to start or a page of
+// the menu to show. Entries become buttons only once paged, so callback tokens
+// are stored for the visible ones only.
+type menuEntry struct {
+	label    string
+	scenario *storage.FSMScenario
+	page     MenuPage
+}
+
+// SetMenuPageSize sets how many entries a page of the scenario menu lists
+func (f *FSM) SetMenuPageSize(size int) {
+	if size > 0 {
+		f.menuPageSize = size
+	}
+}
+
+// GetScenariosButtons returns the first page of the scenario menu for a user
+func (f *FSM) GetScenariosButtons(userID int64) ([]Button, error) {
+	return f.MenuButtons(userID, MenuPage{})
+}
+
+// MenuButtons returns a page of the scenario menu. Hidden scenarios and the site
+// offer are never listed. The top level lists the categories that have scenarios
+// to show, then the scenarios without a category; a category page lists its
+// scenarios. A user who came with a catalog product gets the scenarios linked to
+// it instead of the top level, followed by a button showing the whole menu.
+// Pages past the end show the last page, since scenarios may have been removed
+// since the buttons were sent.
+func (f *FSM) MenuButtons(userID int64, page MenuPage) ([]Button, error) {
+	scenarios, err := f.storage.GetFSMScenarios()
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []*storage.FSMScenario
+	for _, scenario := range scenarios {
+		if !scenario.HiddenFromMenu && scenario.Name != f.siteOffer {
+			listed = append(listed, scenario)
+		}
+	}
+
+	var entries, footer []menuEntry
+	if page.CategoryID == 0 && !page.All {
+		if only := f.productScenarios(userID); only != nil {
+			for _, scenario := range listed {
+				if only[scenario.ID] {
+					entries = append(entries, scenarioEntry(scenario))
+				}
+			}
+			if len(entries) > 0 {
+				footer = append(footer, menuEntry{label: GetAllScenariosButtonText(), page: MenuPage{All: true}})
+			}
+		}
+	}
+
+	switch {
+	case len(entries) > 0:
+		// The scenarios of the user's product
+	case page.CategoryID != 0:
+		for _, scenario := range listed {
+			if scenario.CategoryID != nil && *scenario.CategoryID == page.CategoryID {
+				entries = append(entries, scenarioEntry(scenario))
+			}
+		}
+		footer = append(footer, menuEntry{label: GetCategoriesButtonText(), page: MenuPage{All: page.All}})
+	default:
+		entries, err = f.topLevelEntries(listed, page.All)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buttons := f.pageButtons(userID, entries, page)
+	for _, entry := range footer {
+		button := f.entryButton(userID, entry)
+		button.NewRow = true
+		buttons = append(buttons, button)
+	}
+	return buttons, nil
+}
+
+// topLevelEntries returns an entry for each category with scenarios in listed,
+// in category order, followed by the listed scenarios without a category
+func (f *FSM) topLevelEntries(listed []*storage.FSMScenario, all bool) ([]menuEntry, error) {
+	used := make(map[int]bool)
+	for _, scenario := range listed {
+		if scenario.CategoryID != nil {
+			used[*scenario.CategoryID] = true
+		}
+	}
+
+	var entries []menuEntry
+	if len(used) > 0 {
+		categories, err := f.storage.GetCategories()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get categories: %w", err)
+		}
+		for _, category := range categories {
+			if !used[category.ID] {
+				continue
+			}
+			label := category.Name
+			if category.DisplayName != "" {
+				label = category.DisplayName
+			}
+			entries = append(entries, menuEntry{label: label, page: MenuPage{CategoryID: category.ID, All: all}})
+		}
+	}
+
+	for _, scenario := range listed {
+		if scenario.CategoryID == nil {
+			entries = append(entries, scenarioEntry(scenario))
+		}
+	}
+	return entries, nil
+}
+
+// pageButtons returns the buttons for the entries of a page followed by a row
+// with the buttons leading to the previous and next pages
+func (f *FSM) pageButtons(userID int64, entries []menuEntry, page MenuPage) []Button {
+	pages := (len(entries) + f.menuPageSize - 1) / f.menuPageSize
+	if page.Page >= pages {
+		page.Page = max(pages-1, 0)
+	}
+
+	start := page.Page * f.menuPageSize
+	end := min(start+f.menuPageSize, len(entries))
+	buttons := make([]Button, 0, end-start)
+	for _, entry := range entries[start:end] {
+		buttons = append(buttons, f.entryButton(userID, entry))
+	}
+
+	var navigation []Button
+	if page.Page > 0 {
+		previous := page
+		previous.Page--
+		navigation = append(navigation, f.menuButton(userID, GetPreviousPageButtonText(), previous))
+	}
+	if page.Page < pages-1 {
+		next := page
+		next.Page++
+		navigation = append(navigation, f.menuButton(userID, GetNextPageButtonText(), next))
+	}
+	if len(navigation) > 0 {
+		navigation[0].NewRow = true
+	}
+	return append(buttons, navigation...)
+}
+
+// scenarioEntry returns the menu entry starting a scenario
+func scenarioEntry(scenario *storage.FSMScenario) menuEntry {
+	label := scenario.Name
+	if scenario.DisplayName != "" {
+		label = scenario.DisplayName
+	}
+	return menuEntry{label: label, scenario: scenario}
+}
+
+// entryButton returns the button for a menu entry, storing its callback token
+func (f *FSM) entryButton(userID int64, entry menuEntry) Button {
+	if entry.scenario != nil {
+		return f.scenarioButton(userID, entry.label, entry.scenario)
+	}
+	return f.menuButton(userID, entry.label, entry.page)
+}
+
+// scenarioButton returns a button starting a scenario
+func (f *FSM) scenarioButton(userID int64, label string, scenario *storage.FSMScenario) Button {
+	return Button{
+		Text: label,
+		CallbackData: f.registerCallback(&storage.CallbackToken{
+			UserID:     userID,
+			Kind:       CallbackStartScenario,
+			ScenarioID: scenario.ID,
+		}),
+	}
+}
+
+// menuButton returns a button showing a page of the menu
+func (f *FSM) menuButton(userID int64, label string, page MenuPage) Button {
+	return Button{
+		Text: label,
+		CallbackData: f.registerCallback(&storage.CallbackToken{
+			UserID: userID,
+			Kind:   CallbackMenu,
+			Value:  page.String(),
+		}),
+	}
+}
+
+// GetAllScenariosButtonText returns the label of the button that shows the menu for every tool
+func GetAllScenariosButtonText() string {
+	return "🔧 Другой инструмент"
+}
+
+// GetCategoriesButtonText returns the label of the button leading from a category back to the top of the menu
+func GetCategoriesButtonText() string {
+	return "⬅️ Все инструменты"
+}
+
+// GetPreviousPageButtonText returns the label of the button showing the previous page of the menu
+func GetPreviousPageButtonText() string {
+	return "◀️ Предыдущие"
+}
+
+// GetNextPageButtonText returns the label of the button showing the next page of the menu
+func GetNextPageButtonText() string {
+	return "Следующие ▶️"
+}
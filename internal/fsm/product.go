@@ -0,0 +1,100 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// productPlaceholder matches the placeholders filled from the user's product:
+// {product_model}, {product_sku}, {product_manual} and {spec:<name>}
+var productPlaceholder = regexp.MustCompile(`\{(product_model|product_sku|product_manual|spec:[^{}]+)\}`)
+
+// userProduct returns the catalog product the user came with, or nil if the
+// user has none or its SKU is not in the catalog
+func (f *FSM) userProduct(userID int64) (*storage.Product, error) {
+	user, err := f.storage.GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user == nil || user.ProductSKU == "" {
+		return nil, nil
+	}
+
+	product, err := f.storage.GetProductBySKU(user.ProductSKU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+	return product, nil
+}
+
+// renderProduct fills the product placeholders of a message. A line with a
+// placeholder that has no value (no product, no manual, unknown spec) is
+// dropped, so "Для вашей модели {product_model} ..." lines only show up for
+// users who came with a known product.
+func (f *FSM) renderProduct(userID int64, message string) string {
+	if !productPlaceholder.MatchString(message) {
+		return message
+	}
+
+	product, err := f.userProduct(userID)
+	if err != nil {
+		log.Printf("Error getting product of user %d to render message: %v", userID, err)
+	}
+
+	lines := strings.Split(message, "\n")
+	rendered := lines[:0]
+	for _, line := range lines {
+		complete := true
+		line = productPlaceholder.ReplaceAllStringFunc(line, func(placeholder string) string {
+			value := productValue(product, placeholder[1:len(placeholder)-1])
+			if value == "" {
+				complete = false
+			}
+			return value
+		})
+		if complete {
+			rendered = append(rendered, line)
+		}
+	}
+	return strings.Join(rendered, "\n")
+}
+
+// productValue returns the value of a product placeholder name, empty if there is none
+func productValue(product *storage.Product, name string) string {
+	if product == nil {
+		return ""
+	}
+	switch name {
+	case "product_model":
+		return product.Model
+	case "product_sku":
+		return product.SKU
+	case "product_manual":
+		return product.ManualURL
+	default:
+		return product.Specs[strings.TrimPrefix(name, "spec:")]
+	}
+}
+
+// productScenarios returns the IDs of the scenarios that apply to the user's
+// product, or nil when the user has no product or it is not linked to any scenario
+func (f *FSM) productScenarios(userID int64) map[int]bool {
+	product, err := f.userProduct(userID)
+	if err != nil {
+		log.Printf("Error getting product of user %d for the scenario list: %v", userID, err)
+		return nil
+	}
+	if product == nil || len(product.ScenarioIDs) == 0 {
+		return nil
+	}
+
+	scenarioIDs := make(map[int]bool, len(product.ScenarioIDs))
+	for _, id := range product.ScenarioIDs {
+		scenarioIDs[id] = true
+	}
+	return scenarioIDs
+}
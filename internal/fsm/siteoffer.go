@@ -0,0 +1,177 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// DefaultSiteOfferScenario is the name of the scenario that offers the site link
+const DefaultSiteOfferScenario = "site_offer"
+
+// OfferContext is what an offer policy decides on
+type OfferContext struct {
+	User     *storage.User
+	Settings *storage.Settings
+	// Scenario and Step are where the user is, nil when the user is not in a scenario
+	Scenario *storage.FSMScenario
+	Step     *storage.FSMScenarioStep
+	Now      time.Time
+}
+
+// OfferPolicy decides whether the site link is offered to a user now
+type OfferPolicy interface {
+	ShouldOffer(c OfferContext) bool
+}
+
+// OfferPolicyFunc lets an ordinary function be used as an OfferPolicy
+type OfferPolicyFunc func(c OfferContext) bool
+
+// ShouldOffer calls fn(c)
+func (fn OfferPolicyFunc) ShouldOffer(c OfferContext) bool {
+	return fn(c)
+}
+
+// DefaultOfferPolicy offers the site link once the user has sent enough
+// messages, following the offer settings:
+//   - a scenario is not interrupted unless InterruptScenarios is set; the
+//     offer waits for its final step, or for the user to leave it;
+//   - no offer for OfferCooldownHours after the user declines one;
+//   - no more than MaxOffersPerUser offers per user;
+//   - ScenarioTriggerCounts overrides TriggerMessageCount in the named scenarios.
+type DefaultOfferPolicy struct{}
+
+// ShouldOffer implements OfferPolicy
+func (DefaultOfferPolicy) ShouldOffer(c OfferContext) bool {
+	settings := c.Settings
+	if settings.MaxOffersPerUser > 0 && c.User.SiteOffersCount >= settings.MaxOffersPerUser {
+		return false
+	}
+	if declinedAt := c.User.SiteOfferDeclinedAt; declinedAt != nil {
+		cooldown := time.Duration(settings.OfferCooldownHours) * time.Hour
+		if c.Now.Before(declinedAt.Add(cooldown)) {
+			return false
+		}
+	}
+	if c.Step != nil && !c.Step.IsFinal && !settings.InterruptScenarios {
+		return false
+	}
+
+	triggerCount := settings.TriggerMessageCount
+	if c.Scenario != nil {
+		if count, ok := settings.ScenarioTriggerCounts[c.Scenario.Name]; ok {
+			triggerCount = count
+		}
+	}
+	return c.User.MessageCount >= triggerCount
+}
+
+// SetOfferPolicy replaces the policy deciding when the site link is offered
+func (f *FSM) SetOfferPolicy(policy OfferPolicy) {
+	f.offerPolicy = policy
+}
+
+// SetSiteOfferScenario sets the name of the scenario started to offer the site link.
+// The scenario is not shown in the scenario list.
+func (f *FSM) SetSiteOfferScenario(name string) {
+	f.siteOffer = name
+}
+
+// OfferSiteLink starts the site offer scenario if the offer policy allows it
+// now and returns its first step. An offer made on a final step ends that
+// scenario first; one made in the middle of a scenario returns to it afterwards.
+func (f *FSM) OfferSiteLink(userID int64) (response string, buttons []Button, offered bool, err error) {
+	c, err := f.offerContext(userID)
+	if err != nil || c == nil {
+		return "", nil, false, err
+	}
+	if c.Scenario != nil && c.Scenario.Name == f.siteOffer {
+		return "", nil, false, nil
+	}
+	if !f.offerPolicy.ShouldOffer(*c) {
+		return "", nil, false, nil
+	}
+
+	scenario, err := f.siteOfferScenario()
+	if err != nil {
+		return "", nil, false, err
+	}
+	if scenario == nil {
+		log.Printf("Site offer scenario %q not found", f.siteOffer)
+		return "", nil, false, nil
+	}
+
+	step, err := f.GetFirstStep(scenario.ID)
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to get first step: %w", err)
+	}
+	if step == nil {
+		return "", nil, false, nil
+	}
+
+	if c.Step != nil && c.Step.IsFinal {
+		if err := f.Reset(userID); err != nil {
+			return "", nil, false, err
+		}
+	}
+	if err := f.storage.RecordSiteOffer(userID); err != nil {
+		return "", nil, false, err
+	}
+
+	response, buttons, err = f.EnterStep(userID, step, "")
+	if err != nil {
+		return "", nil, false, err
+	}
+	return response, buttons, true, nil
+}
+
+// offerContext collects what the offer policy decides on, or returns nil for an unknown user
+func (f *FSM) offerContext(userID int64) (*OfferContext, error) {
+	user, err := f.storage.GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	settings, err := f.storage.GetSettings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settings: %w", err)
+	}
+
+	c := &OfferContext{User: user, Settings: settings, Now: time.Now()}
+
+	c.Step, err = f.CurrentStep(userID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Step != nil {
+		c.Scenario, err = f.storage.GetFSMScenario(c.Step.ScenarioID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get scenario: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// siteOfferScenario returns the site offer scenario, or nil if it does not exist
+func (f *FSM) siteOfferScenario() (*storage.FSMScenario, error) {
+	return f.scenarioByName(f.siteOffer)
+}
+
+// scenarioByName returns the scenario with the given name, or nil if there is none
+func (f *FSM) scenarioByName(name string) (*storage.FSMScenario, error) {
+	scenarios, err := f.storage.GetFSMScenarios()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenarios: %w", err)
+	}
+	for _, scenario := range scenarios {
+		if scenario.Name == name {
+			return scenario, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,93 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// State is the state of a user's conversation with the bot
+type State string
+
+const (
+	StateIdle       State = storage.SessionStateIdle
+	StateInScenario State = storage.SessionStateInScenario
+)
+
+// stateTransitions lists the states each state may move to. Every change of a
+// conversation goes through it: EnterStep moves into a scenario or on to
+// another step, and Reset and the end of a scenario return to idle. The site
+// offer and email capture are scenarios too, so they need no states of their own.
+var stateTransitions = map[State][]State{
+	StateIdle:       {StateInScenario},
+	StateInScenario: {StateInScenario, StateIdle},
+}
+
+// ErrInvalidTransition is returned when a state may not move to the requested state
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// ErrStateChanged is returned when the state changed while a transition was being made
+var ErrStateChanged = errors.New("state changed concurrently")
+
+// CanTransition reports whether a conversation may move from one state to another
+func CanTransition(from, to State) bool {
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GetState returns the state of the user's conversation
+func (f *FSM) GetState(userID int64) (State, error) {
+	session, err := f.storage.GetUserSession(userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user session: %w", err)
+	}
+	return State(session.Position().State), nil
+}
+
+// moveTo moves the user's conversation to another position. The storage only
+// applies the move if the conversation is still in the state and at the step
+// read here, so concurrent updates of one user cannot both win. Staying idle
+// is a no-op.
+func (f *FSM) moveTo(userID int64, to storage.SessionPosition) error {
+	session, err := f.storage.GetUserSession(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user session: %w", err)
+	}
+	from := session.Position()
+	if from.State == storage.SessionStateIdle && to.State == storage.SessionStateIdle {
+		return nil
+	}
+	if !CanTransition(State(from.State), State(to.State)) {
+		return fmt.Errorf("failed to move user %d from %s to %s: %w", userID, from.State, to.State, ErrInvalidTransition)
+	}
+
+	changed, err := f.storage.SetUserSessionState(userID, from, to)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return fmt.Errorf("failed to move user %d from %s to %s: %w", userID, from.State, to.State, ErrStateChanged)
+	}
+	return nil
+}
+
+// leaveScenario ends the scenario the user is in, returning the conversation to idle
+func (f *FSM) leaveScenario(userID int64) {
+	if err := f.Reset(userID); err != nil {
+		log.Printf("Error ending scenario for user %d: %v", userID, err)
+	}
+}
+
+// Reset returns the user's conversation to idle, leaving any scenario
+func (f *FSM) Reset(userID int64) error {
+	if err := f.moveTo(userID, storage.IdlePosition); err != nil {
+		return fmt.Errorf("failed to reset conversation: %w", err)
+	}
+	return nil
+}
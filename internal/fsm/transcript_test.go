@@ -0,0 +1,317 @@
+package fsm
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/migrate"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/scenario"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/ZorinIvanA/tgbot-electro-tools/migrations"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite golden transcripts in testdata/transcripts")
+
+const transcriptUserID = 1
+
+// TestScenarioTranscripts walks every path through the seeded scenarios and
+// compares what the user would see with testdata/transcripts. After an
+// intended change of scenario wording or structure, regenerate them with
+//
+//	go test ./internal/fsm -run TestScenarioTranscripts -update
+//
+// and review the diff.
+func TestScenarioTranscripts(t *testing.T) {
+	files, err := filepath.Glob("../../scenarios/*.yaml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	// All scenarios share one storage, so trigger keywords compete like in production
+	s := storage.NewMemoryStorage()
+	var scenarios []*storage.FSMScenario
+	for _, file := range files {
+		def, err := scenario.Load(file)
+		require.NoError(t, err)
+		scenarios = append(scenarios, loadGraph(t, s, def.ToGraph()))
+	}
+	f := NewFSM(s, false, "", "", "")
+
+	for _, sc := range scenarios {
+		t.Run(sc.Name, func(t *testing.T) {
+			got := renderTranscript(t, f, s, sc)
+			golden := filepath.Join("testdata", "transcripts", sc.Name+".txt")
+
+			if *update {
+				require.NoError(t, os.MkdirAll(filepath.Dir(golden), 0o755))
+				require.NoError(t, os.WriteFile(golden, []byte(got), 0o644))
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err, "run with -update to create the golden file")
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
+
+// TestScenarioFilesMatchMigrations checks that scenarios/*.yaml, which the
+// transcripts are rendered from, is what migrations/ seed, so the transcripts
+// show what users of a freshly migrated bot see. The migrations run into a
+// scratch schema. It is skipped unless TEST_DB_NAME names a PostgreSQL
+// database; the other connection parameters come from the usual DB_* variables.
+func TestScenarioFilesMatchMigrations(t *testing.T) {
+	dbname := os.Getenv("TEST_DB_NAME")
+	if dbname == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+
+	host, port := getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432")
+	user, password := getEnv("DB_USER", "postgres"), getEnv("DB_PASSWORD", "postgres")
+	sslmode := getEnv("DB_SSLMODE", "disable")
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		host, port, user, password, dbname, sslmode)
+
+	admin, err := sql.Open("postgres", connStr)
+	require.NoError(t, err)
+	defer admin.Close()
+	schema := fmt.Sprintf("scenario_seed_%d", time.Now().UnixNano())
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	defer func() {
+		_, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		assert.NoError(t, err)
+	}()
+
+	// Connections opened from here on, the storage's included, use the scratch schema
+	t.Setenv("PGOPTIONS", "-c search_path="+schema)
+	db, err := sql.Open("postgres", connStr)
+	require.NoError(t, err)
+	defer db.Close()
+	all, err := migrate.Load(migrations.FS)
+	require.NoError(t, err)
+	require.NoError(t, migrate.NewMigrator(db, all).Up(context.Background(), 0))
+
+	s, err := storage.NewPostgresStorage(host, port, user, password, dbname, sslmode)
+	require.NoError(t, err)
+	defer s.Close()
+
+	seeded, err := s.GetFSMScenarios()
+	require.NoError(t, err)
+	files, err := filepath.Glob("../../scenarios/*.yaml")
+	require.NoError(t, err)
+
+	var seededNames, fileNames []string
+	for _, sc := range seeded {
+		seededNames = append(seededNames, sc.Name)
+	}
+	for _, file := range files {
+		def, err := scenario.Load(file)
+		require.NoError(t, err)
+		fileNames = append(fileNames, def.Name)
+
+		for _, sc := range seeded {
+			if sc.Name != def.Name {
+				continue
+			}
+			graph, err := s.GetFSMScenarioGraph(sc.ID)
+			require.NoError(t, err)
+			assert.Empty(t, scenario.Diff(scenario.FromGraph(graph), def), "%s differs from the migrated scenario", file)
+		}
+	}
+	assert.ElementsMatch(t, seededNames, fileNames, "every seeded scenario has a file and every file is seeded")
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// loadGraph stores a scenario graph and returns the created scenario
+func loadGraph(t *testing.T, s storage.Storage, graph *storage.FSMScenarioGraph) *storage.FSMScenario {
+	t.Helper()
+
+	require.NoError(t, s.CreateFSMScenario(graph.Scenario))
+	for _, step := range graph.Steps {
+		step.ScenarioID = graph.Scenario.ID
+		require.NoError(t, s.CreateFSMScenarioStep(step))
+	}
+	for _, transition := range graph.Transitions {
+		transition.ScenarioID = graph.Scenario.ID
+		require.NoError(t, s.CreateFSMTransition(transition))
+	}
+	for _, action := range graph.Actions {
+		action.ScenarioID = graph.Scenario.ID
+		require.NoError(t, s.CreateFSMStepAction(action))
+	}
+	return graph.Scenario
+}
+
+// transcript renders the conversation tree of one scenario
+type transcript struct {
+	t        *testing.T
+	f        *FSM
+	s        storage.Storage
+	scenario *storage.FSMScenario
+	sb       strings.Builder
+	rendered map[string]bool
+}
+
+func renderTranscript(t *testing.T, f *FSM, s storage.Storage, sc *storage.FSMScenario) string {
+	tr := &transcript{t: t, f: f, s: s, scenario: sc, rendered: make(map[string]bool)}
+
+	fmt.Fprintf(&tr.sb, "# %s (%s)\n\n", sc.DisplayName, sc.Name)
+
+	for _, keyword := range append(append([]string(nil), sc.TriggerKeywords...), sc.ToolKeywords...) {
+		response, _, handled, err := f.ProcessMessage(transcriptUserID, keyword)
+		require.NoError(t, err)
+		require.NoError(t, s.DeleteUserSession(transcriptUserID))
+
+		switch {
+		case !handled:
+			fmt.Fprintf(&tr.sb, "trigger %q: not recognized\n", keyword)
+		case tr.stepKeyByMessage(response) == "":
+			fmt.Fprintf(&tr.sb, "trigger %q: starts another scenario\n", keyword)
+		default:
+			fmt.Fprintf(&tr.sb, "trigger %q: %s\n", keyword, tr.stepKeyByMessage(response))
+		}
+	}
+	tr.sb.WriteString("\n")
+
+	first, err := f.GetFirstStep(sc.ID)
+	require.NoError(t, err)
+	if first == nil {
+		tr.sb.WriteString("!! scenario has no steps\n")
+		return tr.sb.String()
+	}
+
+	tr.renderStep(first, 0, nil)
+
+	// Steps no path reaches are listed so that a removed button shows up in the
+	// diff, and fail the test: a user can never see them
+	steps, err := s.GetFSMScenarioSteps(sc.ID)
+	require.NoError(t, err)
+	var unreachable []string
+	for _, step := range steps {
+		if !tr.rendered[step.StepKey] {
+			unreachable = append(unreachable, step.StepKey)
+		}
+	}
+	if len(unreachable) > 0 {
+		fmt.Fprintf(&tr.sb, "\nunreachable: %s\n", strings.Join(unreachable, ", "))
+	}
+	assert.Empty(t, unreachable, "steps of %s no button leads to", sc.Name)
+	return tr.sb.String()
+}
+
+// renderStep prints a step with its buttons and descends into every button
+// the first time the step is seen; later visits refer back to it
+func (tr *transcript) renderStep(step *storage.FSMScenarioStep, depth int, path []string) {
+	indent := strings.Repeat("    ", depth)
+
+	for _, key := range path {
+		if key == step.StepKey {
+			fmt.Fprintf(&tr.sb, "%s↺ %s\n", indent, step.StepKey)
+			return
+		}
+	}
+	if tr.rendered[step.StepKey] {
+		fmt.Fprintf(&tr.sb, "%s→ %s (see above)\n", indent, step.StepKey)
+		return
+	}
+	tr.rendered[step.StepKey] = true
+	path = append(path, step.StepKey)
+
+	kind := step.StateType
+	if step.IsFinal {
+		kind += ", is_final"
+	}
+	fmt.Fprintf(&tr.sb, "%s[%s] (%s)\n", indent, step.StepKey, kind)
+	for _, line := range strings.Split(step.Message, "\n") {
+		// No trailing spaces, so editors stripping them don't break the golden files
+		fmt.Fprintf(&tr.sb, "%s\n", strings.TrimRight(indent+"  | "+line, " "))
+	}
+
+	if len(step.Effects) > 0 {
+		fmt.Fprintf(&tr.sb, "%s  effects: %s\n", indent, strings.Join(step.Effects, ", "))
+	}
+
+	buttons := tr.f.GenerateButtonsForStep(transcriptUserID, step, tr.scenario.ID)
+	var labels []string
+	for _, button := range buttons {
+		labels = append(labels, "["+button.Text+"]")
+	}
+	if len(labels) > 0 {
+		fmt.Fprintf(&tr.sb, "%s  buttons: %s\n", indent, strings.Join(labels, " "))
+	}
+
+	followed := false
+	for _, button := range buttons {
+		key, ok := tr.buttonTarget(button.CallbackData)
+		if !ok {
+			continue
+		}
+		followed = true
+		fmt.Fprintf(&tr.sb, "%s  > %s\n", indent, button.Text)
+		tr.renderTarget(key, depth+1, path)
+	}
+
+	if !step.IsFinal && step.NextStepKey != nil {
+		followed = true
+		if step.Input != "" {
+			fmt.Fprintf(&tr.sb, "%s  > (valid %s; otherwise %q)\n", indent, step.Input, step.InputError)
+		} else {
+			fmt.Fprintf(&tr.sb, "%s  > (any message)\n", indent)
+		}
+		tr.renderTarget(*step.NextStepKey, depth+1, path)
+	}
+
+	if !followed && !step.IsFinal && step.StateType != "final" {
+		fmt.Fprintf(&tr.sb, "%s  !! dead end: no way forward from a non-final step\n", indent)
+	}
+}
+
+func (tr *transcript) renderTarget(stepKey string, depth int, path []string) {
+	step, err := tr.s.GetFSMScenarioStep(tr.scenario.ID, stepKey)
+	require.NoError(tr.t, err)
+	if step == nil {
+		fmt.Fprintf(&tr.sb, "%s!! step %q does not exist\n", strings.Repeat("    ", depth), stepKey)
+		return
+	}
+	tr.renderStep(step, depth, path)
+}
+
+// stepKeyByMessage finds the step of this scenario that sends message
+func (tr *transcript) stepKeyByMessage(message string) string {
+	steps, err := tr.s.GetFSMScenarioSteps(tr.scenario.ID)
+	require.NoError(tr.t, err)
+	for _, step := range steps {
+		if step.Message == message {
+			return step.StepKey
+		}
+	}
+	return ""
+}
+
+// buttonTarget returns the step a forward button leads to; back buttons have none
+func (tr *transcript) buttonTarget(callbackData string) (string, bool) {
+	token, err := tr.f.ResolveCallback(callbackData)
+	require.NoError(tr.t, err)
+	require.NotNil(tr.t, token, "callback data %q", callbackData)
+	if token.Kind != CallbackGoto {
+		return "", false
+	}
+	return token.StepKey, true
+}
@@ -0,0 +1,35 @@
+package fsm
+
+import "github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+
+// maxTriggerCandidates limits how many scenarios are offered when a message
+// matches several of them equally well
+const maxTriggerCandidates = 3
+
+// triggerCandidates returns the matches the best one does not clearly beat,
+// best first. The best match beats another one that names fewer tools, or
+// names as many but scores at most half as much. A single candidate is a clear
+// winner.
+func triggerCandidates(matches []*storage.ScenarioMatch) []*storage.ScenarioMatch {
+	if len(matches) == 0 {
+		return nil
+	}
+
+	best := matches[0]
+	candidates := []*storage.ScenarioMatch{best}
+	for _, match := range matches[1:] {
+		if len(candidates) == maxTriggerCandidates {
+			break
+		}
+		if match.Tools < best.Tools || match.Score*2 <= best.Score {
+			continue
+		}
+		candidates = append(candidates, match)
+	}
+	return candidates
+}
+
+// GetChooseScenarioMessage returns the message offering the scenarios a message matched
+func GetChooseScenarioMessage() string {
+	return "Уточните, о каком инструменте речь:"
+}
@@ -0,0 +1,304 @@
+package fsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+)
+
+// IssueKind classifies a problem found by ValidateScenario
+type IssueKind string
+
+const (
+	IssueNoSteps          IssueKind = "no_steps"
+	IssueMissingStep      IssueKind = "missing_step"
+	IssueUnreachable      IssueKind = "unreachable"
+	IssueCycleWithoutExit IssueKind = "cycle_without_exit"
+	IssueNoButtons        IssueKind = "no_buttons"
+	IssueFinalWithEdges   IssueKind = "final_with_edges"
+	IssueInputWithoutNext IssueKind = "input_without_next"
+)
+
+// ScenarioIssue is a problem in a scenario step graph
+type ScenarioIssue struct {
+	Kind    IssueKind
+	StepKey string
+	Message string
+}
+
+// Blocking reports whether the issue breaks sessions that walk into it, as
+// opposed to content that is unused or never shown
+func (i ScenarioIssue) Blocking() bool {
+	switch i.Kind {
+	case IssueNoSteps, IssueMissingStep, IssueCycleWithoutExit, IssueNoButtons, IssueInputWithoutNext:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i ScenarioIssue) String() string {
+	if i.StepKey == "" {
+		return fmt.Sprintf("%s: %s", i.Kind, i.Message)
+	}
+	return fmt.Sprintf("%s: step %s: %s", i.Kind, i.StepKey, i.Message)
+}
+
+// edge is a way to leave a step: a button or the next step after free text input
+type edge struct {
+	to     string
+	source string
+}
+
+// ValidateScenario checks a scenario's step graph the way the bot would walk it
+// and returns every problem found, ordered by step. An empty result means the
+// scenario is safe to put live.
+//
+// Edges are next_step_key, transitions, action groups and, for steps without
+// either, numbered options parsed from the message. The back button is not an
+// edge: it only returns to where the user came from.
+func ValidateScenario(graph *storage.FSMScenarioGraph) []ScenarioIssue {
+	if len(graph.Steps) == 0 {
+		return []ScenarioIssue{{Kind: IssueNoSteps, Message: "scenario has no steps"}}
+	}
+
+	steps := make(map[string]*storage.FSMScenarioStep, len(graph.Steps))
+	for _, step := range graph.Steps {
+		steps[step.StepKey] = step
+	}
+
+	var issues []ScenarioIssue
+	edges := scenarioEdges(graph)
+
+	for _, step := range graph.Steps {
+		final := isFinalStep(step)
+		for _, e := range edges[step.StepKey] {
+			if _, ok := steps[e.to]; !ok {
+				issues = append(issues, ScenarioIssue{
+					Kind:    IssueMissingStep,
+					StepKey: step.StepKey,
+					Message: fmt.Sprintf("%s points at missing step %q", e.source, e.to),
+				})
+			}
+			if final {
+				issues = append(issues, ScenarioIssue{
+					Kind:    IssueFinalWithEdges,
+					StepKey: step.StepKey,
+					Message: fmt.Sprintf("final step has %s to %q that is never shown", e.source, e.to),
+				})
+			}
+		}
+
+		// Accepted input has nowhere to go, so the user stays on the step
+		if step.Input != "" && step.NextStepKey == nil && !final {
+			issues = append(issues, ScenarioIssue{
+				Kind:    IssueInputWithoutNext,
+				StepKey: step.StepKey,
+				Message: fmt.Sprintf("step expects %s input but has no next_step_key", step.Input),
+			})
+		}
+
+		// is_final steps end the session on the next message, so they need no way forward
+		if !final && !step.IsFinal && !hasButtons(edges[step.StepKey]) && step.NextStepKey == nil {
+			issues = append(issues, ScenarioIssue{
+				Kind:    IssueNoButtons,
+				StepKey: step.StepKey,
+				Message: fmt.Sprintf("%s step renders no buttons, has no next_step_key and is not final", stateTypeName(step)),
+			})
+		}
+	}
+
+	// Sessions start on the first step; start steps are entry points as well
+	reachable := make(map[string]bool)
+	queue := []string{graph.Steps[0].StepKey}
+	for _, step := range graph.Steps {
+		if step.StateType == "start" {
+			queue = append(queue, step.StepKey)
+		}
+	}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		if reachable[key] {
+			continue
+		}
+		reachable[key] = true
+		if step, ok := steps[key]; ok && !isFinalStep(step) {
+			for _, e := range edges[key] {
+				queue = append(queue, e.to)
+			}
+		}
+	}
+	for _, step := range graph.Steps {
+		if !reachable[step.StepKey] {
+			issues = append(issues, ScenarioIssue{
+				Kind:    IssueUnreachable,
+				StepKey: step.StepKey,
+				Message: fmt.Sprintf("step cannot be reached from %q", graph.Steps[0].StepKey),
+			})
+		}
+	}
+
+	issues = append(issues, trappedCycles(graph, steps, edges)...)
+
+	order := make(map[string]int, len(graph.Steps))
+	for i, step := range graph.Steps {
+		order[step.StepKey] = i + 1
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return order[issues[i].StepKey] < order[issues[j].StepKey]
+	})
+
+	return issues
+}
+
+// scenarioEdges collects the outgoing edges of every step
+func scenarioEdges(graph *storage.FSMScenarioGraph) map[string][]edge {
+	edges := make(map[string][]edge, len(graph.Steps))
+	buttons := make(map[string]bool)
+
+	for _, transition := range graph.Transitions {
+		edges[transition.FromStepKey] = append(edges[transition.FromStepKey], edge{to: transition.ToStepKey, source: "transition"})
+		buttons[transition.FromStepKey] = true
+	}
+	for _, action := range graph.Actions {
+		edges[action.StepKey] = append(edges[action.StepKey], edge{to: action.ActionStepKey, source: "action"})
+		buttons[action.StepKey] = true
+	}
+
+	for _, step := range graph.Steps {
+		if step.NextStepKey != nil {
+			edges[step.StepKey] = append(edges[step.StepKey], edge{to: *step.NextStepKey, source: "next_step_key"})
+		}
+		// Message options are only rendered when the step has no transitions or actions
+		if buttons[step.StepKey] || isFinalStep(step) {
+			continue
+		}
+		for _, option := range parseMessageOptions(step.Message) {
+			edges[step.StepKey] = append(edges[step.StepKey], edge{to: step.StepKey + "_" + option.number, source: "option " + option.number})
+		}
+	}
+
+	return edges
+}
+
+// trappedCycles finds groups of steps that lead only to each other and never to a final step
+func trappedCycles(graph *storage.FSMScenarioGraph, steps map[string]*storage.FSMScenarioStep, edges map[string][]edge) []ScenarioIssue {
+	var issues []ScenarioIssue
+
+	for _, component := range stronglyConnected(graph, steps, edges) {
+		members := make(map[string]bool, len(component))
+		for _, key := range component {
+			members[key] = true
+		}
+
+		cycle := len(component) > 1
+		exit := false
+		for _, key := range component {
+			if isFinalStep(steps[key]) {
+				exit = true
+			}
+			for _, e := range edges[key] {
+				if e.to == key {
+					cycle = true
+				}
+				if !members[e.to] {
+					exit = true
+				}
+			}
+		}
+
+		if cycle && !exit {
+			issues = append(issues, ScenarioIssue{
+				Kind:    IssueCycleWithoutExit,
+				StepKey: component[0],
+				Message: fmt.Sprintf("steps %s only lead to each other and never to a final step", strings.Join(component, ", ")),
+			})
+		}
+	}
+
+	return issues
+}
+
+// stronglyConnected returns the strongly connected components of the step graph
+// (Tarjan's algorithm). Steps inside a component are in scenario order.
+func stronglyConnected(graph *storage.FSMScenarioGraph, steps map[string]*storage.FSMScenarioStep, edges map[string][]edge) [][]string {
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var components [][]string
+
+	var visit func(key string)
+	visit = func(key string) {
+		index[key] = len(index)
+		lowlink[key] = index[key]
+		stack = append(stack, key)
+		onStack[key] = true
+
+		if !isFinalStep(steps[key]) {
+			for _, e := range edges[key] {
+				if _, ok := steps[e.to]; !ok {
+					continue
+				}
+				if _, visited := index[e.to]; !visited {
+					visit(e.to)
+					lowlink[key] = min(lowlink[key], lowlink[e.to])
+				} else if onStack[e.to] {
+					lowlink[key] = min(lowlink[key], index[e.to])
+				}
+			}
+		}
+
+		if lowlink[key] == index[key] {
+			var component []string
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == key {
+					break
+				}
+			}
+			components = append(components, component)
+		}
+	}
+
+	order := make(map[string]int, len(graph.Steps))
+	for i, step := range graph.Steps {
+		order[step.StepKey] = i
+		if _, visited := index[step.StepKey]; !visited {
+			visit(step.StepKey)
+		}
+	}
+	for _, component := range components {
+		sort.Slice(component, func(i, j int) bool { return order[component[i]] < order[component[j]] })
+	}
+
+	return components
+}
+
+// hasButtons reports whether a step renders at least one button besides "back"
+func hasButtons(edges []edge) bool {
+	for _, e := range edges {
+		if e.source != "next_step_key" {
+			return true
+		}
+	}
+	return false
+}
+
+// isFinalStep reports whether the bot ends the scenario on this step
+func isFinalStep(step *storage.FSMScenarioStep) bool {
+	return step.StateType == "final"
+}
+
+func stateTypeName(step *storage.FSMScenarioStep) string {
+	if step.StateType == "" {
+		return "intermediate"
+	}
+	return step.StateType
+}
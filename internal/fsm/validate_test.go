@@ -0,0 +1,175 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStep(key, stateType string, next ...string) *storage.FSMScenarioStep {
+	step := &storage.FSMScenarioStep{StepKey: key, StateType: stateType, Message: key, IsFinal: stateType == "final"}
+	if len(next) > 0 {
+		step.NextStepKey = &next[0]
+	}
+	return step
+}
+
+func testTransition(from, to string) *storage.FSMTransition {
+	return &storage.FSMTransition{FromStepKey: from, ToStepKey: to, ButtonLabel: to}
+}
+
+func issueKinds(issues []ScenarioIssue) []string {
+	var kinds []string
+	for _, issue := range issues {
+		kinds = append(kinds, string(issue.Kind)+" "+issue.StepKey)
+	}
+	return kinds
+}
+
+func TestValidateScenario(t *testing.T) {
+	tests := []struct {
+		name     string
+		graph    *storage.FSMScenarioGraph
+		expected []string
+	}{
+		{
+			name: "valid",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start"),
+					testStep("question", "intermediate"),
+					testStep("yes", "final"),
+					testStep("no", "final"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("root", "question"),
+					testTransition("question", "yes"),
+					testTransition("question", "no"),
+				},
+			},
+		},
+		{
+			name:     "no steps",
+			graph:    &storage.FSMScenarioGraph{},
+			expected: []string{"no_steps "},
+		},
+		{
+			name: "missing next step",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start", "gone"),
+				},
+			},
+			expected: []string{"missing_step root"},
+		},
+		{
+			name: "unreachable step",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start", "done"),
+					testStep("done", "final"),
+					testStep("orphan", "final"),
+				},
+			},
+			expected: []string{"unreachable orphan"},
+		},
+		{
+			name: "cycle without exit",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start"),
+					testStep("a", "intermediate"),
+					testStep("b", "intermediate"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("root", "a"),
+					testTransition("a", "b"),
+					testTransition("b", "a"),
+				},
+			},
+			expected: []string{"cycle_without_exit a"},
+		},
+		{
+			name: "cycle with exit",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start"),
+					testStep("a", "intermediate"),
+					testStep("done", "final"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("root", "a"),
+					testTransition("a", "root"),
+					testTransition("a", "done"),
+				},
+			},
+		},
+		{
+			name: "intermediate step without buttons",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start"),
+					testStep("dead_end", "intermediate"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("root", "dead_end"),
+				},
+			},
+			expected: []string{"no_buttons dead_end"},
+		},
+		{
+			name: "message options count as buttons",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					{StepKey: "root", StateType: "start", Message: "Выберите:\n1. Первое\n2. Второе"},
+					testStep("root_1", "final"),
+					testStep("root_2", "final"),
+				},
+			},
+		},
+		{
+			name: "final step with outgoing edges",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start", "done"),
+					testStep("done", "final"),
+					testStep("after", "final"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("done", "after"),
+				},
+			},
+			expected: []string{"final_with_edges done", "unreachable after"},
+		},
+		{
+			name: "input without next step",
+			graph: &storage.FSMScenarioGraph{
+				Steps: []*storage.FSMScenarioStep{
+					testStep("root", "start"),
+					{StepKey: "ask_email", StateType: "intermediate", Message: "Email?", Input: "email"},
+					testStep("done", "final"),
+				},
+				Transitions: []*storage.FSMTransition{
+					testTransition("root", "ask_email"),
+					testTransition("ask_email", "done"),
+				},
+			},
+			expected: []string{"input_without_next ask_email"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, issueKinds(ValidateScenario(tt.graph)))
+		})
+	}
+}
+
+func TestScenarioIssueBlocking(t *testing.T) {
+	assert.True(t, ScenarioIssue{Kind: IssueMissingStep}.Blocking())
+	assert.True(t, ScenarioIssue{Kind: IssueNoButtons}.Blocking())
+	assert.True(t, ScenarioIssue{Kind: IssueInputWithoutNext}.Blocking())
+	assert.False(t, ScenarioIssue{Kind: IssueUnreachable}.Blocking())
+	assert.False(t, ScenarioIssue{Kind: IssueFinalWithEdges}.Blocking())
+}
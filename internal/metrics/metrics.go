@@ -9,7 +9,17 @@ import (
 
 // Collector collects and exports metrics
 type Collector struct {
-	storage storage.Storage
+	storage    storage.Storage
+	queueStats func() QueueStats
+}
+
+// QueueStats describes the update queue of the bot
+type QueueStats struct {
+	Workers   int
+	Busy      int
+	Queued    int
+	Capacity  int
+	Processed uint64
 }
 
 // NewCollector creates a new metrics collector
@@ -19,6 +29,11 @@ func NewCollector(storage storage.Storage) *Collector {
 	}
 }
 
+// SetQueueStats sets the source of update queue metrics
+func (c *Collector) SetQueueStats(queueStats func() QueueStats) {
+	c.queueStats = queueStats
+}
+
 // Export exports metrics in Prometheus text format
 func (c *Collector) Export() (string, error) {
 	var sb strings.Builder
@@ -57,6 +72,16 @@ func (c *Collector) Export() (string, error) {
 		sb.WriteString(fmt.Sprintf("telegram_bot_fsm_state{state=\"%s\"} %d\n", state, count))
 	}
 
+	if c.queueStats != nil {
+		stats := c.queueStats()
+		sb.WriteString("\n")
+		sb.WriteString(FormatMetric(PrometheusMetric{Name: "telegram_bot_update_queue_depth", Help: "Updates waiting for a worker", Type: "gauge", Value: stats.Queued}))
+		sb.WriteString(FormatMetric(PrometheusMetric{Name: "telegram_bot_update_queue_capacity", Help: "Maximum number of queued updates", Type: "gauge", Value: stats.Capacity}))
+		sb.WriteString(FormatMetric(PrometheusMetric{Name: "telegram_bot_update_workers", Help: "Number of update workers", Type: "gauge", Value: stats.Workers}))
+		sb.WriteString(FormatMetric(PrometheusMetric{Name: "telegram_bot_update_workers_busy", Help: "Workers currently handling an update", Type: "gauge", Value: stats.Busy}))
+		sb.WriteString(FormatMetric(PrometheusMetric{Name: "telegram_bot_updates_processed_total", Help: "Updates handled since start", Type: "counter", Value: stats.Processed}))
+	}
+
 	return sb.String(), nil
 }
 
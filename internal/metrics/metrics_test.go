@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	for _, telegramID := range []int64{1, 2} {
+		_, err := s.GetOrCreateUser(telegramID)
+		require.NoError(t, err)
+	}
+	scenario := &storage.FSMScenario{Name: "diagnose_jigsaw"}
+	require.NoError(t, s.CreateFSMScenario(scenario))
+	require.NoError(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "root", StateType: "start"}))
+	storagetest.EnterStep(t, s, 2, scenario.ID, "root")
+	require.NoError(t, s.LogMessage(1, "привет", "incoming"))
+	require.NoError(t, s.LogMessage(1, "здравствуйте", "outgoing"))
+
+	collector := NewCollector(s)
+	collector.SetQueueStats(func() QueueStats {
+		return QueueStats{Workers: 8, Busy: 2, Queued: 3, Capacity: 800, Processed: 42}
+	})
+
+	output, err := collector.Export()
+	require.NoError(t, err)
+	assert.Contains(t, output, "telegram_bot_active_users_total{period=\"24h\"} 1\n")
+	assert.Contains(t, output, "telegram_bot_messages_total 2\n")
+	assert.Contains(t, output, "telegram_bot_fsm_state{state=\"idle\"} 1\n")
+	assert.Contains(t, output, "telegram_bot_fsm_state{state=\"in_scenario\"} 1\n")
+	assert.Contains(t, output, "telegram_bot_update_queue_depth 3\n")
+	assert.Contains(t, output, "telegram_bot_updates_processed_total 42\n")
+}
@@ -0,0 +1,422 @@
+// Package migrate applies versioned SQL migrations and records them in the
+// schema_migrations table
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LegacyVersion is the last migration the former migrate.go applied. Databases
+// created by it have no schema_migrations table; versions up to LegacyVersion
+// are recorded as applied without running them again, since 001-003 truncate
+// scenario and session tables. Later migrations run as usual: 007 and 008 are
+// written to be safe on a schema that may already have them.
+const LegacyVersion = 6
+
+// lockKey identifies the advisory lock held while migrating
+const lockKey = 7_240_011
+
+// fileName matches NNN_name.sql and NNN_name.down.sql
+var fileName = regexp.MustCompile(`^(\d+)_(.+?)(\.down)?\.sql$`)
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// State describes whether a migration is applied
+type State string
+
+const (
+	StatePending State = "pending"
+	StateApplied State = "applied"
+	// StateChanged means the file was edited after it was applied
+	StateChanged State = "changed"
+	// StateMissing means the migration is recorded as applied but has no file
+	StateMissing State = "missing"
+)
+
+// Status is the state of a migration in the database
+type Status struct {
+	Version   int
+	Name      string
+	State     State
+	AppliedAt *time.Time
+}
+
+// Load reads migrations from the root of fsys ordered by version. Every
+// version needs an up file; the down file is optional.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %03d has files with different names: %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] != "" {
+			migration.Down = string(content)
+			continue
+		}
+		if migration.Up != "" {
+			return nil, fmt.Errorf("duplicate migration version %03d", version)
+		}
+		migration.Up = string(content)
+		sum := sha256.Sum256(content)
+		migration.Checksum = hex.EncodeToString(sum[:])
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %03d_%s has a down file but no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations on one database
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+// NewMigrator creates a migrator for migrations returned by Load
+func NewMigrator(db *sql.DB, migrations []*Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Status lists every known migration, plus applied ones whose files are gone
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := loadApplied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.status(applied), nil
+}
+
+// Up applies pending migrations up to and including target, or all of them
+// when target is 0. Each migration runs in its own transaction. Nothing is
+// applied if an applied migration was changed or is missing.
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := loadApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			if applied, err = m.baseline(ctx, conn); err != nil {
+				return err
+			}
+		}
+
+		if err := checkDrift(m.status(applied)); err != nil {
+			return err
+		}
+
+		count := 0
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if target != 0 && migration.Version > target {
+				break
+			}
+
+			log.Printf("Applying migration %03d_%s", migration.Version, migration.Name)
+			err := inTransaction(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx,
+					`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+					migration.Version, migration.Name, migration.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %03d_%s: %w", migration.Version, migration.Name, err)
+			}
+			count++
+		}
+
+		if count == 0 {
+			log.Println("No pending migrations")
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last steps applied migrations using their down files
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := loadApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+		if len(versions) == 0 {
+			log.Println("No applied migrations")
+			return nil
+		}
+
+		byVersion := make(map[int]*Migration, len(m.migrations))
+		for _, migration := range m.migrations {
+			byVersion[migration.Version] = migration
+		}
+
+		// Check everything first so a missing down file does not leave a half rollback
+		for _, version := range versions {
+			migration, ok := byVersion[version]
+			if !ok {
+				return fmt.Errorf("migration %03d_%s is applied but its file is missing", version, applied[version].name)
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %03d_%s has no down file and cannot be rolled back", version, migration.Name)
+			}
+		}
+
+		for _, version := range versions {
+			migration := byVersion[version]
+			log.Printf("Rolling back migration %03d_%s", migration.Version, migration.Name)
+			err := inTransaction(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to roll back migration %03d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// locked runs fn on a single connection holding the migration advisory lock,
+// so that replicas starting at the same time migrate one after another
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, lockKey).Scan(&acquired); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if !acquired {
+		log.Println("Another process is migrating the database, waiting for it to finish")
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// baseline records legacy migrations as applied when the schema already
+// exists but schema_migrations is empty
+func (m *Migrator) baseline(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	var legacy bool
+	if err := conn.QueryRowContext(ctx, `SELECT to_regclass('public.users') IS NOT NULL`).Scan(&legacy); err != nil {
+		return nil, fmt.Errorf("failed to check for an existing schema: %w", err)
+	}
+	if !legacy {
+		return map[int]appliedMigration{}, nil
+	}
+
+	log.Printf("Existing schema without schema_migrations found, recording migrations up to %03d as applied", LegacyVersion)
+	err := inTransaction(ctx, conn, func(tx *sql.Tx) error {
+		for _, migration := range m.migrations {
+			if migration.Version > LegacyVersion {
+				break
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+				migration.Version, migration.Name, migration.Checksum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record legacy migrations: %w", err)
+	}
+
+	return loadApplied(ctx, conn)
+}
+
+// status merges known migrations with applied ones
+func (m *Migrator) status(applied map[int]appliedMigration) []Status {
+	var statuses []Status
+	known := make(map[int]bool, len(m.migrations))
+
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		status := Status{Version: migration.Version, Name: migration.Name, State: StatePending}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.appliedAt
+			status.AppliedAt = &appliedAt
+			status.State = StateApplied
+			if row.checksum != migration.Checksum {
+				status.State = StateChanged
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	for version, row := range applied {
+		if known[version] {
+			continue
+		}
+		appliedAt := row.appliedAt
+		statuses = append(statuses, Status{Version: version, Name: row.name, State: StateMissing, AppliedAt: &appliedAt})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses
+}
+
+// checkDrift fails if applied migrations no longer match their files
+func checkDrift(statuses []Status) error {
+	var problems []string
+	for _, status := range statuses {
+		switch status.State {
+		case StateChanged:
+			problems = append(problems, fmt.Sprintf("%03d_%s was changed after it was applied", status.Version, status.Name))
+		case StateMissing:
+			problems = append(problems, fmt.Sprintf("%03d_%s is applied but its file is missing", status.Version, status.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("migrations do not match the database: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+func loadApplied(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var row appliedMigration
+		if err := rows.Scan(&version, &row.name, &row.checksum, &row.appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		applied[version] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	return applied, nil
+}
+
+func inTransaction(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
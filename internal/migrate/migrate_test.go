@@ -0,0 +1,146 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/migrations"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"002_add_index.sql":       {Data: []byte("CREATE INDEX i ON t(c);")},
+		"001_create_table.sql":    {Data: []byte("CREATE TABLE t (c INT);")},
+		"002_add_index.down.sql":  {Data: []byte("DROP INDEX i;")},
+		"README.md":               {Data: []byte("not a migration")},
+		"003_not_sql.sql.orig":    {Data: []byte("ignored")},
+		"010_after_nine.sql":      {Data: []byte("SELECT 1;")},
+		"009_before_ten.down.sql": {Data: []byte("SELECT 2;")},
+		"009_before_ten.sql":      {Data: []byte("SELECT 3;")},
+	}
+
+	loaded, err := Load(fsys)
+	require.NoError(t, err)
+
+	var versions []int
+	for _, migration := range loaded {
+		versions = append(versions, migration.Version)
+	}
+	assert.Equal(t, []int{1, 2, 9, 10}, versions)
+	assert.Equal(t, "add_index", loaded[1].Name)
+	assert.Equal(t, "DROP INDEX i;", loaded[1].Down)
+	assert.Empty(t, loaded[0].Down)
+	assert.Len(t, loaded[0].Checksum, 64)
+}
+
+func TestLoadRejectsBrokenSets(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"down without up", fstest.MapFS{"001_a.down.sql": {Data: []byte("x")}}},
+		{"duplicate version", fstest.MapFS{"001_a.sql": {Data: []byte("x")}, "001_b.sql": {Data: []byte("y")}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	loaded, err := Load(migrations.FS)
+	require.NoError(t, err)
+	require.NotEmpty(t, loaded)
+
+	for i, migration := range loaded {
+		assert.Equal(t, i+1, migration.Version, "migration versions must have no gaps")
+	}
+	assert.GreaterOrEqual(t, len(loaded), LegacyVersion)
+}
+
+func TestStatusAndDrift(t *testing.T) {
+	loaded := []*Migration{
+		{Version: 1, Name: "a", Checksum: "aaa"},
+		{Version: 2, Name: "b", Checksum: "bbb"},
+		{Version: 3, Name: "c", Checksum: "ccc"},
+	}
+	m := NewMigrator(nil, loaded)
+	now := time.Now()
+
+	statuses := m.status(map[int]appliedMigration{
+		1: {name: "a", checksum: "aaa", appliedAt: now},
+		2: {name: "b", checksum: "bbb", appliedAt: now},
+	})
+	require.Len(t, statuses, 3)
+	assert.Equal(t, StateApplied, statuses[1].State)
+	assert.Equal(t, StatePending, statuses[2].State)
+	assert.Nil(t, statuses[2].AppliedAt)
+	assert.NoError(t, checkDrift(statuses))
+
+	statuses = m.status(map[int]appliedMigration{
+		1: {name: "a", checksum: "edited", appliedAt: now},
+		4: {name: "d", checksum: "ddd", appliedAt: now},
+	})
+	require.Len(t, statuses, 4)
+	assert.Equal(t, StateChanged, statuses[0].State)
+	assert.Equal(t, StateMissing, statuses[3].State)
+	assert.Error(t, checkDrift(statuses))
+}
+
+// TestBaselineLegacySchema checks that a database created by the former
+// migrate.go only gets 001-006 recorded, so 007 onwards still run. It is
+// skipped unless TEST_DB_NAME names a database that may be wiped; the other
+// connection parameters come from the usual DB_* variables.
+func TestBaselineLegacySchema(t *testing.T) {
+	dbname := os.Getenv("TEST_DB_NAME")
+	if dbname == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432"), getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", "postgres"), dbname, getEnv("DB_SSLMODE", "disable")))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `DROP SCHEMA public CASCADE; CREATE SCHEMA public; CREATE TABLE users (id SERIAL PRIMARY KEY)`)
+	require.NoError(t, err)
+
+	loaded, err := Load(migrations.FS)
+	require.NoError(t, err)
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, ensureTable(ctx, conn))
+
+	applied, err := NewMigrator(db, loaded).baseline(ctx, conn)
+	require.NoError(t, err)
+
+	var versions []int
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, versions)
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,199 @@
+package scenario
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diff lists the changes that turn from into to, one human-readable line per
+// change. Lines start with "+" for additions, "-" for removals and "~" for
+// modifications. An empty result means the definitions are equivalent.
+// Step order is not compared: it only matters for buttons, which are compared
+// per step.
+func Diff(from, to *Definition) []string {
+	var changes []string
+
+	if from.Name != to.Name {
+		changes = append(changes, fmt.Sprintf("~ name: %q -> %q", from.Name, to.Name))
+	}
+	if from.DisplayName != to.DisplayName {
+		changes = append(changes, fmt.Sprintf("~ display_name: %q -> %q", from.DisplayName, to.DisplayName))
+	}
+	if from.Description != to.Description {
+		changes = append(changes, fmt.Sprintf("~ description: %q -> %q", from.Description, to.Description))
+	}
+	if from.Visible() != to.Visible() {
+		changes = append(changes, fmt.Sprintf("~ visible_in_menu: %t -> %t", from.Visible(), to.Visible()))
+	}
+	if from.SortOrder != to.SortOrder {
+		changes = append(changes, fmt.Sprintf("~ sort_order: %d -> %d", from.SortOrder, to.SortOrder))
+	}
+	if strings.Join(from.TriggerKeywords, "\x00") != strings.Join(to.TriggerKeywords, "\x00") {
+		changes = append(changes, fmt.Sprintf("~ trigger_keywords: %q -> %q", from.TriggerKeywords, to.TriggerKeywords))
+	}
+	if strings.Join(from.ToolKeywords, "\x00") != strings.Join(to.ToolKeywords, "\x00") {
+		changes = append(changes, fmt.Sprintf("~ tool_keywords: %q -> %q", from.ToolKeywords, to.ToolKeywords))
+	}
+
+	for _, step := range from.Steps {
+		if to.step(step.Key) == nil {
+			changes = append(changes, fmt.Sprintf("- step %s", step.Key))
+		}
+	}
+	for _, step := range to.Steps {
+		old := from.step(step.Key)
+		if old == nil {
+			changes = append(changes, fmt.Sprintf("+ step %s", step.Key))
+			old = &Step{Key: step.Key}
+		}
+		changes = append(changes, diffStep(old, step)...)
+	}
+
+	return changes
+}
+
+// diffStep compares two versions of the same step
+func diffStep(from, to *Step) []string {
+	var changes []string
+	prefix := "~ step " + to.Key + ": "
+
+	if from.StateType != to.StateType {
+		changes = append(changes, fmt.Sprintf("%sstate_type %q -> %q", prefix, from.StateType, to.StateType))
+	}
+	if from.Final != to.Final {
+		changes = append(changes, fmt.Sprintf("%sfinal %t -> %t", prefix, from.Final, to.Final))
+	}
+	if from.NextStep != to.NextStep {
+		changes = append(changes, fmt.Sprintf("%snext_step %q -> %q", prefix, from.NextStep, to.NextStep))
+	}
+	if from.Input != to.Input {
+		changes = append(changes, fmt.Sprintf("%sinput %q -> %q", prefix, from.Input, to.Input))
+	}
+	if from.InputError != to.InputError {
+		changes = append(changes, fmt.Sprintf("%sinput_error %q -> %q", prefix, from.InputError, to.InputError))
+	}
+	if strings.Join(from.Effects, "\x00") != strings.Join(to.Effects, "\x00") {
+		changes = append(changes, fmt.Sprintf("%seffects %q -> %q", prefix, from.Effects, to.Effects))
+	}
+	if from.Message != to.Message {
+		changes = append(changes, prefix+"message")
+		for _, line := range diffLines(from.Message, to.Message) {
+			changes = append(changes, "    "+line)
+		}
+	}
+
+	changes = append(changes, diffButtons(prefix+"transition", transitionButtons(from.Transitions), transitionButtons(to.Transitions))...)
+	changes = append(changes, diffButtons(prefix+"action", actionButtons(from.Actions), actionButtons(to.Actions))...)
+
+	return changes
+}
+
+// button is the comparable form of a transition or an action
+type button struct {
+	target string
+	label  string
+}
+
+func transitionButtons(transitions []*Transition) []button {
+	buttons := make([]button, 0, len(transitions))
+	for _, t := range transitions {
+		label := fmt.Sprintf("%q", t.Label)
+		if t.Condition != "" {
+			label += " if " + t.Condition
+		}
+		buttons = append(buttons, button{target: t.To, label: label})
+	}
+	return buttons
+}
+
+func actionButtons(actions []*Action) []button {
+	buttons := make([]button, 0, len(actions))
+	for _, a := range actions {
+		buttons = append(buttons, button{target: a.Step, label: fmt.Sprintf("%q", a.Label)})
+	}
+	return buttons
+}
+
+// diffButtons reports added, removed and relabelled buttons and order changes
+func diffButtons(prefix string, from, to []button) []string {
+	var changes []string
+
+	fromByTarget := make(map[string]button, len(from))
+	for _, b := range from {
+		fromByTarget[b.target] = b
+	}
+	toByTarget := make(map[string]button, len(to))
+	for _, b := range to {
+		toByTarget[b.target] = b
+	}
+
+	var kept []string
+	for _, b := range from {
+		if _, ok := toByTarget[b.target]; !ok {
+			changes = append(changes, fmt.Sprintf("%s - %s %s", prefix, b.target, b.label))
+		} else {
+			kept = append(kept, b.target)
+		}
+	}
+
+	var keptOrder []string
+	for _, b := range to {
+		old, ok := fromByTarget[b.target]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s + %s %s", prefix, b.target, b.label))
+		case old.label != b.label:
+			changes = append(changes, fmt.Sprintf("%s ~ %s %s -> %s", prefix, b.target, old.label, b.label))
+		}
+		if ok {
+			keptOrder = append(keptOrder, b.target)
+		}
+	}
+
+	if strings.Join(kept, "\x00") != strings.Join(keptOrder, "\x00") {
+		changes = append(changes, fmt.Sprintf("%s order %s -> %s", prefix, strings.Join(kept, ", "), strings.Join(keptOrder, ", ")))
+	}
+
+	return changes
+}
+
+// diffLines returns a minimal line diff of two texts as "- " and "+ " lines
+func diffLines(from, to string) []string {
+	a := strings.Split(from, "\n")
+	b := strings.Split(to, "\n")
+	if from == "" {
+		a = nil
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,423 @@
+// Package scenario converts FSM scenarios between the database and scenario files
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a scenario file encoding
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// Allowed values of Step.StateType
+const (
+	StateTypeStart        = "start"
+	StateTypeIntermediate = "intermediate"
+	StateTypeFinal        = "final"
+)
+
+// Definition is a whole scenario as kept in a scenario file
+type Definition struct {
+	Name        string `yaml:"name" json:"name"`
+	DisplayName string `yaml:"display_name,omitempty" json:"display_name,omitempty"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	// VisibleInMenu false keeps the scenario out of the start menu; omitted means true
+	VisibleInMenu   *bool    `yaml:"visible_in_menu,omitempty" json:"visible_in_menu,omitempty"`
+	SortOrder       int      `yaml:"sort_order,omitempty" json:"sort_order,omitempty"`
+	TriggerKeywords []string `yaml:"trigger_keywords" json:"trigger_keywords"`
+	// ToolKeywords name the tool; they outrank trigger keywords in matching
+	ToolKeywords []string `yaml:"tool_keywords,omitempty" json:"tool_keywords,omitempty"`
+	Steps        []*Step  `yaml:"steps" json:"steps"`
+}
+
+// Step is a scenario step with the buttons leading out of it.
+// Buttons are shown in the order they are listed.
+type Step struct {
+	Key         string        `yaml:"key" json:"key"`
+	StateType   string        `yaml:"state_type" json:"state_type"`
+	Final       bool          `yaml:"final,omitempty" json:"final,omitempty"`
+	NextStep    string        `yaml:"next_step,omitempty" json:"next_step,omitempty"`
+	Input       string        `yaml:"input,omitempty" json:"input,omitempty"`
+	InputError  string        `yaml:"input_error,omitempty" json:"input_error,omitempty"`
+	Effects     []string      `yaml:"effects,omitempty" json:"effects,omitempty"`
+	Message     string        `yaml:"message" json:"message"`
+	Transitions []*Transition `yaml:"transitions,omitempty" json:"transitions,omitempty"`
+	Actions     []*Action     `yaml:"actions,omitempty" json:"actions,omitempty"`
+}
+
+// Transition is a button leading to another step
+type Transition struct {
+	To        string `yaml:"to" json:"to"`
+	Label     string `yaml:"label" json:"label"`
+	Condition string `yaml:"condition,omitempty" json:"condition,omitempty"`
+}
+
+// Action is a button of a step's terminal action group
+type Action struct {
+	Step  string `yaml:"step" json:"step"`
+	Label string `yaml:"label" json:"label"`
+}
+
+// FormatFromPath picks the file format by extension
+func FormatFromPath(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported scenario file extension %q: use .yaml, .yml or .json", filepath.Ext(path))
+	}
+}
+
+// Load reads and checks a scenario file
+func Load(path string) (*Definition, error) {
+	format, err := FormatFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %w", err)
+	}
+
+	def, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return def, nil
+}
+
+// Parse decodes and checks a scenario definition. Unknown fields are rejected
+// so that typos do not silently drop data.
+func Parse(data []byte, format Format) (*Definition, error) {
+	def := &Definition{}
+	switch format {
+	case FormatYAML:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(def); err != nil {
+			return nil, fmt.Errorf("failed to parse scenario YAML: %w", err)
+		}
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(def); err != nil {
+			return nil, fmt.Errorf("failed to parse scenario JSON: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scenario format %q", format)
+	}
+
+	if err := def.Check(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// Marshal encodes a scenario definition
+func Marshal(def *Definition, format Format) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		data, err := marshalYAML(def)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode scenario YAML: %w", err)
+		}
+		return data, nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(def, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode scenario JSON: %w", err)
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unsupported scenario format %q", format)
+	}
+}
+
+// marshalYAML encodes v as YAML. The yaml.v3 emitter treats characters outside
+// the Basic Multilingual Plane as unprintable, so every emoji in a step message
+// would become \U0001F50B and force the message into a single quoted line. Such
+// characters are swapped for unused private-use characters while emitting and
+// restored afterwards.
+func marshalYAML(v interface{}) ([]byte, error) {
+	var root yaml.Node
+	if err := root.Encode(v); err != nil {
+		return nil, err
+	}
+
+	var scalars []*yaml.Node
+	collectScalars(&root, &scalars)
+
+	used := make(map[rune]bool)
+	for _, node := range scalars {
+		for _, r := range node.Value {
+			used[r] = true
+		}
+	}
+
+	placeholders := make(map[rune]rune)
+	var restore []string
+	next := rune(0xE000)
+	for _, node := range scalars {
+		value := strings.Map(func(r rune) rune {
+			if r <= 0xFFFF {
+				return r
+			}
+			if placeholder, ok := placeholders[r]; ok {
+				return placeholder
+			}
+			for used[next] {
+				next++
+			}
+			placeholders[r] = next
+			restore = append(restore, string(next), string(r))
+			next++
+			return placeholders[r]
+		}, node.Value)
+		if value != node.Value {
+			// The first encoding pass already picked a quoted style because of these characters
+			node.Value = value
+			node.Style = 0
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	if len(restore) == 0 {
+		return buf.Bytes(), nil
+	}
+	return []byte(strings.NewReplacer(restore...).Replace(buf.String())), nil
+}
+
+// collectScalars appends every scalar node under node
+func collectScalars(node *yaml.Node, scalars *[]*yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		*scalars = append(*scalars, node)
+	}
+	for _, child := range node.Content {
+		collectScalars(child, scalars)
+	}
+}
+
+// Check verifies that the definition can be stored: required fields are set,
+// step keys are unique and every button points at a step of the scenario
+func (d *Definition) Check() error {
+	if strings.TrimSpace(d.Name) == "" {
+		return fmt.Errorf("scenario name is required")
+	}
+	if len(d.Steps) == 0 {
+		return fmt.Errorf("scenario %q has no steps", d.Name)
+	}
+
+	keys := make(map[string]bool, len(d.Steps))
+	for _, step := range d.Steps {
+		if strings.TrimSpace(step.Key) == "" {
+			return fmt.Errorf("scenario %q: step key is required", d.Name)
+		}
+		if keys[step.Key] {
+			return fmt.Errorf("scenario %q: duplicate step %q", d.Name, step.Key)
+		}
+		keys[step.Key] = true
+
+		switch step.StateType {
+		case StateTypeStart, StateTypeIntermediate, StateTypeFinal:
+		default:
+			return fmt.Errorf("scenario %q: step %q: state_type must be one of: start, intermediate, final", d.Name, step.Key)
+		}
+		if strings.TrimSpace(step.Message) == "" {
+			return fmt.Errorf("scenario %q: step %q: message is required", d.Name, step.Key)
+		}
+		if step.InputError != "" && step.Input == "" {
+			return fmt.Errorf("scenario %q: step %q: input_error is set without input", d.Name, step.Key)
+		}
+		for _, effect := range step.Effects {
+			if strings.TrimSpace(effect) == "" {
+				return fmt.Errorf("scenario %q: step %q: effect name is required", d.Name, step.Key)
+			}
+		}
+	}
+
+	for _, step := range d.Steps {
+		seen := make(map[string]bool)
+		for _, transition := range step.Transitions {
+			if !keys[transition.To] {
+				return fmt.Errorf("scenario %q: step %q: transition to unknown step %q", d.Name, step.Key, transition.To)
+			}
+			if seen[transition.To] {
+				return fmt.Errorf("scenario %q: step %q: duplicate transition to %q", d.Name, step.Key, transition.To)
+			}
+			if strings.TrimSpace(transition.Label) == "" {
+				return fmt.Errorf("scenario %q: step %q: transition to %q has no label", d.Name, step.Key, transition.To)
+			}
+			seen[transition.To] = true
+		}
+
+		seen = make(map[string]bool)
+		for _, action := range step.Actions {
+			if !keys[action.Step] {
+				return fmt.Errorf("scenario %q: step %q: action with unknown step %q", d.Name, step.Key, action.Step)
+			}
+			if seen[action.Step] {
+				return fmt.Errorf("scenario %q: step %q: duplicate action %q", d.Name, step.Key, action.Step)
+			}
+			if strings.TrimSpace(action.Label) == "" {
+				return fmt.Errorf("scenario %q: step %q: action %q has no label", d.Name, step.Key, action.Step)
+			}
+			seen[action.Step] = true
+		}
+	}
+
+	return nil
+}
+
+// Visible reports whether the scenario is listed in the start menu
+func (d *Definition) Visible() bool {
+	return d.VisibleInMenu == nil || *d.VisibleInMenu
+}
+
+// FromGraph builds a definition from a stored scenario. Steps keep their
+// storage order; transitions and actions are attached to their source step.
+func FromGraph(graph *storage.FSMScenarioGraph) *Definition {
+	def := &Definition{
+		Name:            graph.Scenario.Name,
+		DisplayName:     graph.Scenario.DisplayName,
+		Description:     graph.Scenario.Description,
+		SortOrder:       graph.Scenario.SortOrder,
+		TriggerKeywords: graph.Scenario.TriggerKeywords,
+		ToolKeywords:    graph.Scenario.ToolKeywords,
+	}
+	if graph.Scenario.HiddenFromMenu {
+		visible := false
+		def.VisibleInMenu = &visible
+	}
+
+	steps := make(map[string]*Step, len(graph.Steps))
+	for _, s := range graph.Steps {
+		step := &Step{
+			Key:        s.StepKey,
+			StateType:  s.StateType,
+			Final:      s.IsFinal,
+			Input:      s.Input,
+			InputError: s.InputError,
+			Effects:    s.Effects,
+			Message:    s.Message,
+		}
+		if s.NextStepKey != nil {
+			step.NextStep = *s.NextStepKey
+		}
+		steps[step.Key] = step
+		def.Steps = append(def.Steps, step)
+	}
+
+	// Storage returns transitions and actions ordered by sort_order within a step
+	for _, t := range graph.Transitions {
+		step, ok := steps[t.FromStepKey]
+		if !ok {
+			continue
+		}
+		transition := &Transition{To: t.ToStepKey, Label: t.ButtonLabel}
+		if t.Condition != nil {
+			transition.Condition = *t.Condition
+		}
+		step.Transitions = append(step.Transitions, transition)
+	}
+	for _, a := range graph.Actions {
+		step, ok := steps[a.StepKey]
+		if !ok {
+			continue
+		}
+		step.Actions = append(step.Actions, &Action{Step: a.ActionStepKey, Label: a.Label})
+	}
+
+	return def
+}
+
+// ToGraph converts the definition into storage rows. Sort order of buttons
+// follows their position in the file, starting from 1.
+func (d *Definition) ToGraph() *storage.FSMScenarioGraph {
+	graph := &storage.FSMScenarioGraph{
+		Scenario: &storage.FSMScenario{
+			Name:            d.Name,
+			DisplayName:     d.DisplayName,
+			Description:     d.Description,
+			TriggerKeywords: d.TriggerKeywords,
+			ToolKeywords:    d.ToolKeywords,
+			HiddenFromMenu:  !d.Visible(),
+			SortOrder:       d.SortOrder,
+		},
+	}
+
+	for _, step := range d.Steps {
+		s := &storage.FSMScenarioStep{
+			StepKey:    step.Key,
+			Message:    step.Message,
+			IsFinal:    step.Final,
+			StateType:  step.StateType,
+			Input:      step.Input,
+			InputError: step.InputError,
+			Effects:    step.Effects,
+		}
+		if step.NextStep != "" {
+			next := step.NextStep
+			s.NextStepKey = &next
+		}
+		graph.Steps = append(graph.Steps, s)
+
+		for i, transition := range step.Transitions {
+			t := &storage.FSMTransition{
+				FromStepKey: step.Key,
+				ToStepKey:   transition.To,
+				ButtonLabel: transition.Label,
+				SortOrder:   i + 1,
+			}
+			if transition.Condition != "" {
+				condition := transition.Condition
+				t.Condition = &condition
+			}
+			graph.Transitions = append(graph.Transitions, t)
+		}
+
+		for i, action := range step.Actions {
+			graph.Actions = append(graph.Actions, &storage.FSMStepAction{
+				StepKey:       step.Key,
+				ActionStepKey: action.Step,
+				Label:         action.Label,
+				SortOrder:     i + 1,
+			})
+		}
+	}
+
+	return graph
+}
+
+// step returns a step by key or nil
+func (d *Definition) step(key string) *Step {
+	for _, step := range d.Steps {
+		if step.Key == key {
+			return step
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package scenario
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/fsm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testScenarioYAML = `name: test_tool
+display_name: Тестовый инструмент
+trigger_keywords:
+  - тест
+steps:
+  - key: root
+    state_type: start
+    message: Выберите проблему
+    transitions:
+      - to: no_power
+        label: Не включается
+  - key: no_power
+    state_type: intermediate
+    message: |-
+      Устройство не включается.
+
+      🔋 Проверьте аккумулятор
+    actions:
+      - step: charge
+        label: Зарядить аккумулятор
+  - key: charge
+    state_type: final
+    final: true
+    message: Зарядите аккумулятор
+`
+
+func TestParseAndMarshalRoundTrip(t *testing.T) {
+	def, err := Parse([]byte(testScenarioYAML), FormatYAML)
+	require.NoError(t, err)
+	require.Len(t, def.Steps, 3)
+	assert.Equal(t, "Устройство не включается.\n\n🔋 Проверьте аккумулятор", def.Steps[1].Message)
+
+	data, err := Marshal(def, FormatYAML)
+	require.NoError(t, err)
+	assert.Equal(t, testScenarioYAML, string(data))
+
+	data, err = Marshal(def, FormatJSON)
+	require.NoError(t, err)
+	fromJSON, err := Parse(data, FormatJSON)
+	require.NoError(t, err)
+	assert.Empty(t, Diff(def, fromJSON))
+}
+
+func TestGraphRoundTrip(t *testing.T) {
+	def, err := Parse([]byte(testScenarioYAML), FormatYAML)
+	require.NoError(t, err)
+
+	graph := def.ToGraph()
+	require.Len(t, graph.Steps, 3)
+	require.Len(t, graph.Transitions, 1)
+	require.Len(t, graph.Actions, 1)
+	assert.Equal(t, 1, graph.Actions[0].SortOrder)
+	assert.Nil(t, graph.Transitions[0].Condition)
+
+	assert.Empty(t, Diff(def, FromGraph(graph)))
+}
+
+func TestParseRejectsBrokenDefinitions(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"unknown field", "name: x\nstep: []\n"},
+		{"no steps", "name: x\ntrigger_keywords: []\nsteps: []\n"},
+		{"bad state type", "name: x\nsteps:\n  - key: root\n    state_type: begin\n    message: m\n"},
+		{"duplicate step", "name: x\nsteps:\n  - key: a\n    state_type: start\n    message: m\n  - key: a\n    state_type: final\n    message: m\n"},
+		{"unknown target", "name: x\nsteps:\n  - key: a\n    state_type: start\n    message: m\n    transitions:\n      - to: b\n        label: B\n"},
+		{"input error without input", "name: x\nsteps:\n  - key: a\n    state_type: start\n    input_error: bad\n    message: m\n"},
+		{"empty effect", "name: x\nsteps:\n  - key: a\n    state_type: final\n    effects: [\"\"]\n    message: m\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml), FormatYAML)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from, err := Parse([]byte(testScenarioYAML), FormatYAML)
+	require.NoError(t, err)
+	to, err := Parse([]byte(testScenarioYAML), FormatYAML)
+	require.NoError(t, err)
+
+	to.TriggerKeywords = append(to.TriggerKeywords, "проверка")
+	to.Steps[0].Transitions[0].Label = "Молчит"
+	to.Steps[1].Message = "Устройство не включается.\n\n🔌 Проверьте кабель"
+	to.Steps = append(to.Steps, &Step{Key: "cable", StateType: StateTypeFinal, Message: "Замените кабель"})
+	to.Steps[1].Actions = append(to.Steps[1].Actions, &Action{Step: "cable", Label: "Заменить кабель"})
+
+	assert.Equal(t, []string{
+		`~ trigger_keywords: ["тест"] -> ["тест" "проверка"]`,
+		`~ step root: transition ~ no_power "Не включается" -> "Молчит"`,
+		`~ step no_power: message`,
+		`    - 🔋 Проверьте аккумулятор`,
+		`    + 🔌 Проверьте кабель`,
+		`~ step no_power: action + cable "Заменить кабель"`,
+		`+ step cable`,
+		`~ step cable: state_type "" -> "final"`,
+		`~ step cable: message`,
+		`    + Замените кабель`,
+	}, Diff(from, to))
+}
+
+func TestSeededScenarioFiles(t *testing.T) {
+	files, err := filepath.Glob("../../scenarios/*.yaml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			def, err := Load(file)
+			require.NoError(t, err)
+
+			// Files are kept in the exact form export writes them
+			data, err := Marshal(def, FormatYAML)
+			require.NoError(t, err)
+			exported, err := Parse(data, FormatYAML)
+			require.NoError(t, err)
+			assert.Empty(t, Diff(def, exported))
+
+			for _, issue := range fsm.ValidateScenario(def.ToGraph()) {
+				assert.False(t, issue.Blocking(), issue.String())
+			}
+		})
+	}
+}
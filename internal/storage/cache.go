@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"log"
+	"sync"
+)
+
+// CachedStorage wraps a Storage and keeps FSM scenarios with their steps,
+// transitions and action groups in memory. Everything else goes straight to
+// the wrapped storage.
+//
+// Edits made through CachedStorage invalidate the cache immediately. Edits
+// made elsewhere (another instance, scenarioctl, plain SQL) must be reported
+// with Invalidate, see PostgresStorage.ListenScenarioChanges.
+//
+// Returned values are copies and may be modified by the caller.
+type CachedStorage struct {
+	Storage
+
+	mu         sync.RWMutex
+	generation uint64
+	scenarios  []*FSMScenario
+	graphs     map[int]*cachedGraph
+}
+
+// cachedGraph is one scenario with its rows indexed the way the bot reads them
+type cachedGraph struct {
+	scenario    *FSMScenario
+	steps       []*FSMScenarioStep
+	stepByKey   map[string]*FSMScenarioStep
+	transitions []*FSMTransition
+	actions     []*FSMStepAction
+}
+
+// NewCachedStorage creates a caching decorator around storage
+func NewCachedStorage(storage Storage) *CachedStorage {
+	return &CachedStorage{
+		Storage: storage,
+		graphs:  make(map[int]*cachedGraph),
+	}
+}
+
+// Invalidate drops the cached scenario list and the given scenario.
+// A scenarioID of 0 drops everything.
+func (c *CachedStorage) Invalidate(scenarioID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.scenarios = nil
+	if scenarioID == 0 {
+		c.graphs = make(map[int]*cachedGraph)
+		return
+	}
+	delete(c.graphs, scenarioID)
+}
+
+// GetFSMScenarios returns all scenarios from the cache
+func (c *CachedStorage) GetFSMScenarios() ([]*FSMScenario, error) {
+	scenarios, err := c.loadScenarios()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*FSMScenario, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		result = append(result, cloneScenario(scenario))
+	}
+	return result, nil
+}
+
+// GetFSMScenariosByTrigger matches scenarios by trigger keywords without querying the database
+func (c *CachedStorage) GetFSMScenariosByTrigger(message string) ([]*ScenarioMatch, error) {
+	scenarios, err := c.loadScenarios()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := MatchScenariosByTrigger(scenarios, message)
+	for _, match := range matches {
+		match.Scenario = cloneScenario(match.Scenario)
+	}
+	return matches, nil
+}
+
+// GetFSMScenario returns a scenario by ID from the cache
+func (c *CachedStorage) GetFSMScenario(id int) (*FSMScenario, error) {
+	graph, err := c.loadGraph(id)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+	return cloneScenario(graph.scenario), nil
+}
+
+// GetFSMScenarioSteps returns the steps of a scenario from the cache
+func (c *CachedStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioStep, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	result := make([]*FSMScenarioStep, 0, len(graph.steps))
+	for _, step := range graph.steps {
+		result = append(result, cloneStep(step))
+	}
+	return result, nil
+}
+
+// GetFSMScenarioStep returns a step from the cache
+func (c *CachedStorage) GetFSMScenarioStep(scenarioID int, stepKey string) (*FSMScenarioStep, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	step, ok := graph.stepByKey[stepKey]
+	if !ok {
+		return nil, nil
+	}
+	return cloneStep(step), nil
+}
+
+// GetFSMTransitions returns the transitions leaving a step from the cache
+func (c *CachedStorage) GetFSMTransitions(scenarioID int, fromStepKey string) ([]*FSMTransition, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	var result []*FSMTransition
+	for _, transition := range graph.transitions {
+		if transition.FromStepKey == fromStepKey {
+			result = append(result, cloneTransition(transition))
+		}
+	}
+	return result, nil
+}
+
+// GetFSMScenarioTransitions returns all transitions of a scenario from the cache
+func (c *CachedStorage) GetFSMScenarioTransitions(scenarioID int) ([]*FSMTransition, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	result := make([]*FSMTransition, 0, len(graph.transitions))
+	for _, transition := range graph.transitions {
+		result = append(result, cloneTransition(transition))
+	}
+	return result, nil
+}
+
+// GetFSMStepActions returns the action group of a step from the cache
+func (c *CachedStorage) GetFSMStepActions(scenarioID int, stepKey string) ([]*FSMStepAction, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	var result []*FSMStepAction
+	for _, action := range graph.actions {
+		if action.StepKey == stepKey {
+			copied := *action
+			result = append(result, &copied)
+		}
+	}
+	return result, nil
+}
+
+// GetFSMScenarioActions returns all action groups of a scenario from the cache
+func (c *CachedStorage) GetFSMScenarioActions(scenarioID int) ([]*FSMStepAction, error) {
+	graph, err := c.loadGraph(scenarioID)
+	if err != nil || graph == nil {
+		return nil, err
+	}
+
+	result := make([]*FSMStepAction, 0, len(graph.actions))
+	for _, action := range graph.actions {
+		copied := *action
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+// CreateFSMScenario creates a scenario and invalidates the cache
+func (c *CachedStorage) CreateFSMScenario(scenario *FSMScenario) error {
+	err := c.Storage.CreateFSMScenario(scenario)
+	c.Invalidate(scenario.ID)
+	return err
+}
+
+// UpdateFSMScenario updates a scenario and invalidates the cache
+func (c *CachedStorage) UpdateFSMScenario(scenario *FSMScenario) error {
+	err := c.Storage.UpdateFSMScenario(scenario)
+	c.Invalidate(scenario.ID)
+	return err
+}
+
+// DeleteFSMScenario deletes a scenario and invalidates the cache
+func (c *CachedStorage) DeleteFSMScenario(id int) error {
+	err := c.Storage.DeleteFSMScenario(id)
+	c.Invalidate(id)
+	return err
+}
+
+// DeleteCategory deletes a category and invalidates the cache, since its scenarios lose it
+func (c *CachedStorage) DeleteCategory(id int) error {
+	err := c.Storage.DeleteCategory(id)
+	c.Invalidate(0)
+	return err
+}
+
+// CreateFSMScenarioStep creates a step and invalidates the cache
+func (c *CachedStorage) CreateFSMScenarioStep(step *FSMScenarioStep) error {
+	err := c.Storage.CreateFSMScenarioStep(step)
+	c.Invalidate(step.ScenarioID)
+	return err
+}
+
+// UpdateFSMScenarioStep updates a step and invalidates the cache
+func (c *CachedStorage) UpdateFSMScenarioStep(step *FSMScenarioStep) error {
+	err := c.Storage.UpdateFSMScenarioStep(step)
+	c.Invalidate(step.ScenarioID)
+	return err
+}
+
+// DeleteFSMScenarioStep deletes a step and invalidates the cache
+func (c *CachedStorage) DeleteFSMScenarioStep(scenarioID int, stepKey string) error {
+	err := c.Storage.DeleteFSMScenarioStep(scenarioID, stepKey)
+	c.Invalidate(scenarioID)
+	return err
+}
+
+// CreateFSMTransition creates a transition and invalidates the cache
+func (c *CachedStorage) CreateFSMTransition(transition *FSMTransition) error {
+	err := c.Storage.CreateFSMTransition(transition)
+	c.Invalidate(transition.ScenarioID)
+	return err
+}
+
+// UpdateFSMTransition updates a transition and invalidates the cache
+func (c *CachedStorage) UpdateFSMTransition(transition *FSMTransition) error {
+	err := c.Storage.UpdateFSMTransition(transition)
+	c.Invalidate(transition.ScenarioID)
+	return err
+}
+
+// DeleteFSMTransition deletes a transition and invalidates the cache
+func (c *CachedStorage) DeleteFSMTransition(scenarioID int, id int) error {
+	err := c.Storage.DeleteFSMTransition(scenarioID, id)
+	c.Invalidate(scenarioID)
+	return err
+}
+
+// CreateFSMStepAction creates an action and invalidates the cache
+func (c *CachedStorage) CreateFSMStepAction(action *FSMStepAction) error {
+	err := c.Storage.CreateFSMStepAction(action)
+	c.Invalidate(action.ScenarioID)
+	return err
+}
+
+// UpdateFSMStepAction updates an action and invalidates the cache
+func (c *CachedStorage) UpdateFSMStepAction(action *FSMStepAction) error {
+	err := c.Storage.UpdateFSMStepAction(action)
+	c.Invalidate(action.ScenarioID)
+	return err
+}
+
+// DeleteFSMStepAction deletes an action and invalidates the cache
+func (c *CachedStorage) DeleteFSMStepAction(scenarioID int, id int) error {
+	err := c.Storage.DeleteFSMStepAction(scenarioID, id)
+	c.Invalidate(scenarioID)
+	return err
+}
+
+// loadScenarios returns the cached scenario list, reading it on a miss
+func (c *CachedStorage) loadScenarios() ([]*FSMScenario, error) {
+	c.mu.RLock()
+	scenarios, generation := c.scenarios, c.generation
+	c.mu.RUnlock()
+	if scenarios != nil {
+		return scenarios, nil
+	}
+
+	scenarios, err := c.Storage.GetFSMScenarios()
+	if err != nil {
+		return nil, err
+	}
+	if scenarios == nil {
+		scenarios = []*FSMScenario{}
+	}
+
+	c.mu.Lock()
+	// An invalidation while reading means the result may already be stale
+	if c.generation == generation {
+		c.scenarios = scenarios
+	}
+	c.mu.Unlock()
+
+	return scenarios, nil
+}
+
+// loadGraph returns a cached scenario graph, reading it on a miss.
+// Returns nil if the scenario does not exist.
+func (c *CachedStorage) loadGraph(scenarioID int) (*cachedGraph, error) {
+	c.mu.RLock()
+	graph, ok := c.graphs[scenarioID]
+	generation := c.generation
+	c.mu.RUnlock()
+	if ok {
+		return graph, nil
+	}
+
+	scenario, err := c.Storage.GetFSMScenario(scenarioID)
+	if err != nil || scenario == nil {
+		return nil, err
+	}
+	steps, err := c.Storage.GetFSMScenarioSteps(scenarioID)
+	if err != nil {
+		return nil, err
+	}
+	transitions, err := c.Storage.GetFSMScenarioTransitions(scenarioID)
+	if err != nil {
+		return nil, err
+	}
+	actions, err := c.Storage.GetFSMScenarioActions(scenarioID)
+	if err != nil {
+		return nil, err
+	}
+
+	graph = &cachedGraph{
+		scenario:    scenario,
+		steps:       steps,
+		stepByKey:   make(map[string]*FSMScenarioStep, len(steps)),
+		transitions: transitions,
+		actions:     actions,
+	}
+	for _, step := range steps {
+		graph.stepByKey[step.StepKey] = step
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.graphs[scenarioID] = graph
+	}
+	c.mu.Unlock()
+
+	log.Printf("Loaded scenario %d into cache: %d steps, %d transitions, %d actions", scenarioID, len(steps), len(transitions), len(actions))
+	return graph, nil
+}
+
+func cloneScenario(scenario *FSMScenario) *FSMScenario {
+	copied := *scenario
+	copied.TriggerKeywords = append([]string(nil), scenario.TriggerKeywords...)
+	copied.ToolKeywords = append([]string(nil), scenario.ToolKeywords...)
+	copied.CategoryID = copyIntPtr(scenario.CategoryID)
+	return &copied
+}
+
+func cloneStep(step *FSMScenarioStep) *FSMScenarioStep {
+	copied := *step
+	if step.NextStepKey != nil {
+		next := *step.NextStepKey
+		copied.NextStepKey = &next
+	}
+	copied.Effects = append([]string(nil), step.Effects...)
+	return &copied
+}
+
+func cloneTransition(transition *FSMTransition) *FSMTransition {
+	copied := *transition
+	if transition.Condition != nil {
+		condition := *transition.Condition
+		copied.Condition = &condition
+	}
+	return &copied
+}
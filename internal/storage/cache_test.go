@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage serves one fixed scenario and counts reads of scenario data
+type countingStorage struct {
+	Storage
+	reads int
+	steps []*FSMScenarioStep
+}
+
+func (s *countingStorage) GetFSMScenarios() ([]*FSMScenario, error) {
+	s.reads++
+	return []*FSMScenario{{ID: 1, Name: "drill", TriggerKeywords: []string{"дрель"}}}, nil
+}
+
+func (s *countingStorage) GetFSMScenario(id int) (*FSMScenario, error) {
+	s.reads++
+	if id != 1 {
+		return nil, nil
+	}
+	return &FSMScenario{ID: 1, Name: "drill", TriggerKeywords: []string{"дрель"}}, nil
+}
+
+func (s *countingStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioStep, error) {
+	s.reads++
+	return s.steps, nil
+}
+
+func (s *countingStorage) GetFSMScenarioTransitions(scenarioID int) ([]*FSMTransition, error) {
+	s.reads++
+	return []*FSMTransition{{ID: 1, ScenarioID: 1, FromStepKey: "root", ToStepKey: "no_power", ButtonLabel: "Не включается"}}, nil
+}
+
+func (s *countingStorage) GetFSMScenarioActions(scenarioID int) ([]*FSMStepAction, error) {
+	s.reads++
+	return nil, nil
+}
+
+func (s *countingStorage) UpdateFSMScenarioStep(step *FSMScenarioStep) error {
+	for i, existing := range s.steps {
+		if existing.StepKey == step.StepKey {
+			s.steps[i] = step
+		}
+	}
+	return nil
+}
+
+func newCountingStorage() *countingStorage {
+	return &countingStorage{steps: []*FSMScenarioStep{
+		{ID: 1, ScenarioID: 1, StepKey: "root", Message: "Выберите проблему", StateType: "start"},
+		{ID: 2, ScenarioID: 1, StepKey: "no_power", Message: "Проверьте аккумулятор", StateType: "final"},
+	}}
+}
+
+func TestCachedStorageReadsScenarioOnce(t *testing.T) {
+	backend := newCountingStorage()
+	cache := NewCachedStorage(backend)
+
+	for i := 0; i < 3; i++ {
+		matches, err := cache.GetFSMScenariosByTrigger("Дрель не включается")
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+		scenario := matches[0].Scenario
+
+		step, err := cache.GetFSMScenarioStep(scenario.ID, "root")
+		require.NoError(t, err)
+		require.NotNil(t, step)
+
+		transitions, err := cache.GetFSMTransitions(scenario.ID, "root")
+		require.NoError(t, err)
+		require.Len(t, transitions, 1)
+	}
+
+	// One scenario list read and one read per table of the scenario graph
+	assert.Equal(t, 5, backend.reads)
+
+	missing, err := cache.GetFSMScenarioStep(1, "unknown")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestCachedStorageReturnsCopies(t *testing.T) {
+	cache := NewCachedStorage(newCountingStorage())
+
+	step, err := cache.GetFSMScenarioStep(1, "root")
+	require.NoError(t, err)
+	step.Message = "changed"
+
+	step, err = cache.GetFSMScenarioStep(1, "root")
+	require.NoError(t, err)
+	assert.Equal(t, "Выберите проблему", step.Message)
+}
+
+func TestCachedStorageInvalidation(t *testing.T) {
+	backend := newCountingStorage()
+	cache := NewCachedStorage(backend)
+
+	_, err := cache.GetFSMScenarioSteps(1)
+	require.NoError(t, err)
+
+	// Edits through the cache are visible right away
+	require.NoError(t, cache.UpdateFSMScenarioStep(&FSMScenarioStep{ID: 1, ScenarioID: 1, StepKey: "root", Message: "Что случилось?", StateType: "start"}))
+	step, err := cache.GetFSMScenarioStep(1, "root")
+	require.NoError(t, err)
+	assert.Equal(t, "Что случилось?", step.Message)
+
+	// Edits made elsewhere are visible after Invalidate
+	backend.steps[1] = &FSMScenarioStep{ID: 2, ScenarioID: 1, StepKey: "no_power", Message: "Зарядите аккумулятор", StateType: "final"}
+	step, err = cache.GetFSMScenarioStep(1, "no_power")
+	require.NoError(t, err)
+	assert.Equal(t, "Проверьте аккумулятор", step.Message)
+
+	cache.Invalidate(0)
+	step, err = cache.GetFSMScenarioStep(1, "no_power")
+	require.NoError(t, err)
+	assert.Equal(t, "Зарядите аккумулятор", step.Message)
+}
@@ -0,0 +1,1270 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage implements Storage in memory. It follows the constraints of
+// the PostgreSQL schema (unique keys, foreign keys, cascades) so that code
+// tested against it behaves the same with PostgresStorage; the storagetest
+// package checks both against the same contract.
+type MemoryStorage struct {
+	mu sync.Mutex
+
+	users      map[int64]*User
+	nextUserID int64
+	settings   Settings
+	messages   []memoryMessage
+	rateLimits map[int64][]int64
+
+	scenarios        map[int]*FSMScenario
+	steps            map[int]*FSMScenarioStep
+	transitions      map[int]*FSMTransition
+	actions          map[int]*FSMStepAction
+	sessions         map[int64]*UserSession
+	callbackTokens   map[string]*CallbackToken
+	deepLinks        map[string]*DeepLink
+	categories       map[int]*Category
+	products         map[int]*Product
+	nextScenarioID   int
+	nextStepID       int
+	nextTransitionID int
+	nextActionID     int
+	nextCategoryID   int
+	nextProductID    int
+}
+
+type memoryMessage struct {
+	userID    int64
+	text      string
+	direction string
+	createdAt time.Time
+}
+
+// NewMemoryStorage creates an empty in-memory storage with default settings
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:       make(map[int64]*User),
+		settings:    defaultSettings(),
+		rateLimits:  make(map[int64][]int64),
+		scenarios:   make(map[int]*FSMScenario),
+		steps:       make(map[int]*FSMScenarioStep),
+		transitions: make(map[int]*FSMTransition),
+		actions:     make(map[int]*FSMStepAction),
+		sessions:    make(map[int64]*UserSession),
+
+		callbackTokens: make(map[string]*CallbackToken),
+		deepLinks:      make(map[string]*DeepLink),
+		categories:     make(map[int]*Category),
+		products:       make(map[int]*Product),
+	}
+}
+
+// defaultSettings returns the settings a fresh database starts with
+func defaultSettings() Settings {
+	return Settings{
+		ID:                    1,
+		TriggerMessageCount:   4,
+		SiteURL:               "https://example.com",
+		OfferCooldownHours:    24,
+		MaxOffersPerUser:      3,
+		ScenarioTriggerCounts: map[string]int{},
+		UpdatedAt:             time.Now(),
+	}
+}
+
+// GetOrCreateUser retrieves or creates a user
+func (m *MemoryStorage) GetOrCreateUser(telegramID int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[telegramID]
+	if !ok {
+		m.nextUserID++
+		now := time.Now()
+		user = &User{ID: m.nextUserID, TelegramID: telegramID, CreatedAt: now, UpdatedAt: now}
+		m.users[telegramID] = user
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+// UpdateUserMessageCount increments user's message count
+func (m *MemoryStorage) UpdateUserMessageCount(telegramID int64) error {
+	m.updateUser(telegramID, func(user *User) { user.MessageCount++ })
+	return nil
+}
+
+// ResetUserMessageCount resets user's message count to 0
+func (m *MemoryStorage) ResetUserMessageCount(telegramID int64) error {
+	m.updateUser(telegramID, func(user *User) { user.MessageCount = 0 })
+	return nil
+}
+
+// RecordSiteOffer counts an offer of the site link and restarts the message count towards the next one
+func (m *MemoryStorage) RecordSiteOffer(telegramID int64) error {
+	m.updateUser(telegramID, func(user *User) {
+		user.MessageCount = 0
+		user.SiteOffersCount++
+	})
+	return nil
+}
+
+// RecordSiteOfferDeclined remembers that the user declined the site offer now
+func (m *MemoryStorage) RecordSiteOfferDeclined(telegramID int64) error {
+	now := time.Now()
+	m.updateUser(telegramID, func(user *User) { user.SiteOfferDeclinedAt = &now })
+	return nil
+}
+
+// UpdateUserStartPayload remembers the /start payload the user came with and the product it resolved to
+func (m *MemoryStorage) UpdateUserStartPayload(telegramID int64, payload string, productSKU string) error {
+	m.updateUser(telegramID, func(user *User) {
+		user.StartPayload = payload
+		user.ProductSKU = productSKU
+	})
+	return nil
+}
+
+// UpdateUserEmail updates user's email and consent
+func (m *MemoryStorage) UpdateUserEmail(telegramID int64, email string, consentGranted bool) error {
+	m.updateUser(telegramID, func(user *User) {
+		user.Email = email
+		user.ConsentGranted = consentGranted
+	})
+	return nil
+}
+
+// updateUser applies update to an existing user; unknown users are ignored like an UPDATE matching no rows
+func (m *MemoryStorage) updateUser(telegramID int64, update func(user *User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[telegramID]; ok {
+		update(user)
+		user.UpdatedAt = time.Now()
+	}
+}
+
+// GetUser retrieves a user by Telegram ID
+func (m *MemoryStorage) GetUser(telegramID int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[telegramID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// GetSettings retrieves bot settings
+func (m *MemoryStorage) GetSettings() (*Settings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := m.settings
+	copied.ScenarioTriggerCounts = copyTriggerCounts(m.settings.ScenarioTriggerCounts)
+	return &copied, nil
+}
+
+// UpdateSettings updates bot settings
+func (m *MemoryStorage) UpdateSettings(settings *Settings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settings.TriggerMessageCount = settings.TriggerMessageCount
+	m.settings.SiteURL = settings.SiteURL
+	m.settings.OfferCooldownHours = settings.OfferCooldownHours
+	m.settings.MaxOffersPerUser = settings.MaxOffersPerUser
+	m.settings.InterruptScenarios = settings.InterruptScenarios
+	m.settings.ScenarioTriggerCounts = copyTriggerCounts(settings.ScenarioTriggerCounts)
+	m.settings.UpdatedAt = time.Now()
+	return nil
+}
+
+// copyTriggerCounts copies per-scenario trigger counts, giving an empty map for nil like the JSONB column
+func copyTriggerCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int, len(counts))
+	for name, count := range counts {
+		copied[name] = count
+	}
+	return copied
+}
+
+// LogMessage logs a message of an existing user
+func (m *MemoryStorage) LogMessage(userID int64, text string, direction string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("failed to log message: user %d: %w", userID, ErrNotFound)
+	}
+	if direction != "incoming" && direction != "outgoing" {
+		return fmt.Errorf("failed to log message: invalid direction %q", direction)
+	}
+
+	m.messages = append(m.messages, memoryMessage{userID: userID, text: text, direction: direction, createdAt: time.Now()})
+	return nil
+}
+
+// GetActiveUsersCount24h returns count of unique users in last 24 hours
+func (m *MemoryStorage) GetActiveUsersCount24h() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	since := time.Now().Add(-24 * time.Hour)
+	users := make(map[int64]bool)
+	for _, message := range m.messages {
+		if !message.createdAt.Before(since) {
+			users[message.userID] = true
+		}
+	}
+	return int64(len(users)), nil
+}
+
+// GetTotalMessagesCount returns total count of all messages
+func (m *MemoryStorage) GetTotalMessagesCount() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.messages)), nil
+}
+
+// GetUsersByFSMState returns count of users per conversation state
+func (m *MemoryStorage) GetUsersByFSMState() (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64)
+	for telegramID := range m.users {
+		state := SessionStateIdle
+		if session, ok := m.sessions[telegramID]; ok {
+			state = session.State
+		}
+		result[state]++
+	}
+	return result, nil
+}
+
+// CheckRateLimit checks if user exceeded rate limit
+func (m *MemoryStorage) CheckRateLimit(telegramID int64, maxPerMinute int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	var recent []int64
+	for _, ts := range m.rateLimits[telegramID] {
+		if ts >= now-60 {
+			recent = append(recent, ts)
+		}
+	}
+
+	if len(recent) >= maxPerMinute {
+		return false, nil
+	}
+
+	m.rateLimits[telegramID] = append(recent, now)
+	return true, nil
+}
+
+// GetFSMScenarios returns all FSM scenarios ordered by ID
+func (m *MemoryStorage) GetFSMScenarios() ([]*FSMScenario, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var scenarios []*FSMScenario
+	for _, scenario := range m.scenarios {
+		scenarios = append(scenarios, cloneScenario(scenario))
+	}
+	sort.Slice(scenarios, func(i, j int) bool {
+		if scenarios[i].SortOrder != scenarios[j].SortOrder {
+			return scenarios[i].SortOrder < scenarios[j].SortOrder
+		}
+		return scenarios[i].ID < scenarios[j].ID
+	})
+	return scenarios, nil
+}
+
+// GetFSMScenariosByTrigger returns the scenarios matching the trigger message, best first
+func (m *MemoryStorage) GetFSMScenariosByTrigger(message string) ([]*ScenarioMatch, error) {
+	scenarios, err := m.GetFSMScenarios()
+	if err != nil {
+		return nil, err
+	}
+	return MatchScenariosByTrigger(scenarios, message), nil
+}
+
+// GetFSMScenario returns a specific scenario by ID
+func (m *MemoryStorage) GetFSMScenario(id int) (*FSMScenario, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	scenario, ok := m.scenarios[id]
+	if !ok {
+		return nil, nil
+	}
+	return cloneScenario(scenario), nil
+}
+
+// GetFSMScenarioSteps returns all steps for a scenario ordered by ID
+func (m *MemoryStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioStep, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var steps []*FSMScenarioStep
+	for _, step := range m.steps {
+		if step.ScenarioID == scenarioID {
+			steps = append(steps, cloneStep(step))
+		}
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].ID < steps[j].ID })
+	return steps, nil
+}
+
+// GetFSMScenarioStep returns a specific step
+func (m *MemoryStorage) GetFSMScenarioStep(scenarioID int, stepKey string) (*FSMScenarioStep, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	step := m.findStep(scenarioID, stepKey)
+	if step == nil {
+		return nil, nil
+	}
+	return cloneStep(step), nil
+}
+
+// GetUserSession returns user's current FSM session
+func (m *MemoryStorage) GetUserSession(userID int64) (*UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[userID]
+	if !ok {
+		return nil, nil
+	}
+	return cloneSession(session), nil
+}
+
+// PopUserSessionStep moves the session back to the last step in its history
+// and returns the updated session, or nil if there is nowhere to go back to
+func (m *MemoryStorage) PopUserSessionStep(userID int64) (*UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[userID]
+	if !ok || len(session.History) == 0 {
+		return nil, nil
+	}
+
+	last := session.History[len(session.History)-1]
+	session.History = session.History[:len(session.History)-1]
+	scenarioID, stepKey := last.ScenarioID, last.StepKey
+	session.State = SessionStateInScenario
+	session.ScenarioID = &scenarioID
+	session.CurrentStepKey = &stepKey
+	session.UpdatedAt = time.Now()
+
+	return cloneSession(session), nil
+}
+
+// SetUserSessionState moves the session from one position to another. It
+// reports false and changes nothing if the session is no longer at from, so of
+// two concurrent moves of one user only the first applies. Moving to another
+// step pushes the step being left onto the session history; moving to idle
+// removes the session.
+func (m *MemoryStorage) SetUserSessionState(userID int64, from, to SessionPosition) (bool, error) {
+	if from.State == SessionStateIdle && to.State == SessionStateIdle {
+		return false, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[userID]
+	if !session.Position().Equal(from) {
+		return false, nil
+	}
+
+	if to.State == SessionStateIdle {
+		delete(m.sessions, userID)
+		return true, nil
+	}
+
+	// Mirrors the user_sessions_in_scenario_has_step check constraint
+	if to.State == SessionStateInScenario && (to.ScenarioID == nil || to.StepKey == nil) {
+		return false, fmt.Errorf("failed to set user session state: %s session of user %d has no scenario step", to.State, userID)
+	}
+	if to.ScenarioID != nil {
+		if _, ok := m.scenarios[*to.ScenarioID]; !ok {
+			return false, fmt.Errorf("failed to set user session state: scenario %d: %w", *to.ScenarioID, ErrNotFound)
+		}
+	}
+
+	if !ok {
+		session = &UserSession{UserID: userID, History: []SessionStep{}}
+		m.sessions[userID] = session
+	} else if session.CurrentStepKey != nil && !(equalIntPtr(session.ScenarioID, to.ScenarioID) && equalStringPtr(session.CurrentStepKey, to.StepKey)) {
+		left := SessionStep{StepKey: *session.CurrentStepKey}
+		if session.ScenarioID != nil {
+			left.ScenarioID = *session.ScenarioID
+		}
+		if len(session.History) >= MaxSessionHistory {
+			session.History = session.History[1:]
+		}
+		session.History = append(session.History, left)
+	}
+
+	session.State = to.State
+	session.ScenarioID = copyIntPtr(to.ScenarioID)
+	session.CurrentStepKey = copyStringPtr(to.StepKey)
+	session.UpdatedAt = time.Now()
+	return true, nil
+}
+
+// DeleteUserSession deletes a user session
+func (m *MemoryStorage) DeleteUserSession(userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, userID)
+	return nil
+}
+
+// CreateFSMScenario inserts a new scenario and sets its ID
+func (m *MemoryStorage) CreateFSMScenario(scenario *FSMScenario) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.scenarioNameTaken(scenario.Name, 0) {
+		return fmt.Errorf("failed to create FSM scenario %q: %w", scenario.Name, ErrAlreadyExists)
+	}
+	if !m.categoryExists(scenario.CategoryID) {
+		return fmt.Errorf("failed to create FSM scenario %q: category: %w", scenario.Name, ErrNotFound)
+	}
+
+	m.nextScenarioID++
+	scenario.ID = m.nextScenarioID
+	m.scenarios[scenario.ID] = cloneScenario(scenario)
+	return nil
+}
+
+// UpdateFSMScenario updates scenario metadata, trigger keywords and menu placement
+func (m *MemoryStorage) UpdateFSMScenario(scenario *FSMScenario) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.scenarioNameTaken(scenario.Name, scenario.ID) {
+		return fmt.Errorf("failed to update FSM scenario %q: %w", scenario.Name, ErrAlreadyExists)
+	}
+	if _, ok := m.scenarios[scenario.ID]; !ok {
+		return fmt.Errorf("FSM scenario: %w", ErrNotFound)
+	}
+	if !m.categoryExists(scenario.CategoryID) {
+		return fmt.Errorf("failed to update FSM scenario %q: category: %w", scenario.Name, ErrNotFound)
+	}
+
+	m.scenarios[scenario.ID] = cloneScenario(scenario)
+	return nil
+}
+
+// DeleteFSMScenario deletes a scenario with its steps and the sessions currently inside it
+func (m *MemoryStorage) DeleteFSMScenario(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.scenarios[id]; !ok {
+		return fmt.Errorf("FSM scenario: %w", ErrNotFound)
+	}
+
+	for userID, session := range m.sessions {
+		if session.ScenarioID != nil && *session.ScenarioID == id {
+			delete(m.sessions, userID)
+			continue
+		}
+		history := session.History[:0]
+		for _, entry := range session.History {
+			if entry.ScenarioID != id {
+				history = append(history, entry)
+			}
+		}
+		session.History = history
+	}
+
+	for stepID, step := range m.steps {
+		if step.ScenarioID == id {
+			delete(m.steps, stepID)
+		}
+	}
+	for transitionID, transition := range m.transitions {
+		if transition.ScenarioID == id {
+			delete(m.transitions, transitionID)
+		}
+	}
+	for actionID, action := range m.actions {
+		if action.ScenarioID == id {
+			delete(m.actions, actionID)
+		}
+	}
+	for _, link := range m.deepLinks {
+		if link.ScenarioID != nil && *link.ScenarioID == id {
+			link.ScenarioID = nil
+		}
+	}
+	for _, product := range m.products {
+		scenarioIDs := product.ScenarioIDs[:0]
+		for _, scenarioID := range product.ScenarioIDs {
+			if scenarioID != id {
+				scenarioIDs = append(scenarioIDs, scenarioID)
+			}
+		}
+		product.ScenarioIDs = scenarioIDs
+	}
+	delete(m.scenarios, id)
+	return nil
+}
+
+// CreateFSMScenarioStep inserts a new step and sets its ID
+func (m *MemoryStorage) CreateFSMScenarioStep(step *FSMScenarioStep) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.scenarios[step.ScenarioID]; !ok {
+		return fmt.Errorf("failed to create FSM scenario step: scenario %d: %w", step.ScenarioID, ErrNotFound)
+	}
+	if m.findStep(step.ScenarioID, step.StepKey) != nil {
+		return fmt.Errorf("failed to create FSM scenario step %q: %w", step.StepKey, ErrAlreadyExists)
+	}
+	if err := checkStateType(step.StateType); err != nil {
+		return fmt.Errorf("failed to create FSM scenario step: %w", err)
+	}
+
+	m.nextStepID++
+	step.ID = m.nextStepID
+	m.steps[step.ID] = cloneStep(step)
+	return nil
+}
+
+// UpdateFSMScenarioStep updates a step identified by scenario ID and step key
+func (m *MemoryStorage) UpdateFSMScenarioStep(step *FSMScenarioStep) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := m.findStep(step.ScenarioID, step.StepKey)
+	if existing == nil {
+		return fmt.Errorf("failed to update FSM scenario step %q: %w", step.StepKey, ErrNotFound)
+	}
+	if err := checkStateType(step.StateType); err != nil {
+		return fmt.Errorf("failed to update FSM scenario step: %w", err)
+	}
+
+	step.ID = existing.ID
+	m.steps[step.ID] = cloneStep(step)
+	return nil
+}
+
+// DeleteFSMScenarioStep deletes a step with the transitions and actions
+// referencing it and resets sessions that are parked on it
+func (m *MemoryStorage) DeleteFSMScenarioStep(scenarioID int, stepKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	step := m.findStep(scenarioID, stepKey)
+	if step == nil {
+		return fmt.Errorf("FSM scenario step: %w", ErrNotFound)
+	}
+
+	for userID, session := range m.sessions {
+		if equalIntPtr(session.ScenarioID, &scenarioID) && equalStringPtr(session.CurrentStepKey, &stepKey) {
+			delete(m.sessions, userID)
+		}
+	}
+	for transitionID, transition := range m.transitions {
+		if transition.ScenarioID == scenarioID && (transition.FromStepKey == stepKey || transition.ToStepKey == stepKey) {
+			delete(m.transitions, transitionID)
+		}
+	}
+	for actionID, action := range m.actions {
+		if action.ScenarioID == scenarioID && (action.StepKey == stepKey || action.ActionStepKey == stepKey) {
+			delete(m.actions, actionID)
+		}
+	}
+	delete(m.steps, step.ID)
+	return nil
+}
+
+// GetFSMTransitions returns transitions leaving a step, ordered for display
+func (m *MemoryStorage) GetFSMTransitions(scenarioID int, fromStepKey string) ([]*FSMTransition, error) {
+	return m.listTransitions(func(t *FSMTransition) bool {
+		return t.ScenarioID == scenarioID && t.FromStepKey == fromStepKey
+	}), nil
+}
+
+// GetFSMScenarioTransitions returns all transitions of a scenario
+func (m *MemoryStorage) GetFSMScenarioTransitions(scenarioID int) ([]*FSMTransition, error) {
+	return m.listTransitions(func(t *FSMTransition) bool { return t.ScenarioID == scenarioID }), nil
+}
+
+// GetFSMTransition returns a specific transition of a scenario
+func (m *MemoryStorage) GetFSMTransition(scenarioID int, id int) (*FSMTransition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transition, ok := m.transitions[id]
+	if !ok || transition.ScenarioID != scenarioID {
+		return nil, nil
+	}
+	return cloneTransition(transition), nil
+}
+
+// listTransitions returns matching transitions ordered by source step, sort order and ID
+func (m *MemoryStorage) listTransitions(match func(t *FSMTransition) bool) []*FSMTransition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var transitions []*FSMTransition
+	for _, transition := range m.transitions {
+		if match(transition) {
+			transitions = append(transitions, cloneTransition(transition))
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		a, b := transitions[i], transitions[j]
+		if a.FromStepKey != b.FromStepKey {
+			return a.FromStepKey < b.FromStepKey
+		}
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		return a.ID < b.ID
+	})
+	return transitions
+}
+
+// CreateFSMTransition inserts a new transition and sets its ID
+func (m *MemoryStorage) CreateFSMTransition(transition *FSMTransition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkTransition(transition); err != nil {
+		return fmt.Errorf("failed to create FSM transition %s -> %s: %w", transition.FromStepKey, transition.ToStepKey, err)
+	}
+
+	m.nextTransitionID++
+	transition.ID = m.nextTransitionID
+	m.transitions[transition.ID] = cloneTransition(transition)
+	return nil
+}
+
+// UpdateFSMTransition updates a transition identified by scenario ID and transition ID
+func (m *MemoryStorage) UpdateFSMTransition(transition *FSMTransition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkTransition(transition); err != nil {
+		return fmt.Errorf("failed to update FSM transition %s -> %s: %w", transition.FromStepKey, transition.ToStepKey, err)
+	}
+	existing, ok := m.transitions[transition.ID]
+	if !ok || existing.ScenarioID != transition.ScenarioID {
+		return fmt.Errorf("FSM transition: %w", ErrNotFound)
+	}
+
+	m.transitions[transition.ID] = cloneTransition(transition)
+	return nil
+}
+
+// DeleteFSMTransition deletes a transition
+func (m *MemoryStorage) DeleteFSMTransition(scenarioID int, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transition, ok := m.transitions[id]
+	if !ok || transition.ScenarioID != scenarioID {
+		return fmt.Errorf("FSM transition: %w", ErrNotFound)
+	}
+	delete(m.transitions, id)
+	return nil
+}
+
+// checkTransition enforces the unique and foreign keys of fsm_transitions
+func (m *MemoryStorage) checkTransition(transition *FSMTransition) error {
+	for _, other := range m.transitions {
+		if other.ID != transition.ID && other.ScenarioID == transition.ScenarioID &&
+			other.FromStepKey == transition.FromStepKey && other.ToStepKey == transition.ToStepKey {
+			return ErrAlreadyExists
+		}
+	}
+	if m.findStep(transition.ScenarioID, transition.FromStepKey) == nil || m.findStep(transition.ScenarioID, transition.ToStepKey) == nil {
+		return fmt.Errorf("step: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// GetFSMStepActions returns the action group of a step, ordered for display
+func (m *MemoryStorage) GetFSMStepActions(scenarioID int, stepKey string) ([]*FSMStepAction, error) {
+	return m.listActions(func(a *FSMStepAction) bool {
+		return a.ScenarioID == scenarioID && a.StepKey == stepKey
+	}), nil
+}
+
+// GetFSMScenarioActions returns all action groups of a scenario
+func (m *MemoryStorage) GetFSMScenarioActions(scenarioID int) ([]*FSMStepAction, error) {
+	return m.listActions(func(a *FSMStepAction) bool { return a.ScenarioID == scenarioID }), nil
+}
+
+// GetFSMStepAction returns a specific action of a scenario
+func (m *MemoryStorage) GetFSMStepAction(scenarioID int, id int) (*FSMStepAction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	action, ok := m.actions[id]
+	if !ok || action.ScenarioID != scenarioID {
+		return nil, nil
+	}
+	copied := *action
+	return &copied, nil
+}
+
+// listActions returns matching actions ordered by step, sort order and ID
+func (m *MemoryStorage) listActions(match func(a *FSMStepAction) bool) []*FSMStepAction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var actions []*FSMStepAction
+	for _, action := range m.actions {
+		if match(action) {
+			copied := *action
+			actions = append(actions, &copied)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		a, b := actions[i], actions[j]
+		if a.StepKey != b.StepKey {
+			return a.StepKey < b.StepKey
+		}
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		return a.ID < b.ID
+	})
+	return actions
+}
+
+// CreateFSMStepAction inserts a new action into a step's group and sets its ID
+func (m *MemoryStorage) CreateFSMStepAction(action *FSMStepAction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkAction(action); err != nil {
+		return fmt.Errorf("failed to create FSM step action %s -> %s: %w", action.StepKey, action.ActionStepKey, err)
+	}
+
+	m.nextActionID++
+	action.ID = m.nextActionID
+	copied := *action
+	m.actions[action.ID] = &copied
+	return nil
+}
+
+// UpdateFSMStepAction updates an action identified by scenario ID and action ID
+func (m *MemoryStorage) UpdateFSMStepAction(action *FSMStepAction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkAction(action); err != nil {
+		return fmt.Errorf("failed to update FSM step action %s -> %s: %w", action.StepKey, action.ActionStepKey, err)
+	}
+	existing, ok := m.actions[action.ID]
+	if !ok || existing.ScenarioID != action.ScenarioID {
+		return fmt.Errorf("FSM step action: %w", ErrNotFound)
+	}
+
+	copied := *action
+	m.actions[action.ID] = &copied
+	return nil
+}
+
+// DeleteFSMStepAction deletes an action from its group
+func (m *MemoryStorage) DeleteFSMStepAction(scenarioID int, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	action, ok := m.actions[id]
+	if !ok || action.ScenarioID != scenarioID {
+		return fmt.Errorf("FSM step action: %w", ErrNotFound)
+	}
+	delete(m.actions, id)
+	return nil
+}
+
+// checkAction enforces the unique and foreign keys of fsm_step_actions
+func (m *MemoryStorage) checkAction(action *FSMStepAction) error {
+	for _, other := range m.actions {
+		if other.ID != action.ID && other.ScenarioID == action.ScenarioID &&
+			other.StepKey == action.StepKey && other.ActionStepKey == action.ActionStepKey {
+			return ErrAlreadyExists
+		}
+	}
+	if m.findStep(action.ScenarioID, action.StepKey) == nil || m.findStep(action.ScenarioID, action.ActionStepKey) == nil {
+		return fmt.Errorf("step: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// SaveCallbackToken stores a callback token
+func (m *MemoryStorage) SaveCallbackToken(token *CallbackToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.callbackTokens[token.Token]; ok {
+		return fmt.Errorf("failed to save callback token: %w", ErrAlreadyExists)
+	}
+	copied := *token
+	m.callbackTokens[token.Token] = &copied
+	return nil
+}
+
+// GetCallbackToken returns a callback token, or nil if it is unknown or expired
+func (m *MemoryStorage) GetCallbackToken(token string) (*CallbackToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.callbackTokens[token]
+	if !ok || !t.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	copied := *t
+	return &copied, nil
+}
+
+// DeleteExpiredCallbackTokens deletes expired callback tokens and returns how many were deleted
+func (m *MemoryStorage) DeleteExpiredCallbackTokens() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	now := time.Now()
+	for key, t := range m.callbackTokens {
+		if !t.ExpiresAt.After(now) {
+			delete(m.callbackTokens, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetDeepLinks returns all deep links ordered by payload
+func (m *MemoryStorage) GetDeepLinks() ([]*DeepLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var links []*DeepLink
+	for _, link := range m.deepLinks {
+		links = append(links, copyDeepLink(link))
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Payload < links[j].Payload })
+	return links, nil
+}
+
+// GetDeepLink returns the deep link of a payload, or nil if there is none
+func (m *MemoryStorage) GetDeepLink(payload string) (*DeepLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.deepLinks[payload]
+	if !ok {
+		return nil, nil
+	}
+	return copyDeepLink(link), nil
+}
+
+// CreateDeepLink creates a deep link
+func (m *MemoryStorage) CreateDeepLink(link *DeepLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.deepLinks[link.Payload]; ok {
+		return fmt.Errorf("failed to create deep link %s: %w", link.Payload, ErrAlreadyExists)
+	}
+	if link.ScenarioID != nil {
+		if _, ok := m.scenarios[*link.ScenarioID]; !ok {
+			return fmt.Errorf("failed to create deep link %s: scenario: %w", link.Payload, ErrNotFound)
+		}
+	}
+
+	now := time.Now()
+	link.CreatedAt = now
+	link.UpdatedAt = now
+	m.deepLinks[link.Payload] = copyDeepLink(link)
+	return nil
+}
+
+// UpdateDeepLink updates the product and target of a deep link identified by its payload
+func (m *MemoryStorage) UpdateDeepLink(link *DeepLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.deepLinks[link.Payload]
+	if !ok {
+		return fmt.Errorf("deep link: %w", ErrNotFound)
+	}
+	if link.ScenarioID != nil {
+		if _, ok := m.scenarios[*link.ScenarioID]; !ok {
+			return fmt.Errorf("failed to update deep link %s: scenario: %w", link.Payload, ErrNotFound)
+		}
+	}
+
+	link.CreatedAt = existing.CreatedAt
+	link.UpdatedAt = time.Now()
+	m.deepLinks[link.Payload] = copyDeepLink(link)
+	return nil
+}
+
+// DeleteDeepLink deletes a deep link
+func (m *MemoryStorage) DeleteDeepLink(payload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.deepLinks[payload]; !ok {
+		return fmt.Errorf("deep link: %w", ErrNotFound)
+	}
+	delete(m.deepLinks, payload)
+	return nil
+}
+
+// copyDeepLink copies a deep link together with its pointer fields
+func copyDeepLink(link *DeepLink) *DeepLink {
+	copied := *link
+	if link.ScenarioID != nil {
+		id := *link.ScenarioID
+		copied.ScenarioID = &id
+	}
+	if link.StepKey != nil {
+		key := *link.StepKey
+		copied.StepKey = &key
+	}
+	return &copied
+}
+
+// GetCategories returns all categories in menu order
+func (m *MemoryStorage) GetCategories() ([]*Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var categories []*Category
+	for _, category := range m.categories {
+		copied := *category
+		categories = append(categories, &copied)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].SortOrder != categories[j].SortOrder {
+			return categories[i].SortOrder < categories[j].SortOrder
+		}
+		return categories[i].Name < categories[j].Name
+	})
+	return categories, nil
+}
+
+// GetCategory returns a category by ID, or nil if there is none
+func (m *MemoryStorage) GetCategory(id int) (*Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	category, ok := m.categories[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *category
+	return &copied, nil
+}
+
+// CreateCategory inserts a new category and sets its ID
+func (m *MemoryStorage) CreateCategory(category *Category) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.categoryNameTaken(category.Name, 0) {
+		return fmt.Errorf("failed to create category %q: %w", category.Name, ErrAlreadyExists)
+	}
+
+	m.nextCategoryID++
+	category.ID = m.nextCategoryID
+	copied := *category
+	m.categories[category.ID] = &copied
+	return nil
+}
+
+// UpdateCategory updates a category identified by its ID
+func (m *MemoryStorage) UpdateCategory(category *Category) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.categories[category.ID]; !ok {
+		return fmt.Errorf("category: %w", ErrNotFound)
+	}
+	if m.categoryNameTaken(category.Name, category.ID) {
+		return fmt.Errorf("failed to update category %q: %w", category.Name, ErrAlreadyExists)
+	}
+
+	copied := *category
+	m.categories[category.ID] = &copied
+	return nil
+}
+
+// DeleteCategory deletes a category; its products and scenarios are left without one
+func (m *MemoryStorage) DeleteCategory(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.categories[id]; !ok {
+		return fmt.Errorf("category: %w", ErrNotFound)
+	}
+	for _, product := range m.products {
+		if product.CategoryID != nil && *product.CategoryID == id {
+			product.CategoryID = nil
+		}
+	}
+	for _, scenario := range m.scenarios {
+		if scenario.CategoryID != nil && *scenario.CategoryID == id {
+			scenario.CategoryID = nil
+		}
+	}
+	delete(m.categories, id)
+	return nil
+}
+
+// GetProducts returns all products ordered by SKU
+func (m *MemoryStorage) GetProducts() ([]*Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var products []*Product
+	for _, product := range m.products {
+		products = append(products, copyProduct(product))
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].SKU < products[j].SKU })
+	return products, nil
+}
+
+// GetProduct returns a product by ID, or nil if there is none
+func (m *MemoryStorage) GetProduct(id int) (*Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	product, ok := m.products[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyProduct(product), nil
+}
+
+// GetProductBySKU returns the product with a SKU, or nil if there is none
+func (m *MemoryStorage) GetProductBySKU(sku string) (*Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, product := range m.products {
+		if product.SKU == sku {
+			return copyProduct(product), nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateProduct inserts a new product with its scenario links and sets its ID
+func (m *MemoryStorage) CreateProduct(product *Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.productSKUTaken(product.SKU, 0) {
+		return fmt.Errorf("failed to create product %s: %w", product.SKU, ErrAlreadyExists)
+	}
+	if err := m.checkProductReferences(product); err != nil {
+		return fmt.Errorf("failed to create product %s: %w", product.SKU, err)
+	}
+
+	m.nextProductID++
+	now := time.Now()
+	product.ID = m.nextProductID
+	product.CreatedAt = now
+	product.UpdatedAt = now
+	m.products[product.ID] = copyProduct(product)
+	return nil
+}
+
+// UpdateProduct updates a product identified by its ID and replaces its scenario links
+func (m *MemoryStorage) UpdateProduct(product *Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.products[product.ID]
+	if !ok {
+		return fmt.Errorf("product: %w", ErrNotFound)
+	}
+	if m.productSKUTaken(product.SKU, product.ID) {
+		return fmt.Errorf("failed to update product %s: %w", product.SKU, ErrAlreadyExists)
+	}
+	if err := m.checkProductReferences(product); err != nil {
+		return fmt.Errorf("failed to update product %s: %w", product.SKU, err)
+	}
+
+	product.CreatedAt = existing.CreatedAt
+	product.UpdatedAt = time.Now()
+	m.products[product.ID] = copyProduct(product)
+	return nil
+}
+
+// DeleteProduct deletes a product with its scenario links
+func (m *MemoryStorage) DeleteProduct(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.products[id]; !ok {
+		return fmt.Errorf("product: %w", ErrNotFound)
+	}
+	delete(m.products, id)
+	return nil
+}
+
+// checkProductReferences mirrors the foreign keys of products and product_scenarios; the caller holds the lock
+func (m *MemoryStorage) checkProductReferences(product *Product) error {
+	if !m.categoryExists(product.CategoryID) {
+		return fmt.Errorf("category: %w", ErrNotFound)
+	}
+	for _, scenarioID := range product.ScenarioIDs {
+		if _, ok := m.scenarios[scenarioID]; !ok {
+			return fmt.Errorf("scenario %d: %w", scenarioID, ErrNotFound)
+		}
+	}
+	return nil
+}
+
+// categoryExists reports whether a nullable category reference is valid; the caller holds the lock
+func (m *MemoryStorage) categoryExists(id *int) bool {
+	if id == nil {
+		return true
+	}
+	_, ok := m.categories[*id]
+	return ok
+}
+
+// categoryNameTaken reports whether another category uses name; the caller holds the lock
+func (m *MemoryStorage) categoryNameTaken(name string, exceptID int) bool {
+	for _, category := range m.categories {
+		if category.ID != exceptID && category.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// productSKUTaken reports whether another product uses sku; the caller holds the lock
+func (m *MemoryStorage) productSKUTaken(sku string, exceptID int) bool {
+	for _, product := range m.products {
+		if product.ID != exceptID && product.SKU == sku {
+			return true
+		}
+	}
+	return false
+}
+
+// copyProduct copies a product together with its specs and scenario links.
+// Scenario links are kept sorted and without duplicates, like the primary key of product_scenarios.
+func copyProduct(product *Product) *Product {
+	copied := *product
+	copied.CategoryID = copyIntPtr(product.CategoryID)
+	copied.Specs = make(map[string]string, len(product.Specs))
+	for name, value := range product.Specs {
+		copied.Specs[name] = value
+	}
+	copied.ScenarioIDs = []int{}
+	for _, id := range product.ScenarioIDs {
+		if !containsInt(copied.ScenarioIDs, id) {
+			copied.ScenarioIDs = append(copied.ScenarioIDs, id)
+		}
+	}
+	sort.Ints(copied.ScenarioIDs)
+	return &copied
+}
+
+// containsInt reports whether values contains value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Close does nothing; the data lives as long as the MemoryStorage
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// findStep returns the stored step or nil; the caller holds the lock
+func (m *MemoryStorage) findStep(scenarioID int, stepKey string) *FSMScenarioStep {
+	for _, step := range m.steps {
+		if step.ScenarioID == scenarioID && step.StepKey == stepKey {
+			return step
+		}
+	}
+	return nil
+}
+
+// scenarioNameTaken reports whether another scenario uses name; the caller holds the lock
+func (m *MemoryStorage) scenarioNameTaken(name string, exceptID int) bool {
+	for _, scenario := range m.scenarios {
+		if scenario.ID != exceptID && scenario.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStateType mirrors the CHECK constraint on fsm_steps.state_type
+func checkStateType(stateType string) error {
+	switch stateType {
+	case "start", "intermediate", "final":
+		return nil
+	default:
+		return fmt.Errorf("invalid state_type %q", stateType)
+	}
+}
+
+func cloneSession(session *UserSession) *UserSession {
+	copied := *session
+	copied.ScenarioID = copyIntPtr(session.ScenarioID)
+	copied.CurrentStepKey = copyStringPtr(session.CurrentStepKey)
+	copied.History = append([]SessionStep{}, session.History...)
+	return &copied
+}
+
+func copyIntPtr(p *int) *int {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copyStringPtr(p *string) *string {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func equalIntPtr(a, b *int) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func equalStringPtr(a, b *string) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
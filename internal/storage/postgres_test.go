@@ -0,0 +1,58 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/migrate"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage/storagetest"
+	"github.com/ZorinIvanA/tgbot-electro-tools/migrations"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPostgresStorage runs the storage contract against a real database.
+// It is skipped unless TEST_DB_NAME names a database that may be wiped;
+// the other connection parameters come from the usual DB_* variables.
+func TestPostgresStorage(t *testing.T) {
+	dbname := os.Getenv("TEST_DB_NAME")
+	if dbname == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+
+	host, port := getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432")
+	user, password := getEnv("DB_USER", "postgres"), getEnv("DB_PASSWORD", "postgres")
+	sslmode := getEnv("DB_SSLMODE", "disable")
+
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		host, port, user, password, dbname, sslmode))
+	require.NoError(t, err)
+	defer db.Close()
+
+	all, err := migrate.Load(migrations.FS)
+	require.NoError(t, err)
+	require.NoError(t, migrate.NewMigrator(db, all).Up(context.Background(), 0))
+
+	s, err := storage.NewPostgresStorage(host, port, user, password, dbname, sslmode)
+	require.NoError(t, err)
+	defer s.Close()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		_, err := db.Exec(`TRUNCATE users, messages, rate_limits, user_sessions, callback_tokens, fsm_scenarios, categories, products RESTART IDENTITY CASCADE`)
+		require.NoError(t, err)
+		_, err = db.Exec(`UPDATE settings SET trigger_message_count = 4, site_url = 'https://example.com' WHERE id = 1`)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
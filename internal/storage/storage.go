@@ -2,21 +2,35 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/lib/pq"
 )
 
+// ErrNotFound is returned by write operations when the target row does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyExists is returned when a write violates a uniqueness constraint
+var ErrAlreadyExists = errors.New("already exists")
+
 // Storage represents database storage interface
 type Storage interface {
 	// User operations
 	GetOrCreateUser(telegramID int64) (*User, error)
 	UpdateUserMessageCount(telegramID int64) error
 	ResetUserMessageCount(telegramID int64) error
-	UpdateUserFSMState(telegramID int64, state string) error
+	RecordSiteOffer(telegramID int64) error
+	RecordSiteOfferDeclined(telegramID int64) error
+	UpdateUserStartPayload(telegramID int64, payload string, productSKU string) error
 	UpdateUserEmail(telegramID int64, email string, consentGranted bool) error
 	GetUser(telegramID int64) (*User, error)
 
@@ -37,14 +51,64 @@ type Storage interface {
 
 	// FSM operations
 	GetFSMScenarios() ([]*FSMScenario, error)
-	GetFSMScenarioByTrigger(message string) (*FSMScenario, error)
+	GetFSMScenariosByTrigger(message string) ([]*ScenarioMatch, error)
 	GetFSMScenario(id int) (*FSMScenario, error)
 	GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioStep, error)
 	GetFSMScenarioStep(scenarioID int, stepKey string) (*FSMScenarioStep, error)
 	GetUserSession(userID int64) (*UserSession, error)
-	UpdateUserSession(userID int64, scenarioID *int, stepKey *string) error
+	PopUserSessionStep(userID int64) (*UserSession, error)
+	SetUserSessionState(userID int64, from, to SessionPosition) (bool, error)
 	DeleteUserSession(userID int64) error
 
+	// FSM administration
+	CreateFSMScenario(scenario *FSMScenario) error
+	UpdateFSMScenario(scenario *FSMScenario) error
+	DeleteFSMScenario(id int) error
+	CreateFSMScenarioStep(step *FSMScenarioStep) error
+	UpdateFSMScenarioStep(step *FSMScenarioStep) error
+	DeleteFSMScenarioStep(scenarioID int, stepKey string) error
+
+	// FSM transitions
+	GetFSMTransitions(scenarioID int, fromStepKey string) ([]*FSMTransition, error)
+	GetFSMScenarioTransitions(scenarioID int) ([]*FSMTransition, error)
+	GetFSMTransition(scenarioID int, id int) (*FSMTransition, error)
+	CreateFSMTransition(transition *FSMTransition) error
+	UpdateFSMTransition(transition *FSMTransition) error
+	DeleteFSMTransition(scenarioID int, id int) error
+
+	// FSM action groups
+	GetFSMStepActions(scenarioID int, stepKey string) ([]*FSMStepAction, error)
+	GetFSMScenarioActions(scenarioID int) ([]*FSMStepAction, error)
+	GetFSMStepAction(scenarioID int, id int) (*FSMStepAction, error)
+	CreateFSMStepAction(action *FSMStepAction) error
+	UpdateFSMStepAction(action *FSMStepAction) error
+	DeleteFSMStepAction(scenarioID int, id int) error
+
+	// Callback tokens
+	SaveCallbackToken(token *CallbackToken) error
+	GetCallbackToken(token string) (*CallbackToken, error)
+	DeleteExpiredCallbackTokens() (int64, error)
+
+	// Deep links
+	GetDeepLinks() ([]*DeepLink, error)
+	GetDeepLink(payload string) (*DeepLink, error)
+	CreateDeepLink(link *DeepLink) error
+	UpdateDeepLink(link *DeepLink) error
+	DeleteDeepLink(payload string) error
+
+	// Product catalog
+	GetCategories() ([]*Category, error)
+	GetCategory(id int) (*Category, error)
+	CreateCategory(category *Category) error
+	UpdateCategory(category *Category) error
+	DeleteCategory(id int) error
+	GetProducts() ([]*Product, error)
+	GetProduct(id int) (*Product, error)
+	GetProductBySKU(sku string) (*Product, error)
+	CreateProduct(product *Product) error
+	UpdateProduct(product *Product) error
+	DeleteProduct(id int) error
+
 	// Close database connection
 	Close() error
 }
@@ -54,11 +118,18 @@ type User struct {
 	ID             int64
 	TelegramID     int64
 	MessageCount   int
-	FSMState       string
 	Email          string
 	ConsentGranted bool
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
+	// SiteOffersCount is how many times the user was offered the site link
+	SiteOffersCount int
+	// SiteOfferDeclinedAt is when the user last declined the offer, nil if never
+	SiteOfferDeclinedAt *time.Time
+	// StartPayload is the /start payload the user last came with and
+	// ProductSKU the product it was resolved to, for attribution
+	StartPayload string
+	ProductSKU   string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 // Settings represents bot configuration
@@ -66,7 +137,13 @@ type Settings struct {
 	ID                  int
 	TriggerMessageCount int
 	SiteURL             string
-	UpdatedAt           time.Time
+	// Site offer policy, see fsm.DefaultOfferPolicy. Zero cooldown and cap disable them.
+	OfferCooldownHours int
+	MaxOffersPerUser   int
+	InterruptScenarios bool
+	// ScenarioTriggerCounts overrides TriggerMessageCount for users in the named scenarios
+	ScenarioTriggerCounts map[string]int
+	UpdatedAt             time.Time
 }
 
 // FSMScenario represents a scenario in the FSM
@@ -75,7 +152,27 @@ type FSMScenario struct {
 	Name            string
 	DisplayName     string
 	TriggerKeywords []string
-	Description     string
+	// ToolKeywords name the tool the scenario is about ("лобзик", "болгарка").
+	// They start the scenario like trigger keywords and outrank them in matching.
+	ToolKeywords []string
+	Description  string
+	// CategoryID is the category the scenario is listed under in the menu, nil for the top level
+	CategoryID *int
+	// HiddenFromMenu keeps the scenario out of the menu (visible_in_menu = FALSE);
+	// the zero value lists it, like the column default
+	HiddenFromMenu bool
+	// SortOrder is the position in the menu; GetFSMScenarios orders by it, then by ID
+	SortOrder int
+}
+
+// ScenarioMatch is a scenario with trigger keywords found in a message
+type ScenarioMatch struct {
+	Scenario *FSMScenario
+	// Tools counts the matched tool keywords
+	Tools int
+	// Score sums the lengths of the matched keywords, so more and longer
+	// (more specific) keywords score higher
+	Score int
 }
 
 // FSMScenarioStep represents a step in an FSM scenario
@@ -87,19 +184,151 @@ type FSMScenarioStep struct {
 	IsFinal     bool
 	NextStepKey *string
 	StateType   string
+	// Input names the validator free text must pass before the step moves on to NextStepKey
+	Input      string
+	InputError string
+	// Effects name the side effects run when a user enters the step
+	Effects []string
+}
+
+// FSMTransition represents a button leading from one step to another
+type FSMTransition struct {
+	ID          int
+	ScenarioID  int
+	FromStepKey string
+	ToStepKey   string
+	ButtonLabel string
+	SortOrder   int
+	Condition   *string
+}
+
+// FSMStepAction represents one terminal action offered on an action-selection step
+type FSMStepAction struct {
+	ID            int
+	ScenarioID    int
+	StepKey       string
+	ActionStepKey string
+	Label         string
+	SortOrder     int
 }
 
-// UserSession represents a user's current FSM session
+// FSMScenarioGraph is a scenario together with its steps, transitions and action groups
+type FSMScenarioGraph struct {
+	Scenario    *FSMScenario
+	Steps       []*FSMScenarioStep
+	Transitions []*FSMTransition
+	Actions     []*FSMStepAction
+}
+
+// Session states. A user without a session row is idle.
+const (
+	SessionStateIdle       = "idle"
+	SessionStateInScenario = "in_scenario"
+)
+
+// UserSession represents a user's conversation state: the scenario step the
+// user is on and the steps visited before it
 type UserSession struct {
 	UserID         int64
+	State          string
 	ScenarioID     *int
 	CurrentStepKey *string
+	History        []SessionStep
 	UpdatedAt      time.Time
 }
 
+// SessionPosition is where a conversation is: its state and, in a scenario,
+// the step it is at. An idle conversation has no step.
+type SessionPosition struct {
+	State      string
+	ScenarioID *int
+	StepKey    *string
+}
+
+// IdlePosition is the position of a conversation outside any scenario
+var IdlePosition = SessionPosition{State: SessionStateIdle}
+
+// StepPosition returns the position of a conversation at a scenario step
+func StepPosition(scenarioID int, stepKey string) SessionPosition {
+	return SessionPosition{State: SessionStateInScenario, ScenarioID: &scenarioID, StepKey: &stepKey}
+}
+
+// Equal reports whether two positions are the same state and step
+func (p SessionPosition) Equal(other SessionPosition) bool {
+	return p.State == other.State && equalIntPtr(p.ScenarioID, other.ScenarioID) && equalStringPtr(p.StepKey, other.StepKey)
+}
+
+// Position returns where the session is. A nil session, or one left idle
+// with a stale step, is at IdlePosition.
+func (s *UserSession) Position() SessionPosition {
+	if s == nil || s.State == SessionStateIdle {
+		return IdlePosition
+	}
+	return SessionPosition{State: s.State, ScenarioID: s.ScenarioID, StepKey: s.CurrentStepKey}
+}
+
+// SessionStep is a step the user left, oldest first in UserSession.History
+type SessionStep struct {
+	ScenarioID int    `json:"scenario_id"`
+	StepKey    string `json:"step_key"`
+}
+
+// MaxSessionHistory is how many visited steps a session remembers
+const MaxSessionHistory = 50
+
+// CallbackToken maps the short token sent as button callback data to the action of the button
+type CallbackToken struct {
+	Token       string
+	UserID      int64
+	Kind        string
+	ScenarioID  int
+	FromStepKey string
+	StepKey     string
+	Value       string
+	ExpiresAt   time.Time
+}
+
+// DeepLink maps a /start payload to a product and, optionally, the scenario
+// and step the bot opens for it. ScenarioID becomes nil when the scenario is
+// deleted; a StepKey that no longer exists falls back to the first step.
+type DeepLink struct {
+	Payload    string
+	ProductSKU string
+	ScenarioID *int
+	StepKey    *string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Category groups products and the scenarios of the menu (grinders, saws, mowers...)
+type Category struct {
+	ID          int
+	Name        string
+	DisplayName string
+	// SortOrder is the position in the menu; GetCategories orders by it, then by name
+	SortOrder int
+}
+
+// Product is a tool model in the catalog. ScenarioIDs are the scenarios that
+// apply to it. Deleting a category leaves its products without one; deleting a
+// scenario unlinks it from every product.
+type Product struct {
+	ID         int
+	SKU        string
+	Model      string
+	CategoryID *int
+	// Specs are free-form characteristics by name, e.g. "brushes": "6x10 мм"
+	Specs       map[string]string
+	ManualURL   string
+	ScenarioIDs []int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
 // PostgresStorage implements Storage interface for PostgreSQL
 type PostgresStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	connStr string
 }
 
 // NewPostgresStorage creates a new PostgreSQL storage instance
@@ -122,7 +351,7 @@ func NewPostgresStorage(host, port, user, password, dbname, sslmode string) (*Po
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
-	return &PostgresStorage{db: db}, nil
+	return &PostgresStorage{db: db, connStr: connStr}, nil
 }
 
 // GetOrCreateUser retrieves or creates a user
@@ -130,21 +359,25 @@ func (s *PostgresStorage) GetOrCreateUser(telegramID int64) (*User, error) {
 	user := &User{}
 
 	query := `
-		INSERT INTO users (telegram_id, message_count, fsm_state)
-		VALUES ($1, 0, 'idle')
+		INSERT INTO users (telegram_id, message_count)
+		VALUES ($1, 0)
 		ON CONFLICT (telegram_id) DO NOTHING
-		RETURNING id, telegram_id, message_count, fsm_state, email, consent_granted, created_at, updated_at
+		RETURNING id, telegram_id, message_count, email, consent_granted, site_offers_count, site_offer_declined_at, start_payload, product_sku, created_at, updated_at
 	`
 
 	var nullEmail sql.NullString
 	var nullConsent sql.NullBool
+	var declinedAt sql.NullTime
 	err := s.db.QueryRow(query, telegramID).Scan(
 		&user.ID,
 		&user.TelegramID,
 		&user.MessageCount,
-		&user.FSMState,
 		&nullEmail,
 		&nullConsent,
+		&user.SiteOffersCount,
+		&declinedAt,
+		&user.StartPayload,
+		&user.ProductSKU,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -161,6 +394,9 @@ func (s *PostgresStorage) GetOrCreateUser(telegramID int64) (*User, error) {
 	// Handle nullable fields
 	user.Email = nullEmail.String
 	user.ConsentGranted = nullConsent.Bool
+	if declinedAt.Valid {
+		user.SiteOfferDeclinedAt = &declinedAt.Time
+	}
 
 	return user, nil
 }
@@ -202,12 +438,32 @@ func (s *PostgresStorage) ResetUserMessageCount(telegramID int64) error {
 	return nil
 }
 
-// UpdateUserFSMState updates user's FSM state
-func (s *PostgresStorage) UpdateUserFSMState(telegramID int64, state string) error {
-	query := `UPDATE users SET fsm_state = $1, updated_at = NOW() WHERE telegram_id = $2`
-	_, err := s.db.Exec(query, state, telegramID)
+// RecordSiteOffer counts an offer of the site link and restarts the message count towards the next one
+func (s *PostgresStorage) RecordSiteOffer(telegramID int64) error {
+	query := `UPDATE users SET message_count = 0, site_offers_count = site_offers_count + 1, updated_at = NOW() WHERE telegram_id = $1`
+	_, err := s.db.Exec(query, telegramID)
+	if err != nil {
+		return fmt.Errorf("failed to record site offer: %w", err)
+	}
+	return nil
+}
+
+// RecordSiteOfferDeclined remembers that the user declined the site offer now
+func (s *PostgresStorage) RecordSiteOfferDeclined(telegramID int64) error {
+	query := `UPDATE users SET site_offer_declined_at = NOW(), updated_at = NOW() WHERE telegram_id = $1`
+	_, err := s.db.Exec(query, telegramID)
+	if err != nil {
+		return fmt.Errorf("failed to record declined site offer: %w", err)
+	}
+	return nil
+}
+
+// UpdateUserStartPayload remembers the /start payload the user came with and the product it resolved to
+func (s *PostgresStorage) UpdateUserStartPayload(telegramID int64, payload string, productSKU string) error {
+	query := `UPDATE users SET start_payload = $1, product_sku = $2, updated_at = NOW() WHERE telegram_id = $3`
+	_, err := s.db.Exec(query, payload, productSKU, telegramID)
 	if err != nil {
-		return fmt.Errorf("failed to update FSM state: %w", err)
+		return fmt.Errorf("failed to update user start payload: %w", err)
 	}
 	return nil
 }
@@ -226,20 +482,24 @@ func (s *PostgresStorage) UpdateUserEmail(telegramID int64, email string, consen
 func (s *PostgresStorage) GetUser(telegramID int64) (*User, error) {
 	user := &User{}
 	query := `
-		SELECT id, telegram_id, message_count, fsm_state, email, consent_granted, created_at, updated_at
+		SELECT id, telegram_id, message_count, email, consent_granted, site_offers_count, site_offer_declined_at, start_payload, product_sku, created_at, updated_at
 		FROM users
 		WHERE telegram_id = $1
 	`
 
 	var nullEmail sql.NullString
 	var nullConsent sql.NullBool
+	var declinedAt sql.NullTime
 	err := s.db.QueryRow(query, telegramID).Scan(
 		&user.ID,
 		&user.TelegramID,
 		&user.MessageCount,
-		&user.FSMState,
 		&nullEmail,
 		&nullConsent,
+		&user.SiteOffersCount,
+		&declinedAt,
+		&user.StartPayload,
+		&user.ProductSKU,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -254,6 +514,9 @@ func (s *PostgresStorage) GetUser(telegramID int64) (*User, error) {
 	// Handle nullable fields
 	user.Email = nullEmail.String
 	user.ConsentGranted = nullConsent.Bool
+	if declinedAt.Valid {
+		user.SiteOfferDeclinedAt = &declinedAt.Time
+	}
 
 	return user, nil
 }
@@ -261,12 +524,21 @@ func (s *PostgresStorage) GetUser(telegramID int64) (*User, error) {
 // GetSettings retrieves bot settings
 func (s *PostgresStorage) GetSettings() (*Settings, error) {
 	settings := &Settings{}
-	query := `SELECT id, trigger_message_count, site_url, updated_at FROM settings WHERE id = 1`
+	query := `
+		SELECT id, trigger_message_count, site_url, offer_cooldown_hours, max_offers_per_user,
+			interrupt_scenarios, scenario_trigger_counts, updated_at
+		FROM settings WHERE id = 1
+	`
 
+	var triggerCounts []byte
 	err := s.db.QueryRow(query).Scan(
 		&settings.ID,
 		&settings.TriggerMessageCount,
 		&settings.SiteURL,
+		&settings.OfferCooldownHours,
+		&settings.MaxOffersPerUser,
+		&settings.InterruptScenarios,
+		&triggerCounts,
 		&settings.UpdatedAt,
 	)
 
@@ -274,19 +546,42 @@ func (s *PostgresStorage) GetSettings() (*Settings, error) {
 		return nil, fmt.Errorf("failed to get settings: %w", err)
 	}
 
+	if err := json.Unmarshal(triggerCounts, &settings.ScenarioTriggerCounts); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario trigger counts: %w", err)
+	}
+
 	return settings, nil
 }
 
 // UpdateSettings updates bot settings
 func (s *PostgresStorage) UpdateSettings(settings *Settings) error {
-	query := `UPDATE settings SET trigger_message_count = $1, site_url = $2, updated_at = NOW() WHERE id = 1`
-	_, err := s.db.Exec(query, settings.TriggerMessageCount, settings.SiteURL)
+	triggerCounts, err := json.Marshal(scenarioTriggerCounts(settings))
+	if err != nil {
+		return fmt.Errorf("failed to encode scenario trigger counts: %w", err)
+	}
+
+	query := `
+		UPDATE settings
+		SET trigger_message_count = $1, site_url = $2, offer_cooldown_hours = $3, max_offers_per_user = $4,
+			interrupt_scenarios = $5, scenario_trigger_counts = $6, updated_at = NOW()
+		WHERE id = 1
+	`
+	_, err = s.db.Exec(query, settings.TriggerMessageCount, settings.SiteURL, settings.OfferCooldownHours,
+		settings.MaxOffersPerUser, settings.InterruptScenarios, triggerCounts)
 	if err != nil {
 		return fmt.Errorf("failed to update settings: %w", err)
 	}
 	return nil
 }
 
+// scenarioTriggerCounts returns the per-scenario trigger counts of settings, empty rather than nil
+func scenarioTriggerCounts(settings *Settings) map[string]int {
+	if settings.ScenarioTriggerCounts == nil {
+		return map[string]int{}
+	}
+	return settings.ScenarioTriggerCounts
+}
+
 // LogMessage logs a message to the database
 func (s *PostgresStorage) LogMessage(userID int64, text string, direction string) error {
 	query := `INSERT INTO messages (user_id, message_text, direction) VALUES ($1, $2, $3)`
@@ -327,9 +622,14 @@ func (s *PostgresStorage) GetTotalMessagesCount() (int64, error) {
 	return count, nil
 }
 
-// GetUsersByFSMState returns count of users per FSM state
+// GetUsersByFSMState returns count of users per conversation state
 func (s *PostgresStorage) GetUsersByFSMState() (map[string]int64, error) {
-	query := `SELECT fsm_state, COUNT(*) FROM users GROUP BY fsm_state`
+	query := `
+		SELECT COALESCE(user_sessions.state, 'idle'), COUNT(*)
+		FROM users
+		LEFT JOIN user_sessions ON user_sessions.user_id = users.telegram_id
+		GROUP BY 1
+	`
 
 	rows, err := s.db.Query(query)
 	if err != nil {
@@ -399,9 +699,12 @@ func (s *PostgresStorage) CheckRateLimit(telegramID int64, maxPerMinute int) (bo
 	return true, nil
 }
 
-// GetFSMScenarios returns all FSM scenarios
+// scenarioColumns selects an fsm_scenarios row for scanScenario
+const scenarioColumns = `id, name, display_name, trigger_keywords, tool_keywords, description, category_id, visible_in_menu, sort_order`
+
+// GetFSMScenarios returns all FSM scenarios in menu order
 func (s *PostgresStorage) GetFSMScenarios() ([]*FSMScenario, error) {
-	query := `SELECT id, name, display_name, trigger_keywords, description FROM fsm_scenarios`
+	query := `SELECT ` + scenarioColumns + ` FROM fsm_scenarios ORDER BY sort_order, id`
 
 	rows, err := s.db.Query(query)
 	if err != nil {
@@ -411,63 +714,122 @@ func (s *PostgresStorage) GetFSMScenarios() ([]*FSMScenario, error) {
 
 	var scenarios []*FSMScenario
 	for rows.Next() {
-		scenario := &FSMScenario{}
-		var keywords pq.StringArray
-		var displayName sql.NullString
-		if err := rows.Scan(&scenario.ID, &scenario.Name, &displayName, &keywords, &scenario.Description); err != nil {
+		scenario, err := scanScenario(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan FSM scenario: %w", err)
 		}
-		scenario.TriggerKeywords = []string(keywords)
-		scenario.DisplayName = displayName.String
 		scenarios = append(scenarios, scenario)
 	}
 
 	return scenarios, nil
 }
 
-// GetFSMScenarioByTrigger finds a scenario that matches the trigger message
-func (s *PostgresStorage) GetFSMScenarioByTrigger(message string) (*FSMScenario, error) {
+// GetFSMScenariosByTrigger returns the scenarios matching the trigger message, best first
+func (s *PostgresStorage) GetFSMScenariosByTrigger(message string) ([]*ScenarioMatch, error) {
 	scenarios, err := s.GetFSMScenarios()
 	if err != nil {
 		return nil, err
 	}
 
+	return MatchScenariosByTrigger(scenarios, message), nil
+}
+
+// MatchScenariosByTrigger scores every scenario with a trigger or tool keyword
+// contained in message and returns the matches ordered by the tool keywords
+// they matched, then by score; equal matches keep the order of scenarios. A
+// keyword contained in another matched keyword of the same scenario ("лобзик"
+// in "электролобзик") is not counted twice.
+func MatchScenariosByTrigger(scenarios []*FSMScenario, message string) []*ScenarioMatch {
 	messageLower := strings.ToLower(strings.TrimSpace(message))
 
+	var matches []*ScenarioMatch
 	for _, scenario := range scenarios {
-		for _, keyword := range scenario.TriggerKeywords {
-			if strings.Contains(messageLower, strings.ToLower(keyword)) {
-				return scenario, nil
+		tools := foundKeywords(messageLower, scenario.ToolKeywords)
+		found := append(foundKeywords(messageLower, scenario.TriggerKeywords), tools...)
+		if len(found) == 0 {
+			continue
+		}
+
+		match := &ScenarioMatch{Scenario: scenario}
+		for i, keyword := range found {
+			if !containedInOther(found, i) {
+				match.Score += utf8.RuneCountInString(keyword)
+			}
+		}
+		for i := range tools {
+			if !containedInOther(tools, i) {
+				match.Tools++
 			}
 		}
+		matches = append(matches, match)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Tools != matches[j].Tools {
+			return matches[i].Tools > matches[j].Tools
+		}
+		return matches[i].Score > matches[j].Score
+	})
+	return matches
+}
+
+// foundKeywords returns the lowercased keywords contained in a lowercased message
+func foundKeywords(message string, keywords []string) []string {
+	var found []string
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		if keyword != "" && strings.Contains(message, keyword) {
+			found = append(found, keyword)
+		}
 	}
+	return found
+}
 
-	return nil, nil
+// containedInOther reports whether keywords[i] is part of another keyword of the
+// list; of equal keywords only the first one counts
+func containedInOther(keywords []string, i int) bool {
+	for j, other := range keywords {
+		if j == i || !strings.Contains(other, keywords[i]) {
+			continue
+		}
+		if other != keywords[i] || j < i {
+			return true
+		}
+	}
+	return false
 }
 
 // GetFSMScenario returns a specific scenario by ID
 func (s *PostgresStorage) GetFSMScenario(id int) (*FSMScenario, error) {
-	query := `SELECT id, name, display_name, trigger_keywords, description FROM fsm_scenarios WHERE id = $1`
+	query := `SELECT ` + scenarioColumns + ` FROM fsm_scenarios WHERE id = $1`
 
-	scenario := &FSMScenario{}
-	var keywords pq.StringArray
-	var displayName sql.NullString
-	err := s.db.QueryRow(query, id).Scan(&scenario.ID, &scenario.Name, &displayName, &keywords, &scenario.Description)
+	scenario, err := scanScenario(s.db.QueryRow(query, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get FSM scenario: %w", err)
 	}
+	return scenario, nil
+}
 
-	scenario.TriggerKeywords = []string(keywords)
-	scenario.DisplayName = displayName.String
+// GetFSMScenarioByName returns a scenario by its unique name
+func (s *PostgresStorage) GetFSMScenarioByName(name string) (*FSMScenario, error) {
+	query := `SELECT ` + scenarioColumns + ` FROM fsm_scenarios WHERE name = $1`
+
+	scenario, err := scanScenario(s.db.QueryRow(query, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM scenario by name: %w", err)
+	}
 	return scenario, nil
 }
 
 // GetFSMScenarioSteps returns all steps for a scenario
 func (s *PostgresStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioStep, error) {
-	query := `SELECT id, scenario_id, step_key, message, is_final, next_step_key, state_type FROM fsm_steps WHERE scenario_id = $1 ORDER BY id`
+	query := `SELECT id, scenario_id, step_key, message, is_final, next_step_key, state_type, input, input_error, effects FROM fsm_steps WHERE scenario_id = $1 ORDER BY id`
 
 	rows, err := s.db.Query(query, scenarioID)
 	if err != nil {
@@ -479,12 +841,16 @@ func (s *PostgresStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioSte
 	for rows.Next() {
 		step := &FSMScenarioStep{}
 		var nextStepKey sql.NullString
-		if err := rows.Scan(&step.ID, &step.ScenarioID, &step.StepKey, &step.Message, &step.IsFinal, &nextStepKey, &step.StateType); err != nil {
+		var effects pq.StringArray
+		if err := rows.Scan(&step.ID, &step.ScenarioID, &step.StepKey, &step.Message, &step.IsFinal, &nextStepKey, &step.StateType, &step.Input, &step.InputError, &effects); err != nil {
 			return nil, fmt.Errorf("failed to scan FSM scenario step: %w", err)
 		}
 		if nextStepKey.Valid {
 			step.NextStepKey = &nextStepKey.String
 		}
+		if len(effects) > 0 {
+			step.Effects = []string(effects)
+		}
 		steps = append(steps, step)
 	}
 
@@ -493,11 +859,12 @@ func (s *PostgresStorage) GetFSMScenarioSteps(scenarioID int) ([]*FSMScenarioSte
 
 // GetFSMScenarioStep returns a specific step
 func (s *PostgresStorage) GetFSMScenarioStep(scenarioID int, stepKey string) (*FSMScenarioStep, error) {
-	query := `SELECT id, scenario_id, step_key, message, is_final, next_step_key, state_type FROM fsm_steps WHERE scenario_id = $1 AND step_key = $2`
+	query := `SELECT id, scenario_id, step_key, message, is_final, next_step_key, state_type, input, input_error, effects FROM fsm_steps WHERE scenario_id = $1 AND step_key = $2`
 
 	step := &FSMScenarioStep{}
 	var nextStepKey sql.NullString
-	err := s.db.QueryRow(query, scenarioID, stepKey).Scan(&step.ID, &step.ScenarioID, &step.StepKey, &step.Message, &step.IsFinal, &nextStepKey, &step.StateType)
+	var effects pq.StringArray
+	err := s.db.QueryRow(query, scenarioID, stepKey).Scan(&step.ID, &step.ScenarioID, &step.StepKey, &step.Message, &step.IsFinal, &nextStepKey, &step.StateType, &step.Input, &step.InputError, &effects)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -508,17 +875,17 @@ func (s *PostgresStorage) GetFSMScenarioStep(scenarioID int, stepKey string) (*F
 	if nextStepKey.Valid {
 		step.NextStepKey = &nextStepKey.String
 	}
+	if len(effects) > 0 {
+		step.Effects = []string(effects)
+	}
 	return step, nil
 }
 
 // GetUserSession returns user's current FSM session
 func (s *PostgresStorage) GetUserSession(userID int64) (*UserSession, error) {
-	query := `SELECT user_id, current_scenario_id, current_step_key, updated_at FROM user_sessions WHERE user_id = $1`
+	query := `SELECT user_id, state, current_scenario_id, current_step_key, step_history, updated_at FROM user_sessions WHERE user_id = $1`
 
-	session := &UserSession{}
-	var scenarioID sql.NullInt64
-	var stepKey sql.NullString
-	err := s.db.QueryRow(query, userID).Scan(&session.UserID, &scenarioID, &stepKey, &session.UpdatedAt)
+	session, err := scanUserSession(s.db.QueryRow(query, userID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -526,6 +893,114 @@ func (s *PostgresStorage) GetUserSession(userID int64) (*UserSession, error) {
 		return nil, fmt.Errorf("failed to get user session: %w", err)
 	}
 
+	return session, nil
+}
+
+// SetUserSessionState moves the session from one position to another. It
+// reports false and changes nothing if the session is no longer at from, so of
+// two concurrent moves of one user only the first applies. Moving to another
+// step pushes the step being left onto the session history; moving to idle
+// removes the session.
+func (s *PostgresStorage) SetUserSessionState(userID int64, from, to SessionPosition) (bool, error) {
+	if from.State == SessionStateIdle && to.State == SessionStateIdle {
+		return false, nil
+	}
+
+	var result sql.Result
+	var err error
+	switch {
+	case to.State == SessionStateIdle:
+		result, err = s.db.Exec(`
+			DELETE FROM user_sessions
+			WHERE user_id = $1 AND state = $2
+				AND current_scenario_id IS NOT DISTINCT FROM $3
+				AND current_step_key IS NOT DISTINCT FROM $4
+		`, userID, from.State, from.ScenarioID, from.StepKey)
+	case from.State == SessionStateIdle:
+		// An idle row left by an earlier version is taken over with a fresh history
+		result, err = s.db.Exec(`
+			INSERT INTO user_sessions (user_id, state, current_scenario_id, current_step_key, updated_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (user_id)
+			DO UPDATE SET
+				state = EXCLUDED.state,
+				current_scenario_id = EXCLUDED.current_scenario_id,
+				current_step_key = EXCLUDED.current_step_key,
+				step_history = '[]',
+				updated_at = NOW()
+			WHERE user_sessions.state = $5
+		`, userID, to.State, to.ScenarioID, to.StepKey, SessionStateIdle)
+	default:
+		// The oldest history entry is dropped once the history is full
+		result, err = s.db.Exec(`
+			UPDATE user_sessions
+			SET state = $5,
+				step_history = CASE
+					WHEN current_step_key IS NULL
+						OR (current_scenario_id IS NOT DISTINCT FROM $6 AND current_step_key = $7)
+					THEN step_history
+					ELSE CASE
+						WHEN jsonb_array_length(step_history) >= $8 THEN step_history - 0
+						ELSE step_history
+					END || jsonb_build_array(jsonb_build_object(
+						'scenario_id', current_scenario_id,
+						'step_key', current_step_key))
+				END,
+				current_scenario_id = $6,
+				current_step_key = $7,
+				updated_at = NOW()
+			WHERE user_id = $1 AND state = $2
+				AND current_scenario_id IS NOT DISTINCT FROM $3
+				AND current_step_key IS NOT DISTINCT FROM $4
+		`, userID, from.State, from.ScenarioID, from.StepKey, to.State, to.ScenarioID, to.StepKey, MaxSessionHistory)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to set user session state: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// PopUserSessionStep moves the session back to the last step in its history
+// and returns the updated session, or nil if there is nowhere to go back to
+func (s *PostgresStorage) PopUserSessionStep(userID int64) (*UserSession, error) {
+	query := `
+		UPDATE user_sessions
+		SET state = $2,
+			current_scenario_id = (step_history -> -1 ->> 'scenario_id')::int,
+			current_step_key = step_history -> -1 ->> 'step_key',
+			step_history = step_history - (jsonb_array_length(step_history) - 1),
+			updated_at = NOW()
+		WHERE user_id = $1 AND jsonb_array_length(step_history) > 0
+		RETURNING user_id, state, current_scenario_id, current_step_key, step_history, updated_at
+	`
+
+	session, err := scanUserSession(s.db.QueryRow(query, userID, SessionStateInScenario))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to pop user session step: %w", err)
+	}
+
+	return session, nil
+}
+
+// scanUserSession reads a user_sessions row selected as
+// user_id, state, current_scenario_id, current_step_key, step_history, updated_at
+func scanUserSession(row *sql.Row) (*UserSession, error) {
+	session := &UserSession{}
+	var scenarioID sql.NullInt64
+	var stepKey sql.NullString
+	var history []byte
+	if err := row.Scan(&session.UserID, &session.State, &scenarioID, &stepKey, &history, &session.UpdatedAt); err != nil {
+		return nil, err
+	}
+
 	if scenarioID.Valid {
 		id := int(scenarioID.Int64)
 		session.ScenarioID = &id
@@ -533,55 +1008,1099 @@ func (s *PostgresStorage) GetUserSession(userID int64) (*UserSession, error) {
 	if stepKey.Valid {
 		session.CurrentStepKey = &stepKey.String
 	}
+	if err := json.Unmarshal(history, &session.History); err != nil {
+		return nil, fmt.Errorf("failed to decode session history: %w", err)
+	}
 
 	return session, nil
 }
 
-// UpdateUserSession updates or creates a user session
-func (s *PostgresStorage) UpdateUserSession(userID int64, scenarioID *int, stepKey *string) error {
-	if scenarioID == nil && stepKey == nil {
-		return s.DeleteUserSession(userID)
+// DeleteUserSession deletes a user session
+func (s *PostgresStorage) DeleteUserSession(userID int64) error {
+	query := `DELETE FROM user_sessions WHERE user_id = $1`
+	_, err := s.db.Exec(query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user session: %w", err)
+	}
+	return nil
+}
+
+// CreateFSMScenario inserts a new scenario and sets its ID
+func (s *PostgresStorage) CreateFSMScenario(scenario *FSMScenario) error {
+	query := `
+		INSERT INTO fsm_scenarios (name, display_name, trigger_keywords, tool_keywords, description, category_id, visible_in_menu, sort_order)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, scenario.Name, nullString(scenario.DisplayName), pq.StringArray(scenario.TriggerKeywords), toolKeywords(scenario),
+		scenario.Description, scenario.CategoryID, !scenario.HiddenFromMenu, scenario.SortOrder).Scan(&scenario.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create FSM scenario %q: %w", scenario.Name, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create FSM scenario %q: category: %w", scenario.Name, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create FSM scenario: %w", err)
 	}
 
+	return nil
+}
+
+// UpdateFSMScenario updates scenario metadata, trigger keywords and menu placement
+func (s *PostgresStorage) UpdateFSMScenario(scenario *FSMScenario) error {
 	query := `
-		INSERT INTO user_sessions (user_id, current_scenario_id, current_step_key, updated_at)
-		VALUES ($1, $2, $3, NOW())
-		ON CONFLICT (user_id)
-		DO UPDATE SET current_scenario_id = $2, current_step_key = $3, updated_at = NOW()
+		UPDATE fsm_scenarios
+		SET name = $1, display_name = $2, trigger_keywords = $3, tool_keywords = $4, description = $5,
+			category_id = $6, visible_in_menu = $7, sort_order = $8
+		WHERE id = $9
 	`
 
-	var sid interface{}
-	var skey interface{}
-	if scenarioID != nil {
-		sid = *scenarioID
-	} else {
-		sid = nil
+	result, err := s.db.Exec(query, scenario.Name, nullString(scenario.DisplayName), pq.StringArray(scenario.TriggerKeywords), toolKeywords(scenario),
+		scenario.Description, scenario.CategoryID, !scenario.HiddenFromMenu, scenario.SortOrder, scenario.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update FSM scenario %q: %w", scenario.Name, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to update FSM scenario %q: category: %w", scenario.Name, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update FSM scenario: %w", err)
 	}
-	if stepKey != nil {
-		skey = *stepKey
-	} else {
-		skey = nil
+
+	return checkRowsAffected(result, "FSM scenario")
+}
+
+// DeleteFSMScenario deletes a scenario with its steps and the sessions currently inside it
+func (s *PostgresStorage) DeleteFSMScenario(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	_, err := s.db.Exec(query, userID, sid, skey)
+	// user_sessions references fsm_scenarios without ON DELETE, so only the
+	// sessions inside this scenario are removed; everyone else keeps their place
+	if _, err := tx.Exec(`DELETE FROM user_sessions WHERE current_scenario_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete sessions for FSM scenario: %w", err)
+	}
+	// Back navigation must not return into the deleted scenario
+	if _, err := tx.Exec(`
+		UPDATE user_sessions
+		SET step_history = (
+			SELECT COALESCE(jsonb_agg(entry ORDER BY position), '[]')
+			FROM jsonb_array_elements(step_history) WITH ORDINALITY AS h(entry, position)
+			WHERE (entry->>'scenario_id')::int <> $1
+		)
+		WHERE step_history @> jsonb_build_array(jsonb_build_object('scenario_id', $1::int))
+	`, id); err != nil {
+		return fmt.Errorf("failed to clean session history for FSM scenario: %w", err)
+	}
+
+	result, err := tx.Exec(`DELETE FROM fsm_scenarios WHERE id = $1`, id)
 	if err != nil {
-		return fmt.Errorf("failed to update user session: %w", err)
+		return fmt.Errorf("failed to delete FSM scenario: %w", err)
+	}
+	if err := checkRowsAffected(result, "FSM scenario"); err != nil {
+		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-// DeleteUserSession deletes a user session
-func (s *PostgresStorage) DeleteUserSession(userID int64) error {
-	query := `DELETE FROM user_sessions WHERE user_id = $1`
-	_, err := s.db.Exec(query, userID)
+// CreateFSMScenarioStep inserts a new step and sets its ID
+func (s *PostgresStorage) CreateFSMScenarioStep(step *FSMScenarioStep) error {
+	query := `
+		INSERT INTO fsm_steps (scenario_id, step_key, message, is_final, next_step_key, state_type, input, input_error, effects)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, step.ScenarioID, step.StepKey, step.Message, step.IsFinal, step.NextStepKey, step.StateType, step.Input, step.InputError, stepEffects(step)).Scan(&step.ID)
 	if err != nil {
-		return fmt.Errorf("failed to delete user session: %w", err)
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create FSM scenario step %q: %w", step.StepKey, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create FSM scenario step: scenario %d: %w", step.ScenarioID, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create FSM scenario step: %w", err)
 	}
+
 	return nil
 }
 
-// Close closes the database connection
-func (s *PostgresStorage) Close() error {
-	return s.db.Close()
-}
\ No newline at end of file
+// UpdateFSMScenarioStep updates a step identified by scenario ID and step key
+func (s *PostgresStorage) UpdateFSMScenarioStep(step *FSMScenarioStep) error {
+	query := `
+		UPDATE fsm_steps
+		SET message = $1, is_final = $2, next_step_key = $3, state_type = $4, input = $5, input_error = $6, effects = $7
+		WHERE scenario_id = $8 AND step_key = $9
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, step.Message, step.IsFinal, step.NextStepKey, step.StateType, step.Input, step.InputError, stepEffects(step), step.ScenarioID, step.StepKey).Scan(&step.ID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("failed to update FSM scenario step %q: %w", step.StepKey, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update FSM scenario step: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFSMScenarioStep deletes a step and resets sessions that are parked on it
+func (s *PostgresStorage) DeleteFSMScenarioStep(scenarioID int, stepKey string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_sessions WHERE current_scenario_id = $1 AND current_step_key = $2`, scenarioID, stepKey); err != nil {
+		return fmt.Errorf("failed to delete sessions for FSM scenario step: %w", err)
+	}
+
+	result, err := tx.Exec(`DELETE FROM fsm_steps WHERE scenario_id = $1 AND step_key = $2`, scenarioID, stepKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete FSM scenario step: %w", err)
+	}
+	if err := checkRowsAffected(result, "FSM scenario step"); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetFSMTransitions returns transitions leaving a step, ordered for display
+func (s *PostgresStorage) GetFSMTransitions(scenarioID int, fromStepKey string) ([]*FSMTransition, error) {
+	query := `
+		SELECT id, scenario_id, from_step_key, to_step_key, button_label, sort_order, condition
+		FROM fsm_transitions
+		WHERE scenario_id = $1 AND from_step_key = $2
+		ORDER BY sort_order, id
+	`
+
+	return s.queryFSMTransitions(query, scenarioID, fromStepKey)
+}
+
+// GetFSMScenarioTransitions returns all transitions of a scenario
+func (s *PostgresStorage) GetFSMScenarioTransitions(scenarioID int) ([]*FSMTransition, error) {
+	query := `
+		SELECT id, scenario_id, from_step_key, to_step_key, button_label, sort_order, condition
+		FROM fsm_transitions
+		WHERE scenario_id = $1
+		ORDER BY from_step_key, sort_order, id
+	`
+
+	return s.queryFSMTransitions(query, scenarioID)
+}
+
+// GetFSMTransition returns a specific transition of a scenario
+func (s *PostgresStorage) GetFSMTransition(scenarioID int, id int) (*FSMTransition, error) {
+	query := `
+		SELECT id, scenario_id, from_step_key, to_step_key, button_label, sort_order, condition
+		FROM fsm_transitions
+		WHERE scenario_id = $1 AND id = $2
+	`
+
+	transitions, err := s.queryFSMTransitions(query, scenarioID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(transitions) == 0 {
+		return nil, nil
+	}
+	return transitions[0], nil
+}
+
+func (s *PostgresStorage) queryFSMTransitions(query string, args ...interface{}) ([]*FSMTransition, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM transitions: %w", err)
+	}
+	defer rows.Close()
+
+	var transitions []*FSMTransition
+	for rows.Next() {
+		transition := &FSMTransition{}
+		var condition sql.NullString
+		if err := rows.Scan(&transition.ID, &transition.ScenarioID, &transition.FromStepKey, &transition.ToStepKey, &transition.ButtonLabel, &transition.SortOrder, &condition); err != nil {
+			return nil, fmt.Errorf("failed to scan FSM transition: %w", err)
+		}
+		if condition.Valid {
+			transition.Condition = &condition.String
+		}
+		transitions = append(transitions, transition)
+	}
+
+	return transitions, rows.Err()
+}
+
+// CreateFSMTransition inserts a new transition and sets its ID
+func (s *PostgresStorage) CreateFSMTransition(transition *FSMTransition) error {
+	query := `
+		INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order, condition)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, transition.ScenarioID, transition.FromStepKey, transition.ToStepKey, transition.ButtonLabel, transition.SortOrder, transition.Condition).Scan(&transition.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create FSM transition %s -> %s: %w", transition.FromStepKey, transition.ToStepKey, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create FSM transition %s -> %s: step: %w", transition.FromStepKey, transition.ToStepKey, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create FSM transition: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateFSMTransition updates a transition identified by scenario ID and transition ID
+func (s *PostgresStorage) UpdateFSMTransition(transition *FSMTransition) error {
+	query := `
+		UPDATE fsm_transitions
+		SET from_step_key = $1, to_step_key = $2, button_label = $3, sort_order = $4, condition = $5
+		WHERE scenario_id = $6 AND id = $7
+	`
+
+	result, err := s.db.Exec(query, transition.FromStepKey, transition.ToStepKey, transition.ButtonLabel, transition.SortOrder, transition.Condition, transition.ScenarioID, transition.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update FSM transition %s -> %s: %w", transition.FromStepKey, transition.ToStepKey, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to update FSM transition %s -> %s: step: %w", transition.FromStepKey, transition.ToStepKey, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update FSM transition: %w", err)
+	}
+
+	return checkRowsAffected(result, "FSM transition")
+}
+
+// DeleteFSMTransition deletes a transition
+func (s *PostgresStorage) DeleteFSMTransition(scenarioID int, id int) error {
+	result, err := s.db.Exec(`DELETE FROM fsm_transitions WHERE scenario_id = $1 AND id = $2`, scenarioID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete FSM transition: %w", err)
+	}
+
+	return checkRowsAffected(result, "FSM transition")
+}
+
+// GetFSMStepActions returns the action group of a step, ordered for display
+func (s *PostgresStorage) GetFSMStepActions(scenarioID int, stepKey string) ([]*FSMStepAction, error) {
+	query := `
+		SELECT id, scenario_id, step_key, action_step_key, label, sort_order
+		FROM fsm_step_actions
+		WHERE scenario_id = $1 AND step_key = $2
+		ORDER BY sort_order, id
+	`
+
+	return s.queryFSMStepActions(query, scenarioID, stepKey)
+}
+
+// GetFSMScenarioActions returns all action groups of a scenario
+func (s *PostgresStorage) GetFSMScenarioActions(scenarioID int) ([]*FSMStepAction, error) {
+	query := `
+		SELECT id, scenario_id, step_key, action_step_key, label, sort_order
+		FROM fsm_step_actions
+		WHERE scenario_id = $1
+		ORDER BY step_key, sort_order, id
+	`
+
+	return s.queryFSMStepActions(query, scenarioID)
+}
+
+// GetFSMStepAction returns a specific action of a scenario
+func (s *PostgresStorage) GetFSMStepAction(scenarioID int, id int) (*FSMStepAction, error) {
+	query := `
+		SELECT id, scenario_id, step_key, action_step_key, label, sort_order
+		FROM fsm_step_actions
+		WHERE scenario_id = $1 AND id = $2
+	`
+
+	actions, err := s.queryFSMStepActions(query, scenarioID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(actions) == 0 {
+		return nil, nil
+	}
+	return actions[0], nil
+}
+
+func (s *PostgresStorage) queryFSMStepActions(query string, args ...interface{}) ([]*FSMStepAction, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM step actions: %w", err)
+	}
+	defer rows.Close()
+
+	var actions []*FSMStepAction
+	for rows.Next() {
+		action := &FSMStepAction{}
+		if err := rows.Scan(&action.ID, &action.ScenarioID, &action.StepKey, &action.ActionStepKey, &action.Label, &action.SortOrder); err != nil {
+			return nil, fmt.Errorf("failed to scan FSM step action: %w", err)
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, rows.Err()
+}
+
+// CreateFSMStepAction inserts a new action into a step's group and sets its ID
+func (s *PostgresStorage) CreateFSMStepAction(action *FSMStepAction) error {
+	query := `
+		INSERT INTO fsm_step_actions (scenario_id, step_key, action_step_key, label, sort_order)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, action.ScenarioID, action.StepKey, action.ActionStepKey, action.Label, action.SortOrder).Scan(&action.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create FSM step action %s -> %s: %w", action.StepKey, action.ActionStepKey, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create FSM step action %s -> %s: step: %w", action.StepKey, action.ActionStepKey, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create FSM step action: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateFSMStepAction updates an action identified by scenario ID and action ID
+func (s *PostgresStorage) UpdateFSMStepAction(action *FSMStepAction) error {
+	query := `
+		UPDATE fsm_step_actions
+		SET step_key = $1, action_step_key = $2, label = $3, sort_order = $4
+		WHERE scenario_id = $5 AND id = $6
+	`
+
+	result, err := s.db.Exec(query, action.StepKey, action.ActionStepKey, action.Label, action.SortOrder, action.ScenarioID, action.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update FSM step action %s -> %s: %w", action.StepKey, action.ActionStepKey, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to update FSM step action %s -> %s: step: %w", action.StepKey, action.ActionStepKey, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update FSM step action: %w", err)
+	}
+
+	return checkRowsAffected(result, "FSM step action")
+}
+
+// DeleteFSMStepAction deletes an action from its group
+func (s *PostgresStorage) DeleteFSMStepAction(scenarioID int, id int) error {
+	result, err := s.db.Exec(`DELETE FROM fsm_step_actions WHERE scenario_id = $1 AND id = $2`, scenarioID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete FSM step action: %w", err)
+	}
+
+	return checkRowsAffected(result, "FSM step action")
+}
+
+// GetFSMScenarioGraph returns a scenario with everything needed to export it
+func (s *PostgresStorage) GetFSMScenarioGraph(id int) (*FSMScenarioGraph, error) {
+	scenario, err := s.GetFSMScenario(id)
+	if err != nil || scenario == nil {
+		return nil, err
+	}
+
+	steps, err := s.GetFSMScenarioSteps(id)
+	if err != nil {
+		return nil, err
+	}
+	transitions, err := s.GetFSMScenarioTransitions(id)
+	if err != nil {
+		return nil, err
+	}
+	actions, err := s.GetFSMScenarioActions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FSMScenarioGraph{Scenario: scenario, Steps: steps, Transitions: transitions, Actions: actions}, nil
+}
+
+// SaveFSMScenarioGraph makes the stored scenario with the graph's name match the graph.
+// Rows are upserted by their natural keys so existing IDs survive, rows missing from
+// the graph are deleted, and sessions parked on deleted steps are reset. IDs of the
+// saved rows are written back into the graph.
+func (s *PostgresStorage) SaveFSMScenarioGraph(graph *FSMScenarioGraph) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	scenario := graph.Scenario
+	err = tx.QueryRow(`
+		INSERT INTO fsm_scenarios (name, display_name, trigger_keywords, tool_keywords, description, visible_in_menu, sort_order)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (name)
+		DO UPDATE SET display_name = $2, trigger_keywords = $3, tool_keywords = $4, description = $5, visible_in_menu = $6, sort_order = $7
+		RETURNING id, category_id
+	`, scenario.Name, nullString(scenario.DisplayName), pq.StringArray(scenario.TriggerKeywords), toolKeywords(scenario),
+		scenario.Description, !scenario.HiddenFromMenu, scenario.SortOrder).Scan(&scenario.ID, &scenario.CategoryID)
+	if err != nil {
+		return fmt.Errorf("failed to save FSM scenario %q: %w", scenario.Name, err)
+	}
+
+	stepKeys := make([]string, 0, len(graph.Steps))
+	for _, step := range graph.Steps {
+		step.ScenarioID = scenario.ID
+		err := tx.QueryRow(`
+			INSERT INTO fsm_steps (scenario_id, step_key, message, is_final, next_step_key, state_type, input, input_error, effects)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (scenario_id, step_key)
+			DO UPDATE SET message = $3, is_final = $4, next_step_key = $5, state_type = $6, input = $7, input_error = $8, effects = $9
+			RETURNING id
+		`, step.ScenarioID, step.StepKey, step.Message, step.IsFinal, step.NextStepKey, step.StateType, step.Input, step.InputError, stepEffects(step)).Scan(&step.ID)
+		if err != nil {
+			return fmt.Errorf("failed to save FSM scenario step %q: %w", step.StepKey, err)
+		}
+		stepKeys = append(stepKeys, step.StepKey)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_sessions WHERE current_scenario_id = $1 AND current_step_key <> ALL($2)`, scenario.ID, pq.StringArray(stepKeys)); err != nil {
+		return fmt.Errorf("failed to delete sessions for removed FSM scenario steps: %w", err)
+	}
+	// Transitions and actions of removed steps go away with them via ON DELETE CASCADE
+	if _, err := tx.Exec(`DELETE FROM fsm_steps WHERE scenario_id = $1 AND step_key <> ALL($2)`, scenario.ID, pq.StringArray(stepKeys)); err != nil {
+		return fmt.Errorf("failed to delete removed FSM scenario steps: %w", err)
+	}
+
+	transitionIDs := make([]int64, 0, len(graph.Transitions))
+	for _, transition := range graph.Transitions {
+		transition.ScenarioID = scenario.ID
+		err := tx.QueryRow(`
+			INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order, condition)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (scenario_id, from_step_key, to_step_key)
+			DO UPDATE SET button_label = $4, sort_order = $5, condition = $6
+			RETURNING id
+		`, transition.ScenarioID, transition.FromStepKey, transition.ToStepKey, transition.ButtonLabel, transition.SortOrder, transition.Condition).Scan(&transition.ID)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("failed to save FSM transition %s -> %s: step: %w", transition.FromStepKey, transition.ToStepKey, ErrNotFound)
+			}
+			return fmt.Errorf("failed to save FSM transition %s -> %s: %w", transition.FromStepKey, transition.ToStepKey, err)
+		}
+		transitionIDs = append(transitionIDs, int64(transition.ID))
+	}
+
+	if _, err := tx.Exec(`DELETE FROM fsm_transitions WHERE scenario_id = $1 AND id <> ALL($2)`, scenario.ID, pq.Int64Array(transitionIDs)); err != nil {
+		return fmt.Errorf("failed to delete removed FSM transitions: %w", err)
+	}
+
+	actionIDs := make([]int64, 0, len(graph.Actions))
+	for _, action := range graph.Actions {
+		action.ScenarioID = scenario.ID
+		err := tx.QueryRow(`
+			INSERT INTO fsm_step_actions (scenario_id, step_key, action_step_key, label, sort_order)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (scenario_id, step_key, action_step_key)
+			DO UPDATE SET label = $4, sort_order = $5
+			RETURNING id
+		`, action.ScenarioID, action.StepKey, action.ActionStepKey, action.Label, action.SortOrder).Scan(&action.ID)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("failed to save FSM step action %s -> %s: step: %w", action.StepKey, action.ActionStepKey, ErrNotFound)
+			}
+			return fmt.Errorf("failed to save FSM step action %s -> %s: %w", action.StepKey, action.ActionStepKey, err)
+		}
+		actionIDs = append(actionIDs, int64(action.ID))
+	}
+
+	if _, err := tx.Exec(`DELETE FROM fsm_step_actions WHERE scenario_id = $1 AND id <> ALL($2)`, scenario.ID, pq.Int64Array(actionIDs)); err != nil {
+		return fmt.Errorf("failed to delete removed FSM step actions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database connection
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+// SaveCallbackToken stores a callback token
+func (s *PostgresStorage) SaveCallbackToken(token *CallbackToken) error {
+	query := `
+		INSERT INTO callback_tokens (token, user_id, kind, scenario_id, from_step_key, step_key, value, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := s.db.Exec(query, token.Token, token.UserID, token.Kind, token.ScenarioID, token.FromStepKey, token.StepKey, token.Value, token.ExpiresAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to save callback token: %w", ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to save callback token: %w", err)
+	}
+	return nil
+}
+
+// GetCallbackToken returns a callback token, or nil if it is unknown or expired
+func (s *PostgresStorage) GetCallbackToken(token string) (*CallbackToken, error) {
+	query := `
+		SELECT token, user_id, kind, scenario_id, from_step_key, step_key, value, expires_at
+		FROM callback_tokens WHERE token = $1 AND expires_at > NOW()
+	`
+
+	t := &CallbackToken{}
+	err := s.db.QueryRow(query, token).Scan(&t.Token, &t.UserID, &t.Kind, &t.ScenarioID, &t.FromStepKey, &t.StepKey, &t.Value, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get callback token: %w", err)
+	}
+	return t, nil
+}
+
+// DeleteExpiredCallbackTokens deletes expired callback tokens and returns how many were deleted
+func (s *PostgresStorage) DeleteExpiredCallbackTokens() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM callback_tokens WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired callback tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// GetDeepLinks returns all deep links ordered by payload
+func (s *PostgresStorage) GetDeepLinks() ([]*DeepLink, error) {
+	query := `
+		SELECT payload, product_sku, scenario_id, step_key, created_at, updated_at
+		FROM deep_links ORDER BY payload
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deep links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []*DeepLink
+	for rows.Next() {
+		link, err := scanDeepLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan deep link: %w", err)
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate deep links: %w", err)
+	}
+
+	return links, nil
+}
+
+// GetDeepLink returns the deep link of a payload, or nil if there is none
+func (s *PostgresStorage) GetDeepLink(payload string) (*DeepLink, error) {
+	query := `
+		SELECT payload, product_sku, scenario_id, step_key, created_at, updated_at
+		FROM deep_links WHERE payload = $1
+	`
+
+	link, err := scanDeepLink(s.db.QueryRow(query, payload))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deep link: %w", err)
+	}
+	return link, nil
+}
+
+// CreateDeepLink creates a deep link
+func (s *PostgresStorage) CreateDeepLink(link *DeepLink) error {
+	query := `
+		INSERT INTO deep_links (payload, product_sku, scenario_id, step_key)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at, updated_at
+	`
+
+	err := s.db.QueryRow(query, link.Payload, link.ProductSKU, link.ScenarioID, link.StepKey).Scan(&link.CreatedAt, &link.UpdatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create deep link %s: %w", link.Payload, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create deep link %s: scenario: %w", link.Payload, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create deep link: %w", err)
+	}
+	return nil
+}
+
+// UpdateDeepLink updates the product and target of a deep link identified by its payload
+func (s *PostgresStorage) UpdateDeepLink(link *DeepLink) error {
+	query := `
+		UPDATE deep_links
+		SET product_sku = $1, scenario_id = $2, step_key = $3, updated_at = NOW()
+		WHERE payload = $4
+		RETURNING created_at, updated_at
+	`
+
+	err := s.db.QueryRow(query, link.ProductSKU, link.ScenarioID, link.StepKey, link.Payload).Scan(&link.CreatedAt, &link.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("deep link: %w", ErrNotFound)
+	}
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to update deep link %s: scenario: %w", link.Payload, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update deep link: %w", err)
+	}
+	return nil
+}
+
+// DeleteDeepLink deletes a deep link
+func (s *PostgresStorage) DeleteDeepLink(payload string) error {
+	result, err := s.db.Exec(`DELETE FROM deep_links WHERE payload = $1`, payload)
+	if err != nil {
+		return fmt.Errorf("failed to delete deep link: %w", err)
+	}
+	return checkRowsAffected(result, "deep link")
+}
+
+// GetCategories returns all categories in menu order
+func (s *PostgresStorage) GetCategories() ([]*Category, error) {
+	rows, err := s.db.Query(`SELECT id, name, display_name, sort_order FROM categories ORDER BY sort_order, name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get categories: %w", err)
+	}
+	defer rows.Close()
+
+	var categories []*Category
+	for rows.Next() {
+		category := &Category{}
+		if err := rows.Scan(&category.ID, &category.Name, &category.DisplayName, &category.SortOrder); err != nil {
+			return nil, fmt.Errorf("failed to scan category: %w", err)
+		}
+		categories = append(categories, category)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate categories: %w", err)
+	}
+
+	return categories, nil
+}
+
+// GetCategory returns a category by ID, or nil if there is none
+func (s *PostgresStorage) GetCategory(id int) (*Category, error) {
+	category := &Category{}
+	err := s.db.QueryRow(`SELECT id, name, display_name, sort_order FROM categories WHERE id = $1`, id).
+		Scan(&category.ID, &category.Name, &category.DisplayName, &category.SortOrder)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get category: %w", err)
+	}
+	return category, nil
+}
+
+// CreateCategory inserts a new category and sets its ID
+func (s *PostgresStorage) CreateCategory(category *Category) error {
+	query := `INSERT INTO categories (name, display_name, sort_order) VALUES ($1, $2, $3) RETURNING id`
+
+	if err := s.db.QueryRow(query, category.Name, category.DisplayName, category.SortOrder).Scan(&category.ID); err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create category %q: %w", category.Name, ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to create category: %w", err)
+	}
+	return nil
+}
+
+// UpdateCategory updates a category identified by its ID
+func (s *PostgresStorage) UpdateCategory(category *Category) error {
+	result, err := s.db.Exec(`UPDATE categories SET name = $1, display_name = $2, sort_order = $3 WHERE id = $4`,
+		category.Name, category.DisplayName, category.SortOrder, category.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update category %q: %w", category.Name, ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to update category: %w", err)
+	}
+	return checkRowsAffected(result, "category")
+}
+
+// DeleteCategory deletes a category; its products and scenarios are left without one
+func (s *PostgresStorage) DeleteCategory(id int) error {
+	result, err := s.db.Exec(`DELETE FROM categories WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete category: %w", err)
+	}
+	return checkRowsAffected(result, "category")
+}
+
+// productColumns selects a products row together with its linked scenarios
+const productColumns = `
+	id, sku, model, category_id, specs, manual_url,
+	ARRAY(SELECT scenario_id FROM product_scenarios WHERE product_id = products.id ORDER BY scenario_id),
+	created_at, updated_at
+`
+
+// GetProducts returns all products ordered by SKU
+func (s *PostgresStorage) GetProducts() ([]*Product, error) {
+	rows, err := s.db.Query(`SELECT ` + productColumns + ` FROM products ORDER BY sku`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get products: %w", err)
+	}
+	defer rows.Close()
+
+	var products []*Product
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product: %w", err)
+		}
+		products = append(products, product)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate products: %w", err)
+	}
+
+	return products, nil
+}
+
+// GetProduct returns a product by ID, or nil if there is none
+func (s *PostgresStorage) GetProduct(id int) (*Product, error) {
+	product, err := scanProduct(s.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+	return product, nil
+}
+
+// GetProductBySKU returns the product with a SKU, or nil if there is none
+func (s *PostgresStorage) GetProductBySKU(sku string) (*Product, error) {
+	product, err := scanProduct(s.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE sku = $1`, sku))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product by SKU: %w", err)
+	}
+	return product, nil
+}
+
+// CreateProduct inserts a new product with its scenario links and sets its ID
+func (s *PostgresStorage) CreateProduct(product *Product) error {
+	specs, err := productSpecs(product)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO products (sku, model, category_id, specs, manual_url)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at
+	`
+
+	err = tx.QueryRow(query, product.SKU, product.Model, product.CategoryID, specs, product.ManualURL).
+		Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create product %s: %w", product.SKU, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to create product %s: category: %w", product.SKU, ErrNotFound)
+		}
+		return fmt.Errorf("failed to create product: %w", err)
+	}
+
+	if err := setProductScenarios(tx, product); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// UpdateProduct updates a product identified by its ID and replaces its scenario links
+func (s *PostgresStorage) UpdateProduct(product *Product) error {
+	specs, err := productSpecs(product)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE products
+		SET sku = $1, model = $2, category_id = $3, specs = $4, manual_url = $5, updated_at = NOW()
+		WHERE id = $6
+		RETURNING created_at, updated_at
+	`
+
+	err = tx.QueryRow(query, product.SKU, product.Model, product.CategoryID, specs, product.ManualURL, product.ID).
+		Scan(&product.CreatedAt, &product.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("product: %w", ErrNotFound)
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update product %s: %w", product.SKU, ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("failed to update product %s: category: %w", product.SKU, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update product: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM product_scenarios WHERE product_id = $1`, product.ID); err != nil {
+		return fmt.Errorf("failed to clear product scenarios: %w", err)
+	}
+	if err := setProductScenarios(tx, product); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteProduct deletes a product with its scenario links
+func (s *PostgresStorage) DeleteProduct(id int) error {
+	result, err := s.db.Exec(`DELETE FROM products WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete product: %w", err)
+	}
+	return checkRowsAffected(result, "product")
+}
+
+// setProductScenarios links a product to its scenarios
+func setProductScenarios(tx *sql.Tx, product *Product) error {
+	for _, scenarioID := range product.ScenarioIDs {
+		_, err := tx.Exec(`
+			INSERT INTO product_scenarios (product_id, scenario_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, product.ID, scenarioID)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return fmt.Errorf("failed to link product %s to scenario %d: %w", product.SKU, scenarioID, ErrNotFound)
+			}
+			return fmt.Errorf("failed to link product to scenario: %w", err)
+		}
+	}
+	return nil
+}
+
+// productSpecs returns the specs of a product as JSON for the NOT NULL specs column
+func productSpecs(product *Product) ([]byte, error) {
+	if product.Specs == nil {
+		return []byte("{}"), nil
+	}
+	specs, err := json.Marshal(product.Specs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product specs: %w", err)
+	}
+	return specs, nil
+}
+
+// scanProduct scans a products row selected with productColumns
+func scanProduct(row rowScanner) (*Product, error) {
+	product := &Product{}
+	var categoryID sql.NullInt64
+	var specs []byte
+	var scenarioIDs pq.Int64Array
+	if err := row.Scan(&product.ID, &product.SKU, &product.Model, &categoryID, &specs, &product.ManualURL,
+		&scenarioIDs, &product.CreatedAt, &product.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if categoryID.Valid {
+		id := int(categoryID.Int64)
+		product.CategoryID = &id
+	}
+	if err := json.Unmarshal(specs, &product.Specs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product specs: %w", err)
+	}
+	product.ScenarioIDs = make([]int, len(scenarioIDs))
+	for i, id := range scenarioIDs {
+		product.ScenarioIDs[i] = int(id)
+	}
+	return product, nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanScenario scans an fsm_scenarios row selected with scenarioColumns
+func scanScenario(row rowScanner) (*FSMScenario, error) {
+	scenario := &FSMScenario{}
+	var keywords, toolKeywords pq.StringArray
+	var displayName sql.NullString
+	var categoryID sql.NullInt64
+	var visible bool
+	if err := row.Scan(&scenario.ID, &scenario.Name, &displayName, &keywords, &toolKeywords, &scenario.Description,
+		&categoryID, &visible, &scenario.SortOrder); err != nil {
+		return nil, err
+	}
+	scenario.TriggerKeywords = []string(keywords)
+	if len(toolKeywords) > 0 {
+		scenario.ToolKeywords = []string(toolKeywords)
+	}
+	scenario.DisplayName = displayName.String
+	if categoryID.Valid {
+		id := int(categoryID.Int64)
+		scenario.CategoryID = &id
+	}
+	scenario.HiddenFromMenu = !visible
+	return scenario, nil
+}
+
+// scanDeepLink scans a deep_links row
+func scanDeepLink(row rowScanner) (*DeepLink, error) {
+	link := &DeepLink{}
+	var scenarioID sql.NullInt64
+	var stepKey sql.NullString
+	if err := row.Scan(&link.Payload, &link.ProductSKU, &scenarioID, &stepKey, &link.CreatedAt, &link.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if scenarioID.Valid {
+		id := int(scenarioID.Int64)
+		link.ScenarioID = &id
+	}
+	if stepKey.Valid {
+		link.StepKey = &stepKey.String
+	}
+	return link, nil
+}
+
+// ScenarioChangesChannel is the NOTIFY channel that database triggers use to
+// announce changes to fsm_scenarios, fsm_steps, fsm_transitions and
+// fsm_step_actions. The payload is the scenario ID.
+const ScenarioChangesChannel = "fsm_scenario_changes"
+
+// ListenScenarioChanges calls onChange with the scenario ID of every change
+// announced on ScenarioChangesChannel until the returned listener is closed.
+// After a lost connection onChange is called with 0, because notifications
+// sent in the meantime are gone.
+func (s *PostgresStorage) ListenScenarioChanges(onChange func(scenarioID int)) (io.Closer, error) {
+	listener := pq.NewListener(s.connStr, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Scenario changes listener: %v", err)
+		}
+	})
+	if err := listener.Listen(ScenarioChangesChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen for scenario changes: %w", err)
+	}
+
+	go func() {
+		ping := time.NewTicker(90 * time.Second)
+		defer ping.Stop()
+
+		for {
+			select {
+			case notification, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				// pq sends nil after reconnecting
+				if notification == nil {
+					onChange(0)
+					continue
+				}
+				scenarioID, err := strconv.Atoi(notification.Extra)
+				if err != nil {
+					log.Printf("Invalid scenario change notification %q: %v", notification.Extra, err)
+					scenarioID = 0
+				}
+				onChange(scenarioID)
+			case <-ping.C:
+				// Detects a dead connection when no notifications arrive
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return listener, nil
+}
+
+// nullString converts an empty string to SQL NULL
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// toolKeywords returns the tool keywords of a scenario as an array for the NOT NULL tool_keywords column
+func toolKeywords(scenario *FSMScenario) pq.StringArray {
+	if scenario.ToolKeywords == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(scenario.ToolKeywords)
+}
+
+// stepEffects returns the effects of a step as an array for the NOT NULL effects column
+func stepEffects(step *FSMScenarioStep) pq.StringArray {
+	if step.Effects == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(step.Effects)
+}
+
+// checkRowsAffected returns ErrNotFound when a write did not touch any row
+func checkRowsAffected(result sql.Result, entity string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s: %w", entity, ErrNotFound)
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique_violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isForeignKeyViolation reports whether err is a PostgreSQL foreign_key_violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
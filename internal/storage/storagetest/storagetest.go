@@ -0,0 +1,854 @@
+// Package storagetest provides the contract every storage.Storage implementation must satisfy.
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ZorinIvanA/tgbot-electro-tools/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the contract suite. newStorage must return an empty storage with default settings for every call.
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"Users", testUsers},
+		{"Settings", testSettings},
+		{"MessagesAndMetrics", testMessagesAndMetrics},
+		{"RateLimit", testRateLimit},
+		{"Scenarios", testScenarios},
+		{"Steps", testSteps},
+		{"Transitions", testTransitions},
+		{"Actions", testActions},
+		{"Sessions", testSessions},
+		{"SessionHistory", testSessionHistory},
+		{"SessionState", testSessionState},
+		{"DeleteCascades", testDeleteCascades},
+		{"CallbackTokens", testCallbackTokens},
+		{"DeepLinks", testDeepLinks},
+		{"Categories", testCategories},
+		{"Products", testProducts},
+		{"ScenarioMenu", testScenarioMenu},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	user, err := s.GetUser(100)
+	require.NoError(t, err)
+	assert.Nil(t, user)
+
+	created, err := s.GetOrCreateUser(100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), created.TelegramID)
+	assert.Zero(t, created.MessageCount)
+
+	require.NoError(t, s.UpdateUserMessageCount(100))
+	require.NoError(t, s.UpdateUserMessageCount(100))
+
+	// The second call takes the conflict path and must return the existing row untouched
+	existing, err := s.GetOrCreateUser(100)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, existing.ID)
+	assert.Equal(t, 2, existing.MessageCount)
+
+	other, err := s.GetOrCreateUser(200)
+	require.NoError(t, err)
+	assert.NotEqual(t, created.ID, other.ID)
+
+	require.NoError(t, s.UpdateUserEmail(100, "user@example.com", true))
+	require.NoError(t, s.ResetUserMessageCount(100))
+
+	user, err = s.GetUser(100)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "user@example.com", user.Email)
+	assert.True(t, user.ConsentGranted)
+	assert.Zero(t, user.MessageCount)
+	assert.Zero(t, user.SiteOffersCount)
+	assert.Nil(t, user.SiteOfferDeclinedAt)
+
+	require.NoError(t, s.UpdateUserMessageCount(100))
+	require.NoError(t, s.RecordSiteOffer(100))
+	require.NoError(t, s.RecordSiteOfferDeclined(100))
+
+	user, err = s.GetUser(100)
+	require.NoError(t, err)
+	assert.Zero(t, user.MessageCount)
+	assert.Equal(t, 1, user.SiteOffersCount)
+	require.NotNil(t, user.SiteOfferDeclinedAt)
+	assert.WithinDuration(t, time.Now(), *user.SiteOfferDeclinedAt, time.Minute)
+
+	require.NoError(t, s.UpdateUserStartPayload(100, "JS-650__diagnose_jigsaw", "JS-650"))
+	user, err = s.GetUser(100)
+	require.NoError(t, err)
+	assert.Equal(t, "JS-650__diagnose_jigsaw", user.StartPayload)
+	assert.Equal(t, "JS-650", user.ProductSKU)
+
+	// Updates of unknown users are no-ops, like an UPDATE matching no rows
+	assert.NoError(t, s.UpdateUserMessageCount(999))
+	assert.NoError(t, s.ResetUserMessageCount(999))
+	user, err = s.GetUser(999)
+	require.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func testSettings(t *testing.T, s storage.Storage) {
+	settings, err := s.GetSettings()
+	require.NoError(t, err)
+	require.NotNil(t, settings)
+	assert.Equal(t, 4, settings.TriggerMessageCount)
+	assert.Equal(t, 24, settings.OfferCooldownHours)
+	assert.Equal(t, 3, settings.MaxOffersPerUser)
+	assert.False(t, settings.InterruptScenarios)
+	assert.Empty(t, settings.ScenarioTriggerCounts)
+
+	settings.TriggerMessageCount = 7
+	settings.SiteURL = "https://shop.example.com"
+	settings.OfferCooldownHours = 48
+	settings.MaxOffersPerUser = 0
+	settings.InterruptScenarios = true
+	settings.ScenarioTriggerCounts = map[string]int{"diagnose_ushm": 2}
+	require.NoError(t, s.UpdateSettings(settings))
+
+	updated, err := s.GetSettings()
+	require.NoError(t, err)
+	assert.Equal(t, 7, updated.TriggerMessageCount)
+	assert.Equal(t, "https://shop.example.com", updated.SiteURL)
+	assert.Equal(t, 48, updated.OfferCooldownHours)
+	assert.Zero(t, updated.MaxOffersPerUser)
+	assert.True(t, updated.InterruptScenarios)
+	assert.Equal(t, map[string]int{"diagnose_ushm": 2}, updated.ScenarioTriggerCounts)
+
+	settings.ScenarioTriggerCounts = nil
+	require.NoError(t, s.UpdateSettings(settings))
+	updated, err = s.GetSettings()
+	require.NoError(t, err)
+	assert.Empty(t, updated.ScenarioTriggerCounts)
+}
+
+func testMessagesAndMetrics(t *testing.T, s storage.Storage) {
+	_, err := s.GetOrCreateUser(1)
+	require.NoError(t, err)
+	_, err = s.GetOrCreateUser(2)
+	require.NoError(t, err)
+	_, err = s.GetOrCreateUser(3)
+	require.NoError(t, err)
+	scenario := createScenario(t, s, "metrics", "start")
+	EnterStep(t, s, 2, scenario.ID, "start")
+
+	require.NoError(t, s.LogMessage(1, "hello", "incoming"))
+	require.NoError(t, s.LogMessage(1, "hi", "outgoing"))
+	require.NoError(t, s.LogMessage(2, "hello", "incoming"))
+	assert.Error(t, s.LogMessage(404, "unknown user", "incoming"))
+	assert.Error(t, s.LogMessage(1, "bad direction", "sideways"))
+
+	total, err := s.GetTotalMessagesCount()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+
+	active, err := s.GetActiveUsersCount24h()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), active)
+
+	states, err := s.GetUsersByFSMState()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"idle": 2, "in_scenario": 1}, states)
+}
+
+func testRateLimit(t *testing.T, s storage.Storage) {
+	for i := 0; i < 3; i++ {
+		allowed, err := s.CheckRateLimit(1, 3)
+		require.NoError(t, err)
+		assert.True(t, allowed, "request %d", i+1)
+	}
+
+	allowed, err := s.CheckRateLimit(1, 3)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = s.CheckRateLimit(2, 3)
+	require.NoError(t, err)
+	assert.True(t, allowed, "limits are per user")
+}
+
+func testScenarios(t *testing.T, s storage.Storage) {
+	scenarios, err := s.GetFSMScenarios()
+	require.NoError(t, err)
+	assert.Empty(t, scenarios)
+
+	grinder := &storage.FSMScenario{Name: "grinder", DisplayName: "УШМ", TriggerKeywords: []string{"не включается"}, Description: "Angle grinder"}
+	require.NoError(t, s.CreateFSMScenario(grinder))
+	assert.NotZero(t, grinder.ID)
+
+	saw := &storage.FSMScenario{Name: "saw", DisplayName: "Пила", TriggerKeywords: []string{"пила"}}
+	require.NoError(t, s.CreateFSMScenario(saw))
+	jigsaw := &storage.FSMScenario{Name: "jigsaw", DisplayName: "Лобзик", TriggerKeywords: []string{}, ToolKeywords: []string{"электролобзик", "лобзик"}}
+	require.NoError(t, s.CreateFSMScenario(jigsaw))
+
+	assert.ErrorIs(t, s.CreateFSMScenario(&storage.FSMScenario{Name: "grinder", DisplayName: "Copy"}), storage.ErrAlreadyExists)
+
+	scenarios, err = s.GetFSMScenarios()
+	require.NoError(t, err)
+	require.Len(t, scenarios, 3)
+	assert.Equal(t, grinder.ID, scenarios[0].ID)
+	assert.Equal(t, saw.ID, scenarios[1].ID)
+
+	got, err := s.GetFSMScenario(grinder.ID)
+	require.NoError(t, err)
+	assert.Equal(t, grinder, got)
+	got, err = s.GetFSMScenario(jigsaw.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"электролобзик", "лобзик"}, got.ToolKeywords)
+
+	matches, err := s.GetFSMScenariosByTrigger("Болгарка НЕ ВКЛЮЧАЕТСЯ совсем")
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, grinder.ID, matches[0].Scenario.ID)
+	assert.Equal(t, len([]rune("не включается")), matches[0].Score)
+
+	// The longer keyword ranks first
+	matches, err = s.GetFSMScenariosByTrigger("пила не включается")
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, []int{grinder.ID, saw.ID}, []int{matches[0].Scenario.ID, matches[1].Scenario.ID})
+
+	// A tool keyword outranks a longer trigger keyword; "лобзик" inside
+	// "электролобзик" is counted once
+	matches, err = s.GetFSMScenariosByTrigger("Электролобзик не включается")
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, jigsaw.ID, matches[0].Scenario.ID)
+	assert.Equal(t, 1, matches[0].Tools)
+	assert.Equal(t, len([]rune("электролобзик")), matches[0].Score)
+	assert.Equal(t, grinder.ID, matches[1].Scenario.ID)
+	assert.Zero(t, matches[1].Tools)
+
+	matches, err = s.GetFSMScenariosByTrigger("добрый день")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	grinder.DisplayName = "Болгарка"
+	grinder.TriggerKeywords = []string{"не крутит"}
+	require.NoError(t, s.UpdateFSMScenario(grinder))
+	got, err = s.GetFSMScenario(grinder.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Болгарка", got.DisplayName)
+	assert.Equal(t, []string{"не крутит"}, got.TriggerKeywords)
+
+	saw.Name = "grinder"
+	assert.ErrorIs(t, s.UpdateFSMScenario(saw), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.UpdateFSMScenario(&storage.FSMScenario{ID: 9999, Name: "missing"}), storage.ErrNotFound)
+
+	require.NoError(t, s.DeleteFSMScenario(saw.ID))
+	assert.ErrorIs(t, s.DeleteFSMScenario(saw.ID), storage.ErrNotFound)
+	got, err = s.GetFSMScenario(saw.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testSteps(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "steps", "start", "middle", "end")
+
+	assert.ErrorIs(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "start", StateType: "start"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: 9999, StepKey: "start", StateType: "start"}), storage.ErrNotFound)
+	assert.Error(t, s.CreateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "odd", StateType: "unknown"}))
+
+	steps, err := s.GetFSMScenarioSteps(scenario.ID)
+	require.NoError(t, err)
+	require.Len(t, steps, 3)
+	assert.Equal(t, []string{"start", "middle", "end"}, []string{steps[0].StepKey, steps[1].StepKey, steps[2].StepKey})
+	assert.Equal(t, "start", steps[0].StateType)
+	assert.True(t, steps[2].IsFinal)
+
+	next := "end"
+	middle := &storage.FSMScenarioStep{
+		ScenarioID:  scenario.ID,
+		StepKey:     "middle",
+		Message:     "Updated",
+		NextStepKey: &next,
+		StateType:   "intermediate",
+		Input:       "email",
+		InputError:  "Invalid email",
+		Effects:     []string{"save_email", "grant_consent"},
+	}
+	require.NoError(t, s.UpdateFSMScenarioStep(middle))
+	assert.Equal(t, steps[1].ID, middle.ID)
+
+	got, err := s.GetFSMScenarioStep(scenario.ID, "middle")
+	require.NoError(t, err)
+	assert.Equal(t, middle, got)
+
+	assert.ErrorIs(t, s.UpdateFSMScenarioStep(&storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: "missing", StateType: "intermediate"}), storage.ErrNotFound)
+
+	got, err = s.GetFSMScenarioStep(scenario.ID, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	require.NoError(t, s.DeleteFSMScenarioStep(scenario.ID, "middle"))
+	assert.ErrorIs(t, s.DeleteFSMScenarioStep(scenario.ID, "middle"), storage.ErrNotFound)
+}
+
+func testTransitions(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "transitions", "start", "yes", "no")
+	other := createScenario(t, s, "other", "start")
+
+	no := &storage.FSMTransition{ScenarioID: scenario.ID, FromStepKey: "start", ToStepKey: "no", ButtonLabel: "Нет", SortOrder: 2}
+	yes := &storage.FSMTransition{ScenarioID: scenario.ID, FromStepKey: "start", ToStepKey: "yes", ButtonLabel: "Да", SortOrder: 1}
+	back := &storage.FSMTransition{ScenarioID: scenario.ID, FromStepKey: "no", ToStepKey: "start", ButtonLabel: "Назад"}
+	require.NoError(t, s.CreateFSMTransition(no))
+	require.NoError(t, s.CreateFSMTransition(yes))
+	require.NoError(t, s.CreateFSMTransition(back))
+	assert.NotZero(t, no.ID)
+
+	assert.ErrorIs(t, s.CreateFSMTransition(&storage.FSMTransition{ScenarioID: scenario.ID, FromStepKey: "start", ToStepKey: "yes"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.CreateFSMTransition(&storage.FSMTransition{ScenarioID: scenario.ID, FromStepKey: "start", ToStepKey: "missing"}), storage.ErrNotFound)
+
+	transitions, err := s.GetFSMTransitions(scenario.ID, "start")
+	require.NoError(t, err)
+	require.Len(t, transitions, 2)
+	assert.Equal(t, yes.ID, transitions[0].ID, "ordered by sort_order")
+	assert.Equal(t, no.ID, transitions[1].ID)
+
+	all, err := s.GetFSMScenarioTransitions(scenario.ID)
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, back.ID, all[0].ID, "ordered by from_step_key first")
+
+	got, err := s.GetFSMTransition(scenario.ID, yes.ID)
+	require.NoError(t, err)
+	assert.Equal(t, yes, got)
+	got, err = s.GetFSMTransition(other.ID, yes.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got, "transitions are scoped to their scenario")
+
+	condition := "confirmed"
+	yes.ButtonLabel = "Конечно"
+	yes.Condition = &condition
+	require.NoError(t, s.UpdateFSMTransition(yes))
+	got, err = s.GetFSMTransition(scenario.ID, yes.ID)
+	require.NoError(t, err)
+	assert.Equal(t, yes, got)
+
+	yes.ToStepKey = "no"
+	assert.ErrorIs(t, s.UpdateFSMTransition(yes), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.UpdateFSMTransition(&storage.FSMTransition{ID: 9999, ScenarioID: scenario.ID, FromStepKey: "yes", ToStepKey: "no"}), storage.ErrNotFound)
+
+	require.NoError(t, s.DeleteFSMTransition(scenario.ID, no.ID))
+	assert.ErrorIs(t, s.DeleteFSMTransition(scenario.ID, no.ID), storage.ErrNotFound)
+	assert.ErrorIs(t, s.DeleteFSMTransition(other.ID, back.ID), storage.ErrNotFound)
+}
+
+func testActions(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "actions", "start", "brushes", "cable")
+
+	cable := &storage.FSMStepAction{ScenarioID: scenario.ID, StepKey: "start", ActionStepKey: "cable", Label: "Кабель", SortOrder: 2}
+	brushes := &storage.FSMStepAction{ScenarioID: scenario.ID, StepKey: "start", ActionStepKey: "brushes", Label: "Щётки", SortOrder: 1}
+	require.NoError(t, s.CreateFSMStepAction(cable))
+	require.NoError(t, s.CreateFSMStepAction(brushes))
+
+	assert.ErrorIs(t, s.CreateFSMStepAction(&storage.FSMStepAction{ScenarioID: scenario.ID, StepKey: "start", ActionStepKey: "cable"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.CreateFSMStepAction(&storage.FSMStepAction{ScenarioID: scenario.ID, StepKey: "start", ActionStepKey: "missing"}), storage.ErrNotFound)
+
+	actions, err := s.GetFSMStepActions(scenario.ID, "start")
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+	assert.Equal(t, brushes.ID, actions[0].ID)
+	assert.Equal(t, cable.ID, actions[1].ID)
+
+	all, err := s.GetFSMScenarioActions(scenario.ID)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	brushes.Label = "Угольные щётки"
+	require.NoError(t, s.UpdateFSMStepAction(brushes))
+	got, err := s.GetFSMStepAction(scenario.ID, brushes.ID)
+	require.NoError(t, err)
+	assert.Equal(t, brushes, got)
+	assert.ErrorIs(t, s.UpdateFSMStepAction(&storage.FSMStepAction{ID: 9999, ScenarioID: scenario.ID, StepKey: "brushes", ActionStepKey: "cable"}), storage.ErrNotFound)
+
+	require.NoError(t, s.DeleteFSMStepAction(scenario.ID, cable.ID))
+	assert.ErrorIs(t, s.DeleteFSMStepAction(scenario.ID, cable.ID), storage.ErrNotFound)
+	got, err = s.GetFSMStepAction(scenario.ID, cable.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testSessions(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "sessions", "start", "next")
+	createUser(t, s, 1)
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	EnterStep(t, s, 1, scenario.ID, "start")
+	session, err = s.GetUserSession(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, storage.SessionStateInScenario, session.State)
+	assert.Equal(t, scenario.ID, *session.ScenarioID)
+	assert.Equal(t, "start", *session.CurrentStepKey)
+	assert.Empty(t, session.History)
+
+	changed, err := s.SetUserSessionState(1, storage.StepPosition(scenario.ID, "start"), storage.IdlePosition)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	session, err = s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session, "an idle conversation has no session")
+
+	EnterStep(t, s, 1, scenario.ID, "next")
+	require.NoError(t, s.DeleteUserSession(1))
+	session, err = s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func testSessionHistory(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "history", "start", "a", "b")
+	createUser(t, s, 1)
+
+	EnterStep(t, s, 1, scenario.ID, "start")
+	EnterStep(t, s, 1, scenario.ID, "a")
+	EnterStep(t, s, 1, scenario.ID, "a")
+	EnterStep(t, s, 1, scenario.ID, "b")
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.SessionStep{
+		{ScenarioID: scenario.ID, StepKey: "start"},
+		{ScenarioID: scenario.ID, StepKey: "a"},
+	}, session.History, "re-entering the current step is not recorded")
+
+	session, err = s.PopUserSessionStep(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, "a", *session.CurrentStepKey)
+
+	session, err = s.PopUserSessionStep(1)
+	require.NoError(t, err)
+	assert.Equal(t, "start", *session.CurrentStepKey)
+	assert.Empty(t, session.History)
+
+	session, err = s.PopUserSessionStep(1)
+	require.NoError(t, err)
+	assert.Nil(t, session, "nothing to go back to")
+
+	session, err = s.PopUserSessionStep(404)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	for i := 0; i < storage.MaxSessionHistory+5; i++ {
+		step := "a"
+		if i%2 == 1 {
+			step = "b"
+		}
+		EnterStep(t, s, 1, scenario.ID, step)
+	}
+	session, err = s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Len(t, session.History, storage.MaxSessionHistory)
+}
+
+func testSessionState(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "state", "start", "next")
+	createUser(t, s, 1)
+	start := storage.StepPosition(scenario.ID, "start")
+	next := storage.StepPosition(scenario.ID, "next")
+
+	// A user without a session is idle, and a scenario state needs a step
+	changed, err := s.SetUserSessionState(1, start, storage.IdlePosition)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	_, err = s.SetUserSessionState(1, storage.IdlePosition, storage.SessionPosition{State: storage.SessionStateInScenario})
+	assert.Error(t, err, "a session in a scenario needs a step")
+
+	changed, err = s.SetUserSessionState(1, storage.IdlePosition, start)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = s.SetUserSessionState(1, storage.IdlePosition, next)
+	require.NoError(t, err)
+	assert.False(t, changed, "the session is not idle")
+
+	changed, err = s.SetUserSessionState(1, start, next)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// The step is compared as well as the state
+	changed, err = s.SetUserSessionState(1, start, storage.IdlePosition)
+	require.NoError(t, err)
+	assert.False(t, changed, "the session moved on from the start step")
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, next, session.Position())
+	assert.Equal(t, []storage.SessionStep{{ScenarioID: scenario.ID, StepKey: "start"}}, session.History)
+
+	changed, err = s.SetUserSessionState(1, next, storage.IdlePosition)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	session, err = s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	assert.Equal(t, storage.IdlePosition, session.Position())
+
+	changed, err = s.SetUserSessionState(1, next, storage.IdlePosition)
+	require.NoError(t, err)
+	assert.False(t, changed, "the scenario was already left")
+}
+
+func testDeleteCascades(t *testing.T, s storage.Storage) {
+	first := createScenario(t, s, "first", "start", "middle", "end")
+	second := createScenario(t, s, "second", "start")
+	for _, id := range []int64{1, 2, 3} {
+		createUser(t, s, id)
+	}
+
+	require.NoError(t, s.CreateFSMTransition(&storage.FSMTransition{ScenarioID: first.ID, FromStepKey: "start", ToStepKey: "middle"}))
+	require.NoError(t, s.CreateFSMTransition(&storage.FSMTransition{ScenarioID: first.ID, FromStepKey: "start", ToStepKey: "end"}))
+	require.NoError(t, s.CreateFSMStepAction(&storage.FSMStepAction{ScenarioID: first.ID, StepKey: "middle", ActionStepKey: "end"}))
+
+	EnterStep(t, s, 1, first.ID, "middle")
+	EnterStep(t, s, 2, first.ID, "start")
+	EnterStep(t, s, 3, first.ID, "start")
+	EnterStep(t, s, 3, second.ID, "start")
+
+	// Deleting a step removes everything referencing it and the sessions parked on it
+	require.NoError(t, s.DeleteFSMScenarioStep(first.ID, "middle"))
+	transitions, err := s.GetFSMScenarioTransitions(first.ID)
+	require.NoError(t, err)
+	require.Len(t, transitions, 1)
+	assert.Equal(t, "end", transitions[0].ToStepKey)
+	actions, err := s.GetFSMScenarioActions(first.ID)
+	require.NoError(t, err)
+	assert.Empty(t, actions)
+
+	session, err := s.GetUserSession(1)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	session, err = s.GetUserSession(2)
+	require.NoError(t, err)
+	assert.NotNil(t, session)
+
+	// Deleting a scenario removes sessions inside it and strips it from other sessions' history
+	require.NoError(t, s.DeleteFSMScenario(first.ID))
+	steps, err := s.GetFSMScenarioSteps(first.ID)
+	require.NoError(t, err)
+	assert.Empty(t, steps)
+	transitions, err = s.GetFSMScenarioTransitions(first.ID)
+	require.NoError(t, err)
+	assert.Empty(t, transitions)
+
+	session, err = s.GetUserSession(2)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	session, err = s.GetUserSession(3)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, second.ID, *session.ScenarioID)
+	assert.Empty(t, session.History)
+}
+
+func testCallbackTokens(t *testing.T, s storage.Storage) {
+	token := &storage.CallbackToken{
+		Token:       "t:abc",
+		UserID:      1,
+		Kind:        "goto",
+		ScenarioID:  3,
+		FromStepKey: "root",
+		StepKey:     "no_power_action_lawnmower",
+		ExpiresAt:   time.Now().Add(time.Hour).Truncate(time.Microsecond),
+	}
+	require.NoError(t, s.SaveCallbackToken(token))
+	assert.ErrorIs(t, s.SaveCallbackToken(token), storage.ErrAlreadyExists)
+
+	got, err := s.GetCallbackToken("t:abc")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.True(t, token.ExpiresAt.Equal(got.ExpiresAt))
+	got.ExpiresAt = token.ExpiresAt
+	assert.Equal(t, token, got)
+
+	got, err = s.GetCallbackToken("t:missing")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	require.NoError(t, s.SaveCallbackToken(&storage.CallbackToken{
+		Token: "t:old", UserID: 1, Kind: "email_confirm", Value: "user@example.com", ExpiresAt: time.Now().Add(-time.Minute),
+	}))
+	got, err = s.GetCallbackToken("t:old")
+	require.NoError(t, err)
+	assert.Nil(t, got, "expired tokens are not returned")
+
+	deleted, err := s.DeleteExpiredCallbackTokens()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	got, err = s.GetCallbackToken("t:abc")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+}
+
+func testDeepLinks(t *testing.T, s storage.Storage) {
+	scenario := createScenario(t, s, "diagnose_jigsaw", "root", "done")
+	missingID := scenario.ID + 100
+	root := "root"
+
+	link := &storage.DeepLink{Payload: "JS-650", ProductSKU: "JS-650", ScenarioID: &scenario.ID, StepKey: &root}
+	require.NoError(t, s.CreateDeepLink(link))
+	assert.False(t, link.CreatedAt.IsZero())
+	assert.ErrorIs(t, s.CreateDeepLink(link), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.CreateDeepLink(&storage.DeepLink{Payload: "x", ProductSKU: "X", ScenarioID: &missingID}), storage.ErrNotFound)
+	require.NoError(t, s.CreateDeepLink(&storage.DeepLink{Payload: "CS-190", ProductSKU: "CS-190"}))
+
+	got, err := s.GetDeepLink("JS-650")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "JS-650", got.ProductSKU)
+	assert.Equal(t, scenario.ID, *got.ScenarioID)
+	assert.Equal(t, "root", *got.StepKey)
+
+	got, err = s.GetDeepLink("missing")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	links, err := s.GetDeepLinks()
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	assert.Equal(t, "CS-190", links[0].Payload)
+	assert.Nil(t, links[0].ScenarioID)
+	assert.Equal(t, "JS-650", links[1].Payload)
+
+	link.ProductSKU = "JS-650-PRO"
+	link.StepKey = nil
+	require.NoError(t, s.UpdateDeepLink(link))
+	got, err = s.GetDeepLink("JS-650")
+	require.NoError(t, err)
+	assert.Equal(t, "JS-650-PRO", got.ProductSKU)
+	assert.Nil(t, got.StepKey)
+	assert.ErrorIs(t, s.UpdateDeepLink(&storage.DeepLink{Payload: "missing", ProductSKU: "X"}), storage.ErrNotFound)
+	assert.ErrorIs(t, s.UpdateDeepLink(&storage.DeepLink{Payload: "JS-650", ProductSKU: "X", ScenarioID: &missingID}), storage.ErrNotFound)
+
+	// Deleting the scenario keeps the link and its product
+	require.NoError(t, s.DeleteFSMScenario(scenario.ID))
+	got, err = s.GetDeepLink("JS-650")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Nil(t, got.ScenarioID)
+	assert.Equal(t, "JS-650-PRO", got.ProductSKU)
+
+	require.NoError(t, s.DeleteDeepLink("JS-650"))
+	assert.ErrorIs(t, s.DeleteDeepLink("JS-650"), storage.ErrNotFound)
+	got, err = s.GetDeepLink("JS-650")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testCategories(t *testing.T, s storage.Storage) {
+	saws := &storage.Category{Name: "saws", DisplayName: "Пилы"}
+	require.NoError(t, s.CreateCategory(saws))
+	assert.NotZero(t, saws.ID)
+	assert.ErrorIs(t, s.CreateCategory(&storage.Category{Name: "saws"}), storage.ErrAlreadyExists)
+	grinders := &storage.Category{Name: "grinders", DisplayName: "УШМ"}
+	require.NoError(t, s.CreateCategory(grinders))
+
+	categories, err := s.GetCategories()
+	require.NoError(t, err)
+	require.Len(t, categories, 2)
+	assert.Equal(t, "grinders", categories[0].Name)
+	assert.Equal(t, "saws", categories[1].Name)
+
+	saws.DisplayName = "Пилы и лобзики"
+	require.NoError(t, s.UpdateCategory(saws))
+	got, err := s.GetCategory(saws.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Пилы и лобзики", got.DisplayName)
+	assert.ErrorIs(t, s.UpdateCategory(&storage.Category{ID: saws.ID, Name: "grinders"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.UpdateCategory(&storage.Category{ID: saws.ID + 100, Name: "mowers"}), storage.ErrNotFound)
+
+	require.NoError(t, s.DeleteCategory(saws.ID))
+	assert.ErrorIs(t, s.DeleteCategory(saws.ID), storage.ErrNotFound)
+	got, err = s.GetCategory(saws.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testProducts(t *testing.T, s storage.Storage) {
+	grinder := createScenario(t, s, "diagnose_grinder", "root", "done")
+	saw := createScenario(t, s, "diagnose_saw", "root", "done")
+	category := &storage.Category{Name: "grinders"}
+	require.NoError(t, s.CreateCategory(category))
+	missingID := saw.ID + 100
+
+	product := &storage.Product{
+		SKU:         "AG-125",
+		Model:       "AG 125 Pro",
+		CategoryID:  &category.ID,
+		Specs:       map[string]string{"brushes": "6x10 мм"},
+		ManualURL:   "https://example.com/ag-125.pdf",
+		ScenarioIDs: []int{saw.ID, grinder.ID},
+	}
+	require.NoError(t, s.CreateProduct(product))
+	assert.NotZero(t, product.ID)
+	assert.False(t, product.CreatedAt.IsZero())
+	assert.ErrorIs(t, s.CreateProduct(&storage.Product{SKU: "AG-125", Model: "Copy"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.CreateProduct(&storage.Product{SKU: "X-1", Model: "X", CategoryID: &missingID}), storage.ErrNotFound)
+	assert.ErrorIs(t, s.CreateProduct(&storage.Product{SKU: "X-2", Model: "X", ScenarioIDs: []int{missingID}}), storage.ErrNotFound)
+	require.NoError(t, s.CreateProduct(&storage.Product{SKU: "CS-190", Model: "CS 190"}))
+
+	got, err := s.GetProduct(product.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "AG 125 Pro", got.Model)
+	assert.Equal(t, category.ID, *got.CategoryID)
+	assert.Equal(t, map[string]string{"brushes": "6x10 мм"}, got.Specs)
+	assert.Equal(t, "https://example.com/ag-125.pdf", got.ManualURL)
+	assert.ElementsMatch(t, []int{grinder.ID, saw.ID}, got.ScenarioIDs)
+
+	got, err = s.GetProductBySKU("CS-190")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Empty(t, got.Specs)
+	assert.Empty(t, got.ScenarioIDs)
+	assert.Nil(t, got.CategoryID)
+
+	got, err = s.GetProductBySKU("missing")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = s.GetProduct(product.ID + 100)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	products, err := s.GetProducts()
+	require.NoError(t, err)
+	require.Len(t, products, 2)
+	assert.Equal(t, "AG-125", products[0].SKU)
+	assert.Equal(t, "CS-190", products[1].SKU)
+
+	product.Model = "AG 125 Pro II"
+	product.ScenarioIDs = []int{grinder.ID}
+	require.NoError(t, s.UpdateProduct(product))
+	got, err = s.GetProduct(product.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "AG 125 Pro II", got.Model)
+	assert.Equal(t, []int{grinder.ID}, got.ScenarioIDs)
+	assert.ErrorIs(t, s.UpdateProduct(&storage.Product{ID: product.ID, SKU: "CS-190", Model: "X"}), storage.ErrAlreadyExists)
+	assert.ErrorIs(t, s.UpdateProduct(&storage.Product{ID: product.ID + 100, SKU: "Y", Model: "Y"}), storage.ErrNotFound)
+
+	// Deleting a scenario unlinks it, deleting a category leaves the product without one
+	require.NoError(t, s.DeleteFSMScenario(grinder.ID))
+	require.NoError(t, s.DeleteCategory(category.ID))
+	got, err = s.GetProduct(product.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Empty(t, got.ScenarioIDs)
+	assert.Nil(t, got.CategoryID)
+
+	require.NoError(t, s.DeleteProduct(product.ID))
+	assert.ErrorIs(t, s.DeleteProduct(product.ID), storage.ErrNotFound)
+	got, err = s.GetProduct(product.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testScenarioMenu(t *testing.T, s storage.Storage) {
+	saws := &storage.Category{Name: "saws", SortOrder: 2}
+	require.NoError(t, s.CreateCategory(saws))
+	grinders := &storage.Category{Name: "grinders", SortOrder: 1}
+	require.NoError(t, s.CreateCategory(grinders))
+	garden := &storage.Category{Name: "garden", SortOrder: 1}
+	require.NoError(t, s.CreateCategory(garden))
+
+	categories, err := s.GetCategories()
+	require.NoError(t, err)
+	require.Len(t, categories, 3)
+	assert.Equal(t, []string{"garden", "grinders", "saws"}, []string{categories[0].Name, categories[1].Name, categories[2].Name})
+
+	jigsaw := &storage.FSMScenario{Name: "jigsaw", TriggerKeywords: []string{}, CategoryID: &saws.ID, SortOrder: 2}
+	require.NoError(t, s.CreateFSMScenario(jigsaw))
+	miterSaw := &storage.FSMScenario{Name: "miter_saw", TriggerKeywords: []string{}, CategoryID: &saws.ID, SortOrder: 1}
+	require.NoError(t, s.CreateFSMScenario(miterSaw))
+	brushes := &storage.FSMScenario{Name: "replace_brushes", TriggerKeywords: []string{}, HiddenFromMenu: true, SortOrder: 1}
+	require.NoError(t, s.CreateFSMScenario(brushes))
+	missingID := garden.ID + 100
+	assert.ErrorIs(t, s.CreateFSMScenario(&storage.FSMScenario{Name: "x", TriggerKeywords: []string{}, CategoryID: &missingID}), storage.ErrNotFound)
+
+	// Ordered by sort_order, then by ID
+	scenarios, err := s.GetFSMScenarios()
+	require.NoError(t, err)
+	require.Len(t, scenarios, 3)
+	assert.Equal(t, []string{"miter_saw", "replace_brushes", "jigsaw"}, []string{scenarios[0].Name, scenarios[1].Name, scenarios[2].Name})
+
+	got, err := s.GetFSMScenario(brushes.ID)
+	require.NoError(t, err)
+	assert.True(t, got.HiddenFromMenu)
+	assert.Nil(t, got.CategoryID)
+	got, err = s.GetFSMScenario(jigsaw.ID)
+	require.NoError(t, err)
+	assert.False(t, got.HiddenFromMenu)
+	assert.Equal(t, saws.ID, *got.CategoryID)
+
+	jigsaw.CategoryID = &missingID
+	assert.ErrorIs(t, s.UpdateFSMScenario(jigsaw), storage.ErrNotFound)
+	jigsaw.CategoryID = &grinders.ID
+	jigsaw.HiddenFromMenu = true
+	require.NoError(t, s.UpdateFSMScenario(jigsaw))
+	got, err = s.GetFSMScenario(jigsaw.ID)
+	require.NoError(t, err)
+	assert.Equal(t, grinders.ID, *got.CategoryID)
+	assert.True(t, got.HiddenFromMenu)
+
+	// Deleting a category leaves its scenarios at the top level
+	require.NoError(t, s.DeleteCategory(saws.ID))
+	got, err = s.GetFSMScenario(miterSaw.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.CategoryID)
+}
+
+// createScenario creates a scenario with steps in the given order; the first is the start step and the last is final
+func createScenario(t *testing.T, s storage.Storage, name string, stepKeys ...string) *storage.FSMScenario {
+	t.Helper()
+
+	scenario := &storage.FSMScenario{Name: name, DisplayName: name, TriggerKeywords: []string{}}
+	require.NoError(t, s.CreateFSMScenario(scenario))
+
+	for i, key := range stepKeys {
+		step := &storage.FSMScenarioStep{ScenarioID: scenario.ID, StepKey: key, Message: key, StateType: "intermediate"}
+		if i == 0 {
+			step.StateType = "start"
+		}
+		if i == len(stepKeys)-1 && i > 0 {
+			step.StateType = "final"
+			step.IsFinal = true
+		}
+		require.NoError(t, s.CreateFSMScenarioStep(step))
+	}
+	return scenario
+}
+
+func createUser(t *testing.T, s storage.Storage, telegramID int64) {
+	t.Helper()
+
+	_, err := s.GetOrCreateUser(telegramID)
+	require.NoError(t, err)
+}
+
+// EnterStep moves a user's session to a scenario step from wherever it is
+func EnterStep(t *testing.T, s storage.Storage, userID int64, scenarioID int, stepKey string) {
+	t.Helper()
+
+	session, err := s.GetUserSession(userID)
+	require.NoError(t, err)
+	changed, err := s.SetUserSessionState(userID, session.Position(), storage.StepPosition(scenarioID, stepKey))
+	require.NoError(t, err)
+	require.True(t, changed)
+}
@@ -0,0 +1,4 @@
+-- 007_add_fsm_transitions.down.sql
+-- Buttons fall back to numbered options parsed from step messages.
+
+DROP TABLE IF EXISTS fsm_transitions;
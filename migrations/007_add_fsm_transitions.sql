@@ -0,0 +1,71 @@
+-- 007_add_fsm_transitions.sql
+-- Explicit transitions between steps. Each row is one inline button on the
+-- from_step_key step leading to to_step_key. Replaces the step_key suffix
+-- conventions that FSM.getDiagnosticButtons and getProblemButtons used.
+
+CREATE TABLE IF NOT EXISTS fsm_transitions (
+    id SERIAL PRIMARY KEY,
+    scenario_id INT NOT NULL REFERENCES fsm_scenarios(id) ON DELETE CASCADE,
+    from_step_key TEXT NOT NULL,
+    to_step_key TEXT NOT NULL,
+    button_label TEXT NOT NULL,
+    sort_order INT NOT NULL DEFAULT 0,
+    condition TEXT,                      -- NULL = always shown, e.g. "has_email" or "!has_email"
+    UNIQUE (scenario_id, from_step_key, to_step_key),
+    FOREIGN KEY (scenario_id, from_step_key) REFERENCES fsm_steps(scenario_id, step_key) ON DELETE CASCADE,
+    FOREIGN KEY (scenario_id, to_step_key) REFERENCES fsm_steps(scenario_id, step_key) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_fsm_transitions_from ON fsm_transitions(scenario_id, from_step_key, sort_order);
+
+-- Problem selection on the root step (previously getProblemButtons).
+-- Button text is the first sentence of the problem step message.
+INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order)
+SELECT root.scenario_id,
+       root.step_key,
+       problem.step_key,
+       CASE
+           WHEN problem.title LIKE 'Вращается%' THEN 'Вращается, но не крутит'
+           WHEN problem.title LIKE 'Аккумулятор%' THEN 'Аккумулятор быстро садится'
+           WHEN problem.title LIKE 'Неровный%' THEN 'Неровный срез или вибрация'
+           ELSE regexp_replace(problem.title, '^(Устройство|Мотор|Полотно) ', '')
+       END,
+       ROW_NUMBER() OVER (PARTITION BY root.id ORDER BY problem.id)
+FROM fsm_steps root
+JOIN (
+    SELECT id, scenario_id, step_key,
+           trim(split_part(split_part(message, E'\n', 1), '.', 1)) AS title
+    FROM fsm_steps
+    WHERE step_key IN ('no_power', 'stops_during_work', 'vibration_noise', 'motor_runs_no_blade',
+                       'vibration_inaccurate', 'blade_no_move', 'vibration_drift', 'spins_no_torque',
+                       'battery_drains', 'uneven_vibration')
+) problem ON problem.scenario_id = root.scenario_id
+WHERE root.step_key = 'root' AND root.state_type = 'start'
+ON CONFLICT (scenario_id, from_step_key, to_step_key) DO NOTHING;
+
+-- Diagnostic branches: child steps named <parent>_<suffix> (previously getDiagnosticButtons)
+INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order)
+SELECT parent.scenario_id,
+       parent.step_key,
+       child.step_key,
+       labels.button_label,
+       ROW_NUMBER() OVER (PARTITION BY parent.id ORDER BY child.id)
+FROM fsm_steps parent
+JOIN fsm_steps child ON child.scenario_id = parent.scenario_id
+JOIN (VALUES
+    ('lit', 'Да'), ('ok', 'Да'), ('yes', 'Да'), ('reacts', 'Да'), ('turns', 'Да'), ('disk_turns', 'Да'),
+    ('dark', 'Нет'), ('no', 'Нет'), ('not_ok', 'Нет'), ('no_reaction', 'Нет'), ('disk_stuck', 'Нет'),
+    ('immediately', 'Нет'), ('hot', 'Нет'), ('not_hot', 'Нет'), ('strong_vibration', 'Нет'),
+    ('grinding_noise', 'Нет'), ('other_noise', 'Нет'),
+    ('power_ok', 'Да, работает'), ('no_power', 'Нет, не работает'),
+    ('locks_ok', 'Да, в порядке'), ('locks_not_ok', 'Нет, проблемы'),
+    ('belt_ok', 'Да, целый'), ('belt_broken', 'Нет, повреждён'),
+    ('disk_ok', 'Да, в порядке'), ('disk_problem', 'Нет, проблемы'),
+    ('blade_ok', 'Да, правильно'), ('blade_not_ok', 'Нет, проблемы'),
+    ('clutch_ok', 'Нет, муфта не сработала'), ('clutch_triggered', 'Да, муфта сработала'),
+    ('old', 'Да, старый'), ('new', 'Нет, новый'),
+    ('clear', 'Да, чистый'), ('blocked', 'Нет, заблокирован'),
+    ('wheels_ok', 'Да, одинаково'), ('wheels_not_level', 'Нет, разная высота')
+) AS labels(suffix, button_label) ON child.step_key = parent.step_key || '_' || labels.suffix
+WHERE parent.state_type NOT IN ('start', 'final')
+ON CONFLICT (scenario_id, from_step_key, to_step_key) DO NOTHING;
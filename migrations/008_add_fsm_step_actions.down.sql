@@ -0,0 +1,3 @@
+-- 008_add_fsm_step_actions.down.sql
+
+DROP TABLE IF EXISTS fsm_step_actions;
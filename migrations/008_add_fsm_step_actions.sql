@@ -0,0 +1,80 @@
+-- 008_add_fsm_step_actions.sql
+-- Terminal action groups. An action-selection step (e.g. "no_power_action")
+-- lists repair instructions as buttons; each row is one button of the group.
+-- Replaces the hardcoded FSM.getActionMapping switch.
+
+CREATE TABLE IF NOT EXISTS fsm_step_actions (
+    id SERIAL PRIMARY KEY,
+    scenario_id INT NOT NULL REFERENCES fsm_scenarios(id) ON DELETE CASCADE,
+    step_key TEXT NOT NULL,              -- шаг выбора действия, например "no_power_action"
+    action_step_key TEXT NOT NULL,       -- шаг с инструкцией, например "replace_trigger_button"
+    label TEXT NOT NULL,                 -- текст кнопки
+    sort_order INT NOT NULL DEFAULT 0,
+    UNIQUE (scenario_id, step_key, action_step_key),
+    FOREIGN KEY (scenario_id, step_key) REFERENCES fsm_steps(scenario_id, step_key) ON DELETE CASCADE,
+    FOREIGN KEY (scenario_id, action_step_key) REFERENCES fsm_steps(scenario_id, step_key) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_fsm_step_actions_step ON fsm_step_actions(scenario_id, step_key, sort_order);
+
+-- Move the former getActionMapping groups into the table for every scenario
+-- that has both the selection step and the action step. The label is the first
+-- line of the action step message without its leading emoji.
+INSERT INTO fsm_step_actions (scenario_id, step_key, action_step_key, label, sort_order)
+SELECT selector.scenario_id,
+       selector.step_key,
+       action.step_key,
+       rtrim(regexp_replace(split_part(action.message, E'\n', 1), '^\S+\s+', ''), ':'),
+       mapping.sort_order
+FROM (VALUES
+    ('no_power_action', 'charge_or_replace_battery', 1),
+    ('no_power_action', 'replace_trigger_button', 2),
+    ('no_power_action', 'repair_internal_wiring', 3),
+    ('no_power_action', 'refer_to_service_center', 4),
+    ('stopped_action', 'restart_after_protection_reset', 1),
+    ('stopped_action', 'restart_after_cooling', 2),
+    ('stopped_action', 'repair_mechanical_drive', 3),
+    ('stopped_action', 'replace_carbon_brushes', 4),
+    ('stopped_action', 'refer_to_service_center', 5),
+    ('no_power_action_miter', 'restore_power', 1),
+    ('no_power_action_miter', 'replace_power_cable', 2),
+    ('no_power_action_miter', 'disable_safety_lock', 3),
+    ('no_power_action_miter', 'repair_mechanical_drive_miter', 4),
+    ('no_power_action_miter', 'replace_belt', 5),
+    ('no_power_action_miter', 'reinstall_blade', 6),
+    ('no_power_action_miter', 'install_new_blade', 7),
+    ('no_power_action_miter', 'refer_to_service_center', 8),
+    ('motor_no_blade_action', 'repair_mechanical_drive_miter', 1),
+    ('motor_no_blade_action', 'replace_belt', 2),
+    ('vibration_action', 'reinstall_blade', 1),
+    ('vibration_action', 'install_new_blade', 2),
+    ('vibration_action', 'repair_mechanical_drive_miter', 3),
+    ('no_power_action_jigsaw', 'restore_power', 1),
+    ('no_power_action_jigsaw', 'replace_trigger_button', 2),
+    ('no_power_action_jigsaw', 'repair_internal_wiring', 3),
+    ('blade_not_moving_action', 'correctly_install_blade', 1),
+    ('blade_not_moving_action', 'repair_reciprocating_mechanism', 2),
+    ('vibration_drift_action', 'install_new_blade', 1),
+    ('vibration_drift_action', 'repair_mechanical_drive', 2),
+    ('vibration_drift_action', 'tighten_housing', 3),
+    ('no_power_action_drill', 'charge_or_replace_battery', 1),
+    ('no_power_action_drill', 'service_contact_group', 2),
+    ('no_power_action_drill', 'replace_trigger_button', 3),
+    ('spins_no_torque_action', 'adjust_torque_setting', 1),
+    ('spins_no_torque_action', 'repair_gearbox', 2),
+    ('battery_drains_action', 'replace_battery_cells', 1),
+    ('battery_drains_action', 'refer_to_service_center', 2),
+    ('no_power_action_lawnmower', 'restore_power', 1),
+    ('no_power_action_lawnmower', 'replace_power_cable', 2),
+    ('no_power_action_lawnmower', 'restart_after_cooling', 3),
+    ('motor_no_blade_action_lawnmower', 'clear_working_area', 1),
+    ('motor_no_blade_action_lawnmower', 'replace_belt', 2),
+    ('motor_no_blade_action_lawnmower', 'repair_mechanical_drive', 3),
+    ('uneven_cut_action', 'sharpen_or_replace_blade', 1),
+    ('uneven_cut_action', 'correctly_install_blade', 2),
+    ('uneven_cut_action', 'adjust_cutting_height', 3)
+) AS mapping(step_key, action_step_key, sort_order)
+JOIN fsm_steps selector ON selector.step_key = mapping.step_key
+JOIN fsm_steps action ON action.scenario_id = selector.scenario_id AND action.step_key = mapping.action_step_key
+WHERE split_part(action.message, E'\n', 1) ~ '^(🔋|🔘|🔌|🏪|🔄|❄️|⚙️|🖊️)'
+ON CONFLICT (scenario_id, step_key, action_step_key) DO NOTHING;
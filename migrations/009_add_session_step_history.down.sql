@@ -0,0 +1,3 @@
+-- 009_add_session_step_history.down.sql
+
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS step_history;
@@ -0,0 +1,8 @@
+-- 009_add_session_step_history.sql
+-- Ordered history of the steps a user visited in the current session.
+-- Every move to another step pushes the step being left; the "back" button
+-- pops the last entry, so it returns to the real previous step even when the
+-- step is reachable from several parents or lives in another scenario.
+-- Entries look like {"scenario_id": 1, "step_key": "no_power"}.
+
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS step_history JSONB NOT NULL DEFAULT '[]';
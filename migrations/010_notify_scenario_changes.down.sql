@@ -0,0 +1,9 @@
+-- 010_notify_scenario_changes.down.sql
+-- Running bots keep serving cached scenarios until restarted.
+
+DROP TRIGGER IF EXISTS fsm_scenarios_notify_change ON fsm_scenarios;
+DROP TRIGGER IF EXISTS fsm_scenarios_notify_truncate ON fsm_scenarios;
+DROP TRIGGER IF EXISTS fsm_steps_notify_change ON fsm_steps;
+DROP TRIGGER IF EXISTS fsm_transitions_notify_change ON fsm_transitions;
+DROP TRIGGER IF EXISTS fsm_step_actions_notify_change ON fsm_step_actions;
+DROP FUNCTION IF EXISTS notify_fsm_scenario_change();
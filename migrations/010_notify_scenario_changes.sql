@@ -0,0 +1,55 @@
+-- 010_notify_scenario_changes.sql
+-- Announce every change to scenario data on the fsm_scenario_changes channel
+-- with the scenario ID as payload. Bot instances keep scenarios in memory and
+-- drop the changed scenario when notified, whoever made the change: the admin
+-- API of another instance, scenarioctl or plain SQL.
+
+CREATE OR REPLACE FUNCTION notify_fsm_scenario_change() RETURNS trigger AS $$
+DECLARE
+    changed_scenario_id INT;
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        -- 0 means every scenario may have changed
+        changed_scenario_id := 0;
+    ELSIF TG_OP = 'DELETE' THEN
+        IF TG_TABLE_NAME = 'fsm_scenarios' THEN
+            changed_scenario_id := OLD.id;
+        ELSE
+            changed_scenario_id := OLD.scenario_id;
+        END IF;
+    ELSIF TG_TABLE_NAME = 'fsm_scenarios' THEN
+        changed_scenario_id := NEW.id;
+    ELSE
+        changed_scenario_id := NEW.scenario_id;
+    END IF;
+
+    -- Identical notifications within a transaction are delivered once
+    PERFORM pg_notify('fsm_scenario_changes', changed_scenario_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS fsm_scenarios_notify_change ON fsm_scenarios;
+CREATE TRIGGER fsm_scenarios_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON fsm_scenarios
+    FOR EACH ROW EXECUTE FUNCTION notify_fsm_scenario_change();
+
+DROP TRIGGER IF EXISTS fsm_scenarios_notify_truncate ON fsm_scenarios;
+CREATE TRIGGER fsm_scenarios_notify_truncate
+    AFTER TRUNCATE ON fsm_scenarios
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_fsm_scenario_change();
+
+DROP TRIGGER IF EXISTS fsm_steps_notify_change ON fsm_steps;
+CREATE TRIGGER fsm_steps_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON fsm_steps
+    FOR EACH ROW EXECUTE FUNCTION notify_fsm_scenario_change();
+
+DROP TRIGGER IF EXISTS fsm_transitions_notify_change ON fsm_transitions;
+CREATE TRIGGER fsm_transitions_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON fsm_transitions
+    FOR EACH ROW EXECUTE FUNCTION notify_fsm_scenario_change();
+
+DROP TRIGGER IF EXISTS fsm_step_actions_notify_change ON fsm_step_actions;
+CREATE TRIGGER fsm_step_actions_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON fsm_step_actions
+    FOR EACH ROW EXECUTE FUNCTION notify_fsm_scenario_change();
@@ -0,0 +1,3 @@
+-- 011_add_callback_tokens.down.sql
+
+DROP TABLE IF EXISTS callback_tokens;
@@ -0,0 +1,20 @@
+-- 011_add_callback_tokens.sql
+-- Inline buttons carry short opaque tokens instead of free-form callback data,
+-- which Telegram limits to 64 bytes and which used to expose step keys and
+-- emails. Each token maps to a typed action of one user: go to a step, go
+-- back, start a scenario or confirm an email. from_step_key is the step the
+-- button was shown on, so presses of outdated menus can be told apart.
+
+CREATE TABLE IF NOT EXISTS callback_tokens (
+    token TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    scenario_id INT NOT NULL DEFAULT 0,
+    from_step_key TEXT NOT NULL DEFAULT '',
+    step_key TEXT NOT NULL DEFAULT '',
+    value TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_callback_tokens_expires_at ON callback_tokens(expires_at);
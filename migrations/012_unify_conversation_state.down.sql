@@ -0,0 +1,17 @@
+-- 012_unify_conversation_state.down.sql
+-- Funnel states move back to users.fsm_state; scenario sessions keep their step.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS fsm_state TEXT NOT NULL DEFAULT 'idle';
+CREATE INDEX IF NOT EXISTS idx_users_fsm_state ON users(fsm_state);
+
+UPDATE users
+SET fsm_state = user_sessions.state
+FROM user_sessions
+WHERE user_sessions.user_id = users.telegram_id
+    AND user_sessions.state NOT IN ('idle', 'in_scenario');
+
+DELETE FROM user_sessions WHERE current_scenario_id IS NULL OR current_step_key IS NULL;
+
+DROP INDEX IF EXISTS idx_user_sessions_state;
+ALTER TABLE user_sessions DROP CONSTRAINT IF EXISTS user_sessions_in_scenario_has_step;
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS state;
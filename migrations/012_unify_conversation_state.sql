@@ -0,0 +1,32 @@
+-- 012_unify_conversation_state.sql
+-- users.fsm_state (site link and email funnel) and user_sessions (scenario
+-- step) used to be two state systems that could disagree. The conversation
+-- state now lives in user_sessions.state next to the scenario step, so one
+-- row update changes both. A user without a session row is idle.
+--
+-- States: idle, in_scenario, offering_site_link, offering_site_post,
+-- awaiting_email, awaiting_email_consent. While the user is in the funnel the
+-- scenario step is kept, so declining the offer returns to the scenario.
+-- Legacy values of users.fsm_state that no code moves out of (such as
+-- ushm_not_starting_step1 or completed) become idle.
+
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'idle';
+
+UPDATE user_sessions
+SET state = 'in_scenario'
+WHERE current_scenario_id IS NOT NULL AND current_step_key IS NOT NULL;
+
+INSERT INTO user_sessions (user_id, state, updated_at)
+SELECT telegram_id, fsm_state, NOW()
+FROM users
+WHERE fsm_state IN ('offering_site_link', 'offering_site_post', 'awaiting_email', 'awaiting_email_consent')
+ON CONFLICT (user_id) DO UPDATE SET state = EXCLUDED.state;
+
+-- A session in a scenario always knows its step
+ALTER TABLE user_sessions ADD CONSTRAINT user_sessions_in_scenario_has_step
+    CHECK (state <> 'in_scenario' OR (current_scenario_id IS NOT NULL AND current_step_key IS NOT NULL));
+
+CREATE INDEX IF NOT EXISTS idx_user_sessions_state ON user_sessions(state);
+
+DROP INDEX IF EXISTS idx_users_fsm_state;
+ALTER TABLE users DROP COLUMN IF EXISTS fsm_state;
@@ -0,0 +1,14 @@
+-- 013_add_site_offer_scenario.down.sql
+-- Users in the site_offer scenario return to idle; the funnel states of
+-- migration 012 are not restored.
+
+DELETE FROM user_sessions
+WHERE current_scenario_id IN (SELECT id FROM fsm_scenarios WHERE name = 'site_offer');
+
+DELETE FROM fsm_scenarios WHERE name = 'site_offer';
+
+ALTER TABLE user_sessions DROP CONSTRAINT IF EXISTS user_sessions_state_known;
+
+ALTER TABLE fsm_steps DROP COLUMN IF EXISTS effects;
+ALTER TABLE fsm_steps DROP COLUMN IF EXISTS input_error;
+ALTER TABLE fsm_steps DROP COLUMN IF EXISTS input;
@@ -0,0 +1,59 @@
+-- 013_add_site_offer_scenario.sql
+-- The site link offer and email capture become an ordinary scenario,
+-- site_offer, instead of handlers with their own conversation states. Steps
+-- gain what the funnel needs:
+--   input       - validator free text must pass before next_step_key (e.g. email)
+--   input_error - reply to text the validator rejects
+--   effects     - side effects run when a user enters the step
+--                 (save_email, grant_consent, resume_scenario)
+--
+-- Sessions in the old funnel states return to their scenario step, or end.
+
+ALTER TABLE fsm_steps ADD COLUMN IF NOT EXISTS input TEXT NOT NULL DEFAULT '';
+ALTER TABLE fsm_steps ADD COLUMN IF NOT EXISTS input_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE fsm_steps ADD COLUMN IF NOT EXISTS effects TEXT[] NOT NULL DEFAULT '{}';
+
+DELETE FROM user_sessions
+WHERE state NOT IN ('idle', 'in_scenario')
+    AND (current_scenario_id IS NULL OR current_step_key IS NULL);
+
+UPDATE user_sessions SET state = 'in_scenario' WHERE state NOT IN ('idle', 'in_scenario');
+
+ALTER TABLE user_sessions ADD CONSTRAINT user_sessions_state_known
+    CHECK (state IN ('idle', 'in_scenario'));
+
+-- Same content as scenarios/site_offer.yaml; later edits go through scenarioctl
+INSERT INTO fsm_scenarios (name, display_name, trigger_keywords, description)
+VALUES ('site_offer', 'Материалы на сайте', ARRAY[]::TEXT[], 'Предложение перейти на сайт и подписаться на рекомендации по email')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO fsm_steps (scenario_id, step_key, message, is_final, next_step_key, state_type, input, input_error, effects)
+SELECT fsm_scenarios.id, steps.step_key, steps.message, steps.state_type = 'final', steps.next_step_key, steps.state_type, steps.input, steps.input_error, steps.effects
+FROM fsm_scenarios, (VALUES
+    ('offer', 'Хотите подробнее ознакомиться с инструкциями и рекомендациями по эксплуатации? Перейти на сайт?', NULL, 'start', '', '', ARRAY[]::TEXT[]),
+    ('site', 'Отличный выбор! Вот ссылка на полезные материалы: {site_url}', NULL, 'final', '', '', ARRAY['resume_scenario']),
+    ('declined', 'Хорошо, если что — обращайтесь! Всегда рад помочь.', NULL, 'final', '', '', ARRAY['resume_scenario']),
+    ('ask_email', 'Отлично! Пожалуйста, укажите ваш email адрес для получения полезной информации об эксплуатации электроинструментов.', 'email_consent', 'intermediate', 'email', 'Похоже, в адресе ошибка. Напишите email в формате name@example.com.', ARRAY[]::TEXT[]),
+    ('email_consent', 'Разрешаете ли вы получать технические рекомендации и инструкции по эксплуатации на этот email? Это не реклама.', NULL, 'intermediate', '', '', ARRAY['save_email']),
+    ('email_saved', 'Спасибо! Информация сохранена.
+
+Вот ссылка на полезные материалы: {site_url}', NULL, 'final', '', '', ARRAY['grant_consent', 'resume_scenario']),
+    ('email_declined', 'Понял, не будем использовать ваш email.
+
+Вот ссылка на полезные материалы: {site_url}', NULL, 'final', '', '', ARRAY['resume_scenario'])
+) AS steps (step_key, message, next_step_key, state_type, input, input_error, effects)
+WHERE fsm_scenarios.name = 'site_offer'
+ORDER BY array_position(ARRAY['offer', 'site', 'declined', 'ask_email', 'email_consent', 'email_saved', 'email_declined'], steps.step_key)
+ON CONFLICT (scenario_id, step_key) DO NOTHING;
+
+INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order, condition)
+SELECT fsm_scenarios.id, transitions.from_step_key, transitions.to_step_key, transitions.button_label, transitions.sort_order, transitions.condition
+FROM fsm_scenarios, (VALUES
+    ('offer', 'site', 'Да', 1, NULL),
+    ('offer', 'declined', 'Нет', 2, NULL),
+    ('offer', 'ask_email', '📧 Получать рекомендации на email', 3, '!consent_granted'),
+    ('email_consent', 'email_saved', 'Разрешаю', 1, NULL),
+    ('email_consent', 'email_declined', 'Нет, спасибо', 2, NULL)
+) AS transitions (from_step_key, to_step_key, button_label, sort_order, condition)
+WHERE fsm_scenarios.name = 'site_offer'
+ON CONFLICT (scenario_id, from_step_key, to_step_key) DO NOTHING;
@@ -0,0 +1,12 @@
+-- 014_add_site_offer_policy.down.sql
+
+UPDATE fsm_steps SET effects = array_remove(effects, 'decline_site_offer');
+
+ALTER TABLE users DROP COLUMN IF EXISTS site_offer_declined_at;
+ALTER TABLE users DROP COLUMN IF EXISTS site_offers_count;
+
+ALTER TABLE settings DROP CONSTRAINT IF EXISTS settings_offer_policy_non_negative;
+ALTER TABLE settings DROP COLUMN IF EXISTS scenario_trigger_counts;
+ALTER TABLE settings DROP COLUMN IF EXISTS interrupt_scenarios;
+ALTER TABLE settings DROP COLUMN IF EXISTS max_offers_per_user;
+ALTER TABLE settings DROP COLUMN IF EXISTS offer_cooldown_hours;
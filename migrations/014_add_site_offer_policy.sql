@@ -0,0 +1,27 @@
+-- 014_add_site_offer_policy.sql
+-- Settings of the site offer policy (see fsm.DefaultOfferPolicy):
+--   offer_cooldown_hours    - no offer for this long after the user declines one (0 - no cooldown)
+--   max_offers_per_user     - offers a user gets at most (0 - no cap)
+--   interrupt_scenarios     - offer in the middle of a scenario instead of waiting for a final step
+--   scenario_trigger_counts - {"scenario_name": count} overriding trigger_message_count
+-- and what the policy needs to know about each user.
+
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS offer_cooldown_hours INT NOT NULL DEFAULT 24;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS max_offers_per_user INT NOT NULL DEFAULT 3;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS interrupt_scenarios BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS scenario_trigger_counts JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE settings ADD CONSTRAINT settings_offer_policy_non_negative
+    CHECK (offer_cooldown_hours >= 0 AND max_offers_per_user >= 0);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS site_offers_count INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS site_offer_declined_at TIMESTAMPTZ;
+
+-- Declining the offer starts the cooldown
+UPDATE fsm_steps
+SET effects = array_prepend('decline_site_offer', effects)
+FROM fsm_scenarios
+WHERE fsm_steps.scenario_id = fsm_scenarios.id
+    AND fsm_scenarios.name = 'site_offer'
+    AND fsm_steps.step_key = 'declined'
+    AND NOT ('decline_site_offer' = ANY(fsm_steps.effects));
@@ -0,0 +1,7 @@
+-- 015_add_deep_links.down.sql
+
+DROP INDEX IF EXISTS idx_users_product_sku;
+ALTER TABLE users DROP COLUMN IF EXISTS product_sku;
+ALTER TABLE users DROP COLUMN IF EXISTS start_payload;
+
+DROP TABLE IF EXISTS deep_links;
@@ -0,0 +1,21 @@
+-- 015_add_deep_links.sql
+-- QR codes on product cards open the bot with /start <payload>. deep_links
+-- maps a payload to the product (SKU) it was printed for and, optionally, the
+-- scenario and step to open. A deleted scenario keeps the link and its product
+-- attribution; the bot then shows the scenario list.
+--
+-- users remember the payload they last came with and its product.
+
+CREATE TABLE IF NOT EXISTS deep_links (
+    payload TEXT PRIMARY KEY,
+    product_sku TEXT NOT NULL,
+    scenario_id INT REFERENCES fsm_scenarios(id) ON DELETE SET NULL,
+    step_key TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS start_payload TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS product_sku TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_users_product_sku ON users(product_sku);
@@ -0,0 +1,5 @@
+-- 016_add_product_catalog.down.sql
+
+DROP TABLE IF EXISTS product_scenarios;
+DROP TABLE IF EXISTS products;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,32 @@
+-- 016_add_product_catalog.sql
+-- Product catalog: the tool models the bot knows about, grouped into
+-- categories, with their specs and manual link. product_scenarios links a
+-- product to the scenarios that apply to it; a user who came with a product
+-- SKU (users.product_sku) only sees those scenarios in the start menu, and
+-- step messages can mention the product (see RenderMessage).
+
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    display_name TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS products (
+    id SERIAL PRIMARY KEY,
+    sku TEXT NOT NULL UNIQUE,
+    model TEXT NOT NULL,
+    category_id INT REFERENCES categories(id) ON DELETE SET NULL,
+    specs JSONB NOT NULL DEFAULT '{}',
+    manual_url TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS product_scenarios (
+    product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    scenario_id INT NOT NULL REFERENCES fsm_scenarios(id) ON DELETE CASCADE,
+    PRIMARY KEY (product_id, scenario_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_products_category_id ON products(category_id);
+CREATE INDEX IF NOT EXISTS idx_product_scenarios_scenario_id ON product_scenarios(scenario_id);
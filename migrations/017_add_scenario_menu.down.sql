@@ -0,0 +1,7 @@
+-- 017_add_scenario_menu.down.sql
+
+DROP INDEX IF EXISTS idx_fsm_scenarios_category_id;
+ALTER TABLE categories DROP COLUMN IF EXISTS sort_order;
+ALTER TABLE fsm_scenarios DROP COLUMN IF EXISTS sort_order;
+ALTER TABLE fsm_scenarios DROP COLUMN IF EXISTS visible_in_menu;
+ALTER TABLE fsm_scenarios DROP COLUMN IF EXISTS category_id;
@@ -0,0 +1,47 @@
+-- 017_add_scenario_menu.sql
+-- The start menu groups scenarios by category and pages through them:
+--   category_id     - category the scenario is listed under (the product
+--                     categories); scenarios without one are listed at the top
+--   visible_in_menu - FALSE keeps a scenario out of the menu; it can still be
+--                     started by its triggers, a deep link or the bot itself
+--   sort_order      - position in the menu, then id
+-- Categories get a sort_order of their own.
+--
+-- The site offer and the action scenarios of the first schema are hidden, and
+-- the diagnostic scenarios are put into categories.
+
+ALTER TABLE fsm_scenarios ADD COLUMN IF NOT EXISTS category_id INT REFERENCES categories(id) ON DELETE SET NULL;
+ALTER TABLE fsm_scenarios ADD COLUMN IF NOT EXISTS visible_in_menu BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE fsm_scenarios ADD COLUMN IF NOT EXISTS sort_order INT NOT NULL DEFAULT 0;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS sort_order INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_fsm_scenarios_category_id ON fsm_scenarios(category_id);
+
+UPDATE fsm_scenarios SET visible_in_menu = FALSE
+WHERE name IN (
+    'site_offer',
+    'ushm_not_starting', 'ushm_stopped_during_work', 'battery_charge', 'replace_button',
+    'repair_connection', 'replace_motor', 'restart_device', 'repair_mechanics',
+    'replace_brushes', 'service_center'
+);
+
+INSERT INTO categories (name, display_name, sort_order) VALUES
+    ('grinders', 'Шлифовальные машины', 1),
+    ('saws', 'Пилы и лобзики', 2),
+    ('drills', 'Дрели и шуруповёрты', 3),
+    ('garden', 'Садовая техника', 4)
+ON CONFLICT (name) DO NOTHING;
+
+UPDATE fsm_scenarios
+SET category_id = categories.id, sort_order = placement.sort_order
+FROM (VALUES
+    ('diagnose_angle_grinder', 'grinders', 1),
+    ('diagnose_miter_saw', 'saws', 1),
+    ('diagnose_jigsaw', 'saws', 2),
+    ('diagnose_cordless_drill', 'drills', 1),
+    ('diagnose_cordless_screwdriver', 'drills', 2),
+    ('diagnose_corded_lawnmower', 'garden', 1),
+    ('diagnose_corded_lawn_mower', 'garden', 2)
+) AS placement (scenario_name, category_name, sort_order)
+JOIN categories ON categories.name = placement.category_name
+WHERE fsm_scenarios.name = placement.scenario_name AND fsm_scenarios.category_id IS NULL;
@@ -0,0 +1,7 @@
+-- 018_add_tool_keywords.down.sql
+
+UPDATE fsm_scenarios
+SET trigger_keywords = trigger_keywords || tool_keywords
+WHERE tool_keywords <> '{}';
+
+ALTER TABLE fsm_scenarios DROP COLUMN IF EXISTS tool_keywords;
@@ -0,0 +1,17 @@
+-- 018_add_tool_keywords.sql
+-- Trigger matching scores every scenario and prefers the one whose keywords
+-- name the tool in the message. tool_keywords lists those keywords: they start
+-- the scenario like trigger_keywords, and "лобзик не включается" goes to the
+-- jigsaw rather than to a scenario triggered by "не включается".
+--
+-- The keywords of the diagnostic scenarios all name their tool, so they move
+-- to tool_keywords.
+
+ALTER TABLE fsm_scenarios ADD COLUMN IF NOT EXISTS tool_keywords TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE fsm_scenarios
+SET tool_keywords = trigger_keywords, trigger_keywords = '{}'
+WHERE name IN (
+    'diagnose_angle_grinder', 'diagnose_miter_saw', 'diagnose_jigsaw',
+    'diagnose_cordless_drill', 'diagnose_corded_lawnmower'
+) AND tool_keywords = '{}';
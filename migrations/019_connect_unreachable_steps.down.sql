@@ -0,0 +1,31 @@
+-- 019_connect_unreachable_steps.down.sql
+
+UPDATE fsm_transitions
+SET button_label = 'Нет'
+FROM fsm_scenarios
+WHERE fsm_transitions.scenario_id = fsm_scenarios.id
+    AND fsm_scenarios.name = 'diagnose_angle_grinder'
+    AND fsm_transitions.from_step_key = 'stops_after_time'
+    AND fsm_transitions.to_step_key = 'stops_after_time_hot'
+    AND fsm_transitions.button_label = 'Да';
+
+DELETE FROM fsm_transitions
+USING fsm_scenarios
+WHERE fsm_transitions.scenario_id = fsm_scenarios.id
+    AND (fsm_scenarios.name, fsm_transitions.from_step_key, fsm_transitions.to_step_key) IN (
+        ('diagnose_angle_grinder', 'no_power', 'no_power_indicator_lit'),
+        ('diagnose_angle_grinder', 'no_power', 'no_power_indicator_dark'),
+        ('diagnose_angle_grinder', 'stops_during_work', 'stops_immediately'),
+        ('diagnose_angle_grinder', 'stops_during_work', 'stops_after_time'),
+        ('diagnose_angle_grinder', 'vibration_noise', 'strong_vibration'),
+        ('diagnose_angle_grinder', 'vibration_noise', 'grinding_noise'),
+        ('diagnose_angle_grinder', 'vibration_noise', 'other_noise'),
+        ('diagnose_jigsaw', 'vibration_drift', 'vibration_drift_blade_problem')
+    );
+
+UPDATE fsm_steps
+SET is_final = TRUE
+FROM fsm_scenarios
+WHERE fsm_steps.scenario_id = fsm_scenarios.id
+    AND fsm_scenarios.name = 'diagnose_angle_grinder'
+    AND fsm_steps.step_key IN ('no_power', 'stops_during_work', 'vibration_noise');
@@ -0,0 +1,42 @@
+-- 019_connect_unreachable_steps.sql
+-- The angle grinder problem steps no_power, stops_during_work and
+-- vibration_noise were final, so the questions seeded below them by 003 were
+-- never shown, and the jigsaw question vibration_drift had no answer leading to
+-- vibration_drift_blade_problem. The problem steps now end with buttons into
+-- their questions. Buttons whose steps were removed since are not added.
+--
+-- 007 labelled both answers of stops_after_time "Нет"; the hot one is "Да".
+
+UPDATE fsm_steps
+SET is_final = FALSE
+FROM fsm_scenarios
+WHERE fsm_steps.scenario_id = fsm_scenarios.id
+    AND fsm_scenarios.name = 'diagnose_angle_grinder'
+    AND fsm_steps.step_key IN ('no_power', 'stops_during_work', 'vibration_noise');
+
+INSERT INTO fsm_transitions (scenario_id, from_step_key, to_step_key, button_label, sort_order)
+SELECT fsm_scenarios.id, edges.from_step_key, edges.to_step_key, edges.button_label, edges.sort_order
+FROM fsm_scenarios
+JOIN (VALUES
+    ('diagnose_angle_grinder', 'no_power', 'no_power_indicator_lit', 'Индикатор заряда горит', 1),
+    ('diagnose_angle_grinder', 'no_power', 'no_power_indicator_dark', 'Индикатор заряда не горит', 2),
+    ('diagnose_angle_grinder', 'stops_during_work', 'stops_immediately', 'Сразу после включения', 1),
+    ('diagnose_angle_grinder', 'stops_during_work', 'stops_after_time', 'Через некоторое время', 2),
+    ('diagnose_angle_grinder', 'vibration_noise', 'strong_vibration', 'Сильная вибрация', 1),
+    ('diagnose_angle_grinder', 'vibration_noise', 'grinding_noise', 'Скрежет', 2),
+    ('diagnose_angle_grinder', 'vibration_noise', 'other_noise', 'Другой шум', 3),
+    ('diagnose_jigsaw', 'vibration_drift', 'vibration_drift_blade_problem', 'Нет, неподходящее', 2)
+) AS edges (scenario_name, from_step_key, to_step_key, button_label, sort_order)
+    ON edges.scenario_name = fsm_scenarios.name
+WHERE EXISTS (SELECT 1 FROM fsm_steps WHERE scenario_id = fsm_scenarios.id AND step_key = edges.from_step_key)
+    AND EXISTS (SELECT 1 FROM fsm_steps WHERE scenario_id = fsm_scenarios.id AND step_key = edges.to_step_key)
+ON CONFLICT (scenario_id, from_step_key, to_step_key) DO NOTHING;
+
+UPDATE fsm_transitions
+SET button_label = 'Да'
+FROM fsm_scenarios
+WHERE fsm_transitions.scenario_id = fsm_scenarios.id
+    AND fsm_scenarios.name = 'diagnose_angle_grinder'
+    AND fsm_transitions.from_step_key = 'stops_after_time'
+    AND fsm_transitions.to_step_key = 'stops_after_time_hot'
+    AND fsm_transitions.button_label = 'Нет';
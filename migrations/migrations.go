@@ -0,0 +1,13 @@
+// Package migrations embeds the SQL migration files.
+//
+// Files are named NNN_name.sql; an optional NNN_name.down.sql reverts the
+// migration. Applied files must not be edited: the migration runner keeps
+// their checksums and refuses to run when they change.
+package migrations
+
+import "embed"
+
+// FS holds every migration file
+//
+//go:embed *.sql
+var FS embed.FS